@@ -0,0 +1,168 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/certmgr"
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+func newAcmeHTTPClient(cfg AcmeConfig, dialer limited.NetDialer) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialer != nil {
+		transport.DialContext = dialer.DialContext
+	}
+	if cfg.CACert != "" || cfg.InsecureSkipVerify {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}
+		if cfg.CACert != "" {
+			data, err := os.ReadFile(cfg.CACert)
+			if err != nil {
+				return nil, err
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate was found in %s", cfg.CACert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Minute,
+	}, nil
+}
+
+// setupAcme creates the ACME certificate manager for the public hosts of the clusters, and hooks it into tlsConfig.
+// The certificate will be obtained and renewed in background until ctx is canceled
+func (r *Runner) setupAcme(ctx context.Context, tlsConfig *tls.Config) (err error) {
+	var domains []string
+	for _, cr := range r.group.Clusters() {
+		if cr.host == "" {
+			return fmt.Errorf("acme: public-host of cluster %s must be set", cr.clusterId)
+		}
+		if h := strings.ToLower(cr.host); !slices.Contains(domains, h) {
+			domains = append(domains, h)
+		}
+	}
+	client, err := newAcmeHTTPClient(config.Acme, r.cluster.dialers.Base)
+	if err != nil {
+		return
+	}
+	dir := config.Acme.Dir
+	if dir == "" {
+		dir = filepath.Join(r.cluster.dataDir, "acme")
+	}
+	mgr, err := certmgr.NewManager(certmgr.Options{
+		DirectoryURL: config.Acme.DirectoryURL,
+		Email:        config.Acme.Email,
+		Challenge:    config.Acme.Challenge,
+		Domains:      domains,
+		Dir:          dir,
+		RenewBefore:  config.Acme.RenewBefore.Dur(),
+		HTTPClient:   client,
+	})
+	if err != nil {
+		return
+	}
+	mgr.TLSConfig(tlsConfig)
+
+	if mgr.Challenge() == certmgr.ChallengeHTTP01 {
+		publicPort := strconv.Itoa((int)(r.getPublicPort()))
+		redirect := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			host, _, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				host = req.Host
+			}
+			if !slices.Contains(domains, strings.ToLower(host)) {
+				host = domains[0]
+			}
+			u := *req.URL
+			u.Scheme = "https"
+			u.Host = net.JoinHostPort(host, publicPort)
+			http.Redirect(rw, req, u.String(), http.StatusFound)
+		})
+		listener, err := net.Listen("tcp", config.Acme.HTTPAddress)
+		if err != nil {
+			return err
+		}
+		svr := &http.Server{
+			Handler:           mgr.HTTPHandler(redirect),
+			ReadHeaderTimeout: time.Second * 10,
+		}
+		go func() {
+			defer log.RecordPanic()
+			if err := svr.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("ACME challenge server stopped: %v", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			svr.Close()
+		}()
+		log.Infof("ACME http-01 challenge server is listening at %s", listener.Addr())
+	}
+
+	go func() {
+		defer log.RecordPanic()
+		mgr.Run(ctx)
+	}()
+	r.acmeManager = mgr
+	return
+}
+
+// waitAcmeCert blocks until the ACME certificate is available, it returns false if ctx is canceled
+func (r *Runner) waitAcmeCert(ctx context.Context) bool {
+	if r.acmeManager == nil {
+		return true
+	}
+	select {
+	case <-r.acmeManager.Ready():
+		return true
+	default:
+	}
+	log.Info("Waiting for the ACME certificate ...")
+	select {
+	case <-r.acmeManager.Ready():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
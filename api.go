@@ -22,7 +22,6 @@ package main
 import (
 	"compress/gzip"
 	"context"
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -40,11 +39,13 @@ import (
 	// "github.com/gorilla/websocket"
 	"github.com/google/uuid"
 
+	gocache "github.com/LiterMC/go-openbmclapi/cache"
 	"github.com/LiterMC/go-openbmclapi/database"
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/limited"
 	"github.com/LiterMC/go-openbmclapi/log"
 	"github.com/LiterMC/go-openbmclapi/notify"
+	"github.com/LiterMC/go-openbmclapi/storage"
 	"github.com/LiterMC/go-openbmclapi/utils"
 )
 
@@ -108,14 +109,28 @@ func (cr *Cluster) authMiddleware(rw http.ResponseWriter, req *http.Request, nex
 			if err == nil {
 				err = ErrUnsupportAuthType
 			}
-		} else if id, uid, err = cr.verifyAuthToken(cli, tk); err != nil {
-			id = ""
-		} else {
+		} else if id, uid, err = cr.verifyAuthToken(cli, tk); err == nil {
 			ctx = context.WithValue(ctx, tokenTypeKey, tokenTypeAuth)
+		} else if kid, kuid, scopes, kerr := cr.verifyAPIKey(tk); kerr == nil {
+			id, uid = kid, kuid
+			ctx = context.WithValue(ctx, tokenTypeKey, tokenTypeAPIKey)
+			ctx = context.WithValue(ctx, apiKeyScopesKey, scopes)
+		} else {
+			id = ""
 		}
 	}
 	if id != "" {
+		// the role is looked up every time, so the removed users will be logged out immediately
+		role, err := cr.getUserRole(uid)
+		if err != nil {
+			if err != ErrUserNotFound {
+				log.Errorf("Cannot get the role of user %q: %v", uid, err)
+			}
+			next.ServeHTTP(rw, req)
+			return
+		}
 		ctx = context.WithValue(ctx, loggedUserKey, uid)
+		ctx = context.WithValue(ctx, loggedRoleKey, role)
 		ctx = context.WithValue(ctx, tokenIdKey, id)
 		req = req.WithContext(ctx)
 	}
@@ -130,6 +145,9 @@ func (cr *Cluster) apiAuthHandle(next http.Handler) http.Handler {
 			})
 			return
 		}
+		if rejectUnscopedAPIKey(rw, req) {
+			return
+		}
 		next.ServeHTTP(rw, req)
 	})
 }
@@ -149,22 +167,82 @@ func (cr *Cluster) initAPIv0() http.Handler {
 
 	mux.HandleFunc("/ping", cr.apiV1Ping)
 	mux.HandleFunc("/status", cr.apiV0Status)
+	mux.HandleFunc("/clusters", cr.apiV0Clusters)
+	mux.Handle("/metrics", cr.apiScopeHandle(scopeReadStatus, cr.apiAuthHandleFunc(cr.apiV0Metrics)))
+	mux.Handle("/sync_plan", cr.apiScopeHandle(scopeReadStatus, cr.apiRoleHandleFunc(roleOperator, cr.apiV0SyncPlan)))
+	mux.Handle("/config_reload", cr.auditHandle(auditActions{http.MethodPost: "config.reload"}, cr.apiRoleHandleFunc(roleOperator, cr.apiV0ConfigReload)))
 	mux.Handle("/stat/", http.StripPrefix("/stat/", (http.HandlerFunc)(cr.apiV0Stat)))
 
 	mux.HandleFunc("/challenge", cr.apiV1Challenge)
-	mux.HandleFunc("/login", cr.apiV0Login)
+	mux.Handle("/login", cr.auditHandleFunc(auditActions{http.MethodPost: "login"}, cr.apiV0Login))
+	mux.Handle("/login/mfa", cr.auditHandleFunc(auditActions{http.MethodPost: "login.mfa"}, cr.apiV0LoginMFA))
+	mux.HandleFunc("/login/webauthn", cr.apiV0LoginWebAuthn)
+	mux.Handle("/login/webauthn/finish", cr.auditHandleFunc(auditActions{http.MethodPost: "login.webauthn"}, cr.apiV0LoginWebAuthnFinish))
 	mux.Handle("/requestToken", cr.apiAuthHandleFunc(cr.apiV0RequestToken))
-	mux.Handle("/logout", cr.apiAuthHandleFunc(cr.apiV1Logout))
+	mux.Handle("/logout", cr.auditHandle(auditActions{http.MethodPost: "logout"}, cr.apiAuthHandleFunc(cr.apiV1Logout)))
+	mux.Handle("/me", cr.apiAuthHandleFunc(cr.apiV0Me))
+	mux.Handle("/users", cr.auditHandle(auditActions{http.MethodPost: "user.add"}, cr.apiRoleHandleFunc(roleAdmin, cr.apiV0Users)))
+	mux.Handle("/user/", http.StripPrefix("/user/", cr.auditHandle(auditActions{
+		http.MethodPatch:  "user.update",
+		http.MethodDelete: "user.remove",
+	}, cr.apiAuthHandleFunc(cr.apiV0User))))
+	mux.Handle("/api_keys", cr.auditHandle(auditActions{http.MethodPost: "api_key.create"}, cr.apiAuthHandleFunc(cr.apiV0APIKeys)))
+	mux.Handle("/api_key/", http.StripPrefix("/api_key/", cr.auditHandle(auditActions{
+		http.MethodDelete: "api_key.revoke",
+	}, cr.apiAuthHandleFunc(cr.apiV0APIKey))))
+	mux.Handle("/mfa", cr.apiAuthHandleFunc(cr.apiV0MFA))
+	mux.Handle("/mfa/totp", cr.auditHandle(auditActions{
+		http.MethodPost:   "mfa.totp.begin",
+		http.MethodDelete: "mfa.totp.disable",
+	}, cr.apiAuthHandleFunc(cr.apiV0MFATOTP)))
+	mux.Handle("/mfa/totp/confirm", cr.auditHandle(auditActions{http.MethodPost: "mfa.totp.enable"}, cr.apiAuthHandleFunc(cr.apiV0MFATOTPConfirm)))
+	mux.Handle("/mfa/webauthn/register", cr.apiAuthHandleFunc(cr.apiV0MFAWebAuthnRegister))
+	mux.Handle("/mfa/webauthn/register/finish", cr.auditHandle(auditActions{http.MethodPost: "mfa.webauthn.add"}, cr.apiAuthHandleFunc(cr.apiV0MFAWebAuthnRegisterFinish)))
+	mux.Handle("/mfa/webauthn/", http.StripPrefix("/mfa/webauthn/", cr.auditHandle(auditActions{
+		http.MethodDelete: "mfa.webauthn.remove",
+	}, cr.apiAuthHandleFunc(cr.apiV0MFAWebAuthnCredential))))
+	mux.Handle("/mfa/recovery_codes", cr.auditHandle(auditActions{http.MethodPost: "mfa.recovery_codes.reset"}, cr.apiAuthHandleFunc(cr.apiV0MFARecoveryCodes)))
 
 	mux.HandleFunc("/log.io", cr.apiV1LogIO)
-	mux.Handle("/pprof", cr.apiAuthHandleFunc(cr.apiV1Pprof))
+	mux.Handle("/pprof", cr.auditHandle(auditActions{http.MethodGet: "pprof"}, cr.apiRoleHandleFunc(roleAdmin, cr.apiV1Pprof)))
 	mux.HandleFunc("/subscribeKey", cr.apiV0SubscribeKey)
-	mux.Handle("/subscribe", cr.apiAuthHandleFunc(cr.apiV0Subscribe))
-	mux.Handle("/subscribe_email", cr.apiAuthHandleFunc(cr.apiV0SubscribeEmail))
-	mux.Handle("/webhook", cr.apiAuthHandleFunc(cr.apiV0Webhook))
-
-	mux.Handle("/log_files", cr.apiAuthHandleFunc(cr.apiV0LogFiles))
-	mux.Handle("/log_file/", cr.apiAuthHandle(http.StripPrefix("/log_file/", (http.HandlerFunc)(cr.apiV0LogFile))))
+	mux.Handle("/subscribe", cr.auditHandle(auditActions{
+		http.MethodPost:   "subscribe.set",
+		http.MethodDelete: "subscribe.remove",
+	}, cr.apiAuthHandleFunc(cr.apiV0Subscribe)))
+	mux.Handle("/subscribe_email", cr.auditHandle(auditActions{
+		http.MethodPost:   "subscribe_email.add",
+		http.MethodPatch:  "subscribe_email.update",
+		http.MethodDelete: "subscribe_email.remove",
+	}, cr.apiAuthHandleFunc(cr.apiV0SubscribeEmail)))
+	mux.Handle("/webhook", cr.auditHandle(auditActions{
+		http.MethodPost:   "webhook.add",
+		http.MethodPatch:  "webhook.update",
+		http.MethodDelete: "webhook.remove",
+	}, cr.apiScopeHandle(scopeManageWebhooks, cr.apiRoleHandleFunc(roleAdmin, cr.apiV0Webhook))))
+	mux.Handle("/webhook_deliveries", cr.apiScopeHandle(scopeManageWebhooks, cr.apiRoleHandleFunc(roleAdmin, cr.apiV0WebhookDeliveries)))
+
+	mux.Handle("/control/sync", cr.auditHandle(auditActions{http.MethodPost: "control.sync"},
+		cr.apiScopeHandle(scopeTriggerSync, cr.apiRoleHandleFunc(roleOperator, cr.apiV0ControlSync))))
+	mux.Handle("/control/sync/cancel", cr.auditHandle(auditActions{http.MethodPost: "control.sync.cancel"},
+		cr.apiScopeHandle(scopeTriggerSync, cr.apiRoleHandleFunc(roleOperator, cr.apiV0ControlSyncCancel))))
+	mux.Handle("/control/gc", cr.auditHandle(auditActions{http.MethodPost: "control.gc"},
+		cr.apiScopeHandle(scopeTriggerSync, cr.apiRoleHandleFunc(roleOperator, cr.apiV0ControlGc))))
+	mux.Handle("/control/enable", cr.auditHandle(auditActions{http.MethodPost: "control.enable"},
+		cr.apiRoleHandleFunc(roleOperator, cr.apiV0ControlEnable)))
+	mux.Handle("/control/disable", cr.auditHandle(auditActions{http.MethodPost: "control.disable"},
+		cr.apiRoleHandleFunc(roleOperator, cr.apiV0ControlDisable)))
+	mux.Handle("/jobs", cr.apiScopeHandle(scopeTriggerSync, cr.apiRoleHandleFunc(roleOperator, cr.apiV0Jobs)))
+	mux.Handle("/job/", http.StripPrefix("/job/", cr.auditHandle(auditActions{http.MethodDelete: "job.cancel"},
+		cr.apiScopeHandle(scopeTriggerSync, cr.apiRoleHandleFunc(roleOperator, cr.apiV0Job)))))
+
+	mux.Handle("/log_files", cr.apiScopeHandle(scopeReadLogs, cr.apiRoleHandleFunc(roleOperator, cr.apiV0LogFiles)))
+	mux.Handle("/log_file/", http.StripPrefix("/log_file/", cr.auditHandle(auditActions{http.MethodGet: "log_file.download"},
+		cr.apiScopeHandle(scopeReadLogs, cr.apiRoleHandleFunc(roleOperator, cr.apiV0LogFile)))))
+
+	mux.Handle("/audit_logs", cr.apiRoleHandleFunc(roleAdmin, cr.apiV0AuditLogs))
+	mux.Handle("/audit_logs/export", cr.auditHandle(auditActions{http.MethodGet: "audit_logs.export"},
+		cr.apiRoleHandleFunc(roleAdmin, cr.apiV0AuditLogsExport)))
 
 	next := cr.apiRateLimiter.WrapHandler(mux)
 	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
@@ -184,10 +262,10 @@ func (cr *Cluster) initAPIv1() http.Handler {
 	mux.HandleFunc("/ping", cr.apiV1Ping)
 
 	mux.HandleFunc("/challenge", cr.apiV1Challenge)
-	mux.Handle("/logout", cr.apiAuthHandleFunc(cr.apiV1Logout))
+	mux.Handle("/logout", cr.auditHandle(auditActions{http.MethodPost: "logout"}, cr.apiAuthHandleFunc(cr.apiV1Logout)))
 
 	mux.HandleFunc("/log.io", cr.apiV1LogIO)
-	mux.Handle("/pprof", cr.apiAuthHandleFunc(cr.apiV1Pprof))
+	mux.Handle("/pprof", cr.auditHandle(auditActions{http.MethodGet: "pprof"}, cr.apiRoleHandleFunc(roleAdmin, cr.apiV1Pprof)))
 
 	next := cr.apiRateLimiter.WrapHandler(mux)
 	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
@@ -224,10 +302,27 @@ func (cr *Cluster) apiV0Status(rw http.ResponseWriter, req *http.Request) {
 		IsSync   bool          `json:"isSync"`
 		Sync     *syncData     `json:"sync,omitempty"`
 		Storages []string      `json:"storages"`
+
+		Health map[string]storage.HealthStatus  `json:"health"`
+		Tiered map[string]*storage.TieredStatus `json:"tiered,omitempty"`
+
+		Cache      *gocache.HealthStatus `json:"cache,omitempty"`
+		CacheStats *gocache.CacheStats   `json:"cacheStats,omitempty"`
+
+		SyncBandwidth *SyncBandwidthStatus `json:"syncBandwidth,omitempty"`
 	}
 	storages := make([]string, len(cr.storageOpts))
+	health := make(map[string]storage.HealthStatus, len(cr.storageOpts))
+	var tiered map[string]*storage.TieredStatus
 	for i, opt := range cr.storageOpts {
 		storages[i] = opt.Id
+		health[opt.Id] = cr.storageHealths[i].Status()
+		if s, ok := cr.storageHealths[i].Unwrap().(*storage.TieredStorage); ok {
+			if tiered == nil {
+				tiered = make(map[string]*storage.TieredStatus)
+			}
+			tiered[opt.Id] = s.Status()
+		}
 	}
 	status := statusData{
 		StartAt:  startTime,
@@ -235,6 +330,18 @@ func (cr *Cluster) apiV0Status(rw http.ResponseWriter, req *http.Request) {
 		Enabled:  cr.enabled.Load(),
 		IsSync:   cr.issync.Load(),
 		Storages: storages,
+		Health:   health,
+		Tiered:   tiered,
+
+		SyncBandwidth: cr.SyncBandwidthStatus(),
+	}
+	if hc, ok := cr.cache.(gocache.HealthChecker); ok {
+		h := hc.Health()
+		status.Cache = &h
+	}
+	if sr, ok := cr.cache.(gocache.StatsReporter); ok {
+		st := sr.Stats()
+		status.CacheStats = &st
 	}
 	if status.IsSync {
 		status.Sync = &syncData{
@@ -289,7 +396,7 @@ func (cr *Cluster) apiV0Login(rw http.ResponseWriter, req *http.Request) {
 	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
 		return
 	}
-	if !config.Dashboard.Enable {
+	if !currentConfig().Dashboard.Enable {
 		writeJson(rw, http.StatusServiceUnavailable, Map{
 			"error": "dashboard is disabled in the config",
 		})
@@ -301,6 +408,10 @@ func (cr *Cluster) apiV0Login(rw http.ResponseWriter, req *http.Request) {
 		User      string `json:"username"`
 		Challenge string `json:"challenge"`
 		Signature string `json:"signature"`
+		// Password is the plain password of the users in the database.
+		// They are stored as bcrypt hashes, so there is no secret that a challenge signature can be checked against,
+		// and the password must be protected by TLS during the transmission
+		Password string `json:"password"`
 	}
 	data, ok := parseRequestBody(rw, req, func(rw http.ResponseWriter, req *http.Request, ct string, data *T) error {
 		switch ct {
@@ -308,6 +419,7 @@ func (cr *Cluster) apiV0Login(rw http.ResponseWriter, req *http.Request) {
 			data.User = req.PostFormValue("username")
 			data.Challenge = req.PostFormValue("challenge")
 			data.Signature = req.PostFormValue("signature")
+			data.Password = req.PostFormValue("password")
 			return nil
 		default:
 			return errUnknownContent
@@ -316,41 +428,52 @@ func (cr *Cluster) apiV0Login(rw http.ResponseWriter, req *http.Request) {
 	if !ok {
 		return
 	}
+	setAuditActor(req, data.User)
 
-	expectUsername, expectPassword := config.Dashboard.Username, config.Dashboard.Password
-	if expectUsername == "" || expectPassword == "" {
+	if err := cr.verifyChallengeToken(cli, "login", data.Challenge); err != nil {
 		writeJson(rw, http.StatusUnauthorized, Map{
-			"error": "The username or password was not set on the server",
+			"error": "Invalid challenge",
 		})
 		return
 	}
-
-	if err := cr.verifyChallengeToken(cli, "login", data.Challenge); err != nil {
+	if checkUserSignature(data.User, data.Challenge, data.Signature) {
+		// the config user is logged in by the challenge signature
+	} else if data.Password == "" {
+		// do not tell whether the user is the config user, so the client always retries with the password
 		writeJson(rw, http.StatusUnauthorized, Map{
-			"error": "Invalid challenge",
+			"error":            "The username or password is incorrect",
+			"passwordRequired": true,
 		})
 		return
-	}
-	expectPassword = utils.AsSha256Hex(expectPassword)
-	expectSignature := utils.HMACSha256Hex(expectPassword, data.Challenge)
-	if subtle.ConstantTimeCompare(([]byte)(expectUsername), ([]byte)(data.User)) == 0 ||
-		subtle.ConstantTimeCompare(([]byte)(expectSignature), ([]byte)(data.Signature)) == 0 {
+	} else if isConfigUser(data.User) {
 		writeJson(rw, http.StatusUnauthorized, Map{
 			"error": "The username or password is incorrect",
 		})
 		return
-	}
-	token, err := cr.generateAuthToken(cli, data.User)
-	if err != nil {
-		writeJson(rw, http.StatusInternalServerError, Map{
-			"error":   "Cannot generate token",
-			"message": err.Error(),
+	} else if err := cr.checkUserPassword(data.User, data.Password); err != nil {
+		if err != ErrPasswordMismatch {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "database error",
+				"message": err.Error(),
+			})
+			return
+		}
+		if dashboard := &currentConfig().Dashboard; dashboard.Username == "" || dashboard.Password == "" {
+			// keep the old error message when there is no user at all
+			if n, _ := cr.countUsers(); n == 0 {
+				writeJson(rw, http.StatusUnauthorized, Map{
+					"error": "The username or password was not set on the server",
+				})
+				return
+			}
+		}
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "The username or password is incorrect",
 		})
 		return
 	}
-	writeJson(rw, http.StatusOK, Map{
-		"token": token,
-	})
+	// the auth token will only be issued after the second factor passed
+	cr.loginOrRequireMFA(rw, req, data.User)
 }
 
 func (cr *Cluster) apiV0RequestToken(rw http.ResponseWriter, req *http.Request) {
@@ -463,13 +586,21 @@ func (cr *Cluster) apiV1LogIO(rw http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	if _, _, err = cr.verifyAuthToken(cli, authData.Token); err != nil {
+	_, user, err := cr.verifyAuthToken(cli, authData.Token)
+	if err != nil {
 		conn.WriteJSON(Map{
 			"type":    "error",
 			"message": "auth failed",
 		})
 		return
 	}
+	if role, err := cr.getUserRole(user); err != nil || !roleAllows(role, roleOperator) {
+		conn.WriteJSON(Map{
+			"type":    "error",
+			"message": "permission denied",
+		})
+		return
+	}
 	if err := conn.WriteJSON(Map{
 		"type": "ready",
 	}); err != nil {
@@ -821,6 +952,7 @@ func (cr *Cluster) apiV0SubscribeEmailPOST(rw http.ResponseWriter, req *http.Req
 	}
 
 	data.User = user
+	setAuditTarget(req, data.Addr)
 	if err := cr.database.AddEmailSubscription(data); err != nil {
 		writeJson(rw, http.StatusInternalServerError, Map{
 			"error":   "Database update failed",
@@ -833,6 +965,7 @@ func (cr *Cluster) apiV0SubscribeEmailPOST(rw http.ResponseWriter, req *http.Req
 
 func (cr *Cluster) apiV0SubscribeEmailPATCH(rw http.ResponseWriter, req *http.Request, user string) {
 	addr := req.URL.Query().Get("addr")
+	setAuditTarget(req, addr)
 	data, ok := parseRequestBody[database.EmailSubscriptionRecord](rw, req, nil)
 	if !ok {
 		return
@@ -857,6 +990,7 @@ func (cr *Cluster) apiV0SubscribeEmailPATCH(rw http.ResponseWriter, req *http.Re
 
 func (cr *Cluster) apiV0SubscribeEmailDELETE(rw http.ResponseWriter, req *http.Request, user string) {
 	addr := req.URL.Query().Get("addr")
+	setAuditTarget(req, addr)
 	if err := cr.database.RemoveEmailSubscription(user, addr); err != nil {
 		if err == database.ErrNotFound {
 			writeJson(rw, http.StatusNotFound, Map{
@@ -922,12 +1056,16 @@ func (cr *Cluster) apiV0WebhookGET(rw http.ResponseWriter, req *http.Request, us
 			})
 			return
 		}
-		writeJson(rw, http.StatusOK, record)
+		// the secret is write only
+		rec := *record
+		rec.Secret = nil
+		writeJson(rw, http.StatusOK, rec)
 		return
 	}
 	records := make([]database.WebhookRecord, 0, 4)
 	if err := cr.database.ForEachUsersWebhook(user, func(rec *database.WebhookRecord) error {
 		records = append(records, *rec)
+		records[len(records)-1].Secret = nil
 		return nil
 	}); err != nil {
 		writeJson(rw, http.StatusInternalServerError, Map{
@@ -946,6 +1084,7 @@ func (cr *Cluster) apiV0WebhookPOST(rw http.ResponseWriter, req *http.Request, u
 	}
 
 	data.User = user
+	setAuditTarget(req, data.Name)
 	if err := cr.database.AddWebhook(data); err != nil {
 		writeJson(rw, http.StatusInternalServerError, Map{
 			"error":   "Database update failed",
@@ -958,6 +1097,7 @@ func (cr *Cluster) apiV0WebhookPOST(rw http.ResponseWriter, req *http.Request, u
 
 func (cr *Cluster) apiV0WebhookPATCH(rw http.ResponseWriter, req *http.Request, user string) {
 	id := req.URL.Query().Get("id")
+	setAuditTarget(req, id)
 	data, ok := parseRequestBody[database.WebhookRecord](rw, req, nil)
 	if !ok {
 		return
@@ -988,6 +1128,7 @@ func (cr *Cluster) apiV0WebhookPATCH(rw http.ResponseWriter, req *http.Request,
 }
 
 func (cr *Cluster) apiV0WebhookDELETE(rw http.ResponseWriter, req *http.Request, user string) {
+	setAuditTarget(req, req.URL.Query().Get("id"))
 	id, err := uuid.Parse(req.URL.Query().Get("id"))
 	if err != nil {
 		writeJson(rw, http.StatusBadRequest, Map{
@@ -1012,6 +1153,48 @@ func (cr *Cluster) apiV0WebhookDELETE(rw http.ResponseWriter, req *http.Request,
 	rw.WriteHeader(http.StatusNoContent)
 }
 
+// maxWebhookDeliveries is the maximum number of the delivery records that will be returned at once
+const maxWebhookDeliveries = 256
+
+func (cr *Cluster) apiV0WebhookDeliveries(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	user := getLoggedUser(req)
+	if user == "" {
+		writeJson(rw, http.StatusForbidden, Map{
+			"error": "Unauthorized",
+		})
+		return
+	}
+	var id uuid.UUID
+	if sid := req.URL.Query().Get("id"); sid != "" {
+		var err error
+		if id, err = uuid.Parse(sid); err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "uuid format error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	deliveries := make([]database.WebhookDeliveryRecord, 0, 8)
+	if err := cr.database.ForEachUsersWebhookDelivery(user, id, func(d *database.WebhookDeliveryRecord) error {
+		deliveries = append(deliveries, *d)
+		if len(deliveries) >= maxWebhookDeliveries {
+			return database.ErrStopIter
+		}
+		return nil
+	}); err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, deliveries)
+}
+
 func (cr *Cluster) apiV0LogFiles(rw http.ResponseWriter, req *http.Request) {
 	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
 		return
@@ -0,0 +1,384 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const apiKeySubject = "GOBA-key"
+
+// The scopes of the API keys
+const (
+	scopeReadStatus     = "read-status"
+	scopeReadLogs       = "read-logs"
+	scopeManageWebhooks = "manage-webhooks"
+	scopeTriggerSync    = "trigger-sync"
+)
+
+var apiKeyScopes = []string{
+	scopeReadStatus,
+	scopeReadLogs,
+	scopeManageWebhooks,
+	scopeTriggerSync,
+}
+
+const (
+	tokenTypeAPIKey = "key"
+
+	apiKeyScopesKey  = "go-openbmclapi.cluster.apikey.scopes"
+	apiKeyAllowedKey = "go-openbmclapi.cluster.apikey.allowed"
+)
+
+// apiKeyNoExpire is used as the jti expiration of the keys which never expire,
+// since MySQL cannot save the timestamps after 2038
+var apiKeyNoExpire = time.Date(2038, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// the last used time will be saved at most once in this interval
+const apiKeyLastUsedInterval = time.Minute
+
+var (
+	ErrAPIKeyRevoked = errors.New("API key was revoked")
+	ErrInvalidScope  = fmt.Errorf("scope must be one of %s", strings.Join(apiKeyScopes, ", "))
+)
+
+type apiKeyClaims struct {
+	jwt.RegisteredClaims
+
+	User   string   `json:"usr"`
+	Scopes []string `json:"scp"`
+}
+
+func isValidScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// generateAPIKey creates a named API key for the user, zero expires means the key never expires.
+// Unlike the API tokens, the keys are not bound to a client
+func (cr *Cluster) generateAPIKey(user string, name string, scopes []string, expires time.Time) (key string, rec database.APIKeyRecord, err error) {
+	if name == "" {
+		return "", rec, errors.New("name cannot be empty")
+	}
+	if len(scopes) == 0 {
+		return "", rec, errors.New("at least one scope is required")
+	}
+	for _, s := range scopes {
+		if !isValidScope(s) {
+			return "", rec, ErrInvalidScope
+		}
+	}
+	jti, err := utils.GenRandB64(16)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	jtiExpire := apiKeyNoExpire
+	claims := &apiKeyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       jti,
+			Subject:  apiKeySubject,
+			Issuer:   cr.jwtIssuer,
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		User:   user,
+		Scopes: scopes,
+	}
+	rec = database.APIKeyRecord{
+		Id:        jti,
+		User:      user,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if !expires.IsZero() {
+		if !expires.After(now) {
+			return "", rec, errors.New("expiration must be in the future")
+		}
+		jtiExpire = expires
+		claims.ExpiresAt = jwt.NewNumericDate(expires)
+		rec.ExpiresAt = &expires
+	}
+	if key, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(cr.apiHmacKey); err != nil {
+		return
+	}
+	if err = cr.database.AddAPIKey(rec); err != nil {
+		return
+	}
+	if err = cr.database.AddJTI(jti, jtiExpire); err != nil {
+		cr.database.RemoveAPIKey(jti)
+		return
+	}
+	return
+}
+
+func (cr *Cluster) verifyAPIKey(key string) (id string, user string, scopes []string, err error) {
+	var claims apiKeyClaims
+	if _, err = jwt.ParseWithClaims(
+		key,
+		&claims,
+		cr.getJWTKey,
+		jwt.WithSubject(apiKeySubject),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(cr.jwtIssuer),
+	); err != nil {
+		return
+	}
+	if claims.User == "" {
+		err = ErrJTINotExists
+		return
+	}
+	id = claims.ID
+	if ok, _ := cr.database.ValidJTI(id); !ok {
+		err = ErrAPIKeyRevoked
+		return
+	}
+	cr.touchAPIKey(id)
+	return id, claims.User, claims.Scopes, nil
+}
+
+var apiKeyLastUsed sync.Map // map[string]time.Time
+
+// touchAPIKey records the last used time of the key
+func (cr *Cluster) touchAPIKey(id string) {
+	now := time.Now()
+	if last, ok := apiKeyLastUsed.Load(id); ok && now.Sub(last.(time.Time)) < apiKeyLastUsedInterval {
+		return
+	}
+	apiKeyLastUsed.Store(id, now)
+	if err := cr.database.UpdateAPIKeyLastUsed(id, now); err != nil && err != database.ErrNotFound {
+		log.Errorf("Cannot update the last used time of API key %s: %v", id, err)
+	}
+}
+
+// revokeAPIKey removes the key and its jti, so it cannot be used anymore
+func (cr *Cluster) revokeAPIKey(id string) (err error) {
+	if err = cr.database.RemoveAPIKey(id); err != nil {
+		return
+	}
+	apiKeyLastUsed.Delete(id)
+	// the jti may already be cleaned after the key expired
+	if err = cr.database.RemoveJTI(id); err == database.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// revokeUsersAPIKeys revokes all keys of the removed user
+func (cr *Cluster) revokeUsersAPIKeys(user string) {
+	var ids []string
+	cr.database.ForEachAPIKey(func(rec *database.APIKeyRecord) error {
+		if rec.User == user {
+			ids = append(ids, rec.Id)
+		}
+		return nil
+	})
+	for _, id := range ids {
+		if err := cr.revokeAPIKey(id); err != nil && err != database.ErrNotFound {
+			log.Errorf("Cannot revoke API key %s of user %q: %v", id, user, err)
+		}
+	}
+}
+
+func getAPIKeyScopes(req *http.Request) []string {
+	scopes, _ := req.Context().Value(apiKeyScopesKey).([]string)
+	return scopes
+}
+
+// apiScopeHandle allows the API keys with the scope to access the handler.
+// The requests that not authorized by API keys will not be affected
+func (cr *Cluster) apiScopeHandle(scope string, next http.Handler) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		if getRequestTokenType(req) == tokenTypeAPIKey {
+			if !(database.APIKeyScopes)(getAPIKeyScopes(req)).Has(scope) {
+				writeJson(rw, http.StatusForbidden, Map{
+					"error":    "403 Forbidden",
+					"message":  "API key does not have the required scope",
+					"required": scope,
+				})
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyAllowedKey, true))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (cr *Cluster) apiScopeHandleFunc(scope string, next http.HandlerFunc) http.Handler {
+	return cr.apiScopeHandle(scope, next)
+}
+
+// rejectUnscopedAPIKey reports whether the request is authorized by an API key, and the route does not accept it
+func rejectUnscopedAPIKey(rw http.ResponseWriter, req *http.Request) bool {
+	if getRequestTokenType(req) != tokenTypeAPIKey {
+		return false
+	}
+	if allowed, _ := req.Context().Value(apiKeyAllowedKey).(bool); allowed {
+		return false
+	}
+	writeJson(rw, http.StatusForbidden, Map{
+		"error":   "403 Forbidden",
+		"message": "API key cannot access this endpoint",
+	})
+	return true
+}
+
+type apiKeyPayload struct {
+	// User is the owner of the key, only admins can create keys for the other users
+	User   string   `json:"user"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the lifetime of the key in seconds, 0 means the key never expires
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// apiV0APIKeys lists the keys of the user with GET, and creates a key with POST.
+// Admins can see the keys of all users
+func (cr *Cluster) apiV0APIKeys(rw http.ResponseWriter, req *http.Request) {
+	if getRequestTokenType(req) != tokenTypeAuth {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "invalid authorization type",
+		})
+		return
+	}
+	user := getLoggedUser(req)
+	isAdmin := roleAllows(getLoggedRole(req), roleAdmin)
+	switch req.Method {
+	case http.MethodGet:
+		keys := make([]database.APIKeyRecord, 0, 4)
+		if err := cr.database.ForEachAPIKey(func(rec *database.APIKeyRecord) error {
+			if isAdmin || rec.User == user {
+				keys = append(keys, *rec)
+			}
+			return nil
+		}); err != nil {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "database error",
+				"message": err.Error(),
+			})
+			return
+		}
+		writeJson(rw, http.StatusOK, keys)
+	case http.MethodPost:
+		data, ok := parseRequestBody[apiKeyPayload](rw, req, nil)
+		if !ok {
+			return
+		}
+		setAuditTarget(req, data.Name)
+		owner := user
+		if data.User != "" && data.User != user {
+			if !isAdmin {
+				writeJson(rw, http.StatusForbidden, Map{
+					"error":    "403 Forbidden",
+					"message":  "permission denied",
+					"required": roleAdmin,
+				})
+				return
+			}
+			if _, err := cr.getUserRole(data.User); err != nil {
+				writeJson(rw, http.StatusBadRequest, Map{
+					"error":   "invalid user",
+					"message": err.Error(),
+				})
+				return
+			}
+			owner = data.User
+		}
+		var expires time.Time
+		if data.ExpiresIn > 0 {
+			expires = time.Now().Add(time.Duration(data.ExpiresIn) * time.Second)
+		}
+		key, rec, err := cr.generateAPIKey(owner, data.Name, data.Scopes, expires)
+		if err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "Cannot create API key",
+				"message": err.Error(),
+			})
+			return
+		}
+		// the key will only be shown once
+		writeJson(rw, http.StatusCreated, Map{
+			"key":  key,
+			"info": rec,
+		})
+	default:
+		checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet, http.MethodPost)
+	}
+}
+
+// apiV0APIKey revokes the key at the path
+func (cr *Cluster) apiV0APIKey(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodDelete) {
+		return
+	}
+	if getRequestTokenType(req) != tokenTypeAuth {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "invalid authorization type",
+		})
+		return
+	}
+	id := req.URL.Path
+	rec, err := cr.database.GetAPIKey(id)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeJson(rw, http.StatusNotFound, Map{
+				"error": "API key not found",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if rec.User != getLoggedUser(req) && !roleAllows(getLoggedRole(req), roleAdmin) {
+		writeJson(rw, http.StatusForbidden, Map{
+			"error":    "403 Forbidden",
+			"message":  "permission denied",
+			"required": roleAdmin,
+		})
+		return
+	}
+	if err := cr.revokeAPIKey(id); err != nil && err != database.ErrNotFound {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
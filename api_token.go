@@ -38,6 +38,7 @@ const (
 	tokenIdKey   = "go-openbmclapi.cluster.token.id"
 
 	loggedUserKey = "go-openbmclapi.cluster.logged.user"
+	loggedRoleKey = "go-openbmclapi.cluster.logged.role"
 )
 
 const (
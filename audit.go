@@ -0,0 +1,253 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const auditEntryKey = "go-openbmclapi.cluster.audit.entry"
+
+// auditActions maps the request methods to the audit actions,
+// the requests with the methods that are not in the map will not be recorded
+type auditActions map[string]string
+
+// auditEntry can be filled by the handlers to provide the details that the middleware cannot know
+type auditEntry struct {
+	actor    string
+	actorSet bool
+	target   string
+	failed   bool
+	message  string
+}
+
+func getAuditEntry(req *http.Request) *auditEntry {
+	e, _ := req.Context().Value(auditEntryKey).(*auditEntry)
+	return e
+}
+
+// setAuditActor overrides the actor, it's used by the login handlers since the user is not logged in yet
+func setAuditActor(req *http.Request, actor string) {
+	if e := getAuditEntry(req); e != nil {
+		e.actor, e.actorSet = actor, true
+	}
+}
+
+func setAuditTarget(req *http.Request, target string) {
+	if e := getAuditEntry(req); e != nil {
+		e.target = target
+	}
+}
+
+// setAuditMessage adds a note to the record, it will be overwritten by the error status if the action failed
+func setAuditMessage(req *http.Request, message string) {
+	if e := getAuditEntry(req); e != nil {
+		e.message = message
+	}
+}
+
+// setAuditFailure marks the action as failed even if the response status is successful
+func setAuditFailure(req *http.Request, message string) {
+	if e := getAuditEntry(req); e != nil {
+		e.failed, e.message = true, message
+	}
+}
+
+// auditHandle records the requests after they are handled.
+// The action fails if the response status is 400 or above, or the handler called setAuditFailure.
+// The path of the request is used as the target by default if it's stripped by http.StripPrefix
+func (cr *Cluster) auditHandle(actions auditActions, next http.Handler) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		action, ok := actions[req.Method]
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		entry := new(auditEntry)
+		if p := req.URL.Path; p != "" && p[0] != '/' {
+			entry.target = p
+		}
+		srw := utils.WrapAsStatusResponseWriter(rw)
+		next.ServeHTTP(srw, req.WithContext(context.WithValue(req.Context(), auditEntryKey, entry)))
+
+		status := srw.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= 400 && !entry.failed {
+			entry.failed = true
+			entry.message = strconv.Itoa(status) + " " + http.StatusText(status)
+		}
+		cr.recordAudit(req, action, entry)
+	})
+}
+
+func (cr *Cluster) auditHandleFunc(actions auditActions, next http.HandlerFunc) http.Handler {
+	return cr.auditHandle(actions, next)
+}
+
+func (cr *Cluster) recordAudit(req *http.Request, action string, entry *auditEntry) {
+	rec := database.AuditRecord{
+		Id:      uuid.New(),
+		Time:    time.Now(),
+		Actor:   entry.actor,
+		Action:  action,
+		Target:  entry.target,
+		Result:  database.AuditSuccess,
+		Message: entry.message,
+	}
+	if !entry.actorSet {
+		rec.Actor = getLoggedUser(req)
+	}
+	if getRequestTokenType(req) == tokenTypeAPIKey {
+		// the API keys are not bound to the clients
+		tid, _ := req.Context().Value(tokenIdKey).(string)
+		rec.ClientId = "api-key:" + tid
+	} else {
+		rec.ClientId, _ = req.Context().Value(clientIdKey).(string)
+	}
+	rec.IP, _ = req.Context().Value(RealAddrCtxKey).(string)
+	if entry.failed {
+		rec.Result = database.AuditFailure
+	}
+	if err := cr.database.AddAuditRecord(rec); err != nil {
+		log.Errorf("Cannot record audit action %s by %q: %v", action, rec.Actor, err)
+	}
+}
+
+// parseAuditTime accepts a RFC 3339 time or unix milliseconds
+func parseAuditTime(s string) (t time.Time, err error) {
+	if s == "" {
+		return
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseAuditFilter(rw http.ResponseWriter, req *http.Request) (filter database.AuditFilter, ok bool) {
+	query := req.URL.Query()
+	filter = database.AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		Result: query.Get("result"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "cannot parse since",
+			"message": err.Error(),
+		})
+		return
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "cannot parse until",
+			"message": err.Error(),
+		})
+		return
+	}
+	return filter, true
+}
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+func (cr *Cluster) apiV0AuditLogs(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	filter, ok := parseAuditFilter(rw, req)
+	if !ok {
+		return
+	}
+	query := req.URL.Query()
+	offset, limit := 0, defaultAuditPageSize
+	if s := query.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error": "offset must be a non-negative integer",
+			})
+			return
+		}
+		offset = n
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error": "limit must be a positive integer",
+			})
+			return
+		}
+		limit = min(n, maxAuditPageSize)
+	}
+	records, total, err := cr.database.QueryAuditRecords(filter, offset, limit)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"records": records,
+	})
+}
+
+// apiV0AuditLogsExport writes the matched records as JSON lines from old to new
+func (cr *Cluster) apiV0AuditLogsExport(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	filter, ok := parseAuditFilter(rw, req)
+	if !ok {
+		return
+	}
+	name := time.Now().Format("audit-20060102-150405.jsonl")
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	rw.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(rw)
+	if err := cr.database.ForEachAuditRecord(filter, func(rec *database.AuditRecord) error {
+		return encoder.Encode(rec)
+	}); err != nil {
+		log.Errorf("Cannot export audit logs: %v", err)
+	}
+}
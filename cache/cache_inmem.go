@@ -20,29 +20,221 @@
 package cache
 
 import (
+	"container/list"
+	"strings"
+	"sync"
 	"time"
+)
 
-	"github.com/patrickmn/go-cache"
+const (
+	// entryOverhead is the estimated memory used by an entry besides the key and the value
+	entryOverhead = 128
+	sweepInterval = time.Minute
 )
 
+type InMemOptions struct {
+	// MaxBytes is the memory budget of the cache, 0 means unlimited
+	MaxBytes int64
+	// Quotas limits the memory used by the keys with the prefixes, usually the namespaces.
+	// The longest matching prefix is used if there are more than one
+	Quotas map[string]int64
+}
+
+// CacheStats is the statistics of a cache
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"maxBytes"`
+
+	Namespaces map[string]*CacheStats `json:"namespaces,omitempty"`
+}
+
+// StatsReporter is implemented by the caches that count the hits and misses
+type StatsReporter interface {
+	Stats() CacheStats
+}
+
+type inMemEntry struct {
+	key    string
+	value  any // string or []byte
+	size   int64
+	expire time.Time // zero means never expire
+
+	elem   *list.Element
+	ns     *inMemNamespace
+	nsElem *list.Element
+}
+
+type inMemNamespace struct {
+	prefix string
+	quota  int64
+	lru    list.List
+	stats  CacheStats
+}
+
+// InMemCache is a size-bounded LRU cache in memory
 type InMemCache struct {
-	cache *cache.Cache
+	mux        sync.Mutex
+	maxBytes   int64
+	items      map[string]*inMemEntry
+	lru        list.List // the front is the most recently used
+	namespaces []*inMemNamespace
+	stats      CacheStats
+	lastSweep  time.Time
 }
 
-var _ Cache = (*InMemCache)(nil)
+var (
+	_ Cache         = (*InMemCache)(nil)
+	_ StatsReporter = (*InMemCache)(nil)
+)
 
-func NewInMemCache() *InMemCache {
-	return &InMemCache{
-		cache: cache.New(cache.NoExpiration, time.Minute),
+// NewInMemCache creates an in-memory cache, nil opt means no memory limit
+func NewInMemCache(opt *InMemOptions) *InMemCache {
+	c := &InMemCache{
+		items:     make(map[string]*inMemEntry),
+		lastSweep: time.Now(),
+	}
+	if opt != nil {
+		c.maxBytes = opt.MaxBytes
+		for prefix, quota := range opt.Quotas {
+			c.namespaces = append(c.namespaces, &inMemNamespace{
+				prefix: prefix,
+				quota:  quota,
+			})
+		}
+	}
+	return c
+}
+
+func (c *InMemCache) namespaceOf(key string) (ns *inMemNamespace) {
+	for _, n := range c.namespaces {
+		if strings.HasPrefix(key, n.prefix) && (ns == nil || len(n.prefix) > len(ns.prefix)) {
+			ns = n
+		}
+	}
+	return
+}
+
+func (c *InMemCache) set(key string, value any, size int, opt CacheOpt) {
+	now := time.Now()
+	e := &inMemEntry{
+		key:   key,
+		value: value,
+		size:  (int64)(len(key)+size) + entryOverhead,
+	}
+	if opt.Expiration > 0 {
+		e.expire = now.Add(opt.Expiration)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if now.Sub(c.lastSweep) >= sweepInterval {
+		c.lastSweep = now
+		c.sweepLocked(now)
+	}
+	if old, ok := c.items[key]; ok {
+		c.removeLocked(old)
+	}
+	e.ns = c.namespaceOf(key)
+	// do not store the values that can never fit, otherwise the whole cache will be flushed
+	if c.maxBytes > 0 && e.size > c.maxBytes {
+		return
+	}
+	if e.ns != nil && e.ns.quota > 0 && e.size > e.ns.quota {
+		return
+	}
+
+	c.items[key] = e
+	e.elem = c.lru.PushFront(e)
+	c.stats.Entries++
+	c.stats.Bytes += e.size
+	if ns := e.ns; ns != nil {
+		e.nsElem = ns.lru.PushFront(e)
+		ns.stats.Entries++
+		ns.stats.Bytes += e.size
+		for ns.quota > 0 && ns.stats.Bytes > ns.quota {
+			c.evictLocked(ns.lru.Back().Value.(*inMemEntry))
+		}
+	}
+	for c.maxBytes > 0 && c.stats.Bytes > c.maxBytes {
+		c.evictLocked(c.lru.Back().Value.(*inMemEntry))
+	}
+}
+
+func (c *InMemCache) get(key string) (value any, ok bool) {
+	now := time.Now()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e, ok := c.items[key]
+	if ok && !e.expire.IsZero() && now.After(e.expire) {
+		c.expireLocked(e)
+		ok = false
+	}
+	ns := c.namespaceOf(key)
+	if !ok {
+		c.stats.Misses++
+		if ns != nil {
+			ns.stats.Misses++
+		}
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e.elem)
+	if ns != nil {
+		ns.stats.Hits++
+		ns.lru.MoveToFront(e.nsElem)
+	}
+	return e.value, true
+}
+
+func (c *InMemCache) removeLocked(e *inMemEntry) {
+	delete(c.items, e.key)
+	c.lru.Remove(e.elem)
+	c.stats.Entries--
+	c.stats.Bytes -= e.size
+	if ns := e.ns; ns != nil {
+		ns.lru.Remove(e.nsElem)
+		ns.stats.Entries--
+		ns.stats.Bytes -= e.size
+	}
+}
+
+func (c *InMemCache) evictLocked(e *inMemEntry) {
+	c.removeLocked(e)
+	c.stats.Evictions++
+	if e.ns != nil {
+		e.ns.stats.Evictions++
+	}
+}
+
+func (c *InMemCache) expireLocked(e *inMemEntry) {
+	c.removeLocked(e)
+	c.stats.Expired++
+	if e.ns != nil {
+		e.ns.stats.Expired++
+	}
+}
+
+func (c *InMemCache) sweepLocked(now time.Time) {
+	for _, e := range c.items {
+		if !e.expire.IsZero() && now.After(e.expire) {
+			c.expireLocked(e)
+		}
 	}
 }
 
 func (c *InMemCache) Set(key string, value string, opt CacheOpt) {
-	c.cache.Set(key, value, opt.Expiration)
+	c.set(key, value, len(value), opt)
 }
 
 func (c *InMemCache) Get(key string) (value string, ok bool) {
-	v, ok := c.cache.Get(key)
+	v, ok := c.get(key)
 	if !ok {
 		return "", false
 	}
@@ -51,11 +243,11 @@ func (c *InMemCache) Get(key string) (value string, ok bool) {
 }
 
 func (c *InMemCache) SetBytes(key string, value []byte, opt CacheOpt) {
-	c.cache.Set(key, value, opt.Expiration)
+	c.set(key, value, len(value), opt)
 }
 
 func (c *InMemCache) GetBytes(key string) (value []byte, ok bool) {
-	v, ok := c.cache.Get(key)
+	v, ok := c.get(key)
 	if !ok {
 		return nil, false
 	}
@@ -64,5 +256,26 @@ func (c *InMemCache) GetBytes(key string) (value []byte, ok bool) {
 }
 
 func (c *InMemCache) Delete(key string) {
-	c.cache.Delete(key)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeLocked(e)
+	}
+}
+
+// Stats returns the statistics of the cache and each namespace that has a quota
+func (c *InMemCache) Stats() (s CacheStats) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	s = c.stats
+	s.MaxBytes = c.maxBytes
+	if len(c.namespaces) > 0 {
+		s.Namespaces = make(map[string]*CacheStats, len(c.namespaces))
+		for _, ns := range c.namespaces {
+			st := ns.stats
+			st.MaxBytes = ns.quota
+			s.Namespaces[ns.prefix] = &st
+		}
+	}
+	return
 }
@@ -0,0 +1,148 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"testing"
+
+	"strings"
+	"time"
+)
+
+func TestInMemCacheLRU(t *testing.T) {
+	// each entry uses 1 + 100 + entryOverhead bytes
+	value := strings.Repeat("x", 100)
+	c := NewInMemCache(&InMemOptions{MaxBytes: (1 + 100 + entryOverhead) * 3})
+
+	c.Set("a", value, CacheOpt{})
+	c.Set("b", value, CacheOpt{})
+	c.Set("c", value, CacheOpt{})
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	c.Set("d", value, CacheOpt{})
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Expected the least recently used entry b to be evicted")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if v, ok := c.Get(k); !ok || v != value {
+			t.Errorf("Expected %s to be cached", k)
+		}
+	}
+
+	c.SetBytes("big", make([]byte, 1024), CacheOpt{})
+	if _, ok := c.GetBytes("big"); ok {
+		t.Errorf("Expected the value larger than the budget not to be cached")
+	}
+
+	s := c.Stats()
+	if s.Entries != 3 || s.Bytes != (1+100+entryOverhead)*3 {
+		t.Errorf("Unexpected entries=%d bytes=%d", s.Entries, s.Bytes)
+	}
+	if s.Hits != 4 || s.Misses != 2 || s.Evictions != 1 {
+		t.Errorf("Unexpected hits=%d misses=%d evictions=%d", s.Hits, s.Misses, s.Evictions)
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Expected a to be deleted")
+	}
+	if s := c.Stats(); s.Entries != 2 || s.Bytes != (1+100+entryOverhead)*2 {
+		t.Errorf("Unexpected entries=%d bytes=%d after delete", s.Entries, s.Bytes)
+	}
+}
+
+func TestInMemCacheExpiration(t *testing.T) {
+	c := NewInMemCache(nil)
+	c.Set("short", "v", CacheOpt{Expiration: time.Millisecond})
+	c.Set("long", "v", CacheOpt{Expiration: time.Hour})
+	c.Set("forever", "v", CacheOpt{})
+	time.Sleep(time.Millisecond * 5)
+
+	if _, ok := c.Get("short"); ok {
+		t.Errorf("Expected short to be expired")
+	}
+	for _, k := range []string{"long", "forever"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("Expected %s to be cached", k)
+		}
+	}
+	if s := c.Stats(); s.Expired != 1 || s.Entries != 2 {
+		t.Errorf("Unexpected expired=%d entries=%d", s.Expired, s.Entries)
+	}
+
+	// overwriting should replace the old value and its expiration
+	c.Set("long", "w", CacheOpt{})
+	if v, ok := c.Get("long"); !ok || v != "w" {
+		t.Errorf("Get = %q, %v; want %q, true", v, ok, "w")
+	}
+	if s := c.Stats(); s.Entries != 2 {
+		t.Errorf("Unexpected entries=%d after overwrite", s.Entries)
+	}
+}
+
+func TestInMemCacheNamespaceQuota(t *testing.T) {
+	value := strings.Repeat("x", 100)
+	size := (int64)(len("http@k0")+len(value)) + entryOverhead
+	c := NewInMemCache(&InMemOptions{
+		Quotas: map[string]int64{
+			"http@": size * 2,
+		},
+	})
+	http := NewCacheWithNamespace(c, "http@")
+	other := NewCacheWithNamespace(c, "other@")
+
+	for i := 0; i < 5; i++ {
+		other.Set("k"+string(rune('0'+i)), value, CacheOpt{})
+	}
+	http.Set("k0", value, CacheOpt{})
+	http.Set("k1", value, CacheOpt{})
+	http.Get("k0")
+	http.Set("k2", value, CacheOpt{})
+
+	if _, ok := http.Get("k1"); ok {
+		t.Errorf("Expected k1 to be evicted by the namespace quota")
+	}
+	for _, k := range []string{"k0", "k2"} {
+		if _, ok := http.Get(k); !ok {
+			t.Errorf("Expected http@%s to be cached", k)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := other.Get("k" + string(rune('0'+i))); !ok {
+			t.Errorf("Expected the other namespace not to be affected by the quota")
+		}
+	}
+
+	s := c.Stats()
+	ns := s.Namespaces["http@"]
+	if ns == nil {
+		t.Fatalf("Expected the stats of namespace http@")
+	}
+	if ns.Entries != 2 || ns.Bytes != size*2 || ns.MaxBytes != size*2 {
+		t.Errorf("Unexpected namespace entries=%d bytes=%d max=%d", ns.Entries, ns.Bytes, ns.MaxBytes)
+	}
+	if ns.Evictions != 1 || ns.Hits != 3 || ns.Misses != 1 {
+		t.Errorf("Unexpected namespace hits=%d misses=%d evictions=%d", ns.Hits, ns.Misses, ns.Evictions)
+	}
+	if s.Entries != 7 || s.Evictions != 1 {
+		t.Errorf("Unexpected entries=%d evictions=%d", s.Entries, s.Evictions)
+	}
+}
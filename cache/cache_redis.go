@@ -21,25 +21,85 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisCache struct {
-	Client  *redis.Client
+	Client  redis.UniversalClient
 	Context context.Context
+
+	health *healthTracker
+}
+
+var (
+	_ Cache         = (*RedisCache)(nil)
+	_ HealthChecker = (*RedisCache)(nil)
+)
+
+type RedisTLSOptions struct {
+	Enable bool `yaml:"enable"`
+	// ServerName is used to verify the certificate, the host of the address is used if it's empty
+	ServerName string `yaml:"server-name,omitempty"`
+	// CA is the path of the PEM encoded CA certificates, the system pool is used if it's empty
+	CA string `yaml:"ca,omitempty"`
+	// Cert and Key are the paths of the client certificate and its private key
+	Cert               string `yaml:"cert,omitempty"`
+	Key                string `yaml:"key,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify,omitempty"`
 }
 
-var _ Cache = (*RedisCache)(nil)
+func (o *RedisTLSOptions) TLSConfig() (cfg *tls.Config, err error) {
+	if !o.Enable {
+		return nil, nil
+	}
+	cfg = &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CA != "" {
+		data, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificate found in %q", o.CA)
+		}
+	}
+	if o.Cert != "" || o.Key != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
 
 type RedisOptions struct {
-	Network    string `yaml:"network"`
-	Addr       string `yaml:"addr"`
-	ClientName string `yaml:"client-name"`
-	Username   string `yaml:"username"`
-	Password   string `yaml:"password"`
+	Network string `yaml:"network"`
+	Addr    string `yaml:"addr"`
+	// Addrs are the addresses of the sentinels in sentinel mode, or the seed nodes in cluster mode
+	Addrs      []string `yaml:"addrs,omitempty"`
+	ClientName string   `yaml:"client-name"`
+	Username   string   `yaml:"username"`
+	Password   string   `yaml:"password"`
+	DB         int      `yaml:"db"`
+	// MasterName enables the sentinel mode
+	MasterName       string `yaml:"master-name,omitempty"`
+	SentinelUsername string `yaml:"sentinel-username,omitempty"`
+	SentinelPassword string `yaml:"sentinel-password,omitempty"`
+	// Cluster enables the redis cluster mode
+	Cluster bool            `yaml:"cluster,omitempty"`
+	TLS     RedisTLSOptions `yaml:"tls"`
 }
 
 func (o RedisOptions) ToRedis() *redis.Options {
@@ -49,30 +109,112 @@ func (o RedisOptions) ToRedis() *redis.Options {
 		ClientName: o.ClientName,
 		Username:   o.Username,
 		Password:   o.Password,
+		DB:         o.DB,
+	}
+}
+
+func (o *RedisOptions) addrs() []string {
+	if len(o.Addrs) > 0 {
+		return o.Addrs
+	}
+	if o.Addr != "" {
+		return []string{o.Addr}
+	}
+	return nil
+}
+
+// Validate checks the options and the TLS files
+func (o *RedisOptions) Validate() error {
+	if o.MasterName != "" && o.Cluster {
+		return errors.New("Redis sentinel mode and cluster mode cannot be enabled at the same time")
+	}
+	if (o.MasterName != "" || o.Cluster) && len(o.addrs()) == 0 {
+		return errors.New("Redis addrs is empty")
+	}
+	if o.Cluster && o.DB != 0 {
+		return errors.New("Redis cluster does not support db other than 0")
+	}
+	_, err := o.TLS.TLSConfig()
+	return err
+}
+
+// NewClient creates the redis client by the mode of the options
+func (o *RedisOptions) NewClient() (redis.UniversalClient, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	tlsCfg, err := o.TLS.TLSConfig()
+	if err != nil {
+		return nil, err
 	}
+	switch {
+	case o.MasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       o.MasterName,
+			SentinelAddrs:    o.addrs(),
+			SentinelUsername: o.SentinelUsername,
+			SentinelPassword: o.SentinelPassword,
+			ClientName:       o.ClientName,
+			Username:         o.Username,
+			Password:         o.Password,
+			DB:               o.DB,
+			TLSConfig:        tlsCfg,
+		}), nil
+	case o.Cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:      o.addrs(),
+			ClientName: o.ClientName,
+			Username:   o.Username,
+			Password:   o.Password,
+			TLSConfig:  tlsCfg,
+		}), nil
+	}
+	opt := o.ToRedis()
+	opt.TLSConfig = tlsCfg
+	return redis.NewClient(opt), nil
 }
 
 func NewRedisCache(opt *redis.Options) *RedisCache {
 	return NewRedisCacheByClient(redis.NewClient(opt))
 }
 
-func NewRedisCacheByClient(cli *redis.Client) *RedisCache {
+func NewRedisCacheByClient(cli redis.UniversalClient) *RedisCache {
 	return &RedisCache{
 		Client:  cli,
 		Context: context.Background(),
+		health:  newHealthTracker("Redis cache"),
+	}
+}
+
+// report records the result of a command, redis.Nil means the key does not exist and is not a failure
+func (c *RedisCache) report(err error) {
+	if err == redis.Nil {
+		err = nil
 	}
+	c.health.report(err)
+}
+
+func (c *RedisCache) Ping(ctx context.Context) error {
+	err := c.Client.Ping(ctx).Err()
+	c.report(err)
+	return err
+}
+
+func (c *RedisCache) Health() HealthStatus {
+	return c.health.status()
 }
 
 func (c *RedisCache) Set(key string, value string, opt CacheOpt) {
 	ctx, cancel := context.WithTimeout(c.Context, time.Second*3)
 	defer cancel()
-	c.Client.Set(ctx, key, value, opt.Expiration)
+	c.report(c.Client.Set(ctx, key, value, opt.Expiration).Err())
 }
 
 func (c *RedisCache) Get(key string) (value string, ok bool) {
 	ctx, cancel := context.WithTimeout(c.Context, time.Second)
 	defer cancel()
 	cmd := c.Client.Get(ctx, key)
+	c.report(cmd.Err())
 	if cmd.Err() != nil {
 		return "", false
 	}
@@ -99,5 +241,5 @@ func (c *RedisCache) GetBytes(key string) (value []byte, ok bool) {
 func (c *RedisCache) Delete(key string) {
 	ctx, cancel := context.WithTimeout(c.Context, time.Second)
 	defer cancel()
-	c.Client.Del(ctx)
+	c.report(c.Client.Del(ctx, key).Err())
 }
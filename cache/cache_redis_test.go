@@ -0,0 +1,120 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"testing"
+
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	opts := RedisOptions{Addr: mr.Addr(), DB: 2}
+	cli, err := opts.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	c := NewRedisCacheByClient(cli)
+	defer cli.Close()
+
+	c.Set("key", "value", CacheOpt{Expiration: time.Minute})
+	if v, ok := c.Get("key"); !ok || v != "value" {
+		t.Errorf("Get = %q, %v; want %q, true", v, ok, "value")
+	}
+	mr.Select(2)
+	if v, err := mr.Get("key"); err != nil || v != "value" {
+		t.Errorf("Expected the key to be stored in db 2, got %q, %v", v, err)
+	}
+
+	c.SetBytes("bytes", []byte{0, 1, 2}, CacheOpt{})
+	if v, ok := c.GetBytes("bytes"); !ok || string(v) != "\x00\x01\x02" {
+		t.Errorf("GetBytes = %v, %v", v, ok)
+	}
+
+	c.Delete("key")
+	if _, ok := c.Get("key"); ok {
+		t.Errorf("Expected the key to be deleted")
+	}
+	if mr.Exists("key") {
+		t.Errorf("Expected the key to be deleted from redis")
+	}
+
+	mr.FastForward(time.Minute)
+	if h := c.Health(); !h.Healthy || h.Failures != 0 {
+		t.Errorf("Expected a cache miss not to be a failure, got %+v", h)
+	}
+}
+
+func TestRedisCacheHealth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := NewRedisCache(RedisOptions{Addr: mr.Addr()}.ToRedis())
+	defer c.Client.Close()
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	mr.SetError("LOADING")
+	if _, ok := c.Get("key"); ok {
+		t.Errorf("Expected a cache miss when redis is unavailable")
+	}
+	c.Set("key", "value", CacheOpt{})
+	h := c.Health()
+	if h.Healthy || h.Failures != 2 || h.LastError == "" {
+		t.Errorf("Expected the cache to be unhealthy after 2 failures, got %+v", h)
+	}
+
+	mr.SetError("")
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if h := c.Health(); !h.Healthy || h.Failures != 0 || h.LastError != "" {
+		t.Errorf("Expected the cache to recover, got %+v", h)
+	}
+}
+
+func TestRedisOptionsValidate(t *testing.T) {
+	for name, opts := range map[string]RedisOptions{
+		"sentinel and cluster":   {Addrs: []string{"127.0.0.1:26379"}, MasterName: "mymaster", Cluster: true},
+		"cluster with db":        {Addrs: []string{"127.0.0.1:7000"}, Cluster: true, DB: 1},
+		"sentinel without addrs": {MasterName: "mymaster"},
+		"missing ca":             {Addr: "127.0.0.1:6379", TLS: RedisTLSOptions{Enable: true, CA: "/nonexistent/ca.pem"}},
+	} {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+	for name, opts := range map[string]RedisOptions{
+		"standalone": {Addr: "127.0.0.1:6379", DB: 3},
+		"sentinel":   {Addrs: []string{"127.0.0.1:26379"}, MasterName: "mymaster"},
+		"cluster":    {Addrs: []string{"127.0.0.1:7000", "127.0.0.1:7001"}, Cluster: true},
+		"tls":        {Addr: "127.0.0.1:6380", TLS: RedisTLSOptions{Enable: true, ServerName: "redis.local"}},
+	} {
+		cli, err := opts.NewClient()
+		if err != nil {
+			t.Errorf("NewClient(%s): %v", name, err)
+			continue
+		}
+		cli.Close()
+	}
+}
@@ -0,0 +1,120 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// HealthChecker is implemented by the caches that can be unavailable,
+// since the Cache methods report the failures as cache misses
+type HealthChecker interface {
+	// Ping checks the cache actively, and updates the health status
+	Ping(ctx context.Context) error
+	Health() HealthStatus
+}
+
+// healthTracker records the results of the cache operations
+type healthTracker struct {
+	name string
+
+	mux       sync.Mutex
+	healthy   bool
+	since     time.Time
+	failures  int
+	lastCheck time.Time
+	lastErr   error
+}
+
+func newHealthTracker(name string) *healthTracker {
+	return &healthTracker{
+		name:    name,
+		healthy: true,
+		since:   time.Now(),
+	}
+}
+
+func (t *healthTracker) report(err error) {
+	now := time.Now()
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.lastCheck = now
+	if err == nil {
+		if !t.healthy {
+			log.Infof("%s recovered after %d failures", t.name, t.failures)
+			t.healthy = true
+			t.since = now
+		}
+		t.failures = 0
+		t.lastErr = nil
+		return
+	}
+	t.failures++
+	t.lastErr = err
+	if t.healthy {
+		log.Warnf("%s is unavailable: %v", t.name, err)
+		t.healthy = false
+		t.since = now
+	}
+}
+
+func (t *healthTracker) status() (s HealthStatus) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	s.Healthy = t.healthy
+	s.Since = t.since
+	s.Failures = t.failures
+	s.LastCheck = t.lastCheck
+	if t.lastErr != nil {
+		s.LastError = t.lastErr.Error()
+	}
+	return
+}
+
+// StartHealthCheck pings the cache periodically until the context is canceled
+func StartHealthCheck(ctx context.Context, c HealthChecker, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			tctx, cancel := context.WithTimeout(ctx, time.Second*5)
+			c.Ping(tctx)
+			cancel()
+		}
+	}()
+}
@@ -0,0 +1,495 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package certmgr obtains and renews TLS certificates from an ACME server
+package certmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+const httpChallengePrefix = "/.well-known/acme-challenge/"
+
+type Options struct {
+	// DirectoryURL is the ACME directory endpoint, default is Let's Encrypt production
+	DirectoryURL string
+	// Email is the contact of the ACME account, optional
+	Email string
+	// Challenge is the challenge type, http-01 or tls-alpn-01
+	Challenge string
+	// Domains are the names that the certificate will be issued for
+	Domains []string
+	// Dir is where the account key and the certificates are stored
+	Dir string
+	// RenewBefore is how long before the expiry the certificate will be renewed
+	RenewBefore time.Duration
+	// HTTPClient is used to communicate with the ACME server
+	HTTPClient *http.Client
+}
+
+// Manager obtains a certificate for the domains and keeps it renewed.
+// The certificate is served by GetCertificate, so it can be swapped without restart
+type Manager struct {
+	opts   Options
+	client *acme.Client
+
+	cert  atomic.Pointer[tls.Certificate]
+	ready chan struct{}
+
+	obtainMux  sync.Mutex
+	tokenMux   sync.RWMutex
+	httpTokens map[string][]byte
+	alpnCerts  map[string]*tls.Certificate
+}
+
+func NewManager(opts Options) (m *Manager, err error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("certmgr: no domain was given")
+	}
+	switch opts.Challenge {
+	case "":
+		opts.Challenge = ChallengeHTTP01
+	case ChallengeHTTP01, ChallengeTLSALPN01:
+	default:
+		return nil, fmt.Errorf("certmgr: unsupported challenge type %q", opts.Challenge)
+	}
+	if opts.DirectoryURL == "" {
+		opts.DirectoryURL = acme.LetsEncryptURL
+	}
+	if opts.RenewBefore <= 0 {
+		opts.RenewBefore = time.Hour * 24 * 30
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	for i, d := range opts.Domains {
+		opts.Domains[i] = strings.ToLower(d)
+	}
+	if err = os.MkdirAll(opts.Dir, 0700); err != nil {
+		return
+	}
+	key, err := loadOrCreateKey(filepath.Join(opts.Dir, "account.key"))
+	if err != nil {
+		return
+	}
+	m = &Manager{
+		opts: opts,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: opts.DirectoryURL,
+			HTTPClient:   opts.HTTPClient,
+			UserAgent:    "go-openbmclapi",
+		},
+		ready:      make(chan struct{}),
+		httpTokens: make(map[string][]byte),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+	if cert, err := m.loadCert(); err == nil {
+		m.setCert(cert)
+		log.Infof("Loaded ACME certificate for %s, expires at %s", m.opts.Domains[0], cert.Leaf.NotAfter.Format(time.DateTime))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Cannot load cached ACME certificate: %v", err)
+	}
+	return
+}
+
+func (m *Manager) Challenge() string {
+	return m.opts.Challenge
+}
+
+// Domains returns the lower case names that the certificate is issued for
+func (m *Manager) Domains() []string {
+	return slices.Clone(m.opts.Domains)
+}
+
+// Certificate returns nil if no certificate was obtained yet
+func (m *Manager) Certificate() *tls.Certificate {
+	return m.cert.Load()
+}
+
+// Ready will be closed once a certificate is available
+func (m *Manager) Ready() <-chan struct{} {
+	return m.ready
+}
+
+func (m *Manager) setCert(cert *tls.Certificate) {
+	if m.cert.Swap(cert) == nil {
+		close(m.ready)
+	}
+}
+
+func (m *Manager) certPath() string {
+	return filepath.Join(m.opts.Dir, m.opts.Domains[0]+".crt")
+}
+
+func (m *Manager) keyPath() string {
+	return filepath.Join(m.opts.Dir, m.opts.Domains[0]+".key")
+}
+
+func (m *Manager) loadCert() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(m.certPath(), m.keyPath())
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range m.opts.Domains {
+		if err := cert.Leaf.VerifyHostname(d); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+func (m *Manager) saveCert(chain [][]byte, key *ecdsa.PrivateKey) (err error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = writeFileAtomic(m.keyPath(), keyPEM, 0600); err != nil {
+		return
+	}
+	if err = writeFileAtomic(m.certPath(), certPEM, 0644); err != nil {
+		return
+	}
+	return
+}
+
+// NextRenewal returns the time when the current certificate should be renewed.
+// It returns zero time if there is no certificate
+func (m *Manager) NextRenewal() time.Time {
+	cert := m.cert.Load()
+	if cert == nil {
+		return time.Time{}
+	}
+	return cert.Leaf.NotAfter.Add(-m.opts.RenewBefore)
+}
+
+// Run obtains the certificate when it is missing or going to expire, until the context is canceled
+func (m *Manager) Run(ctx context.Context) {
+	const minRetry, maxRetry = time.Minute, time.Hour
+	retry := minRetry
+	for {
+		wait := time.Until(m.NextRenewal())
+		if wait <= 0 {
+			if err := m.Obtain(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Errorf("Cannot obtain ACME certificate for %s, retry after %s: %v", strings.Join(m.opts.Domains, ", "), retry, err)
+				wait = retry
+				retry = min(retry*2, maxRetry)
+			} else {
+				retry = minRetry
+				continue
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Obtain requests a new certificate from the ACME server and swaps it in
+func (m *Manager) Obtain(ctx context.Context) (err error) {
+	m.obtainMux.Lock()
+	defer m.obtainMux.Unlock()
+
+	log.Infof("Requesting ACME certificate for %s from %s", strings.Join(m.opts.Domains, ", "), m.opts.DirectoryURL)
+	if err = m.register(ctx); err != nil {
+		return
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.opts.Domains...))
+	if err != nil {
+		return
+	}
+	for _, u := range order.AuthzURLs {
+		if err = m.authorize(ctx, u); err != nil {
+			return
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.opts.Domains[0]},
+		DNSNames: m.opts.Domains,
+	}, key)
+	if err != nil {
+		return
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return
+	}
+	if err = m.saveCert(chain, key); err != nil {
+		return
+	}
+	m.setCert(&tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	})
+	log.Infof("Obtained ACME certificate for %s, expires at %s", strings.Join(m.opts.Domains, ", "), leaf.NotAfter.Format(time.DateTime))
+	return
+}
+
+func (m *Manager) register(ctx context.Context) (err error) {
+	if m.client.KID != "" {
+		return
+	}
+	acct := new(acme.Account)
+	if m.opts.Email != "" {
+		acct.Contact = []string{"mailto:" + m.opts.Email}
+	}
+	if _, err = m.client.Register(ctx, acct, acme.AcceptTOS); err == acme.ErrAccountAlreadyExists {
+		err = nil
+	}
+	return
+}
+
+func (m *Manager) authorize(ctx context.Context, authzURL string) (err error) {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return
+	}
+	if authz.Status == acme.StatusValid {
+		return
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.opts.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("certmgr: challenge %s is not offered for %s", m.opts.Challenge, authz.Identifier.Value)
+	}
+	cleanup, err := m.fulfill(chal, authz.Identifier.Value)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+	if _, err = m.client.Accept(ctx, chal); err != nil {
+		return
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return
+}
+
+func (m *Manager) fulfill(chal *acme.Challenge, domain string) (cleanup func(), err error) {
+	switch chal.Type {
+	case ChallengeHTTP01:
+		var resp string
+		if resp, err = m.client.HTTP01ChallengeResponse(chal.Token); err != nil {
+			return
+		}
+		path := m.client.HTTP01ChallengePath(chal.Token)
+		m.tokenMux.Lock()
+		m.httpTokens[path] = ([]byte)(resp)
+		m.tokenMux.Unlock()
+		return func() {
+			m.tokenMux.Lock()
+			delete(m.httpTokens, path)
+			m.tokenMux.Unlock()
+		}, nil
+	case ChallengeTLSALPN01:
+		var cert tls.Certificate
+		if cert, err = m.client.TLSALPN01ChallengeCert(chal.Token, domain); err != nil {
+			return
+		}
+		domain = strings.ToLower(domain)
+		m.tokenMux.Lock()
+		m.alpnCerts[domain] = &cert
+		m.tokenMux.Unlock()
+		return func() {
+			m.tokenMux.Lock()
+			delete(m.alpnCerts, domain)
+			m.tokenMux.Unlock()
+		}, nil
+	}
+	return nil, fmt.Errorf("certmgr: unsupported challenge type %q", chal.Type)
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+// It returns nil certificate for unknown server names,
+// so the tls package can fall back to tls.Config.Certificates
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if slices.Equal(hello.SupportedProtos, []string{acme.ALPNProto}) {
+		m.tokenMux.RLock()
+		cert := m.alpnCerts[name]
+		m.tokenMux.RUnlock()
+		if cert == nil {
+			return nil, fmt.Errorf("certmgr: no tls-alpn-01 challenge for %q", name)
+		}
+		return cert, nil
+	}
+	cert := m.cert.Load()
+	if cert == nil {
+		return nil, nil
+	}
+	if name != "" && !slices.Contains(m.opts.Domains, name) {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// TLSConfig sets up the GetCertificate hook and the ALPN protocol of cfg
+func (m *Manager) TLSConfig(cfg *tls.Config) {
+	fallback := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := m.GetCertificate(hello)
+		if cert == nil && err == nil && fallback != nil {
+			return fallback(hello)
+		}
+		return cert, err
+	}
+	if m.opts.Challenge == ChallengeTLSALPN01 && !slices.Contains(cfg.NextProtos, acme.ALPNProto) {
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{"http/1.1"}
+		}
+		cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	}
+}
+
+// HTTPHandler serves the http-01 challenges, and passes other requests to fallback.
+// If fallback is nil, the requests will be redirected to https
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, httpChallengePrefix) {
+			if fallback != nil {
+				fallback.ServeHTTP(rw, req)
+				return
+			}
+			host, _, err := net.SplitHostPort(req.Host)
+			if err != nil {
+				host = req.Host
+			}
+			u := *req.URL
+			u.Scheme = "https"
+			u.Host = host
+			http.Redirect(rw, req, u.String(), http.StatusFound)
+			return
+		}
+		m.tokenMux.RLock()
+		resp, ok := m.httpTokens[req.URL.Path]
+		m.tokenMux.RUnlock()
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write(resp)
+	})
+}
+
+func loadOrCreateKey(path string) (key crypto.Signer, err error) {
+	if buf, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("certmgr: %s is not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return
+	}
+	if err = writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return
+	}
+	return ecKey, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	fd, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(fd.Name())
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		return
+	}
+	if err = fd.Chmod(perm); err != nil {
+		fd.Close()
+		return
+	}
+	if err = fd.Close(); err != nil {
+		return
+	}
+	return os.Rename(fd.Name(), path)
+}
@@ -0,0 +1,452 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package certmgr
+
+import (
+	"testing"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const testDomain = "example.test"
+
+// pebbleLike is a minimal ACME server which behaves like Pebble,
+// it validates the challenges against the given addresses instead of resolving the domains
+type pebbleLike struct {
+	*httptest.Server
+	t *testing.T
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	httpAddr string
+	alpnAddr string
+
+	mux    sync.Mutex
+	nonce  int
+	orders int
+	authz  map[string]*fakeAuthz
+	order  map[string]*fakeOrder
+}
+
+type fakeAuthz struct {
+	domain string
+	status string
+	token  string
+}
+
+type fakeOrder struct {
+	status  string
+	authz   []string
+	domains []string
+	cert    []byte
+}
+
+func newPebbleLike(t *testing.T) *pebbleLike {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pebble-like test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &pebbleLike{
+		t:      t,
+		caKey:  caKey,
+		caCert: caCert,
+		authz:  make(map[string]*fakeAuthz),
+		order:  make(map[string]*fakeOrder),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *pebbleLike) DirectoryURL() string {
+	return s.URL + "/dir"
+}
+
+func (s *pebbleLike) RootCAs() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	return pool
+}
+
+func (s *pebbleLike) orderJSON(id string, o *fakeOrder) map[string]any {
+	authz := make([]string, len(o.authz))
+	for i, a := range o.authz {
+		authz[i] = s.URL + "/authz/" + a
+	}
+	ids := make([]map[string]string, len(o.domains))
+	for i, d := range o.domains {
+		ids[i] = map[string]string{"type": "dns", "value": d}
+	}
+	res := map[string]any{
+		"status":         o.status,
+		"identifiers":    ids,
+		"authorizations": authz,
+		"finalize":       s.URL + "/finalize/" + id,
+	}
+	if o.cert != nil {
+		res["certificate"] = s.URL + "/cert/" + id
+	}
+	return res
+}
+
+func (s *pebbleLike) authzJSON(id string, a *fakeAuthz) map[string]any {
+	return map[string]any{
+		"status":     a.status,
+		"identifier": map[string]string{"type": "dns", "value": a.domain},
+		"challenges": []map[string]string{
+			{"type": ChallengeHTTP01, "url": s.URL + "/chal/" + id + "/" + ChallengeHTTP01, "token": a.token, "status": "pending"},
+			{"type": ChallengeTLSALPN01, "url": s.URL + "/chal/" + id + "/" + ChallengeTLSALPN01, "token": a.token, "status": "pending"},
+		},
+	}
+}
+
+func (s *pebbleLike) serve(rw http.ResponseWriter, req *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.nonce++
+	rw.Header().Set("Replay-Nonce", "nonce-"+strconv.Itoa(s.nonce))
+	writeJSON := func(code int, v any) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(v)
+	}
+
+	if req.URL.Path == "/dir" {
+		writeJSON(http.StatusOK, map[string]any{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key-change",
+		})
+		return
+	}
+	if req.URL.Path == "/nonce" {
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		writeJSON(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:malformed", "detail": err.Error()})
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	typ, id, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	switch typ {
+	case "account":
+		rw.Header().Set("Location", s.URL+"/account/1")
+		writeJSON(http.StatusCreated, map[string]any{"status": "valid"})
+	case "order":
+		if id != "" {
+			o := s.order[id]
+			if o.status == "pending" {
+				ready := true
+				for _, a := range o.authz {
+					if s.authz[a].status != "valid" {
+						ready = false
+					}
+				}
+				if ready {
+					o.status = "ready"
+				}
+			}
+			writeJSON(http.StatusOK, s.orderJSON(id, o))
+			return
+		}
+		var newOrder struct {
+			Identifiers []struct{ Value string }
+		}
+		json.Unmarshal(payload, &newOrder)
+		s.orders++
+		id = strconv.Itoa(s.orders)
+		o := &fakeOrder{status: "pending"}
+		for i, ident := range newOrder.Identifiers {
+			aid := id + "-" + strconv.Itoa(i)
+			s.authz[aid] = &fakeAuthz{domain: ident.Value, status: "pending", token: "token" + aid}
+			o.authz = append(o.authz, aid)
+			o.domains = append(o.domains, ident.Value)
+		}
+		s.order[id] = o
+		rw.Header().Set("Location", s.URL+"/order/"+id)
+		writeJSON(http.StatusCreated, s.orderJSON(id, o))
+	case "authz":
+		writeJSON(http.StatusOK, s.authzJSON(id, s.authz[id]))
+	case "chal":
+		aid, chalType, _ := strings.Cut(id, "/")
+		a := s.authz[aid]
+		if err := s.validate(chalType, a); err != nil {
+			s.t.Logf("Challenge %s for %s failed: %v", chalType, a.domain, err)
+			a.status = "invalid"
+		} else {
+			a.status = "valid"
+		}
+		writeJSON(http.StatusOK, map[string]string{"type": chalType, "url": s.URL + req.URL.Path, "token": a.token, "status": a.status})
+	case "finalize":
+		o := s.order[id]
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		cert, err := s.issue(csrDER)
+		if err != nil {
+			writeJSON(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+		o.status, o.cert = "valid", cert
+		rw.Header().Set("Location", s.URL+"/order/"+id)
+		writeJSON(http.StatusOK, s.orderJSON(id, o))
+	case "cert":
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		rw.Write(s.order[id].cert)
+	default:
+		writeJSON(http.StatusNotFound, map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+	}
+}
+
+func (s *pebbleLike) validate(chalType string, a *fakeAuthz) error {
+	switch chalType {
+	case ChallengeHTTP01:
+		resp, err := http.Get("http://" + s.httpAddr + httpChallengePrefix + a.token)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix((string)(body), a.token+".") {
+			return fmt.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+		return nil
+	case ChallengeTLSALPN01:
+		conn, err := tls.Dial("tcp", s.alpnAddr, &tls.Config{
+			ServerName:         a.domain,
+			NextProtos:         []string{"acme-tls/1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		if state.NegotiatedProtocol != "acme-tls/1" {
+			return fmt.Errorf("unexpected protocol %q", state.NegotiatedProtocol)
+		}
+		idPeAcmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+		for _, ext := range state.PeerCertificates[0].Extensions {
+			if ext.Id.Equal(idPeAcmeIdentifier) {
+				return nil
+			}
+		}
+		return fmt.Errorf("acmeIdentifier extension not found")
+	}
+	return fmt.Errorf("unknown challenge %q", chalType)
+}
+
+func (s *pebbleLike) issue(csrDER []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	return chain, nil
+}
+
+func TestManagerHTTP01(t *testing.T) {
+	ca := newPebbleLike(t)
+	dir := t.TempDir()
+
+	m, err := NewManager(Options{
+		DirectoryURL: ca.DirectoryURL(),
+		Challenge:    ChallengeHTTP01,
+		Domains:      []string{testDomain},
+		Dir:          dir,
+		RenewBefore:  time.Minute * 30,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create manager: %v", err)
+	}
+	challengeSvr := httptest.NewServer(m.HTTPHandler(nil))
+	defer challengeSvr.Close()
+	ca.httpAddr = challengeSvr.Listener.Addr().String()
+
+	if m.Certificate() != nil {
+		t.Fatalf("Expected no certificate before obtaining")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := m.Obtain(ctx); err != nil {
+		t.Fatalf("Cannot obtain certificate: %v", err)
+	}
+	select {
+	case <-m.Ready():
+	default:
+		t.Fatalf("Manager is not ready after obtained the certificate")
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: testDomain})
+	if err != nil || cert == nil {
+		t.Fatalf("Expected certificate for %s, got %v, %v", testDomain, cert, err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: testDomain, Roots: ca.RootCAs()}); err != nil {
+		t.Errorf("Cannot verify the obtained certificate: %v", err)
+	}
+	if cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); cert != nil || err != nil {
+		t.Errorf("Expected no certificate for other.test, got %v, %v", cert, err)
+	}
+	if renew := m.NextRenewal(); !renew.Equal(cert.Leaf.NotAfter.Add(-time.Minute * 30)) {
+		t.Errorf("Unexpected renewal time %v", renew)
+	}
+
+	// the certificate should be cached on disk
+	m2, err := NewManager(Options{
+		DirectoryURL: ca.DirectoryURL(),
+		Domains:      []string{testDomain},
+		Dir:          dir,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create manager: %v", err)
+	}
+	if cached := m2.Certificate(); cached == nil || !cached.Leaf.Equal(cert.Leaf) {
+		t.Errorf("Expected the cached certificate to be loaded")
+	}
+}
+
+func TestManagerTLSALPN01(t *testing.T) {
+	ca := newPebbleLike(t)
+
+	m, err := NewManager(Options{
+		DirectoryURL: ca.DirectoryURL(),
+		Challenge:    ChallengeTLSALPN01,
+		Domains:      []string{testDomain},
+		Dir:          t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Cannot create manager: %v", err)
+	}
+	tlsConfig := new(tls.Config)
+	m.TLSConfig(tlsConfig)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+	ca.alpnAddr = l.Addr().String()
+
+	servedSerial := func() *big.Int {
+		conn, err := tls.Dial("tcp", ca.alpnAddr, &tls.Config{
+			ServerName: testDomain,
+			RootCAs:    ca.RootCAs(),
+		})
+		if err != nil {
+			t.Fatalf("Cannot connect to the server: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	if err := m.Obtain(ctx); err != nil {
+		t.Fatalf("Cannot obtain certificate: %v", err)
+	}
+	first := servedSerial()
+	if first.Cmp(m.Certificate().Leaf.SerialNumber) != 0 {
+		t.Fatalf("Served certificate is not the obtained one")
+	}
+
+	// renew, the new certificate should be served without restarting the listener
+	if err := m.Obtain(ctx); err != nil {
+		t.Fatalf("Cannot renew certificate: %v", err)
+	}
+	if second := servedSerial(); second.Cmp(first) == 0 {
+		t.Errorf("Expected the renewed certificate to be served")
+	}
+}
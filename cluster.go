@@ -25,10 +25,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"runtime"
 	"sync"
@@ -47,6 +45,7 @@ import (
 	"github.com/LiterMC/go-openbmclapi/log"
 	"github.com/LiterMC/go-openbmclapi/notify"
 	"github.com/LiterMC/go-openbmclapi/notify/email"
+	"github.com/LiterMC/go-openbmclapi/notify/webhook"
 	"github.com/LiterMC/go-openbmclapi/notify/webpush"
 	"github.com/LiterMC/go-openbmclapi/storage"
 	"github.com/LiterMC/go-openbmclapi/utils"
@@ -66,10 +65,15 @@ type Cluster struct {
 	byoc          bool
 	jwtIssuer     string
 
+	group              *ClusterGroup
 	dataDir            string
+	dialers            outboundDialers
 	maxConn            int
+	storagePool        *StoragePool
 	storageOpts        []storage.StorageOption
 	storages           []storage.Storage
+	storageHealths     []*storage.HealthTracker
+	storageWeightMux   sync.RWMutex
 	storageWeights     []uint
 	storageTotalWeight uint
 	cache              gocache.Cache
@@ -82,6 +86,9 @@ type Cluster struct {
 	issync                 atomic.Bool
 	syncProg               atomic.Int64
 	syncTotal              atomic.Int64
+	keepaliveSuccess       atomic.Int64
+	keepaliveFailure       atomic.Int64
+	downloadLatency        *histogram
 
 	mux             sync.RWMutex
 	enabled         atomic.Bool
@@ -93,6 +100,8 @@ type Cluster struct {
 	cancelKeepalive context.CancelFunc
 	downloadMux     sync.RWMutex
 	downloading     map[string]*downloadingItem
+	partialMux      sync.Mutex
+	partials        map[string]struct{}
 	filesetMux      sync.RWMutex
 	fileset         map[string]int64
 	authTokenMux    sync.RWMutex
@@ -100,41 +109,61 @@ type Cluster struct {
 
 	client         *http.Client
 	cachedCli      *http.Client
+	updateCli      *http.Client
+	syncClient     *http.Client
+	syncDialer     *limited.LimitedDialer
+	syncBandwidth  atomic.Pointer[SyncBandwidthStatus]
 	bufSlots       *limited.BufSlots
 	database       database.DB
 	notifyManager  *notify.Manager
 	webpushKeyB64  string
+	webpushPlg     *webpush.Plugin
 	updateChecker  *time.Ticker
 	apiRateLimiter *limited.APIRateMiddleWare
+	clientLimiter  *limited.ClientLimiter
 
 	wsUpgrader    *websocket.Upgrader
 	handlerAPIv0  http.Handler
 	handlerAPIv1  http.Handler
 	hijackHandler http.Handler
+
+	// limitedListener is the listener of the cluster server, it's nil when serve limit is disabled
+	limitedListener *limited.LimitedListener
+	// disabledByStorage is true when the cluster is disabled because all storages are down
+	disabledByStorage atomic.Bool
+	// fileIndexReady is true when the file index can be trusted to check the files
+	fileIndexReady atomic.Bool
+
+	// runCtx lives as long as the cluster, it's used by the jobs that outlive the API requests
+	runCtx        context.Context
+	syncCancelMux sync.Mutex
+	syncCancel    context.CancelFunc
+	jobs          *jobManager
 }
 
 func NewCluster(
 	ctx context.Context,
 	prefix string,
-	baseDir string,
+	dataDir string,
 	host string, publicPort uint16,
 	clusterId string, clusterSecret string,
-	byoc bool, dialer *net.Dialer,
-	storageOpts []storage.StorageOption,
+	byoc bool, dialers outboundDialers,
+	storagePool *StoragePool, storageIds []string,
 	cache gocache.Cache,
 ) (cr *Cluster) {
-	transport := http.DefaultTransport
-	if dialer != nil {
-		transport = &http.Transport{
-			DialContext: dialer.DialContext,
-		}
-	}
+	transport := newDialerTransport(dialers.SocketIO)
+	updateTransport := newDialerTransport(dialers.UpdateCheck)
 
-	cachedTransport := transport
+	cachedTransport, cachedUpdateTransport := transport, updateTransport
 	if cache != gocache.NoCache {
+		httpCache := gocache.WrapToHTTPCache(gocache.NewCacheWithNamespace(cache, "http@"))
 		cachedTransport = &httpcache.Transport{
 			Transport: transport,
-			Cache:     gocache.WrapToHTTPCache(gocache.NewCacheWithNamespace(cache, "http@")),
+			Cache:     httpCache,
+		}
+		cachedUpdateTransport = &httpcache.Transport{
+			Transport: updateTransport,
+			Cache:     httpCache,
 		}
 	}
 
@@ -147,15 +176,22 @@ func NewCluster(
 		byoc:          byoc,
 		jwtIssuer:     jwtIssuerPrefix + "#" + clusterId,
 
-		dataDir:     filepath.Join(baseDir, "data"),
+		dataDir:     dataDir,
+		dialers:     dialers,
 		maxConn:     config.DownloadMaxConn,
-		storageOpts: storageOpts,
+		storagePool: storagePool,
 		cache:       cache,
 
 		disabled: make(chan struct{}, 0),
 		fileset:  make(map[string]int64, 0),
 
 		downloading: make(map[string]*downloadingItem),
+		partials:    make(map[string]struct{}),
+
+		downloadLatency: newHistogram(defaultLatencyBuckets),
+
+		runCtx: ctx,
+		jobs:   newJobManager(),
 
 		client: &http.Client{
 			Transport: transport,
@@ -165,6 +201,10 @@ func NewCluster(
 			Transport: cachedTransport,
 			CheckRedirect: redirectChecker,
 		},
+		updateCli: &http.Client{
+			Transport:     cachedUpdateTransport,
+			CheckRedirect: redirectChecker,
+		},
 
 		wsUpgrader: &websocket.Upgrader{
 			HandshakeTimeout: time.Minute,
@@ -177,24 +217,70 @@ func NewCluster(
 	}
 	cr.bufSlots = limited.NewBufSlots(cr.maxConn)
 
+	cr.syncClient = cr.client
+	if config.SyncBandwidth.Enable {
+		cr.syncClient, cr.syncDialer = newSyncClient(dialers.Sync)
+	} else if dialers.Sync != dialers.SocketIO {
+		cr.syncClient = &http.Client{
+			Transport:     newDialerTransport(dialers.Sync),
+			CheckRedirect: redirectChecker,
+		}
+	}
+
 	{
+		opts, hts, err := storagePool.Select(storageIds)
+		if err != nil {
+			panic(err)
+		}
 		var (
 			n   uint = 0
-			wgs      = make([]uint, len(storageOpts))
-			sts      = make([]storage.Storage, len(storageOpts))
+			wgs      = make([]uint, len(opts))
+			sts      = make([]storage.Storage, len(opts))
 		)
-		for i, s := range storageOpts {
-			sts[i] = storage.NewStorage(s)
+		for i, s := range opts {
+			storagePool.Subscribe(s.Id, cr.onStorageStateChange)
+			sts[i] = hts[i]
 			wgs[i] = s.Weight
 			n += s.Weight
 		}
+		cr.storageOpts = opts
 		cr.storages = sts
+		cr.storageHealths = hts
 		cr.storageWeights = wgs
 		cr.storageTotalWeight = n
 	}
 	return
 }
 
+// storageInitContext returns the context that should be passed to storage.Storage.Init
+func (cr *Cluster) storageInitContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, storage.ClusterCacheCtxKey, cr.cache)
+	if cr.dialers.Webdav != nil {
+		ctx = context.WithValue(ctx, storage.ClusterDialerCtxKey, cr.dialers.Webdav)
+	}
+	return ctx
+}
+
+// newNotifyPlugins creates the notification plugins by the config,
+// the webpush and webhook plugins will be reused if they are already created
+func (cr *Cluster) newNotifyPlugins(cfg NotificationConfig) (plugins []notify.Plugin, err error) {
+	plugins = append(plugins, cr.webpushPlg)
+	if cfg.EnableEmail {
+		emailPlg, err := email.NewSMTP(
+			cfg.EmailSMTP, cfg.EmailSMTPEncryption,
+			cfg.EmailSender, cfg.EmailSenderPassword,
+		)
+		if err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, emailPlg)
+	}
+	if cfg.EnableWebhook {
+		plugins = append(plugins, new(webhook.Plugin))
+	}
+	return
+}
+
 func redirectChecker(req *http.Request, via []*http.Request) error {
 	req.Header.Del("Referer")
 	if len(via) > 10 {
@@ -206,55 +292,65 @@ func redirectChecker(req *http.Request, via []*http.Request) error {
 func (cr *Cluster) Init(ctx context.Context) (err error) {
 	// create data folder
 	os.MkdirAll(cr.dataDir, 0755)
+	cr.cleanCompletedPartials()
 
-	if config.Database.Driver == "memory" {
-		cr.database = database.NewMemoryDB()
-	} else if cr.database, err = database.NewSqlDB(config.Database.Driver, config.Database.DSN); err != nil {
-		return
+	// the database may be shared from the primary cluster
+	if cr.database == nil {
+		if config.Database.Driver == "memory" {
+			cr.database = database.NewMemoryDB()
+		} else if cr.database, err = database.NewSqlDB(config.Database.Driver, config.Database.DSN); err != nil {
+			return
+		}
 	}
 
 	if config.Hijack.Enable {
-		cr.hijackProxy = NewHjProxy(cr.client, cr.database, cr.handleDownload)
+		hijackCli := &http.Client{
+			Transport: newDialerTransport(cr.dialers.Hijack),
+		}
+		cr.hijackProxy = NewHjProxy(hijackCli, cr.database, cr.handleDownload)
 		if config.Hijack.EnableLocalCache {
 			os.MkdirAll(config.Hijack.LocalCachePath, 0755)
 		}
 	}
 
 	// Init notification manager
-	cr.notifyManager = notify.NewManager(cr.dataDir, cr.database, cr.client, config.Dashboard.NotifySubject)
+	notifyCli := &http.Client{
+		Transport: newDialerTransport(cr.dialers.Notification),
+	}
+	cr.notifyManager = notify.NewManager(cr.dataDir, cr.database, notifyCli, config.Dashboard.NotifySubject)
 	// Add notification plugins
-	webpushPlg := new(webpush.Plugin)
-	cr.notifyManager.AddPlugin(webpushPlg)
-	if config.Notification.EnableEmail {
-		emailPlg, err := email.NewSMTP(
-			config.Notification.EmailSMTP, config.Notification.EmailSMTPEncryption,
-			config.Notification.EmailSender, config.Notification.EmailSenderPassword,
-		)
-		if err != nil {
-			return err
-		}
-		cr.notifyManager.AddPlugin(emailPlg)
+	cr.webpushPlg = new(webpush.Plugin)
+	plugins, err := cr.newNotifyPlugins(config.Notification)
+	if err != nil {
+		return
+	}
+	for _, p := range plugins {
+		cr.notifyManager.AddPlugin(p)
 	}
 
 	if err = cr.notifyManager.Init(ctx); err != nil {
 		return
 	}
-	cr.webpushKeyB64 = base64.RawURLEncoding.EncodeToString(webpushPlg.GetPublicKey())
+	cr.webpushKeyB64 = base64.RawURLEncoding.EncodeToString(cr.webpushPlg.GetPublicKey())
 
 	// Init storages
-	vctx := context.WithValue(ctx, storage.ClusterCacheCtxKey, cr.cache)
-	for _, s := range cr.storages {
-		s.Init(vctx)
-	}
+	cr.storagePool.Init(cr.storageInitContext(ctx))
+	cr.startSyncBandwidthScheduler(ctx)
 
 	// read old stats
 	if err := cr.stats.Load(cr.dataDir); err != nil {
 		log.Errorf("Could not load stats: %v", err)
 	}
-	if cr.apiHmacKey, err = utils.LoadOrCreateHmacKey(cr.dataDir); err != nil {
-		return fmt.Errorf("Cannot load hmac key: %w", err)
+	if cr.apiHmacKey == nil {
+		if cr.apiHmacKey, err = utils.LoadOrCreateHmacKey(cr.dataDir); err != nil {
+			return fmt.Errorf("Cannot load hmac key: %w", err)
+		}
 	}
 
+	if !cr.isPrimary() {
+		// only the primary cluster checks update
+		return
+	}
 	cr.updateChecker = time.NewTicker(time.Hour)
 
 	go func(ticker *time.Ticker) {
@@ -274,10 +370,12 @@ func (cr *Cluster) Init(ctx context.Context) (err error) {
 }
 
 func (cr *Cluster) Destroy(ctx context.Context) {
-	if cr.database != nil {
+	if cr.database != nil && cr.isPrimary() {
 		cr.database.Cleanup()
 	}
-	cr.updateChecker.Stop()
+	if cr.updateChecker != nil {
+		cr.updateChecker.Stop()
+	}
 	if cr.apiRateLimiter != nil {
 		cr.apiRateLimiter.Destroy()
 	}
@@ -315,6 +413,9 @@ func (cr *Cluster) Connect(ctx context.Context) bool {
 		log.Errorf("Could not parse Engine.IO options: %v; exit.", err)
 		osExit(CodeClientUnexpectedError)
 	}
+	if wd := newWebsocketDialer(cr.dialers.SocketIO); wd != nil {
+		engio.Dialer = wd
+	}
 
 	cr.reconnectCount = 0
 	connected := false
@@ -465,10 +566,14 @@ func (cr *Cluster) Enable(ctx context.Context) (err error) {
 
 	storagesCount := make(map[string]int, 2)
 	for _, s := range cr.storageOpts {
-		switch s.Type {
+		typ := s.Type
+		if opt, ok := s.Data.(*storage.TieredStorageOption); ok {
+			typ = opt.Slow.Type
+		}
+		switch typ {
 		case storage.StorageLocal:
 			storagesCount["file"]++
-		case storage.StorageMount, storage.StorageWebdav:
+		case storage.StorageMount, storage.StorageWebdav, storage.StorageS3:
 			storagesCount["alist"]++
 		default:
 			log.Errorf("Unknown storage type %q", s.Type)
@@ -586,6 +691,13 @@ func (cr *Cluster) Enable(ctx context.Context) (err error) {
 
 // KeepAlive will fresh hits & hit bytes data and send the keep-alive packet
 func (cr *Cluster) KeepAlive(ctx context.Context) (status int) {
+	defer func() {
+		if status == 0 {
+			cr.keepaliveSuccess.Add(1)
+		} else {
+			cr.keepaliveFailure.Add(1)
+		}
+	}()
 	hits, hbts := cr.stats.GetTmpHits()
 	lhits, lhbts := cr.lastHits.Load(), cr.lastHbts.Load()
 	hits2, hbts2 := cr.statOnlyHits.Load(), cr.statOnlyHbts.Load()
@@ -0,0 +1,333 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	gocache "github.com/LiterMC/go-openbmclapi/cache"
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+const (
+	clusterIdHeader = "X-Cluster-Id"
+	clusterIdCookie = "go-openbmclapi-cluster"
+)
+
+// ClusterGroup is the clusters that are hosted in the same process.
+// They share the HTTP listener, the storages and the database
+type ClusterGroup struct {
+	clusters    []*Cluster // the first one is the primary cluster
+	handlers    []http.Handler
+	byId        map[string]*Cluster
+	hosts       map[string]*Cluster
+	storagePool *StoragePool
+	// syncMux makes the clusters synchronize files one by one, since they are sharing the storages
+	syncMux sync.Mutex
+
+	// limitedListener is the listener of the cluster server, it's nil when serve limit is disabled
+	limitedListener *limited.LimitedListener
+	// clientLimiter limits each client on the download routes, it's nil when client limit is disabled
+	clientLimiter *limited.ClientLimiter
+
+	reloadMux  sync.Mutex
+	lastReload atomic.Pointer[ConfigReloadResult]
+}
+
+func NewClusterGroup(
+	ctx context.Context,
+	prefix string,
+	baseDir string,
+	items []ClusterItem,
+	byoc bool, dialers outboundDialers,
+	storageOpts []storage.StorageOption,
+	cache gocache.Cache,
+) (g *ClusterGroup) {
+	g = &ClusterGroup{
+		clusters:    make([]*Cluster, len(items)),
+		byId:        make(map[string]*Cluster, len(items)),
+		hosts:       make(map[string]*Cluster, len(items)),
+		storagePool: NewStoragePool(storageOpts),
+	}
+	g.storagePool.SubscribeAll(g.onStorageStateChange)
+	for i, item := range items {
+		dataDir := filepath.Join(baseDir, "data")
+		if i > 0 {
+			dataDir = filepath.Join(dataDir, "clusters", item.Id)
+		}
+		cr := NewCluster(ctx,
+			prefix,
+			dataDir,
+			item.PublicHost, item.PublicPort,
+			item.Id, item.Secret,
+			byoc, dialers,
+			g.storagePool, item.Storages,
+			cache,
+		)
+		cr.group = g
+		if i > 0 {
+			// share the dashboard tokens between the clusters
+			cr.jwtIssuer = g.clusters[0].jwtIssuer
+		}
+		g.clusters[i] = cr
+		g.byId[item.Id] = cr
+		g.AddHost(cr, item.PublicHost)
+	}
+	return
+}
+
+// Primary returns the first cluster, which owns the shared resources
+func (g *ClusterGroup) Primary() *Cluster {
+	return g.clusters[0]
+}
+
+func (g *ClusterGroup) Clusters() []*Cluster {
+	return g.clusters
+}
+
+// Get returns nil if the cluster does not exist
+func (g *ClusterGroup) Get(id string) *Cluster {
+	return g.byId[id]
+}
+
+// AddHost routes the requests with the host to the cluster.
+// It must be called before the handler starts serving
+func (g *ClusterGroup) AddHost(cr *Cluster, host string) {
+	host = strings.ToLower(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	if old, ok := g.hosts[host]; ok {
+		if old != cr {
+			log.Warnf("Host %s is used by both cluster %s and %s, it will be routed to %s", host, old.clusterId, cr.clusterId, old.clusterId)
+		}
+		return
+	}
+	g.hosts[host] = cr
+}
+
+// Init initializes the clusters, the database and the hmac key are shared from the primary cluster
+func (g *ClusterGroup) Init(ctx context.Context) (err error) {
+	primary := g.Primary()
+	if err = primary.Init(ctx); err != nil {
+		return
+	}
+	for _, cr := range g.clusters[1:] {
+		cr.database = primary.database
+		cr.apiHmacKey = primary.apiHmacKey
+		if err = cr.Init(ctx); err != nil {
+			return fmt.Errorf("cluster %s: %w", cr.clusterId, err)
+		}
+	}
+	return
+}
+
+func (g *ClusterGroup) Destroy(ctx context.Context) {
+	for i := len(g.clusters) - 1; i >= 0; i-- {
+		g.clusters[i].Destroy(ctx)
+	}
+}
+
+// Disable disables all clusters concurrently
+func (g *ClusterGroup) Disable(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, cr := range g.clusters {
+		wg.Add(1)
+		go func(cr *Cluster) {
+			defer wg.Done()
+			cr.Disable(ctx)
+		}(cr)
+	}
+	wg.Wait()
+}
+
+func (g *ClusterGroup) onStorageStateChange(h *storage.HealthTracker, from, to storage.HealthState) {
+	// the storages are shared, so only notify by the primary cluster
+	if m := g.Primary().notifyManager; m != nil {
+		go m.OnStorageStateChange(h.Id(), from.String(), to.String(), h.Status().LastError)
+	}
+}
+
+// filesetsReady reports whether all clusters have got their filesets
+func (g *ClusterGroup) filesetsReady() bool {
+	for _, cr := range g.clusters {
+		cr.filesetMux.RLock()
+		n := len(cr.fileset)
+		cr.filesetMux.RUnlock()
+		if n == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *ClusterGroup) GetHandler() http.Handler {
+	g.handlers = make([]http.Handler, len(g.clusters))
+	if config.ClientLimit.Enable {
+		// the clients are limited across the clusters since they share the connections
+		g.clientLimiter = limited.NewClientLimiter(RealAddrCtxKey, config.ClientLimit.Options())
+	}
+	for i, cr := range g.clusters {
+		cr.clientLimiter = g.clientLimiter
+		g.handlers[i] = cr.GetHandler()
+	}
+	if len(g.clusters) == 1 {
+		return g.handlers[0]
+	}
+	return g
+}
+
+// clusterIndexFor returns the index of the cluster that should handle the request.
+// The API requests can choose the cluster by the X-Cluster-Id header or the cookie,
+// others are routed by the host
+func (g *ClusterGroup) clusterIndexFor(req *http.Request) int {
+	if strings.HasPrefix(req.URL.Path, "/api/") {
+		id := req.Header.Get(clusterIdHeader)
+		if id == "" {
+			if c, err := req.Cookie(clusterIdCookie); err == nil {
+				id = c.Value
+			}
+		}
+		if id != "" {
+			for i, cr := range g.clusters {
+				if cr.clusterId == id {
+					return i
+				}
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	if cr, ok := g.hosts[strings.ToLower(host)]; ok {
+		for i, c := range g.clusters {
+			if c == cr {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+func (g *ClusterGroup) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	g.handlers[g.clusterIndexFor(req)].ServeHTTP(rw, req)
+}
+
+// isPrimary reports whether the cluster is the primary cluster of its group,
+// a cluster without group is always primary
+func (cr *Cluster) isPrimary() bool {
+	return cr.group == nil || cr.group.Primary() == cr
+}
+
+// fileInUse reports whether the file is still needed by any cluster that sharing the storages
+func (cr *Cluster) fileInUse(hash string) bool {
+	if cr.group == nil {
+		_, ok := cr.CachedFileSize(hash)
+		return ok
+	}
+	for _, c := range cr.group.clusters {
+		if _, ok := c.CachedFileSize(hash); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileNeededOn reports whether the file is needed in the storage by any cluster in the group except the given one.
+// A cluster that has not got its file list yet is considered to need every file
+func (g *ClusterGroup) fileNeededOn(hash string, storageId string, except *Cluster) bool {
+	if g == nil {
+		return false
+	}
+	for _, c := range g.clusters {
+		if c == except || !c.usesStorage(storageId) {
+			continue
+		}
+		c.filesetMux.RLock()
+		_, ok := c.fileset[hash]
+		unknown := len(c.fileset) == 0
+		c.filesetMux.RUnlock()
+		if ok || unknown {
+			return true
+		}
+	}
+	return false
+}
+
+// usesStorage reports whether the storage is one of the storages of the cluster
+func (cr *Cluster) usesStorage(id string) bool {
+	for _, s := range cr.storages {
+		if storageId(s) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// syncing reports whether the cluster or any cluster in the same group is synchronizing files
+func (cr *Cluster) syncing() bool {
+	if cr.group == nil {
+		return cr.issync.Load()
+	}
+	for _, c := range cr.group.clusters {
+		if c.issync.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *Cluster) apiV0Clusters(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	type clusterData struct {
+		Id         string `json:"id"`
+		PublicHost string `json:"publicHost,omitempty"`
+		PublicPort uint16 `json:"publicPort"`
+		Enabled    bool   `json:"enabled"`
+		Current    bool   `json:"current"`
+	}
+	clusters := []*Cluster{cr}
+	if cr.group != nil {
+		clusters = cr.group.clusters
+	}
+	data := make([]clusterData, len(clusters))
+	for i, c := range clusters {
+		data[i] = clusterData{
+			Id:         c.clusterId,
+			PublicHost: c.host,
+			PublicPort: c.publicPort,
+			Enabled:    c.enabled.Load(),
+			Current:    c == cr,
+		}
+	}
+	writeJson(rw, http.StatusOK, data)
+}
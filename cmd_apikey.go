@@ -0,0 +1,177 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// parseExpiresIn parses a go duration, or a number of days with suffix 'd'
+func parseExpiresIn(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * time.Hour * 24, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func cmdAPIKey(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing api-key action, available actions: list, create, revoke")
+		os.Exit(2)
+	}
+	action := args[0]
+	var (
+		positional []string
+		user       string
+		scopes     []string
+		expiresIn  time.Duration
+	)
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--user", "--scopes", "--expires":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "Missing value for option:", a)
+				os.Exit(2)
+			}
+			i++
+			switch a {
+			case "--user":
+				user = args[i]
+			case "--scopes":
+				scopes = strings.Split(args[i], ",")
+			case "--expires":
+				var err error
+				if expiresIn, err = parseExpiresIn(args[i]); err != nil || expiresIn <= 0 {
+					fmt.Fprintln(os.Stderr, "Invalid expiration:", args[i])
+					os.Exit(2)
+				}
+			}
+		default:
+			if strings.HasPrefix(a, "-") {
+				fmt.Fprintln(os.Stderr, "Unknown option:", a)
+				os.Exit(2)
+			}
+			positional = append(positional, a)
+		}
+	}
+	requireArgs := func(n int) {
+		if len(positional) != n {
+			fmt.Fprintf(os.Stderr, "Action %s requires %d argument(s), got %d\n", action, n, len(positional))
+			os.Exit(2)
+		}
+	}
+
+	config = readConfig()
+	if config.Database.Driver == "memory" {
+		fmt.Fprintln(os.Stderr, "The API keys cannot be managed when the database driver is memory")
+		os.Exit(1)
+	}
+	db, err := database.NewSqlDB(config.Database.Driver, config.Database.DSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open database:", err)
+		os.Exit(1)
+	}
+	defer db.Cleanup()
+
+	switch action {
+	case "list", "ls":
+		requireArgs(0)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tUSER\tNAME\tSCOPES\tEXPIRES\tLAST USED")
+		formatTime := func(t *time.Time, def string) string {
+			if t == nil {
+				return def
+			}
+			return t.Format(time.DateTime)
+		}
+		err = db.ForEachAPIKey(func(rec *database.APIKeyRecord) error {
+			if user != "" && rec.User != user {
+				return nil
+			}
+			_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.Id, rec.User, rec.Name,
+				strings.Join(rec.Scopes, ","), formatTime(rec.ExpiresAt, "never"), formatTime(rec.LastUsedAt, "-"))
+			return err
+		})
+		if err == nil {
+			err = tw.Flush()
+		}
+	case "create":
+		requireArgs(2)
+		owner := positional[0]
+		if !isConfigUser(owner) {
+			if _, err = db.GetUser(owner); err == database.ErrNotFound {
+				err = fmt.Errorf("User %q does not exist", owner)
+			}
+		}
+		if err == nil {
+			var cr *Cluster
+			if cr, err = newCLIKeyIssuer(db); err == nil {
+				var expires time.Time
+				if expiresIn > 0 {
+					expires = time.Now().Add(expiresIn)
+				}
+				var key string
+				var rec database.APIKeyRecord
+				if key, rec, err = cr.generateAPIKey(owner, positional[1], scopes, expires); err == nil {
+					fmt.Fprintln(os.Stderr, "Created API key", rec.Id, "the key will not be shown again:")
+					fmt.Println(key)
+				}
+			}
+		}
+	case "revoke":
+		requireArgs(1)
+		if err = (&Cluster{database: db}).revokeAPIKey(positional[0]); err == database.ErrNotFound {
+			err = fmt.Errorf("API key %q does not exist", positional[0])
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown api-key action:", action)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// newCLIKeyIssuer returns a cluster which can only be used to sign the API keys of the primary cluster
+func newCLIKeyIssuer(db database.DB) (cr *Cluster, err error) {
+	key, err := utils.LoadOrCreateHmacKey(filepath.Join(baseDir, "data"))
+	if err != nil {
+		return
+	}
+	return &Cluster{
+		database:   db,
+		jwtIssuer:  jwtIssuerPrefix + "#" + config.clusterItems()[0].Id,
+		apiHmacKey: key,
+	}, nil
+}
@@ -0,0 +1,175 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func cmdUser(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Missing user action, available actions: list, add, set-role, passwd, remove, reset-mfa")
+		os.Exit(2)
+	}
+	action := args[0]
+	var (
+		positional []string
+		role       = roleViewer
+		password   string
+		hasPasswd  bool
+	)
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--role", "--password":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "Missing value for option:", a)
+				os.Exit(2)
+			}
+			i++
+			if a == "--role" {
+				role = args[i]
+			} else {
+				password, hasPasswd = args[i], true
+			}
+		default:
+			if strings.HasPrefix(a, "-") {
+				fmt.Fprintln(os.Stderr, "Unknown option:", a)
+				os.Exit(2)
+			}
+			positional = append(positional, a)
+		}
+	}
+	requireArgs := func(n int) {
+		if len(positional) != n {
+			fmt.Fprintf(os.Stderr, "Action %s requires %d argument(s), got %d\n", action, n, len(positional))
+			os.Exit(2)
+		}
+	}
+	readPassword := func() string {
+		if hasPasswd {
+			return password
+		}
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(os.Stderr, "Cannot read password:", err)
+			os.Exit(1)
+		}
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	config = readConfig()
+	if config.Database.Driver == "memory" {
+		fmt.Fprintln(os.Stderr, "The users cannot be managed when the database driver is memory")
+		os.Exit(1)
+	}
+	db, err := database.NewSqlDB(config.Database.Driver, config.Database.DSN)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot open database:", err)
+		os.Exit(1)
+	}
+	defer db.Cleanup()
+
+	switch action {
+	case "list", "ls":
+		requireArgs(0)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USERNAME\tROLE\tCREATED")
+		if isConfigUser(config.Dashboard.Username) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", config.Dashboard.Username, roleAdmin, "(config)")
+		}
+		err = db.ForEachUser(func(rec *database.UserRecord) error {
+			_, err := fmt.Fprintf(tw, "%s\t%s\t%s\n", rec.Username, rec.Role, rec.CreatedAt.Format(time.DateTime))
+			return err
+		})
+		if err == nil {
+			err = tw.Flush()
+		}
+	case "add":
+		requireArgs(1)
+		var rec database.UserRecord
+		if rec, err = newUserRecord(positional[0], utils.AsSha256Hex(readPassword()), role); err == nil {
+			if err = db.AddUser(rec); err == database.ErrExists {
+				err = fmt.Errorf("User %q already exists", rec.Username)
+			}
+		}
+	case "set-role":
+		requireArgs(2)
+		err = updateUser(db, positional[0], func(rec *database.UserRecord) error {
+			if !isValidRole(positional[1]) {
+				return ErrInvalidRole
+			}
+			rec.Role = positional[1]
+			return nil
+		})
+	case "passwd":
+		requireArgs(1)
+		err = updateUser(db, positional[0], func(rec *database.UserRecord) (err error) {
+			rec.Password, err = hashUserPassword(utils.AsSha256Hex(readPassword()))
+			return
+		})
+	case "remove", "rm":
+		requireArgs(1)
+		if err = db.RemoveUser(positional[0]); err == database.ErrNotFound {
+			err = fmt.Errorf("User %q does not exist", positional[0])
+		} else if err == nil {
+			err = db.RemoveUsersSecondFactors(positional[0], "")
+			(&Cluster{database: db}).revokeUsersAPIKeys(positional[0])
+		}
+	case "reset-mfa":
+		// the config user can reset its second factors too, in case the authenticator was lost
+		requireArgs(1)
+		err = db.RemoveUsersSecondFactors(positional[0], "")
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown user action:", action)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func updateUser(db database.DB, username string, update func(*database.UserRecord) error) error {
+	if isConfigUser(username) {
+		return errors.New("The dashboard user in the config cannot be edited, please edit the config instead")
+	}
+	rec, err := db.GetUser(username)
+	if err != nil {
+		if err == database.ErrNotFound {
+			return fmt.Errorf("User %q does not exist", username)
+		}
+		return err
+	}
+	user := *rec
+	if err := update(&user); err != nil {
+		return err
+	}
+	return db.UpdateUser(user)
+}
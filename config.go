@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -36,6 +37,7 @@ import (
 	"github.com/LiterMC/go-openbmclapi/cache"
 	"github.com/LiterMC/go-openbmclapi/limited"
 	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/resolver"
 	"github.com/LiterMC/go-openbmclapi/storage"
 	"github.com/LiterMC/go-openbmclapi/utils"
 )
@@ -61,18 +63,261 @@ type AdvancedConfig struct {
 	DoNotOpenFAQOnWindows              bool `yaml:"do-not-open-faq-on-windows"`
 }
 
+// ClusterItem is a cluster that hosted by this process besides the others
+type ClusterItem struct {
+	Id         string `yaml:"id"`
+	Secret     string `yaml:"secret"`
+	PublicHost string `yaml:"public-host"`
+	PublicPort uint16 `yaml:"public-port"`
+	// Storages are the ids of the storages that the cluster uses, empty means all storages
+	Storages []string `yaml:"storages"`
+}
+
 type CertificateConfig struct {
 	Cert string `yaml:"cert"`
 	Key  string `yaml:"key"`
 }
 
+type AcmeConfig struct {
+	Enable       bool   `yaml:"enable"`
+	DirectoryURL string `yaml:"directory-url"`
+	Email        string `yaml:"email"`
+	// Challenge can be http-01 or tls-alpn-01
+	Challenge string `yaml:"challenge"`
+	// HTTPAddress is where the http-01 challenge server listens
+	HTTPAddress string             `yaml:"http-address"`
+	RenewBefore utils.YAMLDuration `yaml:"renew-before"`
+	// Dir is where the account key and the certificates are stored, default is <data>/acme
+	Dir string `yaml:"dir"`
+	// CACert is the PEM file of the CA that signed the ACME server's certificate, e.g. Pebble's test CA
+	CACert             string `yaml:"ca-cert"`
+	InsecureSkipVerify bool   `yaml:"insecure-skip-verify"`
+}
+
+type DNSConfig struct {
+	Enable bool `yaml:"enable"`
+	// Upstreams are tried in order, see resolver.ParseUpstream for the formats
+	Upstreams []string           `yaml:"upstreams"`
+	CacheTTL  utils.YAMLDuration `yaml:"cache-ttl"`
+	Timeout   utils.YAMLDuration `yaml:"timeout"`
+}
+
+func (c *DNSConfig) NewResolver() (*resolver.Resolver, error) {
+	upstreams := make([]resolver.Upstream, len(c.Upstreams))
+	for i, addr := range c.Upstreams {
+		u, err := resolver.ParseUpstream(addr)
+		if err != nil {
+			return nil, fmt.Errorf("dns.upstreams[%d]: %w", i, err)
+		}
+		upstreams[i] = u
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("dns.upstreams: at least one upstream is required")
+	}
+	return resolver.New(resolver.Options{
+		Upstreams: upstreams,
+		CacheTTL:  c.CacheTTL.Dur(),
+		Timeout:   c.Timeout.Dur(),
+	}), nil
+}
+
+// ProxiesConfig are the proxy URLs of the subsystems.
+// An empty value means using Default, and "direct" means no proxy
+type ProxiesConfig struct {
+	NoProxy      string `yaml:"no-proxy"`
+	Default      string `yaml:"default"`
+	Sync         string `yaml:"sync"`
+	SocketIO     string `yaml:"socketio"`
+	Hijack       string `yaml:"hijack"`
+	Webdav       string `yaml:"webdav"`
+	Notification string `yaml:"notification"`
+	UpdateCheck  string `yaml:"update-check"`
+}
+
 type ServeLimitConfig struct {
 	Enable     bool `yaml:"enable"`
 	MaxConn    int  `yaml:"max-conn"`
 	UploadRate int  `yaml:"upload-rate"`
+	// Scheduler is how the upload rate is split between the connections, "fifo" or "fair"
+	Scheduler string `yaml:"scheduler"`
+	// MinConnRate is the upload rate in KiB/s that every busy connection can get in fair mode
+	MinConnRate int `yaml:"min-conn-rate"`
+	// PriorityResponseSize is in KiB, the responses that are smaller than it are sent first in fair mode
+	PriorityResponseSize int `yaml:"priority-response-size"`
+}
+
+// FairShare returns the fair share options, or nil if the scheduler is not fair
+func (c *ServeLimitConfig) FairShare() *limited.FairShareOptions {
+	switch strings.ToLower(c.Scheduler) {
+	case "", "fifo":
+		return nil
+	case "fair", "drr":
+		return &limited.FairShareOptions{
+			MinRate:       c.MinConnRate * 1024,
+			PriorityBytes: c.PriorityResponseSize * 1024,
+		}
+	}
+	log.Warnf("Unknown serve-limit.scheduler %q, using fifo", c.Scheduler)
+	return nil
+}
+
+// ClientLimitConfig limits each client on the download and hijack routes
+type ClientLimitConfig struct {
+	Enable bool `yaml:"enable"`
+	// RequestRate is the requests per second, 0 means no limit
+	RequestRate  float64 `yaml:"request-rate"`
+	RequestBurst int     `yaml:"request-burst"`
+	// Bandwidth is in KiB/s, 0 means no limit
+	Bandwidth int `yaml:"bandwidth"`
+	// BandwidthBurst is in KiB, default is one second of the bandwidth
+	BandwidthBurst int      `yaml:"bandwidth-burst"`
+	IPv4Prefix     int      `yaml:"ipv4-prefix"`
+	IPv6Prefix     int      `yaml:"ipv6-prefix"`
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+
+	allow, deny []netip.Prefix `yaml:"-"`
+}
+
+func parsePrefixes(field string, list []string) (prefixes []netip.Prefix, err error) {
+	prefixes = make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return
+}
+
+func (c *ClientLimitConfig) UnmarshalYAML(n *yaml.Node) (err error) {
+	type T ClientLimitConfig
+	if err = n.Decode((*T)(c)); err != nil {
+		return
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4-prefix %d is out of range [0, 32]", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6-prefix %d is out of range [0, 128]", c.IPv6Prefix)
+	}
+	if c.allow, err = parsePrefixes("allow", c.Allow); err != nil {
+		return
+	}
+	if c.deny, err = parsePrefixes("deny", c.Deny); err != nil {
+		return
+	}
+	return nil
+}
+
+func (c *ClientLimitConfig) Options() limited.ClientLimitOptions {
+	opts := limited.ClientLimitOptions{
+		RequestRate:    c.RequestRate,
+		RequestBurst:   max(c.RequestBurst, 1),
+		Bandwidth:      (int64)(c.Bandwidth) * 1024,
+		BandwidthBurst: (int64)(c.BandwidthBurst) * 1024,
+		IPv4Prefix:     c.IPv4Prefix,
+		IPv6Prefix:     c.IPv6Prefix,
+		Allow:          c.allow,
+		Deny:           c.deny,
+	}
+	if opts.BandwidthBurst <= 0 {
+		opts.BandwidthBurst = opts.Bandwidth
+	}
+	return opts
+}
+
+type SyncDownloadConfig struct {
+	// Resume enables resuming the interrupted downloads with HTTP Range requests
+	Resume bool `yaml:"resume"`
+	// PartialDir is where the partial files are stored, default is <data>/downloading
+	PartialDir string `yaml:"partial-dir"`
+	// ParallelChunks is the count of the chunks that a large file will be split into, 0 or 1 disables it
+	ParallelChunks int `yaml:"parallel-chunks"`
+	// ChunkThreshold is the minimum size (in MiB) of the file to be downloaded with parallel chunks
+	ChunkThreshold int `yaml:"chunk-threshold"`
+}
+
+type SyncBandwidthWindow struct {
+	// From and To are the local time of day in format HH:MM, the window is [From, To)
+	// if To is before From, the window will cross the midnight
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+	// Rate is the sync download rate limit (in KiB/s) in this window, 0 means unlimited
+	Rate int `yaml:"rate"`
+
+	from, to int // minutes since midnight
+}
+
+func parseDayMinute(s string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil {
+		return 0, fmt.Errorf("Cannot parse time %q: %w", s, err)
+	}
+	if hour < 0 || hour > 24 || minute < 0 || minute >= 60 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("Time %q out of range [00:00, 24:00]", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w *SyncBandwidthWindow) UnmarshalYAML(n *yaml.Node) (err error) {
+	type T SyncBandwidthWindow
+	if err = n.Decode((*T)(w)); err != nil {
+		return
+	}
+	if w.from, err = parseDayMinute(w.From); err != nil {
+		return
+	}
+	if w.to, err = parseDayMinute(w.To); err != nil {
+		return
+	}
+	return
+}
+
+// Contains reports whether the minute of the day is inside the window
+func (w *SyncBandwidthWindow) Contains(minute int) bool {
+	if w.from <= w.to {
+		return w.from <= minute && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+func (w *SyncBandwidthWindow) String() string {
+	return w.From + "-" + w.To
+}
+
+type SyncBandwidthConfig struct {
+	Enable bool `yaml:"enable"`
+	// Rate is the default sync download rate limit (in KiB/s) outside of the windows, 0 means unlimited
+	Rate    int                   `yaml:"rate"`
+	Windows []SyncBandwidthWindow `yaml:"windows"`
+}
+
+// Current returns the window that the time is in and the rate limit (in KiB/s) of it.
+// The first matched window takes effect, window will be nil if no window matched.
+func (c *SyncBandwidthConfig) Current(now time.Time) (window *SyncBandwidthWindow, rate int) {
+	minute := now.Hour()*60 + now.Minute()
+	for i := range c.Windows {
+		if w := &c.Windows[i]; w.Contains(minute) {
+			return w, w.Rate
+		}
+	}
+	return nil, c.Rate
 }
 
 type APIRateLimitConfig struct {
+	// Store is where the counters are kept, "memory" or "cache".
+	// "cache" shares the counters between the replicas through the redis cache
+	Store     string            `yaml:"store"`
 	Anonymous limited.RateLimit `yaml:"anonymous"`
 	Logged    limited.RateLimit `yaml:"logged"`
 }
@@ -120,20 +365,67 @@ func (c *CacheConfig) UnmarshalYAML(n *yaml.Node) (err error) {
 	case "no", "off", "disabled", "nocache", "no-cache":
 		c.newCache = func() cache.Cache { return cache.NoCache }
 	case "mem", "memory", "inmem":
-		c.newCache = func() cache.Cache { return cache.NewInMemCache() }
+		opt := &InMemCacheConfig{
+			MaxSize: 128,
+		}
+		if cfg.Data.Node != nil {
+			if err = cfg.Data.Decode(opt); err != nil {
+				return
+			}
+		}
+		if opt.MaxSize < 0 {
+			return errors.New("cache.data.max-size cannot be negative")
+		}
+		for ns, quota := range opt.NamespaceQuotas {
+			if quota < 0 {
+				return fmt.Errorf("cache.data.namespace-quotas[%q] cannot be negative", ns)
+			}
+		}
+		c.Data = opt
+		c.newCache = func() cache.Cache { return cache.NewInMemCache(opt.Options()) }
 	case "redis":
 		opt := new(cache.RedisOptions)
 		if err = cfg.Data.Decode(opt); err != nil {
 			return
 		}
+		if err = opt.Validate(); err != nil {
+			return
+		}
 		c.Data = opt
-		c.newCache = func() cache.Cache { return cache.NewRedisCache(opt.ToRedis()) }
+		c.newCache = func() cache.Cache {
+			cli, err := opt.NewClient()
+			if err != nil {
+				log.Errorf("Cannot create redis client, cache is disabled: %v", err)
+				return cache.NoCache
+			}
+			return cache.NewRedisCacheByClient(cli)
+		}
 	default:
 		return fmt.Errorf("Unexpected cache type %q", c.Type)
 	}
 	return nil
 }
 
+type InMemCacheConfig struct {
+	// MaxSize is the memory budget in MiB, 0 means unlimited
+	MaxSize int64 `yaml:"max-size"`
+	// NamespaceQuotas are the memory budgets in MiB of the keys with the prefixes, such as "http@"
+	NamespaceQuotas map[string]int64 `yaml:"namespace-quotas,omitempty"`
+}
+
+func (c *InMemCacheConfig) Options() *cache.InMemOptions {
+	opt := &cache.InMemOptions{
+		MaxBytes: c.MaxSize * 1024 * 1024,
+	}
+	if len(c.NamespaceQuotas) > 0 {
+		opt.Quotas = make(map[string]int64, len(c.NamespaceQuotas))
+		for ns, quota := range c.NamespaceQuotas {
+			opt.Quotas[ns] = quota * 1024 * 1024
+		}
+	}
+	return opt
+}
+
 type GithubAPIConfig struct {
 	UpdateCheckInterval utils.YAMLDuration `yaml:"update-check-interval"`
 	Authorization       string             `yaml:"authorization"`
@@ -148,6 +440,11 @@ type DashboardConfig struct {
 	PwaDesc      string `yaml:"pwa-description"`
 
 	NotifySubject string `yaml:"notification-subject"`
+
+	// WebAuthnRPID is the domain that the passkeys are bound to, the host of the request will be used if it's empty
+	WebAuthnRPID string `yaml:"webauthn-rp-id"`
+	// WebAuthnOrigins are the allowed dashboard origins for WebAuthn, the origin of the request will be used if it's empty
+	WebAuthnOrigins []string `yaml:"webauthn-origins"`
 }
 
 type TunnelConfig struct {
@@ -200,19 +497,55 @@ type Config struct {
 	DownloadMaxConn      int    `yaml:"download-max-conn"`
 	MaxReconnectCount    int    `yaml:"max-reconnect-count"`
 
-	Certificates []CertificateConfig            `yaml:"certificates"`
-	Tunneler     TunnelConfig                   `yaml:"tunneler"`
-	Cache        CacheConfig                    `yaml:"cache"`
-	ServeLimit   ServeLimitConfig               `yaml:"serve-limit"`
-	RateLimit    APIRateLimitConfig             `yaml:"api-rate-limit"`
-	Notification NotificationConfig             `yaml:"notification"`
-	Dashboard    DashboardConfig                `yaml:"dashboard"`
-	GithubAPI    GithubAPIConfig                `yaml:"github-api"`
-	Database     DatabaseConfig                 `yaml:"database"`
-	Hijack       HijackConfig                   `yaml:"hijack"`
-	Storages     []storage.StorageOption        `yaml:"storages"`
-	WebdavUsers  map[string]*storage.WebDavUser `yaml:"webdav-users"`
-	Advanced     AdvancedConfig                 `yaml:"advanced"`
+	Clusters      []ClusterItem                  `yaml:"clusters"`
+	Certificates  []CertificateConfig            `yaml:"certificates"`
+	Acme          AcmeConfig                     `yaml:"acme"`
+	Tunneler      TunnelConfig                   `yaml:"tunneler"`
+	DNS           DNSConfig                      `yaml:"dns"`
+	Proxies       ProxiesConfig                  `yaml:"proxies"`
+	Cache         CacheConfig                    `yaml:"cache"`
+	ServeLimit    ServeLimitConfig               `yaml:"serve-limit"`
+	ClientLimit   ClientLimitConfig              `yaml:"client-limit"`
+	SyncDownload  SyncDownloadConfig             `yaml:"sync-download"`
+	SyncBandwidth SyncBandwidthConfig            `yaml:"sync-bandwidth"`
+	RateLimit     APIRateLimitConfig             `yaml:"api-rate-limit"`
+	Notification  NotificationConfig             `yaml:"notification"`
+	Dashboard     DashboardConfig                `yaml:"dashboard"`
+	GithubAPI     GithubAPIConfig                `yaml:"github-api"`
+	Database      DatabaseConfig                 `yaml:"database"`
+	Hijack        HijackConfig                   `yaml:"hijack"`
+	Storages      []storage.StorageOption        `yaml:"storages"`
+	StorageHealth storage.HealthCheckOption      `yaml:"storage-health"`
+	WebdavUsers   map[string]*storage.WebDavUser `yaml:"webdav-users"`
+	Advanced      AdvancedConfig                 `yaml:"advanced"`
+}
+
+// clusterItems returns the clusters that should be hosted, the first one is the primary cluster.
+// If clusters is not set, the top level cluster-id and cluster-secret will be used
+func (cfg *Config) clusterItems() []ClusterItem {
+	publicPort := cfg.PublicPort
+	if publicPort == 0 {
+		publicPort = cfg.Port
+	}
+	if len(cfg.Clusters) == 0 {
+		return []ClusterItem{{
+			Id:         cfg.ClusterId,
+			Secret:     cfg.ClusterSecret,
+			PublicHost: cfg.PublicHost,
+			PublicPort: publicPort,
+		}}
+	}
+	items := make([]ClusterItem, len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		if c.PublicHost == "" {
+			c.PublicHost = cfg.PublicHost
+		}
+		if c.PublicPort == 0 {
+			c.PublicPort = publicPort
+		}
+		items[i] = c
+	}
+	return items
 }
 
 func (cfg *Config) applyWebManifest(manifest map[string]any) {
@@ -246,6 +579,16 @@ var defaultConfig = Config{
 		},
 	},
 
+	Acme: AcmeConfig{
+		Enable:       false,
+		DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+		Email:        "",
+		Challenge:    "http-01",
+		HTTPAddress:  ":80",
+		RenewBefore:  (utils.YAMLDuration)(time.Hour * 24 * 30),
+		Dir:          "",
+	},
+
 	Tunneler: TunnelConfig{
 		Enable:        false,
 		TunnelProg:    "./path/to/tunnel/program",
@@ -253,18 +596,64 @@ var defaultConfig = Config{
 		TunnelTimeout: 0,
 	},
 
+	DNS: DNSConfig{
+		Enable: false,
+		Upstreams: []string{
+			"https://223.5.5.5/dns-query",
+			"https://1.12.12.12/dns-query",
+			"tls://1.1.1.1",
+		},
+		CacheTTL: (utils.YAMLDuration)(time.Minute * 10),
+		Timeout:  (utils.YAMLDuration)(time.Second * 5),
+	},
+
+	Proxies: ProxiesConfig{
+		NoProxy: "localhost,127.0.0.0/8,::1",
+	},
+
 	Cache: CacheConfig{
 		Type:     "inmem",
-		newCache: func() cache.Cache { return cache.NewInMemCache() },
+		Data:     &InMemCacheConfig{MaxSize: 128},
+		newCache: func() cache.Cache { return cache.NewInMemCache(&cache.InMemOptions{MaxBytes: 128 * 1024 * 1024}) },
 	},
 
 	ServeLimit: ServeLimitConfig{
 		Enable:     false,
 		MaxConn:    16384,
 		UploadRate: 1024 * 12, // 12MB
+
+		Scheduler:            "fifo",
+		MinConnRate:          16,
+		PriorityResponseSize: 64,
+	},
+
+	ClientLimit: ClientLimitConfig{
+		Enable:         false,
+		RequestRate:    20,
+		RequestBurst:   100,
+		Bandwidth:      0,
+		BandwidthBurst: 0,
+		IPv4Prefix:     32,
+		IPv6Prefix:     64,
+		Allow:          []string{},
+		Deny:           []string{},
+	},
+
+	SyncDownload: SyncDownloadConfig{
+		Resume:         true,
+		PartialDir:     "",
+		ParallelChunks: 0,
+		ChunkThreshold: 64,
+	},
+
+	SyncBandwidth: SyncBandwidthConfig{
+		Enable:  false,
+		Rate:    0,
+		Windows: []SyncBandwidthWindow{},
 	},
 
 	RateLimit: APIRateLimitConfig{
+		Store: "memory",
 		Anonymous: limited.RateLimit{
 			PerMin:  10,
 			PerHour: 120,
@@ -316,6 +705,14 @@ var defaultConfig = Config{
 
 	Storages: nil,
 
+	StorageHealth: storage.HealthCheckOption{
+		Interval:     (utils.YAMLDuration)(time.Minute),
+		Timeout:      (utils.YAMLDuration)(time.Second * 10),
+		DegradeAfter: 1,
+		DownAfter:    3,
+		RecoverAfter: 2,
+	},
+
 	WebdavUsers: map[string]*storage.WebDavUser{},
 
 	Advanced: AdvancedConfig{
@@ -347,69 +744,89 @@ func migrateConfig(data []byte, config *Config) {
 	}
 }
 
-func readConfig() (config Config) {
-	const configPath = "config.yaml"
+const configPath = "config.yaml"
 
+// parseConfig parses the content of the config file and fills the default values
+func parseConfig(data []byte) (config Config, err error) {
 	config = defaultConfig
+	// do not share the map with defaultConfig
+	config.WebdavUsers = make(map[string]*storage.WebDavUser, len(defaultConfig.WebdavUsers))
+	for k, v := range defaultConfig.WebdavUsers {
+		config.WebdavUsers[k] = v
+	}
 
-	data, err := os.ReadFile(configPath)
-	notexists := false
-	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			log.Errorf(Tr("error.config.read.failed"), err)
-			osExit(CodeClientError)
+	migrateConfig(data, &config)
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return
+	}
+	if len(config.Storages) == 0 {
+		config.Storages = []storage.StorageOption{
+			{
+				BasicStorageOption: storage.BasicStorageOption{
+					Id:     "local",
+					Type:   storage.StorageLocal,
+					Weight: 100,
+				},
+				Data: &storage.LocalStorageOption{
+					CachePath: "cache",
+				},
+			},
 		}
-		log.Error(Tr("error.config.not.exists"))
-		notexists = true
-	} else {
-		migrateConfig(data, &config)
-		if err = yaml.Unmarshal(data, &config); err != nil {
-			log.Errorf(Tr("error.config.parse.failed"), err)
-			osExit(CodeClientError)
+	}
+	if len(config.WebdavUsers) == 0 {
+		config.WebdavUsers["example-user"] = &storage.WebDavUser{
+			EndPoint: "https://webdav.example.com/path/to/endpoint/",
+			Username: "example-username",
+			Password: "example-password",
 		}
-		if len(config.Storages) == 0 {
-			config.Storages = []storage.StorageOption{
-				{
-					BasicStorageOption: storage.BasicStorageOption{
-						Id:     "local",
-						Type:   storage.StorageLocal,
-						Weight: 100,
-					},
-					Data: &storage.LocalStorageOption{
-						CachePath: "cache",
-					},
-				},
-			}
+	}
+	ids := make(map[string]int, len(config.Storages))
+	for i, s := range config.Storages {
+		if s.Id == "" {
+			s.Id = fmt.Sprintf("storage-%d", i)
+			config.Storages[i].Id = s.Id
 		}
-		if len(config.WebdavUsers) == 0 {
-			config.WebdavUsers["example-user"] = &storage.WebDavUser{
-				EndPoint: "https://webdav.example.com/path/to/endpoint/",
-				Username: "example-username",
-				Password: "example-password",
-			}
+		if j, ok := ids[s.Id]; ok {
+			return config, fmt.Errorf("Duplicated storage id %q at [%d] and [%d], please edit the config.", s.Id, i, j)
 		}
-		ids := make(map[string]int, len(config.Storages))
-		for i, s := range config.Storages {
-			if s.Id == "" {
-				s.Id = fmt.Sprintf("storage-%d", i)
-				config.Storages[i].Id = s.Id
-			}
-			if j, ok := ids[s.Id]; ok {
-				log.Errorf("Duplicated storage id %q at [%d] and [%d], please edit the config.", s.Id, i, j)
-				osExit(CodeClientError)
+		ids[s.Id] = i
+	}
+	clusterIds := make(map[string]int, len(config.Clusters))
+	for i, c := range config.Clusters {
+		if c.Id == "" || c.Secret == "" {
+			return config, fmt.Errorf("clusters[%d]: id and secret must be set", i)
+		}
+		if j, ok := clusterIds[c.Id]; ok {
+			return config, fmt.Errorf("Duplicated cluster id %q at [%d] and [%d], please edit the config.", c.Id, i, j)
+		}
+		clusterIds[c.Id] = i
+		for _, id := range c.Storages {
+			if _, ok := ids[id]; !ok {
+				return config, fmt.Errorf("clusters[%d]: storage %q does not exist", i, id)
 			}
-			ids[s.Id] = i
 		}
 	}
+	if len(config.Clusters) > 1 && config.Tunneler.Enable {
+		return config, errors.New("tunneler cannot be used with multiple clusters")
+	}
+	return
+}
 
-	for _, so := range config.Storages {
-		switch opt := so.Data.(type) {
+// resolveStorages fills the endpoints of the webdav storages
+func (config *Config) resolveStorages() (err error) {
+	storageOpts := make([]*storage.StorageOption, 0, len(config.Storages))
+	for i := range config.Storages {
+		storageOpts = append(storageOpts, &config.Storages[i])
+	}
+	for i := 0; i < len(storageOpts); i++ {
+		switch opt := storageOpts[i].Data.(type) {
+		case *storage.TieredStorageOption:
+			storageOpts = append(storageOpts, &opt.Fast, &opt.Slow)
 		case *storage.WebDavStorageOption:
 			if alias := opt.Alias; alias != "" {
 				user, ok := config.WebdavUsers[alias]
 				if !ok {
-					log.Errorf(Tr("error.config.alias.user.not.exists"), alias)
-					osExit(CodeClientError)
+					return fmt.Errorf(Tr("error.config.alias.user.not.exists"), alias)
 				}
 				opt.AliasUser = user
 				var end *url.URL
@@ -430,23 +847,11 @@ func readConfig() (config Config) {
 			}
 		}
 	}
+	return
+}
 
-	var buf bytes.Buffer
-	encoder := yaml.NewEncoder(&buf)
-	encoder.SetIndent(2)
-	if err = encoder.Encode(config); err != nil {
-		log.Errorf(Tr("error.config.encode.failed"), err)
-		osExit(CodeClientError)
-	}
-	if err = os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
-		log.Errorf(Tr("error.config.write.failed"), err)
-		osExit(CodeClientError)
-	}
-	if notexists {
-		log.Error(Tr("error.config.created"))
-		osExit(0xff)
-	}
-
+// applyEnv overrides the config by the environment variables
+func (config *Config) applyEnv() {
 	if os.Getenv("DEBUG") == "true" {
 		config.Advanced.DebugLog = true
 	}
@@ -476,6 +881,63 @@ func readConfig() (config Config) {
 	if byoc := os.Getenv("CLUSTER_BYOC"); byoc != "" {
 		config.Byoc = byoc == "true"
 	}
+}
+
+// loadConfig reads the config file like readConfig,
+// but it returns the error instead of exiting, and it will not rewrite the config file
+func loadConfig() (config Config, err error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+	if config, err = parseConfig(data); err != nil {
+		return
+	}
+	if err = config.resolveStorages(); err != nil {
+		return
+	}
+	config.applyEnv()
+	return
+}
+
+func readConfig() (config Config) {
+	config = defaultConfig
+
+	data, err := os.ReadFile(configPath)
+	notexists := false
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf(Tr("error.config.read.failed"), err)
+			osExit(CodeClientError)
+		}
+		log.Error(Tr("error.config.not.exists"))
+		notexists = true
+	} else if config, err = parseConfig(data); err != nil {
+		log.Errorf(Tr("error.config.parse.failed"), err)
+		osExit(CodeClientError)
+	}
+	if err = config.resolveStorages(); err != nil {
+		log.Error(err)
+		osExit(CodeClientError)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(config); err != nil {
+		log.Errorf(Tr("error.config.encode.failed"), err)
+		osExit(CodeClientError)
+	}
+	if err = os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
+		log.Errorf(Tr("error.config.write.failed"), err)
+		osExit(CodeClientError)
+	}
+	if notexists {
+		log.Error(Tr("error.config.created"))
+		osExit(0xff)
+	}
+
+	config.applyEnv()
 	return
 }
 
@@ -0,0 +1,384 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/notify"
+)
+
+// liveConfig is the config with the reloaded fields, it is nil if the config was never reloaded.
+// The global config is only written during startup, so the fields that can be reloaded
+// must be read through currentConfig
+var liveConfig atomic.Pointer[Config]
+
+// currentConfig returns the config that contains the latest reloaded fields.
+// The returned config must not be modified
+func currentConfig() *Config {
+	if c := liveConfig.Load(); c != nil {
+		return c
+	}
+	return &config
+}
+
+type ConfigReloadResult struct {
+	At time.Time `json:"at"`
+	// Applied are the changed fields that took effect without restart
+	Applied []string `json:"applied"`
+	// NeedRestart are the changed fields that will only take effect after restart
+	NeedRestart []string `json:"needRestart"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// diffConfig returns the yaml paths of the fields that are different between a and b
+func diffConfig(a, b *Config) []string {
+	return diffValue("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), nil)
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func diffValue(path string, a, b reflect.Value, out []string) []string {
+	switch a.Kind() {
+	case reflect.Struct:
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			p := path
+			if name != "" {
+				p = joinConfigPath(path, name)
+			} else if !strings.Contains(opts, "inline") {
+				p = joinConfigPath(path, strings.ToLower(f.Name))
+			}
+			out = diffValue(p, a.Field(i), b.Field(i), out)
+		}
+		return out
+	case reflect.Slice:
+		if a.Len() == b.Len() && a.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < a.Len(); i++ {
+				out = diffValue(path+"["+strconv.Itoa(i)+"]", a.Index(i), b.Index(i), out)
+			}
+			return out
+		}
+	}
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		out = append(out, path)
+	}
+	return out
+}
+
+func pathUnder(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	return rest == "" || rest[0] == '.' || rest[0] == '['
+}
+
+// liveConfigField is a config field that can be applied without restart
+type liveConfigField struct {
+	match func(path string) bool
+	// apply should copy the new values into cur, and apply them to the running clusters.
+	// cur is a copy of the current config, it will be published after all the fields are applied.
+	// If apply returns an error, none of the clusters should be changed
+	apply func(g *ClusterGroup, cur, next *Config) error
+}
+
+func matchConfigPrefix(prefixes ...string) func(path string) bool {
+	return func(path string) bool {
+		for _, p := range prefixes {
+			if pathUnder(path, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var storageWeightPathRe = regexp.MustCompile(`^storages\[\d+\]\.weight$`)
+
+var liveConfigFields = []liveConfigField{
+	{
+		match: matchConfigPrefix("advanced.debug-log"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.Advanced.DebugLog = next.Advanced.DebugLog
+			if cur.Advanced.DebugLog {
+				log.SetLevel(log.LevelDebug)
+			} else {
+				log.SetLevel(log.LevelInfo)
+			}
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("no-access-log", "access-log-slots"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.NoAccessLog = next.NoAccessLog
+			cur.AccessLogSlots = next.AccessLogSlots
+			if cur.NoAccessLog {
+				log.SetAccessLogSlots(-1)
+			} else {
+				log.SetAccessLogSlots(cur.AccessLogSlots)
+			}
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("api-rate-limit"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			storeChanged := cur.RateLimit.Store != next.RateLimit.Store
+			cur.RateLimit = next.RateLimit
+			for _, cr := range g.clusters {
+				if cr.apiRateLimiter != nil {
+					if storeChanged {
+						cr.apiRateLimiter.SetStore(cr.newAPIRateLimitStore(cur.RateLimit.Store))
+					}
+					cr.apiRateLimiter.SetAnonymousRateLimit(cur.RateLimit.Anonymous)
+					cr.apiRateLimiter.SetLoggedRateLimit(cur.RateLimit.Logged)
+				}
+			}
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("serve-limit.upload-rate"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.ServeLimit.UploadRate = next.ServeLimit.UploadRate
+			if g.limitedListener != nil {
+				g.limitedListener.SetWriteRate(cur.ServeLimit.UploadRate * 1024)
+			}
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("serve-limit.scheduler", "serve-limit.min-conn-rate", "serve-limit.priority-response-size"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.ServeLimit.Scheduler = next.ServeLimit.Scheduler
+			cur.ServeLimit.MinConnRate = next.ServeLimit.MinConnRate
+			cur.ServeLimit.PriorityResponseSize = next.ServeLimit.PriorityResponseSize
+			if g.limitedListener != nil {
+				g.limitedListener.SetFairShare(cur.ServeLimit.FairShare())
+			}
+			return nil
+		},
+	},
+	{
+		// the limiter is only created when client-limit.enable is set, so enable needs restart
+		match: func(path string) bool {
+			return pathUnder(path, "client-limit") && path != "client-limit.enable"
+		},
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			enable := cur.ClientLimit.Enable
+			cur.ClientLimit = next.ClientLimit
+			cur.ClientLimit.Enable = enable
+			if g.clientLimiter != nil {
+				g.clientLimiter.SetOptions(cur.ClientLimit.Options())
+			}
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("sync-bandwidth.rate", "sync-bandwidth.windows"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.SyncBandwidth.Rate = next.SyncBandwidth.Rate
+			cur.SyncBandwidth.Windows = next.SyncBandwidth.Windows
+			for _, cr := range g.clusters {
+				if cr.syncDialer != nil {
+					cr.applySyncBandwidth(time.Now())
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// the dashboard credentials are checked at every login
+		match: matchConfigPrefix("dashboard.enable", "dashboard.username", "dashboard.password",
+			"dashboard.webauthn-rp-id", "dashboard.webauthn-origins"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.Dashboard.Enable = next.Dashboard.Enable
+			cur.Dashboard.Username = next.Dashboard.Username
+			cur.Dashboard.Password = next.Dashboard.Password
+			cur.Dashboard.WebAuthnRPID = next.Dashboard.WebAuthnRPID
+			cur.Dashboard.WebAuthnOrigins = next.Dashboard.WebAuthnOrigins
+			return nil
+		},
+	},
+	{
+		match: matchConfigPrefix("notification"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			// create all the plugins first, so a bad option will not change any cluster
+			var clusters []*Cluster
+			var newPlugins [][]notify.Plugin
+			for _, cr := range g.clusters {
+				if cr.notifyManager == nil {
+					continue
+				}
+				plugins, err := cr.newNotifyPlugins(next.Notification)
+				if err != nil {
+					return err
+				}
+				clusters = append(clusters, cr)
+				newPlugins = append(newPlugins, plugins)
+			}
+			oldPlugins := make([][]notify.Plugin, len(clusters))
+			for i, cr := range clusters {
+				oldPlugins[i] = cr.notifyManager.Plugins()
+				tctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+				err := cr.notifyManager.SetPlugins(tctx, newPlugins[i])
+				cancel()
+				if err != nil {
+					// the old plugins are already initialized, so restoring them will not fail
+					for j := i - 1; j >= 0; j-- {
+						clusters[j].notifyManager.SetPlugins(context.Background(), oldPlugins[j])
+					}
+					return err
+				}
+			}
+			cur.Notification = next.Notification
+			return nil
+		},
+	},
+	{
+		// the hijack auth users are checked at every request
+		match: matchConfigPrefix("hijack.require-auth", "hijack.auth-users"),
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			cur.Hijack.RequireAuth = next.Hijack.RequireAuth
+			cur.Hijack.AuthUsers = next.Hijack.AuthUsers
+			return nil
+		},
+	},
+	{
+		match: storageWeightPathRe.MatchString,
+		apply: func(g *ClusterGroup, cur, next *Config) error {
+			weights := make(map[string]uint, len(next.Storages))
+			for i := range next.Storages {
+				cur.Storages[i].Weight = next.Storages[i].Weight
+				weights[cur.Storages[i].Id] = next.Storages[i].Weight
+			}
+			for _, cr := range g.clusters {
+				cr.setStorageWeights(weights)
+			}
+			return nil
+		},
+	},
+}
+
+// ReloadConfig reads the config file again, and applies the changes that can take effect without restart.
+// The fields that need restart are reported in the result, and they will be kept as they are
+func (g *ClusterGroup) ReloadConfig() *ConfigReloadResult {
+	g.reloadMux.Lock()
+	defer g.reloadMux.Unlock()
+
+	res := &ConfigReloadResult{
+		At:          time.Now(),
+		Applied:     []string{},
+		NeedRestart: []string{},
+	}
+	defer g.lastReload.Store(res)
+
+	newConfig, err := loadConfig()
+	if err != nil {
+		log.Errorf("Cannot reload config: %v", err)
+		res.Error = err.Error()
+		return res
+	}
+
+	cur := *currentConfig()
+	// the storages are modified in place by the weight field, so do not share the backing array
+	cur.Storages = slices.Clone(cur.Storages)
+	matched := make([][]string, len(liveConfigFields))
+	for _, p := range diffConfig(&cur, &newConfig) {
+		live := false
+		for i, f := range liveConfigFields {
+			if f.match(p) {
+				matched[i] = append(matched[i], p)
+				live = true
+				break
+			}
+		}
+		if !live {
+			res.NeedRestart = append(res.NeedRestart, p)
+		}
+	}
+	for i, paths := range matched {
+		if len(paths) == 0 {
+			continue
+		}
+		if err := liveConfigFields[i].apply(g, &cur, &newConfig); err != nil {
+			log.Errorf("Cannot apply config %v: %v", paths, err)
+			res.NeedRestart = append(res.NeedRestart, paths...)
+			continue
+		}
+		res.Applied = append(res.Applied, paths...)
+	}
+	liveConfig.Store(&cur)
+
+	if len(res.Applied) > 0 {
+		log.Infof("Config reloaded, applied: %s", strings.Join(res.Applied, ", "))
+	} else {
+		log.Info("Config reloaded, nothing changed")
+	}
+	if len(res.NeedRestart) > 0 {
+		log.Warnf("Following config fields need restart to take effect: %s", strings.Join(res.NeedRestart, ", "))
+	}
+	return res
+}
+
+// LastConfigReload returns nil if the config was never reloaded
+func (g *ClusterGroup) LastConfigReload() *ConfigReloadResult {
+	return g.lastReload.Load()
+}
+
+func (cr *Cluster) apiV0ConfigReload(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(rw, http.StatusOK, cr.group.LastConfigReload())
+	case http.MethodPost:
+		res := cr.group.ReloadConfig()
+		if res.Error != "" {
+			writeJson(rw, http.StatusBadRequest, res)
+			return
+		}
+		writeJson(rw, http.StatusOK, res)
+	default:
+		checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet, http.MethodPost)
+	}
+}
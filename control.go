@@ -0,0 +1,285 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+const (
+	jobTypeSync       = "sync"
+	jobTypeCancelSync = "cancel-sync"
+	jobTypeGc         = "gc"
+	jobTypeEnable     = "enable"
+	jobTypeDisable    = "disable"
+)
+
+var errSyncFailed = errors.New("Sync failed, see the logs for details")
+
+// parseOptionalBody parses the JSON body if there is one, the zero value will be used when the body is empty
+func parseOptionalBody[T any](rw http.ResponseWriter, req *http.Request) (data T, parsed bool) {
+	if req.ContentLength == 0 && req.Header.Get("Content-Type") == "" {
+		return data, true
+	}
+	return parseRequestBody[T](rw, req, nil)
+}
+
+func (cr *Cluster) writeJobStarted(rw http.ResponseWriter, req *http.Request, j *job, err error) {
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "cannot start job",
+			"message": err.Error(),
+		})
+		return
+	}
+	setAuditMessage(req, "job "+j.info.Id)
+	writeJson(rw, http.StatusAccepted, j.Snapshot())
+}
+
+func writeJobConflict(rw http.ResponseWriter, message string, running *job) {
+	res := Map{
+		"error":   "409 Conflict",
+		"message": message,
+	}
+	if running != nil {
+		res["job"] = running.Snapshot()
+	}
+	writeJson(rw, http.StatusConflict, res)
+}
+
+// apiV0ControlSync starts to synchronize with the full file list immediately
+func (cr *Cluster) apiV0ControlSync(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	type syncPayload struct {
+		HeavyCheck bool `json:"heavyCheck"`
+	}
+	data, ok := parseOptionalBody[syncPayload](rw, req)
+	if !ok {
+		return
+	}
+	if cr.issync.Load() {
+		writeJobConflict(rw, "Another sync task is running", cr.jobs.Running(jobTypeSync))
+		return
+	}
+	j, running, err := cr.jobs.StartExclusive(cr.runCtx, jobTypeSync, getLoggedUser(req), Map{"heavyCheck": data.HeavyCheck},
+		func(ctx context.Context, j *job) (any, error) {
+			log.Info(Tr("info.filelist.fetching"))
+			files, err := cr.GetFileList(ctx, 0)
+			if err != nil {
+				return nil, err
+			}
+			if err := cr.SaveLastFileList(files, true); err != nil {
+				log.Errorf("Cannot save file list: %v", err)
+			}
+			j.SetProgressFunc(func() (int64, int64) {
+				return cr.syncProg.Load(), cr.syncTotal.Load()
+			})
+			if !cr.SyncFiles(ctx, files, true, data.HeavyCheck) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errSyncFailed
+			}
+			if cfg := currentConfig(); !cfg.Advanced.NoGC && !cfg.OnlyGcWhenStart {
+				go cr.Gc()
+			}
+			return Map{"files": len(files)}, nil
+		})
+	if running != nil {
+		writeJobConflict(rw, "Another sync task is running", running)
+		return
+	}
+	cr.writeJobStarted(rw, req, j, err)
+}
+
+// apiV0ControlSyncCancel interrupts the running sync task, no matter it's started by the API or the schedule
+func (cr *Cluster) apiV0ControlSyncCancel(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !cr.issync.Load() {
+		writeJobConflict(rw, "No sync task is running", nil)
+		return
+	}
+	j, err := cr.jobs.Start(cr.runCtx, jobTypeCancelSync, getLoggedUser(req), nil,
+		func(ctx context.Context, j *job) (any, error) {
+			if !cr.CancelSync() {
+				return Map{"canceled": false}, nil
+			}
+			// wait for the sync task to exit
+			ticker := time.NewTicker(time.Millisecond * 100)
+			defer ticker.Stop()
+			for cr.issync.Load() {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return Map{"canceled": true}, nil
+		})
+	cr.writeJobStarted(rw, req, j, err)
+}
+
+// apiV0ControlGc removes the unused files from the storage,
+// all storages of the cluster will be cleaned if no storage is specified
+func (cr *Cluster) apiV0ControlGc(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	type gcPayload struct {
+		Storage string `json:"storage"`
+	}
+	data, ok := parseOptionalBody[gcPayload](rw, req)
+	if !ok {
+		return
+	}
+	setAuditTarget(req, data.Storage)
+	storages := cr.storages
+	if data.Storage != "" {
+		storages = nil
+		for i, opt := range cr.storageOpts {
+			if opt.Id == data.Storage {
+				storages = []storage.Storage{cr.storages[i]}
+				break
+			}
+		}
+		if storages == nil {
+			writeJson(rw, http.StatusNotFound, Map{
+				"error":   "storage not found",
+				"storage": data.Storage,
+			})
+			return
+		}
+	}
+	if !cr.filesetsReady() {
+		writeJobConflict(rw, "Cannot run gc before the first synchronization is finished", nil)
+		return
+	}
+	if cr.syncing() {
+		writeJobConflict(rw, "Cannot run gc while synchronizing", cr.jobs.Running(jobTypeSync))
+		return
+	}
+	j, running, err := cr.jobs.StartExclusive(cr.runCtx, jobTypeGc, getLoggedUser(req), Map{"storage": data.Storage},
+		func(ctx context.Context, j *job) (any, error) {
+			var removed int64
+			for _, s := range storages {
+				n, err := cr.gcFor(ctx, s, func(walked, n int64) {
+					j.SetProgress(removed+n, -1)
+				})
+				removed += n
+				if err != nil {
+					if ctx.Err() == nil && cr.syncing() {
+						err = errors.New("Interrupted by the sync task")
+					}
+					return Map{"removed": removed}, err
+				}
+			}
+			j.SetProgress(removed, removed)
+			return Map{"removed": removed}, nil
+		})
+	if running != nil {
+		writeJobConflict(rw, "Another gc task is running", running)
+		return
+	}
+	cr.writeJobStarted(rw, req, j, err)
+}
+
+// filesetsReady reports whether the filesets that the gc depends on are loaded
+func (cr *Cluster) filesetsReady() bool {
+	if cr.group != nil {
+		return cr.group.filesetsReady()
+	}
+	cr.filesetMux.RLock()
+	defer cr.filesetMux.RUnlock()
+	return len(cr.fileset) > 0
+}
+
+// apiV0ControlEnable re-enables the cluster that disabled by the API
+func (cr *Cluster) apiV0ControlEnable(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if cr.Enabled() {
+		writeJobConflict(rw, "Cluster is already enabled", nil)
+		return
+	}
+	if !cr.filesetsReady() {
+		writeJobConflict(rw, "Cannot enable the cluster before the first synchronization is finished", nil)
+		return
+	}
+	j, running, err := cr.jobs.StartExclusive(cr.runCtx, jobTypeEnable, getLoggedUser(req), nil,
+		func(ctx context.Context, j *job) (any, error) {
+			cr.mux.RLock()
+			connected := cr.socket != nil
+			cr.mux.RUnlock()
+			// the socket is closed after disabled, and the connection should live as long as the cluster
+			if !connected && !cr.Connect(cr.runCtx) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				return nil, errors.New("Cannot connect to the center server")
+			}
+			if err := cr.Enable(cr.runCtx); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		})
+	if running != nil {
+		writeJobConflict(rw, "Cluster is enabling", running)
+		return
+	}
+	cr.writeJobStarted(rw, req, j, err)
+}
+
+// apiV0ControlDisable disables the cluster without exiting, it can be enabled again by the API
+func (cr *Cluster) apiV0ControlDisable(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !cr.Enabled() {
+		writeJobConflict(rw, "Cluster is not enabled", cr.jobs.Running(jobTypeEnable))
+		return
+	}
+	j, err := cr.jobs.Start(cr.runCtx, jobTypeDisable, getLoggedUser(req), nil,
+		func(ctx context.Context, j *job) (any, error) {
+			// the cluster should not be enabled automatically after the storages recovered
+			cr.disabledByStorage.Store(false)
+			tctx, cancel := context.WithTimeout(ctx, time.Second*30)
+			defer cancel()
+			if !cr.Disable(tctx) {
+				if cr.Enabled() {
+					return nil, errors.New("Disable failed, see the logs for details")
+				}
+				// the cluster is disabled locally even if the center did not acknowledge it
+				return Map{"acked": false}, nil
+			}
+			return Map{"acked": true}, nil
+		})
+	cr.writeJobStarted(rw, req, j, err)
+}
@@ -1,5 +1,6 @@
-import axios, { AxiosError } from 'axios'
+import axios, { AxiosError, type AxiosResponse } from 'axios'
 import { sha256 } from 'js-sha256'
+import { createCredential, getCredential, type WebAuthnOptions } from './webauthn'
 
 export interface StatInstData {
 	hits: number
@@ -112,6 +113,19 @@ export async function getStatus(token?: string | null): Promise<StatusRes> {
 	return res.data
 }
 
+export interface ClusterInfo {
+	id: string
+	publicHost?: string
+	publicPort: number
+	enabled: boolean
+	current: boolean
+}
+
+export async function getClusters(): Promise<ClusterInfo[]> {
+	const res = await axios.get<ClusterInfo[]>(`/api/v0/clusters`)
+	return res.data
+}
+
 export async function getStat(name: string, token?: string | null): Promise<Stats | null> {
 	const res = await axios.get<Stats | null>(`/api/v0/stat/${name}`, {
 		headers: {
@@ -139,17 +153,434 @@ export function signChallenge(challenge: string, secret: string): string {
 	return signed
 }
 
-export async function login(username: string, password: string): Promise<string> {
+export type MFAMethod = 'totp' | 'webauthn' | 'recovery'
+
+export interface MFAChallenge {
+	token: string
+	methods: MFAMethod[]
+}
+
+interface LoginRes {
+	token?: string
+	mfa?: MFAChallenge
+}
+
+// login returns the auth token, or a MFAChallenge if the user has to pass a second factor
+export async function login(username: string, password: string): Promise<string | MFAChallenge> {
 	const challenge = await getChallenge('login')
 	const signature = signChallenge(challenge, password)
-	const res = await axios.post<TokenRes>(`/api/v0/login`, {
-		username: username,
-		challenge: challenge,
-		signature: signature,
+	let res: AxiosResponse<LoginRes>
+	try {
+		res = await axios.post<LoginRes>(`/api/v0/login`, {
+			username: username,
+			challenge: challenge,
+			signature: signature,
+		})
+	} catch (e) {
+		if (!(e instanceof AxiosError) || !e.response?.data?.passwordRequired) {
+			throw e
+		}
+		// the users in the database have no challenge secret, so the plain password is sent, which relies on TLS
+		res = await axios.post<LoginRes>(`/api/v0/login`, {
+			username: username,
+			challenge: await getChallenge('login'),
+			password: password,
+		})
+	}
+	if (res.data.mfa) {
+		return res.data.mfa
+	}
+	return res.data.token as string
+}
+
+export async function loginMFA(
+	mfaToken: string,
+	method: 'totp' | 'recovery',
+	code: string,
+): Promise<string> {
+	const res = await axios.post<TokenRes>(`/api/v0/login/mfa`, {
+		token: mfaToken,
+		method: method,
+		code: code,
 	})
 	return res.data.token
 }
 
+export async function loginWebAuthn(mfaToken: string): Promise<string> {
+	const begin = await axios.post<{ options: WebAuthnOptions; session: string }>(`/api/v0/login/webauthn`, {
+		token: mfaToken,
+	})
+	const credential = await getCredential(begin.data.options)
+	const res = await axios.post<TokenRes>(`/api/v0/login/webauthn/finish`, {
+		session: begin.data.session,
+		credential: credential,
+	})
+	return res.data.token
+}
+
+export interface MFAStatus {
+	totp: boolean
+	webauthn: {
+		id: string
+		name: string
+		createdAt: string
+	}[]
+	recoveryCodes: number
+}
+
+export interface MFAEnabledRes {
+	// recoveryCodes only exists when the first second factor is enabled
+	recoveryCodes?: string[]
+}
+
+export async function getMFAStatus(token: string): Promise<MFAStatus> {
+	const res = await axios.get<MFAStatus>(`/api/v0/mfa`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function beginTOTP(token: string): Promise<{ secret: string; uri: string }> {
+	const res = await axios.post<{ secret: string; uri: string }>(`/api/v0/mfa/totp`, null, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function confirmTOTP(token: string, code: string): Promise<MFAEnabledRes> {
+	const res = await axios.post<MFAEnabledRes>(
+		`/api/v0/mfa/totp/confirm`,
+		{ code: code },
+		{
+			headers: {
+				Authorization: `Bearer ${token}`,
+			},
+		},
+	)
+	return res.data
+}
+
+export async function disableTOTP(
+	token: string,
+	method: 'totp' | 'recovery',
+	code: string,
+): Promise<void> {
+	await axios.delete(`/api/v0/mfa/totp`, {
+		data: { method: method, code: code },
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+}
+
+export async function registerWebAuthn(token: string, name: string): Promise<MFAEnabledRes> {
+	const headers = {
+		Authorization: `Bearer ${token}`,
+	}
+	const begin = await axios.post<{ options: WebAuthnOptions; session: string }>(
+		`/api/v0/mfa/webauthn/register`,
+		null,
+		{ headers },
+	)
+	const credential = await createCredential(begin.data.options)
+	const res = await axios.post<MFAEnabledRes>(
+		`/api/v0/mfa/webauthn/register/finish`,
+		{
+			session: begin.data.session,
+			name: name,
+			credential: credential,
+		},
+		{ headers },
+	)
+	return res.data
+}
+
+export async function removeWebAuthn(token: string, id: string): Promise<void> {
+	await axios.delete(`/api/v0/mfa/webauthn/${encodeURIComponent(id)}`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+}
+
+export async function resetRecoveryCodes(token: string): Promise<string[]> {
+	const res = await axios.post<{ recoveryCodes: string[] }>(`/api/v0/mfa/recovery_codes`, null, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data.recoveryCodes
+}
+
+export type UserRole = 'viewer' | 'operator' | 'admin'
+
+export interface UserInfo {
+	username: string
+	role: UserRole
+	createdAt: string
+}
+
+export interface MeRes {
+	username: string
+	role: UserRole
+	builtin: boolean
+}
+
+export async function getMe(token: string): Promise<MeRes> {
+	const res = await axios.get<MeRes>(`/api/v0/me`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function getUsers(token: string): Promise<UserInfo[]> {
+	const res = await axios.get<UserInfo[]>(`/api/v0/users`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function addUser(
+	token: string,
+	username: string,
+	password: string,
+	role: UserRole,
+): Promise<UserInfo> {
+	const res = await axios.post<UserInfo>(
+		`/api/v0/users`,
+		{
+			username: username,
+			password: sha256(password),
+			role: role,
+		},
+		{
+			headers: {
+				Authorization: `Bearer ${token}`,
+			},
+		},
+	)
+	return res.data
+}
+
+export async function updateUser(
+	token: string,
+	username: string,
+	opts: { password?: string; role?: UserRole },
+): Promise<void> {
+	await axios.patch(
+		`/api/v0/user/${encodeURIComponent(username)}`,
+		{
+			password: opts.password ? sha256(opts.password) : undefined,
+			role: opts.role,
+		},
+		{
+			headers: {
+				Authorization: `Bearer ${token}`,
+			},
+		},
+	)
+}
+
+export async function removeUser(token: string, username: string): Promise<void> {
+	await axios.delete(`/api/v0/user/${encodeURIComponent(username)}`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+}
+
+export type APIKeyScope = 'read-status' | 'read-logs' | 'manage-webhooks' | 'trigger-sync'
+
+export interface APIKeyInfo {
+	id: string
+	user: string
+	name: string
+	scopes: APIKeyScope[]
+	createdAt: string
+	expiresAt: string | null
+	lastUsedAt: string | null
+}
+
+export async function getAPIKeys(token: string): Promise<APIKeyInfo[]> {
+	const res = await axios.get<APIKeyInfo[]>(`/api/v0/api_keys`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+// expiresIn is in seconds, 0 means the key never expires
+export async function createAPIKey(
+	token: string,
+	name: string,
+	scopes: APIKeyScope[],
+	expiresIn: number,
+	user?: string,
+): Promise<{ key: string; info: APIKeyInfo }> {
+	const res = await axios.post<{ key: string; info: APIKeyInfo }>(
+		`/api/v0/api_keys`,
+		{
+			user: user,
+			name: name,
+			scopes: scopes,
+			expiresIn: expiresIn,
+		},
+		{
+			headers: {
+				Authorization: `Bearer ${token}`,
+			},
+		},
+	)
+	return res.data
+}
+
+export async function revokeAPIKey(token: string, id: string): Promise<void> {
+	await axios.delete(`/api/v0/api_key/${encodeURIComponent(id)}`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+}
+
+export type JobStatus = 'running' | 'done' | 'failed' | 'canceled'
+
+export interface JobInfo {
+	id: string
+	type: 'sync' | 'cancel-sync' | 'gc' | 'enable' | 'disable'
+	params?: { [key: string]: any }
+	user: string
+	status: JobStatus
+	progress: number
+	total: number
+	result?: any
+	error?: string
+	createdAt: string
+	finishedAt?: string
+}
+
+async function startJob(token: string, action: string, body?: any): Promise<JobInfo> {
+	const res = await axios.post<JobInfo>(`/api/v0/control/${action}`, body, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function triggerSync(token: string, heavyCheck?: boolean): Promise<JobInfo> {
+	return startJob(token, 'sync', { heavyCheck: !!heavyCheck })
+}
+
+export async function cancelSync(token: string): Promise<JobInfo> {
+	return startJob(token, 'sync/cancel')
+}
+
+// runGC cleans all storages of the cluster if the storage is not given
+export async function runGC(token: string, storage?: string): Promise<JobInfo> {
+	return startJob(token, 'gc', { storage: storage })
+}
+
+export async function setClusterEnabled(token: string, enabled: boolean): Promise<JobInfo> {
+	return startJob(token, enabled ? 'enable' : 'disable')
+}
+
+export async function getJobs(token: string): Promise<JobInfo[]> {
+	const res = await axios.get<JobInfo[]>(`/api/v0/jobs`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function getJob(token: string, id: string): Promise<JobInfo> {
+	const res = await axios.get<JobInfo>(`/api/v0/job/${encodeURIComponent(id)}`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function cancelJob(token: string, id: string): Promise<JobInfo> {
+	const res = await axios.delete<JobInfo>(`/api/v0/job/${encodeURIComponent(id)}`, {
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export interface AuditRecord {
+	id: string
+	time: string
+	actor: string
+	clientId: string
+	ip: string
+	action: string
+	target?: string
+	result: 'success' | 'failure'
+	message?: string
+}
+
+export interface AuditFilter {
+	actor?: string
+	action?: string
+	target?: string
+	result?: 'success' | 'failure'
+	since?: string
+	until?: string
+}
+
+export interface AuditLogsRes {
+	total: number
+	offset: number
+	limit: number
+	records: AuditRecord[]
+}
+
+export async function getAuditLogs(
+	token: string,
+	filter: AuditFilter,
+	offset?: number,
+	limit?: number,
+): Promise<AuditLogsRes> {
+	const res = await axios.get<AuditLogsRes>(`/api/v0/audit_logs`, {
+		params: {
+			...filter,
+			offset: offset,
+			limit: limit,
+		},
+		headers: {
+			Authorization: `Bearer ${token}`,
+		},
+	})
+	return res.data
+}
+
+export async function getAuditLogsExportURL(token: string, filter: AuditFilter): Promise<string> {
+	const u = new URL(`${window.location.origin}/api/v0/audit_logs/export`)
+	const query: { [key: string]: string } = {}
+	for (const [k, v] of Object.entries(filter)) {
+		if (v) {
+			query[k] = v
+			u.searchParams.set(k, v)
+		}
+	}
+	const tk = await requestToken(token, u.pathname, query)
+	u.searchParams.set('_t', tk)
+	return u.toString()
+}
+
 // Avaliable values for pprof lookup are at <https://pkg.go.dev/runtime/pprof>
 //
 // goroutine    - stack traces of all current goroutines
@@ -208,6 +639,7 @@ export type SubscribeScope =
 	| 'syncdone'
 	| 'updates'
 	| 'dailyreport'
+	| 'storagestate'
 export const ALL_SUBSCRIBE_SCOPES: SubscribeScope[] = [
 	'enabled',
 	'disabled',
@@ -215,6 +647,7 @@ export const ALL_SUBSCRIBE_SCOPES: SubscribeScope[] = [
 	'syncdone',
 	'updates',
 	'dailyreport',
+	'storagestate',
 ]
 export type ScopeFlags = {
 	[key in SubscribeScope]: boolean
@@ -336,6 +769,7 @@ export interface WebhookItemPayload {
 	name: string
 	endpoint: string
 	auth: string | undefined
+	secret: string | undefined
 	scopes: SubscribeScope[]
 	enabled: boolean
 }
@@ -0,0 +1,78 @@
+// helpers to convert the WebAuthn options and credentials between JSON and the browser API
+
+function b64urlToBuffer(s: string): ArrayBuffer {
+	const b64 = s.replace(/-/g, '+').replace(/_/g, '/')
+	const raw = atob(b64 + '='.repeat((4 - (b64.length % 4)) % 4))
+	const buf = new Uint8Array(raw.length)
+	for (let i = 0; i < raw.length; i++) {
+		buf[i] = raw.charCodeAt(i)
+	}
+	return buf.buffer
+}
+
+function bufferToB64url(buf: ArrayBuffer | null): string | null {
+	if (!buf) {
+		return null
+	}
+	const bytes = new Uint8Array(buf)
+	let raw = ''
+	for (const b of bytes) {
+		raw += String.fromCharCode(b)
+	}
+	return btoa(raw).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+// the options are the JSON encoded PublicKeyCredentialCreationOptions or PublicKeyCredentialRequestOptions,
+// which the binary fields are base64url encoded
+export type WebAuthnOptions = { publicKey: any }
+
+export async function createCredential(options: WebAuthnOptions): Promise<object> {
+	const pk = options.publicKey
+	pk.challenge = b64urlToBuffer(pk.challenge)
+	pk.user.id = b64urlToBuffer(pk.user.id)
+	if (pk.excludeCredentials) {
+		for (const c of pk.excludeCredentials) {
+			c.id = b64urlToBuffer(c.id)
+		}
+	}
+	const cred = (await navigator.credentials.create({ publicKey: pk })) as PublicKeyCredential | null
+	if (!cred) {
+		throw new Error('WebAuthn registration was cancelled')
+	}
+	const res = cred.response as AuthenticatorAttestationResponse
+	return {
+		id: cred.id,
+		rawId: bufferToB64url(cred.rawId),
+		type: cred.type,
+		response: {
+			attestationObject: bufferToB64url(res.attestationObject),
+			clientDataJSON: bufferToB64url(res.clientDataJSON),
+		},
+	}
+}
+
+export async function getCredential(options: WebAuthnOptions): Promise<object> {
+	const pk = options.publicKey
+	pk.challenge = b64urlToBuffer(pk.challenge)
+	if (pk.allowCredentials) {
+		for (const c of pk.allowCredentials) {
+			c.id = b64urlToBuffer(c.id)
+		}
+	}
+	const cred = (await navigator.credentials.get({ publicKey: pk })) as PublicKeyCredential | null
+	if (!cred) {
+		throw new Error('WebAuthn login was cancelled')
+	}
+	const res = cred.response as AuthenticatorAssertionResponse
+	return {
+		id: cred.id,
+		rawId: bufferToB64url(cred.rawId),
+		type: cred.type,
+		response: {
+			authenticatorData: bufferToB64url(res.authenticatorData),
+			clientDataJSON: bufferToB64url(res.clientDataJSON),
+			signature: bufferToB64url(res.signature),
+			userHandle: bufferToB64url(res.userHandle),
+		},
+	}
+}
@@ -54,6 +54,13 @@ type PushData =
 			typ: 'daily-report'
 			data: string
 	  }
+	| {
+			typ: 'storage-state'
+			at: number
+			storage: string
+			from: string
+			to: string
+	  }
 
 function decodeB64(b64: string): Uint8Array {
 	const bin = atob(b64)
@@ -103,6 +110,16 @@ async function onRecvPush(data: PushData): Promise<void> {
 				})
 				.catch((err) => console.error('notify error:', err))
 			break
+		case 'storage-state':
+			await self.registration
+				.showNotification('OpenBmclApi', {
+					icon: ICON_URL,
+					tag: `storage-state-${data.storage}`,
+					body: `Storage ${data.storage} is ${data.to} (was ${data.from})`,
+					renotify: true,
+				})
+				.catch((err) => console.error('notify error:', err))
+			break
 		case 'daily-report': {
 			const compressed = decodeB64(data.data)
 			const stats: Stats = JSON.parse(pako.inflate(compressed, { to: 'string' }))
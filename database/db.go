@@ -45,6 +45,8 @@ type DB interface {
 
 	ValidJTI(jti string) (bool, error)
 	AddJTI(jti string, expire time.Time) error
+	// RemoveJTI returns ErrNotFound if the jti does not exist,
+	// so only one of the concurrent calls with the same jti can succeed
 	RemoveJTI(jti string) error
 
 	// You should not edit the record pointer
@@ -55,6 +57,57 @@ type DB interface {
 	// the callback should not edit the record pointer
 	ForEachFileRecord(cb func(*FileRecord) error) error
 
+	// GetFileIndex returns ErrNotFound if the hash is not indexed
+	GetFileIndex(hash string) (*FileIndexRecord, error)
+	SetFileIndex(FileIndexRecord) error
+	// SetFileIndexes is the batch version of SetFileIndex
+	SetFileIndexes([]FileIndexRecord) error
+	RemoveFileIndex(hash string) error
+	// if the callback returns ErrStopIter, ForEach must immediately stop and returns a nil error
+	// the callback should not edit the record pointer
+	ForEachFileIndex(cb func(*FileIndexRecord) error) error
+
+	// GetUser returns ErrNotFound if the user does not exist
+	GetUser(username string) (*UserRecord, error)
+	// AddUser returns ErrExists if the username was already taken
+	AddUser(UserRecord) error
+	// UpdateUser updates the password and the role of the user, it returns ErrNotFound if the user does not exist
+	UpdateUser(UserRecord) error
+	RemoveUser(username string) error
+	ForEachUser(cb func(*UserRecord) error) error
+
+	// GetSecondFactor returns ErrNotFound if the factor does not exist
+	GetSecondFactor(user string, typ string, id string) (*SecondFactorRecord, error)
+	// AddSecondFactor returns ErrExists if the factor was already exists
+	AddSecondFactor(SecondFactorRecord) error
+	// UpdateSecondFactor updates the name, the secret, the enabled state and the counter of the factor
+	UpdateSecondFactor(SecondFactorRecord) error
+	// AdvanceSecondFactorCounter sets the counter of the factor only if the saved counter is less than the new one.
+	// It returns ErrNotFound if the factor does not exist or the counter is not advanced,
+	// so a TOTP code can only be accepted once even if it's used concurrently
+	AdvanceSecondFactorCounter(user string, typ string, id string, counter int64) error
+	// RemoveSecondFactor returns ErrNotFound if the factor does not exist,
+	// so a one-time factor can be consumed safely by removing it
+	RemoveSecondFactor(user string, typ string, id string) error
+	// RemoveUsersSecondFactors removes all factors of the user with the type, empty type means all types
+	RemoveUsersSecondFactors(user string, typ string) error
+	ForEachUsersSecondFactor(user string, cb func(*SecondFactorRecord) error) error
+
+	// GetAPIKey returns ErrNotFound if the key does not exist
+	GetAPIKey(id string) (*APIKeyRecord, error)
+	// AddAPIKey returns ErrExists if the id was already taken
+	AddAPIKey(APIKeyRecord) error
+	// UpdateAPIKeyLastUsed returns ErrNotFound if the key does not exist
+	UpdateAPIKeyLastUsed(id string, lastUsed time.Time) error
+	RemoveAPIKey(id string) error
+	ForEachAPIKey(cb func(*APIKeyRecord) error) error
+
+	AddAuditRecord(AuditRecord) error
+	// QueryAuditRecords returns the matched records from new to old, and the total count of the matched records
+	QueryAuditRecords(filter AuditFilter, offset int, limit int) (records []AuditRecord, total int, err error)
+	// ForEachAuditRecord iterates the matched records from old to new
+	ForEachAuditRecord(filter AuditFilter, cb func(*AuditRecord) error) error
+
 	GetSubscribe(user string, client string) (*SubscribeRecord, error)
 	SetSubscribe(SubscribeRecord) error
 	RemoveSubscribe(user string, client string) error
@@ -76,6 +129,13 @@ type DB interface {
 	ForEachWebhook(cb func(*WebhookRecord) error) error
 	ForEachUsersWebhook(user string, cb func(*WebhookRecord) error) error
 	ForEachEnabledWebhook(cb func(*WebhookRecord) error) error
+
+	AddWebhookDelivery(WebhookDeliveryRecord) error
+	// ForEachUsersWebhookDelivery iterates the delivery records of the user from new to old,
+	// uuid.Nil matches the records of all the webhooks of the user
+	ForEachUsersWebhookDelivery(user string, webhook uuid.UUID, cb func(*WebhookDeliveryRecord) error) error
+	// RemoveWebhookDeliveriesBefore removes the delivery records that are older than the time
+	RemoveWebhookDeliveriesBefore(before time.Time) error
 }
 
 type FileRecord struct {
@@ -84,6 +144,203 @@ type FileRecord struct {
 	Size int64
 }
 
+// FileIndexRecord records a synchronized file and which storages have it
+type FileIndexRecord struct {
+	Hash     string
+	Size     int64
+	Mtime    int64
+	Storages StorageIds
+}
+
+// StorageIds is a list of storage id
+type StorageIds []string
+
+var (
+	_ sql.Scanner   = (*StorageIds)(nil)
+	_ driver.Valuer = (*StorageIds)(nil)
+)
+
+// Has reports whether id is in the list
+func (s StorageIds) Has(id string) bool {
+	for _, v := range s {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Add returns the list with id appended if it's not in the list yet
+func (s StorageIds) Add(id string) StorageIds {
+	if s.Has(id) {
+		return s
+	}
+	return append(s, id)
+}
+
+// Remove returns a new list without id
+func (s StorageIds) Remove(id string) StorageIds {
+	res := make(StorageIds, 0, len(s))
+	for _, v := range s {
+		if v != id {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (s *StorageIds) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = ([]byte)(v)
+	default:
+		return errors.New("Source is not a string")
+	}
+	return json.Unmarshal(data, s)
+}
+
+func (s StorageIds) Value() (driver.Value, error) {
+	if s == nil {
+		s = StorageIds{}
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return (string)(buf), nil
+}
+
+// UserRecord is a dashboard user
+type UserRecord struct {
+	Username string `json:"username"`
+	// Password is the bcrypt hash of the hex encoded sha256 of the password
+	Password  string    `json:"-"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	SecondFactorTOTP     = "totp"
+	SecondFactorWebAuthn = "webauthn"
+	SecondFactorRecovery = "recovery"
+)
+
+// SecondFactorRecord is a second factor authenticator of a dashboard user
+type SecondFactorRecord struct {
+	User string `json:"user"`
+	// Type is one of SecondFactorTOTP, SecondFactorWebAuthn or SecondFactorRecovery
+	Type string `json:"type"`
+	// Id is the credential id for WebAuthn, and the hex encoded sha256 of the code for the recovery codes
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Secret is the base32 encoded key for TOTP, and the credential in JSON format for WebAuthn
+	Secret string `json:"-"`
+	// Enabled is false when the factor has not been confirmed yet
+	Enabled bool `json:"enabled"`
+	// Counter is the last accepted time step for TOTP
+	Counter   int64     `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// APIKeyRecord is the metadata of a long-lived API key, the key itself is not saved
+type APIKeyRecord struct {
+	// Id is the jti of the key
+	Id        string       `json:"id"`
+	User      string       `json:"user"`
+	Name      string       `json:"name"`
+	Scopes    APIKeyScopes `json:"scopes"`
+	CreatedAt time.Time    `json:"createdAt"`
+	// ExpiresAt is nil if the key never expires
+	ExpiresAt *time.Time `json:"expiresAt"`
+	// LastUsedAt is nil if the key was never used
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// APIKeyScopes is a list of scopes that an API key is allowed to access
+type APIKeyScopes []string
+
+var (
+	_ sql.Scanner   = (*APIKeyScopes)(nil)
+	_ driver.Valuer = (*APIKeyScopes)(nil)
+)
+
+func (s APIKeyScopes) Has(scope string) bool {
+	for _, v := range s {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *APIKeyScopes) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = ([]byte)(v)
+	default:
+		return errors.New("Source is not a string")
+	}
+	return json.Unmarshal(data, s)
+}
+
+func (s APIKeyScopes) Value() (driver.Value, error) {
+	if s == nil {
+		s = APIKeyScopes{}
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return (string)(buf), nil
+}
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditRecord is an administrative action or a login attempt
+type AuditRecord struct {
+	Id   uuid.UUID `json:"id"`
+	Time time.Time `json:"time"`
+	// Actor is the user who did the action, it's the attempted username for the login actions
+	Actor string `json:"actor"`
+	// ClientId is the hashed client id, or the id of the API key
+	ClientId string `json:"clientId"`
+	IP       string `json:"ip"`
+	Action   string `json:"action"`
+	Target   string `json:"target,omitempty"`
+	// Result is either AuditSuccess or AuditFailure
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// AuditFilter selects the audit records, the empty fields match all records
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Result string
+	// Since is inclusive and Until is exclusive
+	Since time.Time
+	Until time.Time
+}
+
+func (f *AuditFilter) Match(rec *AuditRecord) bool {
+	return (f.Actor == "" || rec.Actor == f.Actor) &&
+		(f.Action == "" || rec.Action == f.Action) &&
+		(f.Target == "" || rec.Target == f.Target) &&
+		(f.Result == "" || rec.Result == f.Result) &&
+		(f.Since.IsZero() || !rec.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || rec.Time.Before(f.Until))
+}
+
 type SubscribeRecord struct {
 	User       string              `json:"user"`
 	Client     string              `json:"client"`
@@ -122,12 +379,13 @@ func (sk SubscribeRecordKeys) Value() (driver.Value, error) {
 }
 
 type NotificationScopes struct {
-	Disabled    bool `json:"disabled"`
-	Enabled     bool `json:"enabled"`
-	SyncBegin   bool `json:"syncbegin"`
-	SyncDone    bool `json:"syncdone"`
-	Updates     bool `json:"updates"`
-	DailyReport bool `json:"dailyreport"`
+	Disabled     bool `json:"disabled"`
+	Enabled      bool `json:"enabled"`
+	SyncBegin    bool `json:"syncbegin"`
+	SyncDone     bool `json:"syncdone"`
+	Updates      bool `json:"updates"`
+	DailyReport  bool `json:"dailyreport"`
+	StorageState bool `json:"storagestate"`
 }
 
 var (
@@ -144,6 +402,7 @@ const (
 	nsFlagUpdates
 	nsFlagDailyReport
 	nsFlagSyncBegin
+	nsFlagStorageState
 )
 
 func (ns NotificationScopes) ToInt64() (v int64) {
@@ -165,6 +424,9 @@ func (ns NotificationScopes) ToInt64() (v int64) {
 	if ns.DailyReport {
 		v |= nsFlagDailyReport
 	}
+	if ns.StorageState {
+		v |= nsFlagStorageState
+	}
 	return
 }
 
@@ -175,6 +437,7 @@ func (ns *NotificationScopes) FromInt64(v int64) {
 	ns.SyncDone = v&nsFlagSyncDone != 0
 	ns.Updates = v&nsFlagUpdates != 0
 	ns.DailyReport = v&nsFlagDailyReport != 0
+	ns.StorageState = v&nsFlagStorageState != 0
 }
 
 func (ns *NotificationScopes) Scan(src any) error {
@@ -205,6 +468,8 @@ func (ns *NotificationScopes) FromStrings(scopes []string) {
 			ns.Updates = true
 		case "dailyreport":
 			ns.DailyReport = true
+		case "storagestate":
+			ns.StorageState = true
 		}
 	}
 }
@@ -306,14 +571,30 @@ type EmailSubscriptionRecord struct {
 }
 
 type WebhookRecord struct {
-	User     string             `json:"user"`
-	Id       uuid.UUID          `json:"id"`
-	Name     string             `json:"name"`
-	EndPoint string             `json:"endpoint"`
-	Auth     *string            `json:"auth,omitempty"`
-	AuthHash string             `json:"authHash,omitempty"`
-	Scopes   NotificationScopes `json:"scopes"`
-	Enabled  bool               `json:"enabled"`
+	User     string    `json:"user"`
+	Id       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	EndPoint string    `json:"endpoint"`
+	Auth     *string   `json:"auth,omitempty"`
+	AuthHash string    `json:"authHash,omitempty"`
+	// Secret is the key to sign the payloads, unlike Auth it's never sent with the deliveries.
+	// It's write only, and only ForEachEnabledWebhook is required to return it
+	Secret  *string            `json:"secret,omitempty"`
+	Scopes  NotificationScopes `json:"scopes"`
+	Enabled bool               `json:"enabled"`
+}
+
+// WebhookDeliveryRecord records the result of sending one event to one webhook
+type WebhookDeliveryRecord struct {
+	Id       uuid.UUID     `json:"id"`
+	User     string        `json:"user"`
+	Webhook  uuid.UUID     `json:"webhook"`
+	Event    string        `json:"event"`
+	At       time.Time     `json:"at"`
+	Attempts int           `json:"attempts"`
+	Status   int           `json:"status"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
 }
 
 func (rec *WebhookRecord) CovertAuthHash() {
@@ -21,8 +21,12 @@ package database_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"time"
 
+	"github.com/google/uuid"
+
 	. "github.com/LiterMC/go-openbmclapi/database"
 	"testing"
 )
@@ -93,3 +97,535 @@ func TestScheduleReadySince(t *testing.T) {
 		}
 	}
 }
+
+func testFileIndex(t *testing.T, db DB) {
+	if _, err := db.GetFileIndex("a"); err != ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, got %v", err)
+	}
+	if err := db.SetFileIndex(FileIndexRecord{Hash: "a", Size: 1, Mtime: 2, Storages: StorageIds{"s1"}}); err != nil {
+		t.Fatalf("SetFileIndex: %v", err)
+	}
+	if err := db.SetFileIndexes([]FileIndexRecord{
+		{Hash: "a", Size: 3, Mtime: 4, Storages: StorageIds{"s1", "s2"}},
+		{Hash: "b", Size: 5, Mtime: 6, Storages: StorageIds{}},
+	}); err != nil {
+		t.Fatalf("SetFileIndexes: %v", err)
+	}
+	// setting an unchanged record must not be treated as a missing row
+	if err := db.SetFileIndexes([]FileIndexRecord{
+		{Hash: "b", Size: 5, Mtime: 6, Storages: StorageIds{}},
+		{Hash: "b", Size: 5, Mtime: 6, Storages: StorageIds{}},
+	}); err != nil {
+		t.Fatalf("SetFileIndexes with unchanged record: %v", err)
+	}
+	rec, err := db.GetFileIndex("a")
+	if err != nil {
+		t.Fatalf("GetFileIndex: %v", err)
+	}
+	if rec.Size != 3 || rec.Mtime != 4 || len(rec.Storages) != 2 || !rec.Storages.Has("s2") {
+		t.Errorf("Unexpected record %#v", rec)
+	}
+	if err := db.RemoveFileIndex("a"); err != nil {
+		t.Fatalf("RemoveFileIndex: %v", err)
+	}
+	if err := db.RemoveFileIndex("a"); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	var hashes []string
+	if err := db.ForEachFileIndex(func(rec *FileIndexRecord) error {
+		hashes = append(hashes, rec.Hash)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachFileIndex: %v", err)
+	}
+	if len(hashes) != 1 || hashes[0] != "b" {
+		t.Errorf("Expect only [b] is indexed, got %v", hashes)
+	}
+
+	// a large batch should be written in several transactions
+	many := make([]FileIndexRecord, 2500)
+	for i := range many {
+		many[i] = FileIndexRecord{Hash: fmt.Sprintf("%064x", i), Size: (int64)(i + 1), Storages: StorageIds{"s1"}}
+	}
+	if err := db.SetFileIndexes(many); err != nil {
+		t.Fatalf("SetFileIndexes with many records: %v", err)
+	}
+	count := 0
+	if err := db.ForEachFileIndex(func(rec *FileIndexRecord) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachFileIndex: %v", err)
+	}
+	if count != len(many)+1 {
+		t.Errorf("Expect %d records, got %d", len(many)+1, count)
+	}
+}
+
+func TestMemoryFileIndex(t *testing.T) {
+	testFileIndex(t, NewMemoryDB())
+}
+
+func TestSqliteFileIndex(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testFileIndex(t, db)
+}
+
+func testUsers(t *testing.T, db DB) {
+	if _, err := db.GetUser("alice"); err != ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, got %v", err)
+	}
+	created := time.UnixMilli(time.Now().UnixMilli())
+	if err := db.AddUser(UserRecord{Username: "alice", Password: "hash1", Role: "viewer", CreatedAt: created}); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if err := db.AddUser(UserRecord{Username: "alice", Password: "hash2", Role: "admin"}); err != ErrExists {
+		t.Errorf("Expect ErrExists, got %v", err)
+	}
+	if err := db.UpdateUser(UserRecord{Username: "alice", Password: "hash3", Role: "operator"}); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if err := db.UpdateUser(UserRecord{Username: "bob", Role: "viewer"}); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	rec, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if rec.Password != "hash3" || rec.Role != "operator" || !rec.CreatedAt.Equal(created) {
+		t.Errorf("Unexpected record %#v", rec)
+	}
+	if err := db.AddUser(UserRecord{Username: "bob", Password: "hash4", Role: "admin", CreatedAt: created}); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if err := db.RemoveUser("alice"); err != nil {
+		t.Fatalf("RemoveUser: %v", err)
+	}
+	if err := db.RemoveUser("alice"); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	var names []string
+	if err := db.ForEachUser(func(rec *UserRecord) error {
+		names = append(names, rec.Username)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachUser: %v", err)
+	}
+	if len(names) != 1 || names[0] != "bob" {
+		t.Errorf("Expect only [bob] exists, got %v", names)
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	testUsers(t, NewMemoryDB())
+}
+
+func TestSqliteUsers(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testUsers(t, db)
+}
+
+func testSecondFactors(t *testing.T, db DB) {
+	if _, err := db.GetSecondFactor("alice", SecondFactorTOTP, ""); err != ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, got %v", err)
+	}
+	created := time.UnixMilli(time.Now().UnixMilli())
+	totp := SecondFactorRecord{User: "alice", Type: SecondFactorTOTP, Secret: "ABCDEF", CreatedAt: created}
+	if err := db.AddSecondFactor(totp); err != nil {
+		t.Fatalf("AddSecondFactor: %v", err)
+	}
+	if err := db.AddSecondFactor(totp); err != ErrExists {
+		t.Errorf("Expect ErrExists, got %v", err)
+	}
+	totp.Enabled, totp.Counter = true, 12345
+	if err := db.UpdateSecondFactor(totp); err != nil {
+		t.Fatalf("UpdateSecondFactor: %v", err)
+	}
+	if rec, err := db.GetSecondFactor("alice", SecondFactorTOTP, ""); err != nil {
+		t.Fatalf("GetSecondFactor: %v", err)
+	} else if !rec.Enabled || rec.Counter != 12345 || rec.Secret != "ABCDEF" || !rec.CreatedAt.Equal(created) {
+		t.Errorf("Unexpected record %#v", rec)
+	}
+	if err := db.AdvanceSecondFactorCounter("alice", SecondFactorTOTP, "", 12346); err != nil {
+		t.Errorf("AdvanceSecondFactorCounter: %v", err)
+	}
+	for _, counter := range []int64{12346, 12345} {
+		if err := db.AdvanceSecondFactorCounter("alice", SecondFactorTOTP, "", counter); err != ErrNotFound {
+			t.Errorf("Expect counter %d cannot be used again, got %v", counter, err)
+		}
+	}
+	if err := db.AdvanceSecondFactorCounter("bob", SecondFactorTOTP, "", 1); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	if rec, err := db.GetSecondFactor("alice", SecondFactorTOTP, ""); err != nil {
+		t.Fatalf("GetSecondFactor: %v", err)
+	} else if rec.Counter != 12346 || !rec.Enabled || rec.Secret != "ABCDEF" {
+		t.Errorf("Unexpected record after advanced the counter %#v", rec)
+	}
+	for _, id := range []string{"code1", "code2"} {
+		if err := db.AddSecondFactor(SecondFactorRecord{User: "alice", Type: SecondFactorRecovery, Id: id, Enabled: true}); err != nil {
+			t.Fatalf("AddSecondFactor: %v", err)
+		}
+	}
+	if err := db.AddSecondFactor(SecondFactorRecord{User: "bob", Type: SecondFactorRecovery, Id: "code1", Enabled: true}); err != nil {
+		t.Fatalf("AddSecondFactor: %v", err)
+	}
+
+	if err := db.RemoveSecondFactor("alice", SecondFactorRecovery, "code1"); err != nil {
+		t.Errorf("RemoveSecondFactor: %v", err)
+	}
+	if err := db.RemoveSecondFactor("alice", SecondFactorRecovery, "code1"); err != ErrNotFound {
+		t.Errorf("Expect a used code cannot be removed again, got %v", err)
+	}
+	count := func(user string) (n int) {
+		if err := db.ForEachUsersSecondFactor(user, func(*SecondFactorRecord) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("ForEachUsersSecondFactor: %v", err)
+		}
+		return
+	}
+	if n := count("alice"); n != 2 {
+		t.Errorf("Expect 2 factors, got %d", n)
+	}
+	if err := db.RemoveUsersSecondFactors("alice", SecondFactorRecovery); err != nil {
+		t.Fatalf("RemoveUsersSecondFactors: %v", err)
+	}
+	if n := count("alice"); n != 1 {
+		t.Errorf("Expect only the TOTP factor left, got %d", n)
+	}
+	if err := db.RemoveUsersSecondFactors("alice", ""); err != nil {
+		t.Fatalf("RemoveUsersSecondFactors: %v", err)
+	}
+	if n := count("alice"); n != 0 {
+		t.Errorf("Expect no factor left, got %d", n)
+	}
+	if n := count("bob"); n != 1 {
+		t.Errorf("Expect the factors of other users are kept, got %d", n)
+	}
+}
+
+func TestMemorySecondFactors(t *testing.T) {
+	testSecondFactors(t, NewMemoryDB())
+}
+
+func TestSqliteSecondFactors(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testSecondFactors(t, db)
+}
+
+func testAPIKeys(t *testing.T, db DB) {
+	if _, err := db.GetAPIKey("key1"); err != ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, got %v", err)
+	}
+	created := time.UnixMilli(time.Now().UnixMilli())
+	expires := created.Add(time.Hour)
+	rec := APIKeyRecord{
+		Id:        "key1",
+		User:      "alice",
+		Name:      "ansible",
+		Scopes:    APIKeyScopes{"read-status", "read-logs"},
+		CreatedAt: created,
+		ExpiresAt: &expires,
+	}
+	if err := db.AddAPIKey(rec); err != nil {
+		t.Fatalf("AddAPIKey: %v", err)
+	}
+	if err := db.AddAPIKey(rec); err != ErrExists {
+		t.Errorf("Expect ErrExists, got %v", err)
+	}
+	if err := db.AddAPIKey(APIKeyRecord{Id: "key2", User: "bob", Name: "monitor", CreatedAt: created}); err != nil {
+		t.Fatalf("AddAPIKey: %v", err)
+	}
+	used := created.Add(time.Minute)
+	if err := db.UpdateAPIKeyLastUsed("key1", used); err != nil {
+		t.Fatalf("UpdateAPIKeyLastUsed: %v", err)
+	}
+	if err := db.UpdateAPIKeyLastUsed("key3", used); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	got, err := db.GetAPIKey("key1")
+	if err != nil {
+		t.Fatalf("GetAPIKey: %v", err)
+	}
+	if !got.Scopes.Has("read-logs") || got.Scopes.Has("manage-webhooks") || got.Name != "ansible" {
+		t.Errorf("Unexpected record %#v", got)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || got.LastUsedAt == nil || !got.LastUsedAt.Equal(used) {
+		t.Errorf("Unexpected times %v, %v", got.ExpiresAt, got.LastUsedAt)
+	}
+	if got, err := db.GetAPIKey("key2"); err != nil {
+		t.Fatalf("GetAPIKey: %v", err)
+	} else if got.ExpiresAt != nil || got.LastUsedAt != nil || len(got.Scopes) != 0 {
+		t.Errorf("Unexpected record %#v", got)
+	}
+
+	if err := db.RemoveAPIKey("key1"); err != nil {
+		t.Errorf("RemoveAPIKey: %v", err)
+	}
+	if err := db.RemoveAPIKey("key1"); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound, got %v", err)
+	}
+	var ids []string
+	if err := db.ForEachAPIKey(func(rec *APIKeyRecord) error {
+		ids = append(ids, rec.Id)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachAPIKey: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "key2" {
+		t.Errorf("Unexpected keys %v", ids)
+	}
+}
+
+func TestMemoryAPIKeys(t *testing.T) {
+	testAPIKeys(t, NewMemoryDB())
+}
+
+func TestSqliteAPIKeys(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testAPIKeys(t, db)
+}
+
+func testAuditRecords(t *testing.T, db DB) {
+	base := time.UnixMilli(time.Now().UnixMilli())
+	for i, r := range []struct {
+		actor, action, result string
+	}{
+		{"alice", "login", AuditSuccess},
+		{"bob", "login", AuditFailure},
+		{"alice", "webhook.add", AuditSuccess},
+		{"alice", "login", AuditFailure},
+	} {
+		if err := db.AddAuditRecord(AuditRecord{
+			Id:       uuid.New(),
+			Time:     base.Add(time.Duration(i) * time.Second),
+			Actor:    r.actor,
+			ClientId: "cli",
+			IP:       "127.0.0.1",
+			Action:   r.action,
+			Result:   r.result,
+		}); err != nil {
+			t.Fatalf("AddAuditRecord: %v", err)
+		}
+	}
+
+	records, total, err := db.QueryAuditRecords(AuditFilter{Actor: "alice"}, 0, 2)
+	if err != nil {
+		t.Fatalf("QueryAuditRecords: %v", err)
+	}
+	if total != 3 || len(records) != 2 {
+		t.Fatalf("Expect 2 of 3 records, got %d of %d", len(records), total)
+	}
+	if !records[0].Time.Equal(base.Add(time.Second*3)) || records[1].Action != "webhook.add" {
+		t.Errorf("Expect the records from new to old, got %#v", records)
+	}
+	if records, total, err = db.QueryAuditRecords(AuditFilter{Actor: "alice"}, 2, 2); err != nil {
+		t.Fatalf("QueryAuditRecords: %v", err)
+	} else if total != 3 || len(records) != 1 || !records[0].Time.Equal(base) {
+		t.Errorf("Unexpected second page %#v", records)
+	}
+	if _, total, _ = db.QueryAuditRecords(AuditFilter{Action: "login", Result: AuditFailure}, 0, 10); total != 2 {
+		t.Errorf("Expect 2 failed logins, got %d", total)
+	}
+
+	var actions []string
+	if err := db.ForEachAuditRecord(AuditFilter{Since: base.Add(time.Second), Until: base.Add(time.Second * 3)}, func(rec *AuditRecord) error {
+		actions = append(actions, rec.Actor+"/"+rec.Action)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachAuditRecord: %v", err)
+	}
+	if len(actions) != 2 || actions[0] != "bob/login" || actions[1] != "alice/webhook.add" {
+		t.Errorf("Unexpected records %v", actions)
+	}
+}
+
+func TestMemoryAuditRecords(t *testing.T) {
+	testAuditRecords(t, NewMemoryDB())
+}
+
+func TestSqliteAuditRecords(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testAuditRecords(t, db)
+}
+
+func testWebhookSecret(t *testing.T, db DB) {
+	auth, secret := "Bearer token", "s3cret"
+	if err := db.AddWebhook(WebhookRecord{User: "alice", Name: "test", EndPoint: "https://example.com", Auth: &auth, Secret: &secret, Enabled: true}); err != nil {
+		t.Fatalf("AddWebhook: %v", err)
+	}
+	getEnabled := func() (rec WebhookRecord) {
+		n := 0
+		if err := db.ForEachEnabledWebhook(func(r *WebhookRecord) error {
+			rec = *r
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("ForEachEnabledWebhook: %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("Expect 1 enabled webhook, got %d", n)
+		}
+		return
+	}
+	rec := getEnabled()
+	if rec.Secret == nil || *rec.Secret != secret || rec.Auth == nil || *rec.Auth != auth {
+		t.Fatalf("Unexpected webhook %#v", rec)
+	}
+
+	// the secret is kept if it's not provided
+	rec.Name, rec.Auth, rec.Secret = "renamed", nil, nil
+	if err := db.UpdateWebhook(rec); err != nil {
+		t.Fatalf("UpdateWebhook: %v", err)
+	}
+	if rec := getEnabled(); rec.Name != "renamed" || rec.Secret == nil || *rec.Secret != secret {
+		t.Errorf("Expect the secret is kept, got %#v", rec)
+	}
+
+	newSecret := "another"
+	rec.Secret = &newSecret
+	if err := db.UpdateWebhook(rec); err != nil {
+		t.Fatalf("UpdateWebhook: %v", err)
+	}
+	if rec := getEnabled(); rec.Secret == nil || *rec.Secret != newSecret || *rec.Auth != auth {
+		t.Errorf("Expect the secret is updated, got %#v", rec)
+	}
+}
+
+func TestMemoryWebhookSecret(t *testing.T) {
+	testWebhookSecret(t, NewMemoryDB())
+}
+
+func TestSqliteWebhookSecret(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testWebhookSecret(t, db)
+}
+
+func testWebhookDeliveries(t *testing.T, db DB) {
+	base := time.UnixMilli(time.Now().UnixMilli())
+	hook1, hook2 := uuid.New(), uuid.New()
+	for i, r := range []struct {
+		user    string
+		webhook uuid.UUID
+	}{
+		{"alice", hook1},
+		{"alice", hook2},
+		{"bob", hook1},
+		{"alice", hook1},
+	} {
+		if err := db.AddWebhookDelivery(WebhookDeliveryRecord{
+			Id:       uuid.New(),
+			User:     r.user,
+			Webhook:  r.webhook,
+			Event:    "test",
+			At:       base.Add(time.Duration(i) * time.Second),
+			Attempts: i + 1,
+			Status:   200,
+			Latency:  time.Duration(i) * time.Millisecond,
+		}); err != nil {
+			t.Fatalf("AddWebhookDelivery: %v", err)
+		}
+	}
+
+	collect := func(user string, webhook uuid.UUID) (attempts []int) {
+		if err := db.ForEachUsersWebhookDelivery(user, webhook, func(rec *WebhookDeliveryRecord) error {
+			if rec.User != user || (webhook != uuid.Nil && rec.Webhook != webhook) {
+				t.Errorf("Unexpected record %#v", rec)
+			}
+			attempts = append(attempts, rec.Attempts)
+			return nil
+		}); err != nil {
+			t.Fatalf("ForEachUsersWebhookDelivery: %v", err)
+		}
+		return
+	}
+	if got := collect("alice", uuid.Nil); len(got) != 3 || got[0] != 4 || got[1] != 2 || got[2] != 1 {
+		t.Errorf("Expect alice's records from new to old, got %v", got)
+	}
+	if got := collect("alice", hook1); len(got) != 2 || got[0] != 4 || got[1] != 1 {
+		t.Errorf("Unexpected records of webhook 1 %v", got)
+	}
+
+	if err := db.RemoveWebhookDeliveriesBefore(base.Add(time.Second * 2)); err != nil {
+		t.Fatalf("RemoveWebhookDeliveriesBefore: %v", err)
+	}
+	if got := collect("alice", uuid.Nil); len(got) != 1 || got[0] != 4 {
+		t.Errorf("Expect only the newest record to be kept, got %v", got)
+	}
+	var rec WebhookDeliveryRecord
+	db.ForEachUsersWebhookDelivery("bob", uuid.Nil, func(r *WebhookDeliveryRecord) error {
+		rec = *r
+		return ErrStopIter
+	})
+	if !rec.At.Equal(base.Add(time.Second*2)) || rec.Latency != 2*time.Millisecond || rec.Webhook != hook1 {
+		t.Errorf("Unexpected record %#v", rec)
+	}
+}
+
+func TestMemoryWebhookDeliveries(t *testing.T) {
+	testWebhookDeliveries(t, NewMemoryDB())
+}
+
+func TestSqliteWebhookDeliveries(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testWebhookDeliveries(t, db)
+}
+
+func testJTI(t *testing.T, db DB) {
+	if err := db.AddJTI("jti", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("AddJTI: %v", err)
+	}
+	if ok, err := db.ValidJTI("jti"); err != nil || !ok {
+		t.Fatalf("Expect the jti to be valid, got %v, %v", ok, err)
+	}
+	if err := db.RemoveJTI("jti"); err != nil {
+		t.Fatalf("RemoveJTI: %v", err)
+	}
+	// the jti can only be consumed once
+	if err := db.RemoveJTI("jti"); err != ErrNotFound {
+		t.Errorf("Expect ErrNotFound when removing the jti again, got %v", err)
+	}
+}
+
+func TestMemoryJTI(t *testing.T) {
+	testJTI(t, NewMemoryDB())
+}
+
+func TestSqliteJTI(t *testing.T) {
+	db, err := NewSqlDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Cleanup()
+	testJTI(t, db)
+}
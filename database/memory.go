@@ -37,9 +37,24 @@ type MemoryDB struct {
 	fileRecMux  sync.RWMutex
 	fileRecords map[string]*FileRecord
 
+	fileIndexMux sync.RWMutex
+	fileIndexes  map[string]*FileIndexRecord
+
 	tokenMux sync.RWMutex
 	tokens   map[string]time.Time
 
+	userMux sync.RWMutex
+	users   map[string]*UserRecord
+
+	factorMux sync.RWMutex
+	factors   map[[3]string]*SecondFactorRecord
+
+	apiKeyMux sync.RWMutex
+	apiKeys   map[string]*APIKeyRecord
+
+	auditMux     sync.RWMutex
+	auditRecords []*AuditRecord // from old to new
+
 	subscribeMux     sync.RWMutex
 	subscribeRecords map[[2]string]*SubscribeRecord
 
@@ -48,6 +63,9 @@ type MemoryDB struct {
 
 	webhookMux     sync.RWMutex
 	webhookRecords map[webhookMemKey]*WebhookRecord
+
+	deliveryMux sync.RWMutex
+	deliveries  []*WebhookDeliveryRecord // from old to new
 }
 
 var _ DB = (*MemoryDB)(nil)
@@ -55,13 +73,20 @@ var _ DB = (*MemoryDB)(nil)
 func NewMemoryDB() *MemoryDB {
 	return &MemoryDB{
 		fileRecords:      make(map[string]*FileRecord),
+		fileIndexes:      make(map[string]*FileIndexRecord),
 		tokens:           make(map[string]time.Time),
+		users:            make(map[string]*UserRecord),
+		factors:          make(map[[3]string]*SecondFactorRecord),
+		apiKeys:          make(map[string]*APIKeyRecord),
 		subscribeRecords: make(map[[2]string]*SubscribeRecord),
+		emailSubRecords:  make(map[[2]string]*EmailSubscriptionRecord),
+		webhookRecords:   make(map[webhookMemKey]*WebhookRecord),
 	}
 }
 
 func (m *MemoryDB) Cleanup() (err error) {
 	m.fileRecords = nil
+	m.fileIndexes = nil
 	m.tokens = nil
 	return
 }
@@ -156,6 +181,334 @@ func (m *MemoryDB) ForEachFileRecord(cb func(*FileRecord) error) error {
 	return nil
 }
 
+func (m *MemoryDB) GetFileIndex(hash string) (*FileIndexRecord, error) {
+	m.fileIndexMux.RLock()
+	defer m.fileIndexMux.RUnlock()
+
+	record, ok := m.fileIndexes[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+func (m *MemoryDB) SetFileIndex(record FileIndexRecord) error {
+	m.fileIndexMux.Lock()
+	defer m.fileIndexMux.Unlock()
+
+	record.Storages = append(StorageIds(nil), record.Storages...)
+	m.fileIndexes[record.Hash] = &record
+	return nil
+}
+
+func (m *MemoryDB) SetFileIndexes(records []FileIndexRecord) error {
+	m.fileIndexMux.Lock()
+	defer m.fileIndexMux.Unlock()
+
+	for _, record := range records {
+		record := record
+		record.Storages = append(StorageIds(nil), record.Storages...)
+		m.fileIndexes[record.Hash] = &record
+	}
+	return nil
+}
+
+func (m *MemoryDB) RemoveFileIndex(hash string) error {
+	m.fileIndexMux.Lock()
+	defer m.fileIndexMux.Unlock()
+
+	if _, ok := m.fileIndexes[hash]; !ok {
+		return ErrNotFound
+	}
+	delete(m.fileIndexes, hash)
+	return nil
+}
+
+func (m *MemoryDB) ForEachFileIndex(cb func(*FileIndexRecord) error) error {
+	m.fileIndexMux.RLock()
+	defer m.fileIndexMux.RUnlock()
+
+	for _, v := range m.fileIndexes {
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetUser(username string) (*UserRecord, error) {
+	m.userMux.RLock()
+	defer m.userMux.RUnlock()
+
+	record, ok := m.users[username]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+func (m *MemoryDB) AddUser(record UserRecord) error {
+	m.userMux.Lock()
+	defer m.userMux.Unlock()
+
+	if _, ok := m.users[record.Username]; ok {
+		return ErrExists
+	}
+	m.users[record.Username] = &record
+	return nil
+}
+
+func (m *MemoryDB) UpdateUser(record UserRecord) error {
+	m.userMux.Lock()
+	defer m.userMux.Unlock()
+
+	old, ok := m.users[record.Username]
+	if !ok {
+		return ErrNotFound
+	}
+	record.CreatedAt = old.CreatedAt
+	m.users[record.Username] = &record
+	return nil
+}
+
+func (m *MemoryDB) RemoveUser(username string) error {
+	m.userMux.Lock()
+	defer m.userMux.Unlock()
+
+	if _, ok := m.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(m.users, username)
+	return nil
+}
+
+func (m *MemoryDB) ForEachUser(cb func(*UserRecord) error) error {
+	m.userMux.RLock()
+	defer m.userMux.RUnlock()
+
+	for _, v := range m.users {
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetSecondFactor(user string, typ string, id string) (*SecondFactorRecord, error) {
+	m.factorMux.RLock()
+	defer m.factorMux.RUnlock()
+
+	record, ok := m.factors[[3]string{user, typ, id}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+func (m *MemoryDB) AddSecondFactor(record SecondFactorRecord) error {
+	m.factorMux.Lock()
+	defer m.factorMux.Unlock()
+
+	key := [3]string{record.User, record.Type, record.Id}
+	if _, ok := m.factors[key]; ok {
+		return ErrExists
+	}
+	m.factors[key] = &record
+	return nil
+}
+
+func (m *MemoryDB) UpdateSecondFactor(record SecondFactorRecord) error {
+	m.factorMux.Lock()
+	defer m.factorMux.Unlock()
+
+	key := [3]string{record.User, record.Type, record.Id}
+	old, ok := m.factors[key]
+	if !ok {
+		return ErrNotFound
+	}
+	record.CreatedAt = old.CreatedAt
+	m.factors[key] = &record
+	return nil
+}
+
+func (m *MemoryDB) AdvanceSecondFactorCounter(user string, typ string, id string, counter int64) error {
+	m.factorMux.Lock()
+	defer m.factorMux.Unlock()
+
+	key := [3]string{user, typ, id}
+	old, ok := m.factors[key]
+	if !ok || old.Counter >= counter {
+		return ErrNotFound
+	}
+	record := *old
+	record.Counter = counter
+	m.factors[key] = &record
+	return nil
+}
+
+func (m *MemoryDB) RemoveSecondFactor(user string, typ string, id string) error {
+	m.factorMux.Lock()
+	defer m.factorMux.Unlock()
+
+	key := [3]string{user, typ, id}
+	if _, ok := m.factors[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.factors, key)
+	return nil
+}
+
+func (m *MemoryDB) RemoveUsersSecondFactors(user string, typ string) error {
+	m.factorMux.Lock()
+	defer m.factorMux.Unlock()
+
+	for k := range m.factors {
+		if k[0] == user && (typ == "" || k[1] == typ) {
+			delete(m.factors, k)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) ForEachUsersSecondFactor(user string, cb func(*SecondFactorRecord) error) error {
+	m.factorMux.RLock()
+	defer m.factorMux.RUnlock()
+
+	for k, v := range m.factors {
+		if k[0] != user {
+			continue
+		}
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetAPIKey(id string) (*APIKeyRecord, error) {
+	m.apiKeyMux.RLock()
+	defer m.apiKeyMux.RUnlock()
+
+	record, ok := m.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+func (m *MemoryDB) AddAPIKey(record APIKeyRecord) error {
+	m.apiKeyMux.Lock()
+	defer m.apiKeyMux.Unlock()
+
+	if _, ok := m.apiKeys[record.Id]; ok {
+		return ErrExists
+	}
+	m.apiKeys[record.Id] = &record
+	return nil
+}
+
+func (m *MemoryDB) UpdateAPIKeyLastUsed(id string, lastUsed time.Time) error {
+	m.apiKeyMux.Lock()
+	defer m.apiKeyMux.Unlock()
+
+	old, ok := m.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	record := *old
+	record.LastUsedAt = &lastUsed
+	m.apiKeys[id] = &record
+	return nil
+}
+
+func (m *MemoryDB) RemoveAPIKey(id string) error {
+	m.apiKeyMux.Lock()
+	defer m.apiKeyMux.Unlock()
+
+	if _, ok := m.apiKeys[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.apiKeys, id)
+	return nil
+}
+
+func (m *MemoryDB) ForEachAPIKey(cb func(*APIKeyRecord) error) error {
+	m.apiKeyMux.RLock()
+	defer m.apiKeyMux.RUnlock()
+
+	for _, v := range m.apiKeys {
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// maxMemoryAuditRecords is the maximum number of the audit records that MemoryDB keeps,
+// the oldest records will be dropped when exceeded
+const maxMemoryAuditRecords = 10000
+
+func (m *MemoryDB) AddAuditRecord(record AuditRecord) error {
+	m.auditMux.Lock()
+	defer m.auditMux.Unlock()
+
+	if len(m.auditRecords) >= maxMemoryAuditRecords {
+		n := copy(m.auditRecords, m.auditRecords[len(m.auditRecords)-maxMemoryAuditRecords+1:])
+		clear(m.auditRecords[n:])
+		m.auditRecords = m.auditRecords[:n]
+	}
+	m.auditRecords = append(m.auditRecords, &record)
+	return nil
+}
+
+func (m *MemoryDB) QueryAuditRecords(filter AuditFilter, offset int, limit int) (records []AuditRecord, total int, err error) {
+	m.auditMux.RLock()
+	defer m.auditMux.RUnlock()
+
+	records = make([]AuditRecord, 0, min(limit, 64))
+	for i := len(m.auditRecords) - 1; i >= 0; i-- {
+		rec := m.auditRecords[i]
+		if !filter.Match(rec) {
+			continue
+		}
+		if total >= offset && len(records) < limit {
+			records = append(records, *rec)
+		}
+		total++
+	}
+	return
+}
+
+func (m *MemoryDB) ForEachAuditRecord(filter AuditFilter, cb func(*AuditRecord) error) error {
+	m.auditMux.RLock()
+	defer m.auditMux.RUnlock()
+
+	for _, v := range m.auditRecords {
+		if !filter.Match(v) {
+			continue
+		}
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *MemoryDB) GetSubscribe(user string, client string) (*SubscribeRecord, error) {
 	m.subscribeMux.RLock()
 	defer m.subscribeMux.RUnlock()
@@ -355,12 +708,15 @@ func (m *MemoryDB) UpdateWebhook(record WebhookRecord) error {
 
 	key := webhookMemKey{record.User, record.Id}
 	old, ok := m.webhookRecords[key]
-	if ok {
+	if !ok {
 		return ErrNotFound
 	}
 	if record.Auth == nil {
 		record.Auth = old.Auth
 	}
+	if record.Secret == nil {
+		record.Secret = old.Secret
+	}
 	if auth := *record.Auth; auth != "" {
 		record.AuthHash = utils.AsSha256(auth)
 	}
@@ -374,7 +730,7 @@ func (m *MemoryDB) UpdateEnableWebhook(user string, id uuid.UUID, enabled bool)
 
 	key := webhookMemKey{user, id}
 	old, ok := m.webhookRecords[key]
-	if ok {
+	if !ok {
 		return ErrNotFound
 	}
 	record := *old
@@ -388,7 +744,7 @@ func (m *MemoryDB) RemoveWebhook(user string, id uuid.UUID) error {
 	defer m.webhookMux.Unlock()
 
 	key := webhookMemKey{user, id}
-	if _, ok := m.webhookRecords[key]; ok {
+	if _, ok := m.webhookRecords[key]; !ok {
 		return ErrNotFound
 	}
 	delete(m.webhookRecords, key)
@@ -445,3 +801,53 @@ func (m *MemoryDB) ForEachEnabledWebhook(cb func(*WebhookRecord) error) error {
 	}
 	return nil
 }
+
+// maxMemoryWebhookDeliveries is the maximum number of the delivery records that MemoryDB keeps,
+// the oldest records will be dropped when exceeded
+const maxMemoryWebhookDeliveries = 1000
+
+func (m *MemoryDB) AddWebhookDelivery(record WebhookDeliveryRecord) error {
+	m.deliveryMux.Lock()
+	defer m.deliveryMux.Unlock()
+
+	if len(m.deliveries) >= maxMemoryWebhookDeliveries {
+		n := copy(m.deliveries, m.deliveries[len(m.deliveries)-maxMemoryWebhookDeliveries+1:])
+		clear(m.deliveries[n:])
+		m.deliveries = m.deliveries[:n]
+	}
+	m.deliveries = append(m.deliveries, &record)
+	return nil
+}
+
+func (m *MemoryDB) ForEachUsersWebhookDelivery(user string, webhook uuid.UUID, cb func(*WebhookDeliveryRecord) error) error {
+	m.deliveryMux.RLock()
+	defer m.deliveryMux.RUnlock()
+
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		v := m.deliveries[i]
+		if v.User != user || (webhook != uuid.Nil && v.Webhook != webhook) {
+			continue
+		}
+		if err := cb(v); err != nil {
+			if err == ErrStopIter {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) RemoveWebhookDeliveriesBefore(before time.Time) error {
+	m.deliveryMux.Lock()
+	defer m.deliveryMux.Unlock()
+
+	i := 0
+	for i < len(m.deliveries) && m.deliveries[i].At.Before(before) {
+		i++
+	}
+	n := copy(m.deliveries, m.deliveries[i:])
+	clear(m.deliveries[n:])
+	m.deliveries = m.deliveries[:n]
+	return nil
+}
@@ -24,6 +24,8 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"errors"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -51,6 +53,44 @@ type SqlDB struct {
 		forEach   *sql.Stmt
 	}
 
+	fileIndexStmts struct {
+		get     *sql.Stmt
+		upsert  *sql.Stmt
+		remove  *sql.Stmt
+		forEach *sql.Stmt
+	}
+
+	userStmts struct {
+		get     *sql.Stmt
+		add     *sql.Stmt
+		update  *sql.Stmt
+		remove  *sql.Stmt
+		forEach *sql.Stmt
+	}
+
+	factorStmts struct {
+		get           *sql.Stmt
+		add           *sql.Stmt
+		update        *sql.Stmt
+		advance       *sql.Stmt
+		remove        *sql.Stmt
+		removeUsers   *sql.Stmt
+		removeUsersOf *sql.Stmt
+		forEachUsers  *sql.Stmt
+	}
+
+	apiKeyStmts struct {
+		get            *sql.Stmt
+		add            *sql.Stmt
+		updateLastUsed *sql.Stmt
+		remove         *sql.Stmt
+		forEach        *sql.Stmt
+	}
+
+	auditStmts struct {
+		add *sql.Stmt
+	}
+
 	subscribeStmts struct {
 		get                     *sql.Stmt
 		has                     *sql.Stmt
@@ -78,6 +118,7 @@ type SqlDB struct {
 		add              *sql.Stmt
 		update           *sql.Stmt
 		updateExceptAuth *sql.Stmt
+		updateSecret     *sql.Stmt
 		updateEnableOnly *sql.Stmt
 		remove           *sql.Stmt
 		forEach          *sql.Stmt
@@ -85,6 +126,13 @@ type SqlDB struct {
 		forEachEnabled   *sql.Stmt
 	}
 
+	deliveryStmts struct {
+		add            *sql.Stmt
+		forEachUsers   *sql.Stmt
+		forEachUsersOf *sql.Stmt
+		removeBefore   *sql.Stmt
+	}
+
 	jtiCleaner *time.Ticker
 }
 
@@ -125,6 +173,26 @@ func (db *SqlDB) setup(ctx context.Context) (err error) {
 		return
 	}
 
+	if err = db.setupFileIndexes(ctx); err != nil {
+		return
+	}
+
+	if err = db.setupUsers(ctx); err != nil {
+		return
+	}
+
+	if err = db.setupSecondFactors(ctx); err != nil {
+		return
+	}
+
+	if err = db.setupAPIKeys(ctx); err != nil {
+		return
+	}
+
+	if err = db.setupAuditRecords(ctx); err != nil {
+		return
+	}
+
 	if err = db.setupSubscribe(ctx); err != nil {
 		return
 	}
@@ -136,6 +204,10 @@ func (db *SqlDB) setup(ctx context.Context) (err error) {
 	if err = db.setupWebhooks(ctx); err != nil {
 		return
 	}
+
+	if err = db.setupWebhookDeliveries(ctx); err != nil {
+		return
+	}
 	return
 }
 
@@ -280,7 +352,136 @@ func (db *SqlDB) RemoveJTI(jti string) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	if _, err = db.jtiStmts.remove.ExecContext(ctx, jti); err != nil {
+	res, err := db.jtiStmts.remove.ExecContext(ctx, jti)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) setupFileRecords(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupFileRecordsQuestionMark(ctx)
+	case "postgres":
+		return db.setupFileRecordsDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupFileRecordsQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`file_records`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `path` VARCHAR(255) NOT NULL," +
+		" `hash` VARCHAR(255) NOT NULL," +
+		" `size` INTEGER NOT NULL," +
+		" PRIMARY KEY (`path`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT `hash`,`size` FROM " + tableName +
+		" WHERE `path`=?"
+	if db.fileRecordStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const hasSelectCmd = "SELECT 1 FROM " + tableName +
+		" WHERE `path`=?"
+	if db.fileRecordStmts.has, err = db.db.PrepareContext(ctx, hasSelectCmd); err != nil {
+		return
+	}
+
+	const setInsertCmd = "INSERT INTO " + tableName +
+		" (`path`,`hash`,`size`) VALUES" +
+		" (?,?,?)"
+	const setUpdateCmd = "UPDATE " + tableName + " SET" +
+		" `hash`=?, `size`=?" +
+		" WHERE `path`=?"
+	if db.fileRecordStmts.setInsert, err = db.db.PrepareContext(ctx, setInsertCmd); err != nil {
+		return
+	}
+	if db.fileRecordStmts.setUpdate, err = db.db.PrepareContext(ctx, setUpdateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `path`=?"
+	if db.fileRecordStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT `path`,`hash`,`size` FROM " + tableName
+	if db.fileRecordStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return err
+}
+
+func (db *SqlDB) setupFileRecordsDollarMark(ctx context.Context) (err error) {
+	const tableName = "file_records"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" path VARCHAR(255) NOT NULL," +
+		" hash VARCHAR(255) NOT NULL," +
+		" size INTEGER NOT NULL," +
+		" PRIMARY KEY (path)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT hash,size FROM " + tableName +
+		" WHERE path=$1"
+	if db.fileRecordStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const hasSelectCmd = "SELECT 1 FROM " + tableName +
+		" WHERE path=$1"
+	if db.fileRecordStmts.has, err = db.db.PrepareContext(ctx, hasSelectCmd); err != nil {
+		return
+	}
+
+	const setInsertCmd = "INSERT INTO " + tableName +
+		" (path,hash,size) VALUES" +
+		" ($1,$2,$3)"
+	const setUpdateCmd = "UPDATE " + tableName + " SET" +
+		" hash=$1, size=$2" +
+		" WHERE path=$3"
+	if db.fileRecordStmts.setInsert, err = db.db.PrepareContext(ctx, setInsertCmd); err != nil {
+		return
+	}
+	if db.fileRecordStmts.setUpdate, err = db.db.PrepareContext(ctx, setUpdateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE path=$1"
+	if db.fileRecordStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT path,hash,size FROM " + tableName
+	if db.fileRecordStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return err
+}
+
+func (db *SqlDB) GetFileRecord(path string) (rec *FileRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rec = new(FileRecord)
+	rec.Path = path
+	if err = db.fileRecordStmts.get.QueryRowContext(ctx, &rec.Path).Scan(&rec.Hash, &rec.Size); err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
@@ -289,179 +490,1149 @@ func (db *SqlDB) RemoveJTI(jti string) (err error) {
 	return
 }
 
-func (db *SqlDB) setupFileRecords(ctx context.Context) (err error) {
+func (db *SqlDB) SetFileRecord(rec FileRecord) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = db.fileRecordStmts.setUpdate.ExecContext(ctx, &rec.Hash, &rec.Size, &rec.Path); err != nil {
+		if _, er := db.fileRecordStmts.setInsert.ExecContext(ctx, &rec.Path, &rec.Hash, &rec.Size); er != nil {
+			return errors.Join(err, er)
+		}
+	}
+	return
+}
+
+func (db *SqlDB) RemoveFileRecord(path string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = db.fileRecordStmts.remove.ExecContext(ctx, path); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	return
+}
+
+func (db *SqlDB) ForEachFileRecord(cb func(*FileRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = db.fileRecordStmts.remove.QueryContext(ctx); err != nil {
+		return
+	}
+	defer rows.Close()
+	var rec FileRecord
+	for rows.Next() {
+		if err = rows.Scan(&rec.Path, &rec.Hash, &rec.Size); err != nil {
+			return
+		}
+		cb(&rec)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupFileIndexes(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupFileIndexesQuestionMark(ctx)
+	case "postgres":
+		return db.setupFileIndexesDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupFileIndexesQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`file_indexes`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `hash` VARCHAR(64) NOT NULL," +
+		" `size` BIGINT NOT NULL," +
+		" `mtime` BIGINT NOT NULL," +
+		" `storages` TEXT NOT NULL," +
+		" PRIMARY KEY (`hash`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT `size`,`mtime`,`storages` FROM " + tableName +
+		" WHERE `hash`=?"
+	if db.fileIndexStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const insertCmd = "INSERT INTO " + tableName +
+		" (`hash`,`size`,`mtime`,`storages`) VALUES" +
+		" (?,?,?,?)"
+	var upsertCmd string
+	if db.driverName == "mysql" {
+		upsertCmd = insertCmd + " ON DUPLICATE KEY UPDATE" +
+			" `size`=VALUES(`size`), `mtime`=VALUES(`mtime`), `storages`=VALUES(`storages`)"
+	} else {
+		upsertCmd = insertCmd + " ON CONFLICT (`hash`) DO UPDATE SET" +
+			" `size`=excluded.`size`, `mtime`=excluded.`mtime`, `storages`=excluded.`storages`"
+	}
+	if db.fileIndexStmts.upsert, err = db.db.PrepareContext(ctx, upsertCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `hash`=?"
+	if db.fileIndexStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT `hash`,`size`,`mtime`,`storages` FROM " + tableName
+	if db.fileIndexStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupFileIndexesDollarMark(ctx context.Context) (err error) {
+	const tableName = "file_indexes"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" hash VARCHAR(64) NOT NULL," +
+		" size BIGINT NOT NULL," +
+		" mtime BIGINT NOT NULL," +
+		" storages TEXT NOT NULL," +
+		" PRIMARY KEY (hash)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT size,mtime,storages FROM " + tableName +
+		" WHERE hash=$1"
+	if db.fileIndexStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const upsertCmd = "INSERT INTO " + tableName +
+		" (hash,size,mtime,storages) VALUES" +
+		" ($1,$2,$3,$4)" +
+		" ON CONFLICT (hash) DO UPDATE SET" +
+		" size=EXCLUDED.size, mtime=EXCLUDED.mtime, storages=EXCLUDED.storages"
+	if db.fileIndexStmts.upsert, err = db.db.PrepareContext(ctx, upsertCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE hash=$1"
+	if db.fileIndexStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT hash,size,mtime,storages FROM " + tableName
+	if db.fileIndexStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) GetFileIndex(hash string) (rec *FileIndexRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rec = new(FileIndexRecord)
+	rec.Hash = hash
+	if err = db.fileIndexStmts.get.QueryRowContext(ctx, hash).Scan(&rec.Size, &rec.Mtime, &rec.Storages); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	return
+}
+
+func (db *SqlDB) SetFileIndex(rec FileIndexRecord) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.fileIndexStmts.upsert.ExecContext(ctx, rec.Hash, rec.Size, rec.Mtime, rec.Storages)
+	return
+}
+
+// fileIndexBatchSize is how many records are written in one transaction by SetFileIndexes
+const fileIndexBatchSize = 1000
+
+// SetFileIndexes writes the records in batches, each batch is committed separately,
+// so a large index will not hold a transaction for a long time
+func (db *SqlDB) SetFileIndexes(recs []FileIndexRecord) (err error) {
+	for len(recs) > 0 {
+		n := min(len(recs), fileIndexBatchSize)
+		if err = db.setFileIndexBatch(recs[:n]); err != nil {
+			return
+		}
+		recs = recs[n:]
+	}
+	return
+}
+
+func (db *SqlDB) setFileIndexBatch(recs []FileIndexRecord) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	upsert := tx.StmtContext(ctx, db.fileIndexStmts.upsert)
+	for _, rec := range recs {
+		if _, err = upsert.ExecContext(ctx, rec.Hash, rec.Size, rec.Mtime, rec.Storages); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SqlDB) RemoveFileIndex(hash string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := db.fileIndexStmts.remove.ExecContext(ctx, hash)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) ForEachFileIndex(cb func(*FileIndexRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = db.fileIndexStmts.forEach.QueryContext(ctx); err != nil {
+		return
+	}
+	defer rows.Close()
+	var rec FileIndexRecord
+	for rows.Next() {
+		rec.Storages = nil
+		if err = rows.Scan(&rec.Hash, &rec.Size, &rec.Mtime, &rec.Storages); err != nil {
+			return
+		}
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupUsers(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupUsersQuestionMark(ctx)
+	case "postgres":
+		return db.setupUsersDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupUsersQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`users`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `username` VARCHAR(127) NOT NULL," +
+		" `password` VARCHAR(255) NOT NULL," +
+		" `role` VARCHAR(31) NOT NULL," +
+		" `created_at` BIGINT NOT NULL," +
+		" PRIMARY KEY (`username`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT `password`,`role`,`created_at` FROM " + tableName +
+		" WHERE `username`=?"
+	if db.userStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (`username`,`password`,`role`,`created_at`) VALUES" +
+		" (?,?,?,?)"
+	if db.userStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateCmd = "UPDATE " + tableName + " SET" +
+		" `password`=?, `role`=?" +
+		" WHERE `username`=?"
+	if db.userStmts.update, err = db.db.PrepareContext(ctx, updateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `username`=?"
+	if db.userStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT `username`,`password`,`role`,`created_at` FROM " + tableName
+	if db.userStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupUsersDollarMark(ctx context.Context) (err error) {
+	const tableName = "users"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" username VARCHAR(127) NOT NULL," +
+		" password VARCHAR(255) NOT NULL," +
+		" role VARCHAR(31) NOT NULL," +
+		" created_at BIGINT NOT NULL," +
+		" PRIMARY KEY (username)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT password,role,created_at FROM " + tableName +
+		" WHERE username=$1"
+	if db.userStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (username,password,role,created_at) VALUES" +
+		" ($1,$2,$3,$4)"
+	if db.userStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateCmd = "UPDATE " + tableName + " SET" +
+		" password=$1, role=$2" +
+		" WHERE username=$3"
+	if db.userStmts.update, err = db.db.PrepareContext(ctx, updateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE username=$1"
+	if db.userStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT username,password,role,created_at FROM " + tableName
+	if db.userStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) GetUser(username string) (rec *UserRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rec = new(UserRecord)
+	rec.Username = username
+	var createdAt int64
+	if err = db.userStmts.get.QueryRowContext(ctx, username).Scan(&rec.Password, &rec.Role, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	rec.CreatedAt = time.UnixMilli(createdAt)
+	return
+}
+
+func (db *SqlDB) AddUser(rec UserRecord) (err error) {
+	if _, err = db.GetUser(rec.Username); err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.userStmts.add.ExecContext(ctx, rec.Username, rec.Password, rec.Role, rec.CreatedAt.UnixMilli())
+	return
+}
+
+func (db *SqlDB) UpdateUser(rec UserRecord) (err error) {
+	// RowsAffected is not reliable here, since MySQL does not count the rows that are not changed
+	if _, err = db.GetUser(rec.Username); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.userStmts.update.ExecContext(ctx, rec.Password, rec.Role, rec.Username)
+	return
+}
+
+func (db *SqlDB) RemoveUser(username string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := db.userStmts.remove.ExecContext(ctx, username)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) ForEachUser(cb func(*UserRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = db.userStmts.forEach.QueryContext(ctx); err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		rec       UserRecord
+		createdAt int64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&rec.Username, &rec.Password, &rec.Role, &createdAt); err != nil {
+			return
+		}
+		rec.CreatedAt = time.UnixMilli(createdAt)
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupSecondFactors(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupSecondFactorsQuestionMark(ctx)
+	case "postgres":
+		return db.setupSecondFactorsDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupSecondFactorsQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`second_factors`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `user` VARCHAR(127) NOT NULL," +
+		" `type` VARCHAR(15) NOT NULL," +
+		" `id` VARCHAR(255) NOT NULL," +
+		" `name` VARCHAR(127) NOT NULL," +
+		" `secret` TEXT NOT NULL," +
+		" `enabled` BOOLEAN NOT NULL," +
+		" `counter` BIGINT NOT NULL," +
+		" `created_at` BIGINT NOT NULL," +
+		" PRIMARY KEY (`user`,`type`,`id`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT `name`,`secret`,`enabled`,`counter`,`created_at` FROM " + tableName +
+		" WHERE `user`=? AND `type`=? AND `id`=?"
+	if db.factorStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (`user`,`type`,`id`,`name`,`secret`,`enabled`,`counter`,`created_at`) VALUES" +
+		" (?,?,?,?,?,?,?,?)"
+	if db.factorStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateCmd = "UPDATE " + tableName + " SET" +
+		" `name`=?, `secret`=?, `enabled`=?, `counter`=?" +
+		" WHERE `user`=? AND `type`=? AND `id`=?"
+	if db.factorStmts.update, err = db.db.PrepareContext(ctx, updateCmd); err != nil {
+		return
+	}
+
+	const advanceUpdateCmd = "UPDATE " + tableName + " SET" +
+		" `counter`=?" +
+		" WHERE `user`=? AND `type`=? AND `id`=? AND `counter`<?"
+	if db.factorStmts.advance, err = db.db.PrepareContext(ctx, advanceUpdateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `user`=? AND `type`=? AND `id`=?"
+	if db.factorStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const removeUsersDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `user`=?"
+	if db.factorStmts.removeUsers, err = db.db.PrepareContext(ctx, removeUsersDeleteCmd); err != nil {
+		return
+	}
+
+	const removeUsersOfDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `user`=? AND `type`=?"
+	if db.factorStmts.removeUsersOf, err = db.db.PrepareContext(ctx, removeUsersOfDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachUsersSelectCmd = "SELECT `type`,`id`,`name`,`secret`,`enabled`,`counter`,`created_at` FROM " + tableName +
+		" WHERE `user`=?"
+	if db.factorStmts.forEachUsers, err = db.db.PrepareContext(ctx, forEachUsersSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupSecondFactorsDollarMark(ctx context.Context) (err error) {
+	const tableName = "second_factors"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		` "user" VARCHAR(127) NOT NULL,` +
+		" type VARCHAR(15) NOT NULL," +
+		" id VARCHAR(255) NOT NULL," +
+		" name VARCHAR(127) NOT NULL," +
+		" secret TEXT NOT NULL," +
+		" enabled BOOLEAN NOT NULL," +
+		" counter BIGINT NOT NULL," +
+		" created_at BIGINT NOT NULL," +
+		` PRIMARY KEY ("user",type,id)` +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT name,secret,enabled,counter,created_at FROM " + tableName +
+		` WHERE "user"=$1 AND type=$2 AND id=$3`
+	if db.factorStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		` ("user",type,id,name,secret,enabled,counter,created_at) VALUES` +
+		" ($1,$2,$3,$4,$5,$6,$7,$8)"
+	if db.factorStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateCmd = "UPDATE " + tableName + " SET" +
+		" name=$1, secret=$2, enabled=$3, counter=$4" +
+		` WHERE "user"=$5 AND type=$6 AND id=$7`
+	if db.factorStmts.update, err = db.db.PrepareContext(ctx, updateCmd); err != nil {
+		return
+	}
+
+	const advanceUpdateCmd = "UPDATE " + tableName + " SET" +
+		" counter=$1" +
+		` WHERE "user"=$2 AND type=$3 AND id=$4 AND counter<$1`
+	if db.factorStmts.advance, err = db.db.PrepareContext(ctx, advanceUpdateCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		` WHERE "user"=$1 AND type=$2 AND id=$3`
+	if db.factorStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const removeUsersDeleteCmd = "DELETE FROM " + tableName +
+		` WHERE "user"=$1`
+	if db.factorStmts.removeUsers, err = db.db.PrepareContext(ctx, removeUsersDeleteCmd); err != nil {
+		return
+	}
+
+	const removeUsersOfDeleteCmd = "DELETE FROM " + tableName +
+		` WHERE "user"=$1 AND type=$2`
+	if db.factorStmts.removeUsersOf, err = db.db.PrepareContext(ctx, removeUsersOfDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachUsersSelectCmd = "SELECT type,id,name,secret,enabled,counter,created_at FROM " + tableName +
+		` WHERE "user"=$1`
+	if db.factorStmts.forEachUsers, err = db.db.PrepareContext(ctx, forEachUsersSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) GetSecondFactor(user string, typ string, id string) (rec *SecondFactorRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rec = new(SecondFactorRecord)
+	rec.User = user
+	rec.Type = typ
+	rec.Id = id
+	var createdAt int64
+	if err = db.factorStmts.get.QueryRowContext(ctx, user, typ, id).
+		Scan(&rec.Name, &rec.Secret, &rec.Enabled, &rec.Counter, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	rec.CreatedAt = time.UnixMilli(createdAt)
+	return
+}
+
+func (db *SqlDB) AddSecondFactor(rec SecondFactorRecord) (err error) {
+	if _, err = db.GetSecondFactor(rec.User, rec.Type, rec.Id); err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.factorStmts.add.ExecContext(ctx,
+		rec.User, rec.Type, rec.Id, rec.Name, rec.Secret, rec.Enabled, rec.Counter, rec.CreatedAt.UnixMilli())
+	return
+}
+
+func (db *SqlDB) UpdateSecondFactor(rec SecondFactorRecord) (err error) {
+	if _, err = db.GetSecondFactor(rec.User, rec.Type, rec.Id); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.factorStmts.update.ExecContext(ctx,
+		rec.Name, rec.Secret, rec.Enabled, rec.Counter, rec.User, rec.Type, rec.Id)
+	return
+}
+
+func (db *SqlDB) AdvanceSecondFactorCounter(user string, typ string, id string, counter int64) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var res sql.Result
+	if db.driverName == "postgres" {
+		res, err = db.factorStmts.advance.ExecContext(ctx, counter, user, typ, id)
+	} else {
+		res, err = db.factorStmts.advance.ExecContext(ctx, counter, user, typ, id, counter)
+	}
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) RemoveSecondFactor(user string, typ string, id string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := db.factorStmts.remove.ExecContext(ctx, user, typ, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) RemoveUsersSecondFactors(user string, typ string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if typ == "" {
+		_, err = db.factorStmts.removeUsers.ExecContext(ctx, user)
+	} else {
+		_, err = db.factorStmts.removeUsersOf.ExecContext(ctx, user, typ)
+	}
+	return
+}
+
+func (db *SqlDB) ForEachUsersSecondFactor(user string, cb func(*SecondFactorRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = db.factorStmts.forEachUsers.QueryContext(ctx, user); err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		rec       SecondFactorRecord
+		createdAt int64
+	)
+	rec.User = user
+	for rows.Next() {
+		if err = rows.Scan(&rec.Type, &rec.Id, &rec.Name, &rec.Secret, &rec.Enabled, &rec.Counter, &createdAt); err != nil {
+			return
+		}
+		rec.CreatedAt = time.UnixMilli(createdAt)
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupAPIKeys(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupAPIKeysQuestionMark(ctx)
+	case "postgres":
+		return db.setupAPIKeysDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupAPIKeysQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`api_keys`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `id` VARCHAR(127) NOT NULL," +
+		" `user` VARCHAR(127) NOT NULL," +
+		" `name` VARCHAR(127) NOT NULL," +
+		" `scopes` TEXT NOT NULL," +
+		" `created_at` BIGINT NOT NULL," +
+		" `expires_at` BIGINT NOT NULL," +
+		" `last_used_at` BIGINT NOT NULL," +
+		" PRIMARY KEY (`id`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = "SELECT `user`,`name`,`scopes`,`created_at`,`expires_at`,`last_used_at` FROM " + tableName +
+		" WHERE `id`=?"
+	if db.apiKeyStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (`id`,`user`,`name`,`scopes`,`created_at`,`expires_at`,`last_used_at`) VALUES" +
+		" (?,?,?,?,?,?,?)"
+	if db.apiKeyStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateLastUsedCmd = "UPDATE " + tableName + " SET" +
+		" `last_used_at`=?" +
+		" WHERE `id`=?"
+	if db.apiKeyStmts.updateLastUsed, err = db.db.PrepareContext(ctx, updateLastUsedCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE `id`=?"
+	if db.apiKeyStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = "SELECT `id`,`user`,`name`,`scopes`,`created_at`,`expires_at`,`last_used_at` FROM " + tableName
+	if db.apiKeyStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupAPIKeysDollarMark(ctx context.Context) (err error) {
+	const tableName = "api_keys"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" id VARCHAR(127) NOT NULL," +
+		` "user" VARCHAR(127) NOT NULL,` +
+		" name VARCHAR(127) NOT NULL," +
+		" scopes TEXT NOT NULL," +
+		" created_at BIGINT NOT NULL," +
+		" expires_at BIGINT NOT NULL," +
+		" last_used_at BIGINT NOT NULL," +
+		" PRIMARY KEY (id)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+
+	const getSelectCmd = `SELECT "user",name,scopes,created_at,expires_at,last_used_at FROM ` + tableName +
+		" WHERE id=$1"
+	if db.apiKeyStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		` (id,"user",name,scopes,created_at,expires_at,last_used_at) VALUES` +
+		" ($1,$2,$3,$4,$5,$6,$7)"
+	if db.apiKeyStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const updateLastUsedCmd = "UPDATE " + tableName + " SET" +
+		" last_used_at=$1" +
+		" WHERE id=$2"
+	if db.apiKeyStmts.updateLastUsed, err = db.db.PrepareContext(ctx, updateLastUsedCmd); err != nil {
+		return
+	}
+
+	const removeDeleteCmd = "DELETE FROM " + tableName +
+		" WHERE id=$1"
+	if db.apiKeyStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
+		return
+	}
+
+	const forEachSelectCmd = `SELECT id,"user",name,scopes,created_at,expires_at,last_used_at FROM ` + tableName
+	if db.apiKeyStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+		return
+	}
+	return
+}
+
+// optionalUnixMilli converts a nullable time to the unix milliseconds, 0 means nil
+func optionalUnixMilli(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func optionalTimeFromUnixMilli(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.UnixMilli(ms)
+	return &t
+}
+
+func (db *SqlDB) GetAPIKey(id string) (rec *APIKeyRecord, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rec = new(APIKeyRecord)
+	rec.Id = id
+	var createdAt, expiresAt, lastUsedAt int64
+	if err = db.apiKeyStmts.get.QueryRowContext(ctx, id).
+		Scan(&rec.User, &rec.Name, &rec.Scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return
+	}
+	rec.CreatedAt = time.UnixMilli(createdAt)
+	rec.ExpiresAt = optionalTimeFromUnixMilli(expiresAt)
+	rec.LastUsedAt = optionalTimeFromUnixMilli(lastUsedAt)
+	return
+}
+
+func (db *SqlDB) AddAPIKey(rec APIKeyRecord) (err error) {
+	if _, err = db.GetAPIKey(rec.Id); err == nil {
+		return ErrExists
+	} else if err != ErrNotFound {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.apiKeyStmts.add.ExecContext(ctx,
+		rec.Id, rec.User, rec.Name, rec.Scopes, rec.CreatedAt.UnixMilli(),
+		optionalUnixMilli(rec.ExpiresAt), optionalUnixMilli(rec.LastUsedAt))
+	return
+}
+
+func (db *SqlDB) UpdateAPIKeyLastUsed(id string, lastUsed time.Time) (err error) {
+	if _, err = db.GetAPIKey(id); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.apiKeyStmts.updateLastUsed.ExecContext(ctx, lastUsed.UnixMilli(), id)
+	return
+}
+
+func (db *SqlDB) RemoveAPIKey(id string) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := db.apiKeyStmts.remove.ExecContext(ctx, id)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return
+}
+
+func (db *SqlDB) ForEachAPIKey(cb func(*APIKeyRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = db.apiKeyStmts.forEach.QueryContext(ctx); err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		rec                              APIKeyRecord
+		createdAt, expiresAt, lastUsedAt int64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&rec.Id, &rec.User, &rec.Name, &rec.Scopes, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+			return
+		}
+		rec.CreatedAt = time.UnixMilli(createdAt)
+		rec.ExpiresAt = optionalTimeFromUnixMilli(expiresAt)
+		rec.LastUsedAt = optionalTimeFromUnixMilli(lastUsedAt)
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupAuditRecords(ctx context.Context) (err error) {
 	switch db.driverName {
 	case "sqlite", "mysql":
-		return db.setupFileRecordsQuestionMark(ctx)
+		return db.setupAuditRecordsQuestionMark(ctx)
 	case "postgres":
-		return db.setupFileRecordsDollarMark(ctx)
+		return db.setupAuditRecordsDollarMark(ctx)
 	default:
 		panic("Unknown sql drive " + db.driverName)
 	}
 }
 
-func (db *SqlDB) setupFileRecordsQuestionMark(ctx context.Context) (err error) {
-	const tableName = "`file_records`"
+func (db *SqlDB) setupAuditRecordsQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`audit_logs`"
 
 	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
-		" `path` VARCHAR(255) NOT NULL," +
-		" `hash` VARCHAR(255) NOT NULL," +
-		" `size` INTEGER NOT NULL," +
-		" PRIMARY KEY (`path`)" +
+		" `id` CHAR(36) NOT NULL," +
+		" `created_at` BIGINT NOT NULL," +
+		" `actor` VARCHAR(127) NOT NULL," +
+		" `client_id` VARCHAR(127) NOT NULL," +
+		" `ip` VARCHAR(63) NOT NULL," +
+		" `action` VARCHAR(63) NOT NULL," +
+		" `target` VARCHAR(255) NOT NULL," +
+		" `result` VARCHAR(15) NOT NULL," +
+		" `message` TEXT NOT NULL," +
+		" PRIMARY KEY (`id`)" +
 		")"
 	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
 		return
 	}
+	// the index may already exist
+	db.db.ExecContext(ctx, "CREATE INDEX `audit_logs_created_at` ON "+tableName+" (`created_at`)")
 
-	const getSelectCmd = "SELECT `hash`,`size` FROM " + tableName +
-		" WHERE `path`=?"
-	if db.fileRecordStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
-		return
-	}
-
-	const hasSelectCmd = "SELECT 1 FROM " + tableName +
-		" WHERE `path`=?"
-	if db.fileRecordStmts.has, err = db.db.PrepareContext(ctx, hasSelectCmd); err != nil {
-		return
-	}
-
-	const setInsertCmd = "INSERT INTO " + tableName +
-		" (`path`,`hash`,`size`) VALUES" +
-		" (?,?,?)"
-	const setUpdateCmd = "UPDATE " + tableName + " SET" +
-		" `hash`=?, `size`=?" +
-		" WHERE `path`=?"
-	if db.fileRecordStmts.setInsert, err = db.db.PrepareContext(ctx, setInsertCmd); err != nil {
-		return
-	}
-	if db.fileRecordStmts.setUpdate, err = db.db.PrepareContext(ctx, setUpdateCmd); err != nil {
-		return
-	}
-
-	const removeDeleteCmd = "DELETE FROM " + tableName +
-		" WHERE `path`=?"
-	if db.fileRecordStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
-		return
-	}
-
-	const forEachSelectCmd = "SELECT `path`,`hash`,`size` FROM " + tableName
-	if db.fileRecordStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (`id`,`created_at`,`actor`,`client_id`,`ip`,`action`,`target`,`result`,`message`) VALUES" +
+		" (?,?,?,?,?,?,?,?,?)"
+	if db.auditStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
 		return
 	}
-	return err
+	return
 }
 
-func (db *SqlDB) setupFileRecordsDollarMark(ctx context.Context) (err error) {
-	const tableName = "file_records"
+func (db *SqlDB) setupAuditRecordsDollarMark(ctx context.Context) (err error) {
+	const tableName = "audit_logs"
 
 	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
-		" path VARCHAR(255) NOT NULL," +
-		" hash VARCHAR(255) NOT NULL," +
-		" size INTEGER NOT NULL," +
-		" PRIMARY KEY (path)" +
+		" id CHAR(36) NOT NULL," +
+		" created_at BIGINT NOT NULL," +
+		" actor VARCHAR(127) NOT NULL," +
+		" client_id VARCHAR(127) NOT NULL," +
+		" ip VARCHAR(63) NOT NULL," +
+		" action VARCHAR(63) NOT NULL," +
+		" target VARCHAR(255) NOT NULL," +
+		" result VARCHAR(15) NOT NULL," +
+		" message TEXT NOT NULL," +
+		" PRIMARY KEY (id)" +
 		")"
 	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
 		return
 	}
-
-	const getSelectCmd = "SELECT hash,size FROM " + tableName +
-		" WHERE path=$1"
-	if db.fileRecordStmts.get, err = db.db.PrepareContext(ctx, getSelectCmd); err != nil {
+	if _, err = db.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS audit_logs_created_at ON "+tableName+" (created_at)"); err != nil {
 		return
 	}
 
-	const hasSelectCmd = "SELECT 1 FROM " + tableName +
-		" WHERE path=$1"
-	if db.fileRecordStmts.has, err = db.db.PrepareContext(ctx, hasSelectCmd); err != nil {
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (id,created_at,actor,client_id,ip,action,target,result,message) VALUES" +
+		" ($1,$2,$3,$4,$5,$6,$7,$8,$9)"
+	if db.auditStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
 		return
 	}
+	return
+}
 
-	const setInsertCmd = "INSERT INTO " + tableName +
-		" (path,hash,size) VALUES" +
-		" ($1,$2,$3)"
-	const setUpdateCmd = "UPDATE " + tableName + " SET" +
-		" hash=$1, size=$2" +
-		" WHERE path=$3"
-	if db.fileRecordStmts.setInsert, err = db.db.PrepareContext(ctx, setInsertCmd); err != nil {
-		return
+// auditWhere builds the WHERE clause of the filter, since the queries cannot be prepared
+func (db *SqlDB) auditWhere(filter AuditFilter) (where string, args []any) {
+	dollarMark := db.driverName == "postgres"
+	var conds []string
+	add := func(column string, op string, value any) {
+		args = append(args, value)
+		mark := "?"
+		if dollarMark {
+			mark = "$" + strconv.Itoa(len(args))
+		} else {
+			column = "`" + column + "`"
+		}
+		conds = append(conds, column+op+mark)
 	}
-	if db.fileRecordStmts.setUpdate, err = db.db.PrepareContext(ctx, setUpdateCmd); err != nil {
-		return
+	if filter.Actor != "" {
+		add("actor", "=", filter.Actor)
 	}
-
-	const removeDeleteCmd = "DELETE FROM " + tableName +
-		" WHERE path=$1"
-	if db.fileRecordStmts.remove, err = db.db.PrepareContext(ctx, removeDeleteCmd); err != nil {
-		return
+	if filter.Action != "" {
+		add("action", "=", filter.Action)
 	}
-
-	const forEachSelectCmd = "SELECT path,hash,size FROM " + tableName
-	if db.fileRecordStmts.forEach, err = db.db.PrepareContext(ctx, forEachSelectCmd); err != nil {
-		return
+	if filter.Target != "" {
+		add("target", "=", filter.Target)
 	}
-	return err
+	if filter.Result != "" {
+		add("result", "=", filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at", ">=", filter.Since.UnixMilli())
+	}
+	if !filter.Until.IsZero() {
+		add("created_at", "<", filter.Until.UnixMilli())
+	}
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	return
 }
 
-func (db *SqlDB) GetFileRecord(path string) (rec *FileRecord, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+func (db *SqlDB) auditSelect(filter AuditFilter, suffix string, extraArgs ...any) (cmd string, args []any) {
+	where, args := db.auditWhere(filter)
+	if db.driverName == "postgres" {
+		cmd = "SELECT id,created_at,actor,client_id,ip,action,target,result,message FROM audit_logs"
+	} else {
+		cmd = "SELECT `id`,`created_at`,`actor`,`client_id`,`ip`,`action`,`target`,`result`,`message` FROM `audit_logs`"
+	}
+	return cmd + where + suffix, append(args, extraArgs...)
+}
 
-	rec = new(FileRecord)
-	rec.Path = path
-	if err = db.fileRecordStmts.get.QueryRowContext(ctx, &rec.Path).Scan(&rec.Hash, &rec.Size); err != nil {
-		if err == sql.ErrNoRows {
-			err = ErrNotFound
+func scanAuditRecords(rows *sql.Rows, cb func(*AuditRecord) error) (err error) {
+	defer rows.Close()
+	var (
+		rec       AuditRecord
+		createdAt int64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&rec.Id, &createdAt, &rec.Actor, &rec.ClientId, &rec.IP, &rec.Action, &rec.Target, &rec.Result, &rec.Message); err != nil {
+			return
+		}
+		rec.Time = time.UnixMilli(createdAt)
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
 		}
+	}
+	if err = rows.Err(); err != nil {
 		return
 	}
 	return
 }
 
-func (db *SqlDB) SetFileRecord(rec FileRecord) (err error) {
+func (db *SqlDB) AddAuditRecord(rec AuditRecord) (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	if _, err = db.fileRecordStmts.setUpdate.ExecContext(ctx, &rec.Hash, &rec.Size, &rec.Path); err != nil {
-		if _, er := db.fileRecordStmts.setInsert.ExecContext(ctx, &rec.Path, &rec.Hash, &rec.Size); er != nil {
-			return errors.Join(err, er)
-		}
-	}
+	_, err = db.auditStmts.add.ExecContext(ctx,
+		rec.Id.String(), rec.Time.UnixMilli(), rec.Actor, rec.ClientId, rec.IP,
+		rec.Action, rec.Target, rec.Result, rec.Message)
 	return
 }
 
-func (db *SqlDB) RemoveFileRecord(path string) (err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+func (db *SqlDB) QueryAuditRecords(filter AuditFilter, offset int, limit int) (records []AuditRecord, total int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	if _, err = db.fileRecordStmts.remove.ExecContext(ctx, path); err != nil {
-		if err == sql.ErrNoRows {
-			err = ErrNotFound
-		}
+	where, args := db.auditWhere(filter)
+	countCmd := "SELECT COUNT(*) FROM audit_logs" + where
+	if db.driverName != "postgres" {
+		countCmd = "SELECT COUNT(*) FROM `audit_logs`" + where
+	}
+	if err = db.db.QueryRowContext(ctx, countCmd, args...).Scan(&total); err != nil {
+		return
+	}
+
+	var suffix string
+	if db.driverName == "postgres" {
+		suffix = " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+	} else {
+		suffix = " ORDER BY `created_at` DESC LIMIT ? OFFSET ?"
+	}
+	cmd, args := db.auditSelect(filter, suffix, limit, offset)
+	rows, err := db.db.QueryContext(ctx, cmd, args...)
+	if err != nil {
 		return
 	}
+	records = make([]AuditRecord, 0, min(limit, 64))
+	err = scanAuditRecords(rows, func(rec *AuditRecord) error {
+		records = append(records, *rec)
+		return nil
+	})
 	return
 }
 
-func (db *SqlDB) ForEachFileRecord(cb func(*FileRecord) error) (err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (db *SqlDB) ForEachAuditRecord(filter AuditFilter, cb func(*AuditRecord) error) (err error) {
+	// exporting may take a long time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancel()
 
-	var rows *sql.Rows
-	if rows, err = db.fileRecordStmts.remove.QueryContext(ctx); err != nil {
-		return
-	}
-	defer rows.Close()
-	var rec FileRecord
-	for rows.Next() {
-		if err = rows.Scan(&rec.Path, &rec.Hash, &rec.Size); err != nil {
-			return
-		}
-		cb(&rec)
+	suffix := " ORDER BY `created_at`"
+	if db.driverName == "postgres" {
+		suffix = " ORDER BY created_at"
 	}
-	if err = rows.Err(); err != nil {
+	cmd, args := db.auditSelect(filter, suffix)
+	rows, err := db.db.QueryContext(ctx, cmd, args...)
+	if err != nil {
 		return
 	}
-	return
+	return scanAuditRecords(rows, cb)
 }
 
 func (db *SqlDB) setupSubscribe(ctx context.Context) (err error) {
@@ -1004,11 +2175,13 @@ func (db *SqlDB) setupWebhooksQuestionMark(ctx context.Context) (err error) {
 		" `auth` VARCHAR(255) NOT NULL," +
 		" `scopes` INTEGER NOT NULL," +
 		" `enabled` BOOLEAN NOT NULL," +
+		" `secret` VARCHAR(255) DEFAULT '' NOT NULL," +
 		" PRIMARY KEY (`user`,`id`)" +
 		")"
 	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
 		return
 	}
+	db.db.ExecContext(ctx, "ALTER TABLE "+tableName+" ADD `secret` VARCHAR(255) DEFAULT '' NOT NULL")
 
 	const getSelectCmd = "SELECT `name`,`endpoint`,`auth`,`scopes`,`enabled` FROM " + tableName +
 		" WHERE `user`=? AND `id`=?"
@@ -1017,8 +2190,8 @@ func (db *SqlDB) setupWebhooksQuestionMark(ctx context.Context) (err error) {
 	}
 
 	const addInsertCmd = "INSERT INTO " + tableName +
-		" (`user`,`id`,`endpoint`,`auth`,`scopes`,`enabled`) VALUES" +
-		" (?,?,?,?,?,?)"
+		" (`user`,`id`,`name`,`endpoint`,`auth`,`scopes`,`enabled`,`secret`) VALUES" +
+		" (?,?,?,?,?,?,?,?)"
 	if db.webhookStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
 		return
 	}
@@ -1036,6 +2209,13 @@ func (db *SqlDB) setupWebhooksQuestionMark(ctx context.Context) (err error) {
 		return
 	}
 
+	const updateSecretCmd = "UPDATE " + tableName + " SET" +
+		" `secret`=?" +
+		" WHERE `user`=? AND `id`=?"
+	if db.webhookStmts.updateSecret, err = db.db.PrepareContext(ctx, updateSecretCmd); err != nil {
+		return
+	}
+
 	const updateEnableOnlyCmd = "UPDATE " + tableName + " SET" +
 		" `enabled`=?" +
 		" WHERE `user`=? AND `id`=?"
@@ -1060,7 +2240,7 @@ func (db *SqlDB) setupWebhooksQuestionMark(ctx context.Context) (err error) {
 		return
 	}
 
-	const forEachEnabledSelectCmd = "SELECT `user`,`id`,`name`,`endpoint`,`auth`,`scopes` FROM " + tableName +
+	const forEachEnabledSelectCmd = "SELECT `user`,`id`,`name`,`endpoint`,`auth`,`scopes`,`secret` FROM " + tableName +
 		" WHERE `enabled`=TRUE"
 	if db.webhookStmts.forEachEnabled, err = db.db.PrepareContext(ctx, forEachEnabledSelectCmd); err != nil {
 		return
@@ -1079,11 +2259,15 @@ func (db *SqlDB) setupWebhooksDollarMark(ctx context.Context) (err error) {
 		" auth VARCHAR(255) NOT NULL," +
 		" scopes INTEGER NOT NULL," +
 		" enabled BOOLEAN NOT NULL," +
+		" secret VARCHAR(255) DEFAULT '' NOT NULL," +
 		` PRIMARY KEY ("user",id)` +
 		")"
 	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
 		return
 	}
+	if _, err = db.db.ExecContext(ctx, "ALTER TABLE "+tableName+" ADD COLUMN IF NOT EXISTS secret VARCHAR(255) DEFAULT '' NOT NULL"); err != nil {
+		return
+	}
 
 	const getSelectCmd = "SELECT name,endpoint,auth,scopes,enabled FROM " + tableName +
 		` WHERE "user"=$1 AND id=$2`
@@ -1092,8 +2276,8 @@ func (db *SqlDB) setupWebhooksDollarMark(ctx context.Context) (err error) {
 	}
 
 	const addInsertCmd = "INSERT INTO " + tableName +
-		` ("user",id,endpoint,auth,scopes,enabled) VALUES` +
-		" ($1,$2,$3,$4,$5,$6)"
+		` ("user",id,name,endpoint,auth,scopes,enabled,secret) VALUES` +
+		" ($1,$2,$3,$4,$5,$6,$7,$8)"
 	if db.webhookStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
 		return
 	}
@@ -1111,6 +2295,13 @@ func (db *SqlDB) setupWebhooksDollarMark(ctx context.Context) (err error) {
 		return
 	}
 
+	const updateSecretCmd = "UPDATE " + tableName + " SET" +
+		" secret=$1" +
+		` WHERE "user"=$2 AND id=$3`
+	if db.webhookStmts.updateSecret, err = db.db.PrepareContext(ctx, updateSecretCmd); err != nil {
+		return
+	}
+
 	const updateEnableOnlyCmd = "UPDATE " + tableName + " SET" +
 		" enabled=$1" +
 		` WHERE "user"=$2 AND id=$3`
@@ -1135,7 +2326,7 @@ func (db *SqlDB) setupWebhooksDollarMark(ctx context.Context) (err error) {
 		return
 	}
 
-	const forEachEnabledSelectCmd = `SELECT "user",id,name,endpoint,auth,scopes FROM ` + tableName +
+	const forEachEnabledSelectCmd = `SELECT "user",id,name,endpoint,auth,scopes,secret FROM ` + tableName +
 		" WHERE enabled=TRUE"
 	if db.webhookStmts.forEachEnabled, err = db.db.PrepareContext(ctx, forEachEnabledSelectCmd); err != nil {
 		return
@@ -1166,7 +2357,13 @@ func (db *SqlDB) AddWebhook(rec WebhookRecord) (err error) {
 	if rec.Id, err = uuid.NewV7(); err != nil {
 		return
 	}
-	if _, err = db.webhookStmts.add.ExecContext(ctx, rec.User, hex.EncodeToString(rec.Id[:]), rec.Name, rec.EndPoint, rec.Auth, rec.Scopes, rec.Enabled); err != nil {
+	if rec.Auth == nil {
+		rec.Auth = emptyStrPtr
+	}
+	if rec.Secret == nil {
+		rec.Secret = emptyStrPtr
+	}
+	if _, err = db.webhookStmts.add.ExecContext(ctx, rec.User, hex.EncodeToString(rec.Id[:]), rec.Name, rec.EndPoint, rec.Auth, rec.Scopes, rec.Enabled, rec.Secret); err != nil {
 		return
 	}
 	return
@@ -1185,6 +2382,11 @@ func (db *SqlDB) UpdateWebhook(rec WebhookRecord) (err error) {
 			return
 		}
 	}
+	if rec.Secret != nil {
+		if _, err = db.webhookStmts.updateSecret.ExecContext(ctx, rec.Secret, rec.User, hex.EncodeToString(rec.Id[:])); err != nil {
+			return
+		}
+	}
 	return
 }
 
@@ -1192,7 +2394,7 @@ func (db *SqlDB) UpdateEnableWebhook(user string, id uuid.UUID, enabled bool) (e
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	if _, err = db.webhookStmts.updateExceptAuth.ExecContext(ctx, enabled, user, hex.EncodeToString(id[:])); err != nil {
+	if _, err = db.webhookStmts.updateEnableOnly.ExecContext(ctx, enabled, user, hex.EncodeToString(id[:])); err != nil {
 		return
 	}
 	return
@@ -1267,7 +2469,7 @@ func (db *SqlDB) ForEachEnabledWebhook(cb func(*WebhookRecord) error) (err error
 	defer rows.Close()
 	var rec WebhookRecord
 	for rows.Next() {
-		if err = rows.Scan(&rec.User, &rec.Id, &rec.Name, &rec.EndPoint, &rec.Auth, &rec.Scopes); err != nil {
+		if err = rows.Scan(&rec.User, &rec.Id, &rec.Name, &rec.EndPoint, &rec.Auth, &rec.Scopes, &rec.Secret); err != nil {
 			return
 		}
 		cb(&rec)
@@ -1277,3 +2479,166 @@ func (db *SqlDB) ForEachEnabledWebhook(cb func(*WebhookRecord) error) (err error
 	}
 	return
 }
+
+func (db *SqlDB) setupWebhookDeliveries(ctx context.Context) (err error) {
+	switch db.driverName {
+	case "sqlite", "mysql":
+		return db.setupWebhookDeliveriesQuestionMark(ctx)
+	case "postgres":
+		return db.setupWebhookDeliveriesDollarMark(ctx)
+	default:
+		panic("Unknown sql drive " + db.driverName)
+	}
+}
+
+func (db *SqlDB) setupWebhookDeliveriesQuestionMark(ctx context.Context) (err error) {
+	const tableName = "`webhook_deliveries`"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" `id` CHAR(36) NOT NULL," +
+		" `user` VARCHAR(127) NOT NULL," +
+		" `webhook` CHAR(36) NOT NULL," +
+		" `event` VARCHAR(63) NOT NULL," +
+		" `created_at` BIGINT NOT NULL," +
+		" `attempts` INTEGER NOT NULL," +
+		" `status` INTEGER NOT NULL," +
+		" `latency` BIGINT NOT NULL," +
+		" `error` TEXT NOT NULL," +
+		" PRIMARY KEY (`id`)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+	// the index may already exist
+	db.db.ExecContext(ctx, "CREATE INDEX `webhook_deliveries_created_at` ON "+tableName+" (`created_at`)")
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		" (`id`,`user`,`webhook`,`event`,`created_at`,`attempts`,`status`,`latency`,`error`) VALUES" +
+		" (?,?,?,?,?,?,?,?,?)"
+	if db.deliveryStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const forEachUsersSelectCmd = "SELECT `id`,`webhook`,`event`,`created_at`,`attempts`,`status`,`latency`,`error` FROM " + tableName +
+		" WHERE `user`=? ORDER BY `created_at` DESC"
+	if db.deliveryStmts.forEachUsers, err = db.db.PrepareContext(ctx, forEachUsersSelectCmd); err != nil {
+		return
+	}
+
+	const forEachUsersOfSelectCmd = "SELECT `id`,`webhook`,`event`,`created_at`,`attempts`,`status`,`latency`,`error` FROM " + tableName +
+		" WHERE `user`=? AND `webhook`=? ORDER BY `created_at` DESC"
+	if db.deliveryStmts.forEachUsersOf, err = db.db.PrepareContext(ctx, forEachUsersOfSelectCmd); err != nil {
+		return
+	}
+
+	const removeBeforeCmd = "DELETE FROM " + tableName + " WHERE `created_at`<?"
+	if db.deliveryStmts.removeBefore, err = db.db.PrepareContext(ctx, removeBeforeCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) setupWebhookDeliveriesDollarMark(ctx context.Context) (err error) {
+	const tableName = "webhook_deliveries"
+
+	const createTable = "CREATE TABLE IF NOT EXISTS " + tableName + " (" +
+		" id CHAR(36) NOT NULL," +
+		` "user" VARCHAR(127) NOT NULL,` +
+		" webhook CHAR(36) NOT NULL," +
+		" event VARCHAR(63) NOT NULL," +
+		" created_at BIGINT NOT NULL," +
+		" attempts INTEGER NOT NULL," +
+		" status INTEGER NOT NULL," +
+		" latency BIGINT NOT NULL," +
+		" error TEXT NOT NULL," +
+		" PRIMARY KEY (id)" +
+		")"
+	if _, err = db.db.ExecContext(ctx, createTable); err != nil {
+		return
+	}
+	if _, err = db.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS webhook_deliveries_created_at ON "+tableName+" (created_at)"); err != nil {
+		return
+	}
+
+	const addInsertCmd = "INSERT INTO " + tableName +
+		` (id,"user",webhook,event,created_at,attempts,status,latency,error) VALUES` +
+		" ($1,$2,$3,$4,$5,$6,$7,$8,$9)"
+	if db.deliveryStmts.add, err = db.db.PrepareContext(ctx, addInsertCmd); err != nil {
+		return
+	}
+
+	const forEachUsersSelectCmd = "SELECT id,webhook,event,created_at,attempts,status,latency,error FROM " + tableName +
+		` WHERE "user"=$1 ORDER BY created_at DESC`
+	if db.deliveryStmts.forEachUsers, err = db.db.PrepareContext(ctx, forEachUsersSelectCmd); err != nil {
+		return
+	}
+
+	const forEachUsersOfSelectCmd = "SELECT id,webhook,event,created_at,attempts,status,latency,error FROM " + tableName +
+		` WHERE "user"=$1 AND webhook=$2 ORDER BY created_at DESC`
+	if db.deliveryStmts.forEachUsersOf, err = db.db.PrepareContext(ctx, forEachUsersOfSelectCmd); err != nil {
+		return
+	}
+
+	const removeBeforeCmd = "DELETE FROM " + tableName + " WHERE created_at<$1"
+	if db.deliveryStmts.removeBefore, err = db.db.PrepareContext(ctx, removeBeforeCmd); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) AddWebhookDelivery(rec WebhookDeliveryRecord) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = db.deliveryStmts.add.ExecContext(ctx,
+		rec.Id.String(), rec.User, rec.Webhook.String(), rec.Event, rec.At.UnixMilli(),
+		rec.Attempts, rec.Status, int64(rec.Latency), rec.Error)
+	return
+}
+
+func (db *SqlDB) ForEachUsersWebhookDelivery(user string, webhook uuid.UUID, cb func(*WebhookDeliveryRecord) error) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rows *sql.Rows
+	if webhook == uuid.Nil {
+		rows, err = db.deliveryStmts.forEachUsers.QueryContext(ctx, user)
+	} else {
+		rows, err = db.deliveryStmts.forEachUsersOf.QueryContext(ctx, user, webhook.String())
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		rec       WebhookDeliveryRecord
+		createdAt int64
+		latency   int64
+	)
+	rec.User = user
+	for rows.Next() {
+		if err = rows.Scan(&rec.Id, &rec.Webhook, &rec.Event, &createdAt, &rec.Attempts, &rec.Status, &latency, &rec.Error); err != nil {
+			return
+		}
+		rec.At = time.UnixMilli(createdAt)
+		rec.Latency = (time.Duration)(latency)
+		if err = cb(&rec); err != nil {
+			if err == ErrStopIter {
+				return nil
+			}
+			return
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (db *SqlDB) RemoveWebhookDeliveriesBefore(before time.Time) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = db.deliveryStmts.removeBefore.ExecContext(ctx, before.UnixMilli())
+	return
+}
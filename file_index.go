@@ -0,0 +1,322 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+// storageId returns the configured id of the storage
+func storageId(s storage.Storage) string {
+	if h, ok := s.(*storage.HealthTracker); ok {
+		return h.Id()
+	}
+	return s.String()
+}
+
+func (cr *Cluster) readFileIndex() (index map[string]database.FileIndexRecord, err error) {
+	index = make(map[string]database.FileIndexRecord)
+	err = cr.database.ForEachFileIndex(func(rec *database.FileIndexRecord) error {
+		r := *rec
+		r.Storages = append(database.StorageIds(nil), rec.Storages...)
+		index[r.Hash] = r
+		return nil
+	})
+	return
+}
+
+// LoadFileIndex fills the fileset with the files in the last saved file list that are recorded in the file index,
+// so a warm restart does not have to check every file's existence
+func (cr *Cluster) LoadFileIndex() (count int, err error) {
+	files, err := cr.LoadLastFileList()
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	index, err := cr.readFileIndex()
+	if err != nil {
+		return
+	}
+	ids := make(map[string]struct{}, len(cr.storages))
+	for _, s := range cr.storages {
+		ids[storageId(s)] = struct{}{}
+	}
+	fileset := make(map[string]int64, len(files))
+	for _, f := range files {
+		rec, ok := index[f.Hash]
+		if !ok || rec.Size != f.Size {
+			continue
+		}
+		for _, id := range rec.Storages {
+			if _, ok := ids[id]; ok {
+				fileset[f.Hash] = f.Size
+				break
+			}
+		}
+	}
+	count = len(fileset)
+	if count == 0 {
+		return
+	}
+
+	cr.filesetMux.Lock()
+	for hash, size := range fileset {
+		cr.fileset[hash] = size
+	}
+	cr.filesetMux.Unlock()
+	cr.fileIndexReady.Store(true)
+	return
+}
+
+// checkFilesByIndex finds out the missing files by the file index instead of walking the storages
+func (cr *Cluster) checkFilesByIndex(files []FileInfo) (map[string]*fileInfoWithTargets, error) {
+	index, err := cr.readFileIndex()
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[string]*fileInfoWithTargets)
+	for _, f := range files {
+		if f.Size == 0 {
+			continue
+		}
+		rec, ok := index[f.Hash]
+		for _, s := range cr.storages {
+			if ok && rec.Size == f.Size && rec.Storages.Has(storageId(s)) {
+				continue
+			}
+			info := missing[f.Hash]
+			if info == nil {
+				info = &fileInfoWithTargets{FileInfo: f}
+				missing[f.Hash] = info
+			}
+			info.targets = append(info.targets, s)
+		}
+	}
+	log.Infof("Checked %d files by the file index, %d files are missing", len(files), len(missing))
+	return missing, nil
+}
+
+// updateFileIndexByCheck updates the file index by the result of CheckFiles.
+// The presence of the storages that failed to check will not be changed.
+// If files is the full file list, the records of the files that are not in the list will be removed.
+// It returns how many records are different from the old index
+func (cr *Cluster) updateFileIndexByCheck(
+	files []FileInfo, full bool, missing map[string]*fileInfoWithTargets, failed []storage.Storage,
+) (changed int, err error) {
+	cr.storagePool.fileIndexMux.Lock()
+	defer cr.storagePool.fileIndexMux.Unlock()
+
+	index, err := cr.readFileIndex()
+	if err != nil {
+		return
+	}
+	isFailed := make(map[storage.Storage]bool, len(failed))
+	for _, s := range failed {
+		isFailed[s] = true
+	}
+
+	var records []database.FileIndexRecord
+	for _, f := range files {
+		if f.Size == 0 {
+			continue
+		}
+		old, ok := index[f.Hash]
+		rec := database.FileIndexRecord{
+			Hash:  f.Hash,
+			Size:  f.Size,
+			Mtime: f.Mtime,
+		}
+		if ok && old.Size == f.Size {
+			rec.Storages = old.Storages
+		}
+		var missingTargets []storage.Storage
+		if info := missing[f.Hash]; info != nil {
+			missingTargets = info.targets
+		}
+	STORAGES:
+		for _, s := range cr.storages {
+			if isFailed[s] {
+				continue
+			}
+			id := storageId(s)
+			for _, t := range missingTargets {
+				if t == s {
+					rec.Storages = rec.Storages.Remove(id)
+					continue STORAGES
+				}
+			}
+			rec.Storages = rec.Storages.Add(id)
+		}
+		if ok {
+			if sameFileIndex(old, rec) {
+				// only write the records that are changed, the index may be very large
+				if old.Mtime == rec.Mtime {
+					continue
+				}
+			} else {
+				changed++
+			}
+		}
+		records = append(records, rec)
+	}
+	if len(records) > 0 {
+		if err = cr.database.SetFileIndexes(records); err != nil {
+			return
+		}
+	}
+	if full {
+		if err = cr.pruneFileIndexLocked(files, index); err != nil {
+			return
+		}
+	}
+	if len(failed) == 0 {
+		cr.fileIndexReady.Store(true)
+	}
+	return
+}
+
+// pruneFileIndex removes the storages of the cluster from the records of the files that are not in the full file list,
+// unless another cluster in the group that uses the same storage still needs the file
+func (cr *Cluster) pruneFileIndex(files []FileInfo) (err error) {
+	cr.storagePool.fileIndexMux.Lock()
+	defer cr.storagePool.fileIndexMux.Unlock()
+
+	index, err := cr.readFileIndex()
+	if err != nil {
+		return
+	}
+	return cr.pruneFileIndexLocked(files, index)
+}
+
+func (cr *Cluster) pruneFileIndexLocked(files []FileInfo, index map[string]database.FileIndexRecord) (err error) {
+	inList := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		inList[f.Hash] = struct{}{}
+	}
+	var (
+		updates []database.FileIndexRecord
+		removed int
+	)
+	for hash, rec := range index {
+		if _, ok := inList[hash]; ok {
+			continue
+		}
+		storages := rec.Storages
+		for _, s := range cr.storages {
+			id := storageId(s)
+			// the storages may be shared with the other clusters which still need the file
+			if !cr.group.fileNeededOn(hash, id, cr) {
+				storages = storages.Remove(id)
+			}
+		}
+		if len(storages) == len(rec.Storages) {
+			continue
+		}
+		if len(storages) == 0 {
+			if err = cr.database.RemoveFileIndex(hash); err != nil && err != database.ErrNotFound {
+				return
+			}
+			err = nil
+			removed++
+			continue
+		}
+		rec.Storages = storages
+		updates = append(updates, rec)
+	}
+	if len(updates) > 0 {
+		if err = cr.database.SetFileIndexes(updates); err != nil {
+			return
+		}
+	}
+	if n := removed + len(updates); n > 0 {
+		log.Infof("Removed %d files that are not in the file list from the file index", n)
+	}
+	return
+}
+
+func sameFileIndex(a, b database.FileIndexRecord) bool {
+	if a.Size != b.Size || len(a.Storages) != len(b.Storages) {
+		return false
+	}
+	for _, id := range a.Storages {
+		if !b.Storages.Has(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// markFileStored records that the file was stored into the storages
+func (cr *Cluster) markFileStored(f FileInfo, stored []storage.Storage) {
+	if len(stored) == 0 {
+		return
+	}
+
+	cr.storagePool.fileIndexMux.Lock()
+	defer cr.storagePool.fileIndexMux.Unlock()
+
+	rec := database.FileIndexRecord{
+		Hash:  f.Hash,
+		Size:  f.Size,
+		Mtime: f.Mtime,
+	}
+	if old, err := cr.database.GetFileIndex(f.Hash); err == nil && old.Size == f.Size {
+		rec.Storages = append(rec.Storages, old.Storages...)
+		if rec.Mtime == 0 {
+			rec.Mtime = old.Mtime
+		}
+	}
+	for _, s := range stored {
+		rec.Storages = rec.Storages.Add(storageId(s))
+	}
+	if err := cr.database.SetFileIndex(rec); err != nil {
+		log.Errorf("Cannot update file index for %s: %v", f.Hash, err)
+	}
+}
+
+// markFileRemoved records that the file was removed from the storage
+func (cr *Cluster) markFileRemoved(hash string, s storage.Storage) {
+	cr.storagePool.fileIndexMux.Lock()
+	defer cr.storagePool.fileIndexMux.Unlock()
+
+	old, err := cr.database.GetFileIndex(hash)
+	if err != nil {
+		if err != database.ErrNotFound {
+			log.Errorf("Cannot get file index for %s: %v", hash, err)
+		}
+		return
+	}
+	rec := *old
+	rec.Storages = old.Storages.Remove(storageId(s))
+	if len(rec.Storages) == 0 {
+		err = cr.database.RemoveFileIndex(hash)
+	} else {
+		err = cr.database.SetFileIndex(rec)
+	}
+	if err != nil && err != database.ErrNotFound {
+		log.Errorf("Cannot update file index for %s: %v", hash, err)
+	}
+}
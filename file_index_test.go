@@ -0,0 +1,86 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+func TestPruneFileIndexShared(t *testing.T) {
+	pool := NewStoragePool([]storage.StorageOption{
+		{BasicStorageOption: storage.BasicStorageOption{Id: "shared", Type: storage.StorageLocal}, Data: &storage.LocalStorageOption{CachePath: t.TempDir()}},
+		{BasicStorageOption: storage.BasicStorageOption{Id: "own", Type: storage.StorageLocal}, Data: &storage.LocalStorageOption{CachePath: t.TempDir()}},
+	})
+	_, sharedOnly, _ := pool.Select([]string{"shared"})
+	_, both, _ := pool.Select([]string{"shared", "own"})
+	db := database.NewMemoryDB()
+	g := new(ClusterGroup)
+	newCluster := func(healths []*storage.HealthTracker, fileset map[string]int64) *Cluster {
+		cr := &Cluster{
+			group:       g,
+			database:    db,
+			storagePool: pool,
+			fileset:     fileset,
+		}
+		for _, h := range healths {
+			cr.storages = append(cr.storages, h)
+		}
+		g.clusters = append(g.clusters, cr)
+		return cr
+	}
+	cr := newCluster(both, map[string]int64{"a": 1})
+	newCluster(sharedOnly, map[string]int64{"b": 1})
+
+	db.SetFileIndexes([]database.FileIndexRecord{
+		{Hash: "a", Size: 1, Storages: database.StorageIds{"shared", "own"}},
+		{Hash: "b", Size: 1, Storages: database.StorageIds{"shared", "own"}},
+		{Hash: "c", Size: 1, Storages: database.StorageIds{"shared", "own"}},
+	})
+	if err := cr.pruneFileIndex([]FileInfo{{Hash: "a", Size: 1}}); err != nil {
+		t.Fatalf("pruneFileIndex: %v", err)
+	}
+
+	expects := map[string]database.StorageIds{
+		"a": {"shared", "own"},
+		// the other cluster still needs b in the shared storage
+		"b": {"shared"},
+	}
+	for hash, expect := range expects {
+		rec, err := db.GetFileIndex(hash)
+		if err != nil {
+			t.Fatalf("GetFileIndex %s: %v", hash, err)
+		}
+		if len(rec.Storages) != len(expect) {
+			t.Errorf("%s: expect storages %v, got %v", hash, expect, rec.Storages)
+			continue
+		}
+		for _, id := range expect {
+			if !rec.Storages.Has(id) {
+				t.Errorf("%s: expect storages %v, got %v", hash, expect, rec.Storages)
+			}
+		}
+	}
+	if _, err := db.GetFileIndex("c"); err != database.ErrNotFound {
+		t.Errorf("Expect c is removed from the index, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hamba/avro/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const lastFileListName = "filelist.avro.zst"
+
+func (cr *Cluster) lastFileListPath() string {
+	return filepath.Join(cr.dataDir, lastFileListName)
+}
+
+// LoadLastFileList loads the file list that saved by the last synchronization,
+// so it can be used when the center server is not reachable
+func (cr *Cluster) LoadLastFileList() (files []FileInfo, err error) {
+	fd, err := os.Open(cr.lastFileListPath())
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	zr, err := zstd.NewReader(fd)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	if err = avro.NewDecoderForSchema(fileListSchema, zr).Decode(&files); err != nil {
+		return
+	}
+	return
+}
+
+// SaveLastFileList saves the file list to the data directory.
+// If full is false, the files will be merged into the saved list
+func (cr *Cluster) SaveLastFileList(files []FileInfo, full bool) (err error) {
+	if !full {
+		old, err := cr.LoadLastFileList()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(old) > 0 {
+			index := make(map[string]int, len(old))
+			for i, f := range old {
+				index[f.Path] = i
+			}
+			for _, f := range files {
+				if i, ok := index[f.Path]; ok {
+					old[i] = f
+				} else {
+					index[f.Path] = len(old)
+					old = append(old, f)
+				}
+			}
+			files = old
+		}
+	}
+
+	if err = os.MkdirAll(cr.dataDir, 0755); err != nil {
+		return
+	}
+	fd, err := os.CreateTemp(cr.dataDir, lastFileListName+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := fd.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	zw, err := zstd.NewWriter(fd)
+	if err != nil {
+		fd.Close()
+		return
+	}
+	if err = avro.NewEncoderForSchema(fileListSchema, zw).Encode(files); err != nil {
+		zw.Close()
+		fd.Close()
+		return
+	}
+	if err = zw.Close(); err != nil {
+		fd.Close()
+		return
+	}
+	if err = fd.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmpPath, cr.lastFileListPath())
+}
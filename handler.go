@@ -38,6 +38,7 @@ import (
 	"strings"
 	"time"
 
+	gocache "github.com/LiterMC/go-openbmclapi/cache"
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/limited"
 	"github.com/LiterMC/go-openbmclapi/log"
@@ -115,13 +116,31 @@ func (r *accessRecord) String() string {
 	return buf.String()
 }
 
+// newAPIRateLimitStore creates the store of the API rate limiter by the api-rate-limit.store config
+func (cr *Cluster) newAPIRateLimitStore(typ string) limited.RateLimitStore {
+	switch strings.ToLower(typ) {
+	case "", "mem", "memory", "inmem":
+	case "cache", "redis":
+		if rc, ok := cr.cache.(*gocache.RedisCache); ok {
+			return limited.NewRedisRateLimitStore(rc.Client, "go-openbmclapi:ratelimit:"+cr.clusterId+":")
+		}
+		log.Warnf("api-rate-limit.store is %q but the cache is not redis, the rate limits will not be shared", typ)
+	default:
+		log.Warnf("Unknown api-rate-limit.store %q, using memory", typ)
+	}
+	return limited.NewMemoryRateLimitStore()
+}
+
 func (cr *Cluster) GetHandler() http.Handler {
-	cr.apiRateLimiter = limited.NewAPIRateMiddleWare(RealAddrCtxKey, loggedUserKey)
+	cr.apiRateLimiter = limited.NewAPIRateMiddleWare(RealAddrCtxKey, loggedUserKey, cr.newAPIRateLimitStore(config.RateLimit.Store))
 	cr.apiRateLimiter.SetAnonymousRateLimit(config.RateLimit.Anonymous)
 	cr.apiRateLimiter.SetLoggedRateLimit(config.RateLimit.Logged)
 	cr.handlerAPIv0 = http.StripPrefix("/api/v0", cr.cliIdHandle(cr.initAPIv0()))
 	cr.handlerAPIv1 = http.StripPrefix("/api/v1", cr.cliIdHandle(cr.initAPIv1()))
 	cr.hijackHandler = http.StripPrefix("/bmclapi", cr.hijackProxy)
+	if cr.clientLimiter != nil {
+		cr.hijackHandler = cr.clientLimiter.WrapHandler(cr.hijackHandler)
+	}
 
 	handler := utils.NewHttpMiddleWareHandler(cr)
 	// recover panic and log it
@@ -306,6 +325,7 @@ func (cr *Cluster) getRecordMiddleWare() utils.MiddleWareFunc {
 		}
 		var rec record
 		rec.used = used.Seconds()
+		cr.downloadLatency.Observe(rec.used)
 		rec.bytes = (float64)(srw.Wrote)
 		ua, _, _ = strings.Cut(ua, " ")
 		rec.ua, _, _ = strings.Cut(ua, "/")
@@ -380,6 +400,17 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if cr.clientLimiter != nil {
+			var (
+				done func()
+				ok   bool
+			)
+			if rw, done, ok = cr.clientLimiter.Limit(rw, req); !ok {
+				return
+			}
+			defer done()
+		}
+
 		hash := rawpath[len("/download/"):]
 		if !utils.IsHex(hash) {
 			http.Error(rw, hash+" is not a valid hash", http.StatusNotFound)
@@ -421,7 +452,7 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			http.Error(rw, fmt.Sprintf("measure size %d out of range (0, 200]", n), http.StatusBadRequest)
 			return
 		}
-		if err := cr.storages[0].ServeMeasure(rw, req, n); err != nil {
+		if err := cr.firstAvailableStorage().ServeMeasure(rw, req, n); err != nil {
 			log.Errorf("Could not serve measure %d: %v", n, err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 		}
@@ -440,7 +471,7 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		http.ServeContent(rw, req, "robots.txt", time.Time{}, strings.NewReader(robotTxtContent))
 		return
 	case strings.HasPrefix(rawpath, "/dashboard/"):
-		if !config.Dashboard.Enable {
+		if !currentConfig().Dashboard.Enable {
 			http.NotFound(rw, req)
 			return
 		}
@@ -495,7 +526,13 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 		}
 	}
 	var sto storage.Storage
-	if forEachFromRandomIndexWithPossibility(cr.storageWeights, cr.storageTotalWeight, func(i int) bool {
+	weights, totalWeight, alive := cr.availableStorageWeights()
+	if alive == 0 {
+		err = storage.ErrNotWorking
+	} else if forEachFromRandomIndexWithPossibility(weights, totalWeight, func(i int) bool {
+		if cr.storageHealths[i].State() == storage.HealthDown {
+			return false
+		}
 		sto = cr.storages[i]
 		log.Debugf("[handler]: Checking %s on storage [%d] %s ...", hash, i, sto.String())
 
@@ -531,13 +568,6 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 		} else {
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 		}
-		if err == storage.ErrNotWorking {
-			log.Errorf("All storages are down, exit.")
-			tctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
-			cr.Disable(tctx)
-			cancel()
-			osExit(CodeClientOrEnvionmentError)
-		}
 		return
 	}
 	log.Debug("[handler]: download served successed")
@@ -58,4 +58,44 @@ func printHelp() {
 	fmt.Println()
 	fmt.Println("  upload-webdav")
 	fmt.Println("  \t" + "Upload objects from local storage to webdav storage")
+	fmt.Println()
+	fmt.Println("  sync --dry-run [options ...]")
+	fmt.Println("  \t" + "Show what a file synchronization would do, without downloading or removing any file")
+	fmt.Println()
+	fmt.Println("    Options:")
+	fmt.Println("      " + "--heavy : Check the hash of every file instead of using the file index")
+	fmt.Println("      " + "--json : Output the report in JSON format")
+	fmt.Println("      " + "--verbose | -v : List every missing and orphan file")
+	fmt.Println("      " + "--cluster <id> : Only check the cluster, default is all clusters")
+	fmt.Println()
+	fmt.Println("  verify [options ...]")
+	fmt.Println("  \t" + "Re-hash every file in the storages and compare them with the last known file list, works offline")
+	fmt.Println()
+	fmt.Println("    Options:")
+	fmt.Println("      " + "--repair | -r : Remove corrupted files and re-fetch the corrupted and missing files")
+	fmt.Println("      " + "--quarantine <dir> : Where to move the corrupted files, default is data/quarantine")
+	fmt.Println("      " + "--delete : Delete the corrupted files instead of moving them to the quarantine directory")
+	fmt.Println("      " + "--report <file> : Where to save the JSON report, default is data/verify-report-<time>.json")
+	fmt.Println("      " + "--cluster <id> : Only verify the cluster, default is all clusters. It's required by --report if there are multiple clusters")
+	fmt.Println()
+	fmt.Println("  user <action> [options ...]")
+	fmt.Println("  \t" + "Manage the dashboard users, the users are saved in the database")
+	fmt.Println()
+	fmt.Println("    Actions:")
+	fmt.Println("      " + "list : List all users")
+	fmt.Println("      " + "add <username> [--role <role>] [--password <password>] : Add a user, the default role is viewer")
+	fmt.Println("      " + "set-role <username> <role> : Change the role of a user, the role can be viewer, operator or admin")
+	fmt.Println("      " + "passwd <username> [--password <password>] : Change the password of a user")
+	fmt.Println("      " + "remove <username> : Remove a user")
+	fmt.Println("      " + "reset-mfa <username> : Remove all second factors of a user, use it when the authenticator was lost")
+	fmt.Println("    " + "The password will be read from the standard input if --password is not given")
+	fmt.Println()
+	fmt.Println("  api-key <action> [options ...]")
+	fmt.Println("  \t" + "Manage the long-lived API keys")
+	fmt.Println()
+	fmt.Println("    Actions:")
+	fmt.Println("      " + "list [--user <username>] : List the API keys")
+	fmt.Println("      " + "create <username> <name> --scopes <scope,...> [--expires <duration>] : Create an API key, the duration can be like 720h or 30d")
+	fmt.Println("      " + "revoke <id> : Revoke an API key")
+	fmt.Println("    " + "Available scopes: read-status, read-logs, manage-webhooks, trigger-sync")
 }
@@ -111,11 +111,11 @@ func (h *HjProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Hijack is disabled in the config", http.StatusServiceUnavailable)
 		return
 	}
-	if config.Hijack.RequireAuth {
+	if hijack := &currentConfig().Hijack; hijack.RequireAuth {
 		needAuth := true
 		user, passwd, ok := req.BasicAuth()
 		if ok {
-			for _, u := range config.Hijack.AuthUsers {
+			for _, u := range hijack.AuthUsers {
 				if u.Username == user && utils.ComparePasswd(u.Password, passwd) {
 					needAuth = false
 					return
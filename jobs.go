@@ -0,0 +1,367 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type JobStatus string
+
+const (
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobFailed   JobStatus = "failed"
+	JobCanceled JobStatus = "canceled"
+)
+
+// maxKeptJobs is the maximum number of the finished jobs that will be kept for polling
+const maxKeptJobs = 64
+
+// Job is the snapshot of an administrative task started by the API
+type Job struct {
+	Id     string    `json:"id"`
+	Type   string    `json:"type"`
+	Params Map       `json:"params,omitempty"`
+	User   string    `json:"user"`
+	Status JobStatus `json:"status"`
+	// Total is -1 when the amount of work is unknown yet
+	Progress   int64      `json:"progress"`
+	Total      int64      `json:"total"`
+	Result     any        `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type job struct {
+	mux        sync.RWMutex
+	info       Job
+	progressFn func() (progress, total int64)
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// jobFunc is the body of a job, the returned result will be shown to the client when the job is done
+type jobFunc = func(ctx context.Context, j *job) (result any, err error)
+
+// Snapshot returns a copy of the job's current state
+func (j *job) Snapshot() Job {
+	j.mux.RLock()
+	defer j.mux.RUnlock()
+	info := j.info
+	if j.progressFn != nil && info.Status == JobRunning {
+		info.Progress, info.Total = j.progressFn()
+	}
+	return info
+}
+
+// SetProgress updates the progress of the job
+func (j *job) SetProgress(progress, total int64) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.info.Progress, j.info.Total = progress, total
+}
+
+// SetProgressFunc makes the progress be read from fn until the job is finished
+func (j *job) SetProgressFunc(fn func() (progress, total int64)) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.progressFn = fn
+}
+
+// Cancel interrupts the job, it returns false if the job is already finished
+func (j *job) Cancel() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+	}
+	j.cancel()
+	return true
+}
+
+// Done returns a channel that will be closed after the job is finished
+func (j *job) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *job) finish(result any, err error, canceled bool) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	if j.progressFn != nil {
+		j.info.Progress, j.info.Total = j.progressFn()
+		j.progressFn = nil
+	}
+	now := time.Now()
+	j.info.FinishedAt = &now
+	j.info.Result = result
+	switch {
+	case err == nil:
+		j.info.Status = JobDone
+	case canceled:
+		j.info.Status = JobCanceled
+		j.info.Error = err.Error()
+	default:
+		j.info.Status = JobFailed
+		j.info.Error = err.Error()
+	}
+}
+
+type jobManager struct {
+	mux   sync.RWMutex
+	jobs  map[string]*job
+	order []*job // from old to new
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs: make(map[string]*job),
+	}
+}
+
+// Start runs fn in a new goroutine, the context passed to fn will be canceled when ctx is done or the job is canceled
+func (m *jobManager) Start(ctx context.Context, typ string, user string, params Map, fn jobFunc) (j *job, err error) {
+	j, _, err = m.start(ctx, typ, user, params, fn, false)
+	return
+}
+
+// StartExclusive is same as Start, but it will not start the job if another job with the same type is running.
+// If so, j is nil and running is the running job
+func (m *jobManager) StartExclusive(ctx context.Context, typ string, user string, params Map, fn jobFunc) (j *job, running *job, err error) {
+	return m.start(ctx, typ, user, params, fn, true)
+}
+
+func (m *jobManager) start(ctx context.Context, typ string, user string, params Map, fn jobFunc, exclusive bool) (j *job, running *job, err error) {
+	id, err := utils.GenRandB64(12)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j = &job{
+		info: Job{
+			Id:        id,
+			Type:      typ,
+			Params:    params,
+			User:      user,
+			Status:    JobRunning,
+			Total:     -1,
+			CreatedAt: time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	m.mux.Lock()
+	if exclusive {
+		if running = m.runningLocked(typ); running != nil {
+			m.mux.Unlock()
+			cancel()
+			return nil, running, nil
+		}
+	}
+	m.jobs[id] = j
+	m.order = append(m.order, j)
+	m.pruneLocked()
+	m.mux.Unlock()
+
+	log.Infof("Job %s (%s) started by %q", id, typ, user)
+	go func() {
+		defer close(j.done)
+		defer cancel()
+		var (
+			result any
+			err    error
+		)
+		func() {
+			defer log.RecoverPanic(func(pe any) {
+				err = fmt.Errorf("panic: %v", pe)
+			})
+			result, err = fn(ctx, j)
+		}()
+		canceled := err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled)
+		j.finish(result, err, canceled)
+		if err != nil {
+			if canceled {
+				log.Warnf("Job %s (%s) is canceled", id, typ)
+			} else {
+				log.Errorf("Job %s (%s) failed: %v", id, typ, err)
+			}
+		} else {
+			log.Infof("Job %s (%s) is done", id, typ)
+		}
+	}()
+	return
+}
+
+// pruneLocked removes the oldest finished jobs when there are too many jobs
+func (m *jobManager) pruneLocked() {
+	n := len(m.order) - maxKeptJobs
+	if n <= 0 {
+		return
+	}
+	kept := m.order[:0]
+	for _, j := range m.order {
+		if n > 0 {
+			select {
+			case <-j.done:
+				delete(m.jobs, j.info.Id)
+				n--
+				continue
+			default:
+			}
+		}
+		kept = append(kept, j)
+	}
+	clear(m.order[len(kept):])
+	m.order = kept
+}
+
+// Get returns nil if the job does not exist or was pruned
+func (m *jobManager) Get(id string) *job {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.jobs[id]
+}
+
+// Running returns the first running job with the type, or nil if there is none
+func (m *jobManager) Running(typ string) *job {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.runningLocked(typ)
+}
+
+func (m *jobManager) runningLocked(typ string) *job {
+	for _, j := range m.order {
+		if j.info.Type != typ {
+			continue
+		}
+		select {
+		case <-j.done:
+		default:
+			return j
+		}
+	}
+	return nil
+}
+
+// List returns the snapshots of the jobs, the newest job is the first one
+func (m *jobManager) List() []Job {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	list := make([]Job, len(m.order))
+	for i, j := range m.order {
+		list[len(list)-1-i] = j.Snapshot()
+	}
+	return list
+}
+
+func (cr *Cluster) apiV0Jobs(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	writeJson(rw, http.StatusOK, cr.jobs.List())
+}
+
+func (cr *Cluster) apiV0Job(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	j := cr.jobs.Get(req.URL.Path)
+	if j == nil {
+		writeJson(rw, http.StatusNotFound, Map{
+			"error": "job not found",
+			"id":    req.URL.Path,
+		})
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL.Query().Get("stream") == "1" || strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+			streamJob(rw, req, j)
+			return
+		}
+		writeJson(rw, http.StatusOK, j.Snapshot())
+	case http.MethodDelete:
+		if !j.Cancel() {
+			writeJson(rw, http.StatusConflict, Map{
+				"error": "job is already finished",
+				"job":   j.Snapshot(),
+			})
+			return
+		}
+		writeJson(rw, http.StatusAccepted, j.Snapshot())
+	}
+}
+
+// streamJob sends the job's snapshot as server-sent events every second until the job is finished.
+// The event type is "progress" when the job is running, and "done" for the last event
+func streamJob(rw http.ResponseWriter, req *http.Request, j *job) {
+	rc := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+
+	var last []byte
+	send := func(event string) bool {
+		buf, err := json.Marshal(j.Snapshot())
+		if err != nil {
+			return false
+		}
+		if event == "progress" && string(buf) == string(last) {
+			return true
+		}
+		last = buf
+		if _, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, buf); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	if !send("progress") {
+		return
+	}
+	for {
+		select {
+		case <-j.Done():
+			send("done")
+			return
+		case <-ticker.C:
+			if !send("progress") {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
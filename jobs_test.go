@@ -0,0 +1,87 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+func TestJobStartExclusive(t *testing.T) {
+	m := newJobManager()
+	unblock := make(chan struct{})
+	var started atomic.Int32
+	fn := func(ctx context.Context, j *job) (any, error) {
+		started.Add(1)
+		<-unblock
+		return nil, nil
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mux     sync.Mutex
+		jobs    []*job
+		running []*job
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			j, r, err := m.StartExclusive(context.Background(), "test", "user", nil, fn)
+			if err != nil {
+				t.Errorf("StartExclusive: %v", err)
+				return
+			}
+			mux.Lock()
+			defer mux.Unlock()
+			if j != nil {
+				jobs = append(jobs, j)
+			} else {
+				running = append(running, r)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(jobs) != 1 {
+		t.Fatalf("Expect only one job to be started, got %d", len(jobs))
+	}
+	for _, r := range running {
+		if r != jobs[0] {
+			t.Errorf("Expect the running job to be returned, got %v", r)
+		}
+	}
+	if n := len(m.List()); n != 1 {
+		t.Errorf("Expect 1 job in the list, got %d", n)
+	}
+
+	close(unblock)
+	<-jobs[0].done
+	j, r, err := m.StartExclusive(context.Background(), "test", "user", nil, fn)
+	if err != nil || j == nil || r != nil {
+		t.Fatalf("Expect the job to be started after the last one is done, got %v, %v, %v", j, r, err)
+	}
+	<-j.done
+	if n := started.Load(); n != 2 {
+		t.Errorf("Expect the job function to be called 2 times, got %d", n)
+	}
+}
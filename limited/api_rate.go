@@ -25,7 +25,6 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/LiterMC/go-openbmclapi/log"
@@ -37,166 +36,26 @@ type RateLimit struct {
 	PerHour int64 `json:"per-hour" yaml:"per-hour"`
 }
 
-type limitSet struct {
-	Limit RateLimit
-
-	mux        sync.RWMutex
-	cleanCount int // min clean mask: 0xffff; hour clean mask: 0xff0000
-	accessMin  map[string]*atomic.Int64
-	accessHour map[string]*atomic.Int64
-}
-
-func makeLimitSet() limitSet {
-	return limitSet{
-		cleanCount: 1,
-		accessMin:  make(map[string]*atomic.Int64),
-		accessHour: make(map[string]*atomic.Int64),
-	}
-}
-
-func (s *limitSet) try(id string) (leftHour, leftMin int64, cleanId int) {
-	checkHour, checkMin := s.Limit.PerHour > 0, s.Limit.PerMin > 0
-	if !checkHour {
-		leftHour = -1
-	}
-	if !checkMin {
-		leftMin = -1
-	}
-	if !checkHour && !checkMin {
-		cleanId = -1
-		return
-	}
-
-	var (
-		hour, min *atomic.Int64
-		ok1, ok2  bool
-	)
-
-	s.mux.RLock()
-	cleanId = s.cleanCount
-	if checkHour {
-		hour, ok1 = s.accessHour[id]
-	}
-	if checkMin {
-		min, ok2 = s.accessMin[id]
-	}
-	s.mux.RUnlock()
-
-	if checkHour {
-		if !ok1 {
-			s.mux.Lock()
-			cleanId = s.cleanCount
-			if hour, ok1 = s.accessHour[id]; !ok1 {
-				hour = new(atomic.Int64)
-				s.accessHour[id] = hour
-			}
-			if checkMin {
-				if min, ok2 = s.accessMin[id]; !ok2 {
-					min = new(atomic.Int64)
-					s.accessMin[id] = min
-					ok2 = true
-				}
-			}
-			s.mux.Unlock()
-		}
-		leftHour = s.Limit.PerHour - hour.Add(1)
-		if leftHour < 0 {
-			hour.Add(-1)
-			leftHour = 0
-			cleanId = 0
-			return
-		}
-	}
-
-	if checkMin {
-		if !ok2 {
-			s.mux.Lock()
-			cleanId = s.cleanCount
-			if min, ok2 = s.accessMin[id]; !ok2 {
-				min = new(atomic.Int64)
-				s.accessMin[id] = min
-			}
-			s.mux.Unlock()
-		}
-		leftMin = s.Limit.PerMin - min.Add(1)
-		if leftMin < 0 {
-			hour.Add(-1)
-			min.Add(-1)
-			leftMin = 0
-			cleanId = 0
-			return
-		}
-	}
-	return
-}
-
-func (s *limitSet) release(id string, cleanId int) {
-	if cleanId <= 0 {
-		return
-	}
-	checkHour, checkMin := s.Limit.PerHour > 0, s.Limit.PerMin > 0
-	if !checkHour && !checkMin {
-		return
-	}
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	releaseHour := checkHour && cleanId&0xff0000 == s.cleanCount&0xff0000
-	releaseMin := checkMin && cleanId&0xffff == s.cleanCount&0xffff
-	if releaseHour {
-		if hour, ok := s.accessHour[id]; ok {
-			hour.Add(-1)
-		}
-	}
-	if releaseMin {
-		if min, ok := s.accessMin[id]; ok {
-			min.Add(-1)
-		}
-	}
-}
-
-func (s *limitSet) clean(hour bool) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	s.cleanCount = s.cleanCount&0xff0000 | (s.cleanCount+1)&0xffff
-	clear(s.accessMin)
-	if hour {
-		s.cleanCount = (s.cleanCount+0x10000)&0xff0000 | s.cleanCount&0xffff
-		clear(s.accessHour)
-	}
-}
-
 type APIRateMiddleWare struct {
 	realIPContextKey, loggedContextKey any
 
-	annoySet  limitSet
-	loggedSet limitSet
-
-	cleanTicker *time.Ticker
-	startAt     time.Time
+	mux        sync.RWMutex
+	store      RateLimitStore
+	annoyRate  RateLimit
+	loggedRate RateLimit
 }
 
-func NewAPIRateMiddleWare(realIPContextKey, loggedContextKey any) (a *APIRateMiddleWare) {
-	a = &APIRateMiddleWare{
+// NewAPIRateMiddleWare creates the API rate limiter with the counters kept in the store,
+// nil store means a new MemoryRateLimitStore
+func NewAPIRateMiddleWare(realIPContextKey, loggedContextKey any, store RateLimitStore) (a *APIRateMiddleWare) {
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	return &APIRateMiddleWare{
+		realIPContextKey: realIPContextKey,
 		loggedContextKey: loggedContextKey,
-		annoySet:         makeLimitSet(),
-		loggedSet:        makeLimitSet(),
-		cleanTicker:      time.NewTicker(time.Minute),
-		startAt:          time.Now(),
+		store:            store,
 	}
-	go func() {
-		count := 0
-		for range a.cleanTicker.C {
-			count++
-			ishour := count > 60
-			if ishour {
-				count = 0
-			}
-			a.clean(ishour)
-		}
-		log.Debugf("cleaner exited")
-	}()
-	return
 }
 
 var _ utils.MiddleWare = (*APIRateMiddleWare)(nil)
@@ -219,31 +78,44 @@ func SetSkipRateLimit(req *http.Request) *http.Request {
 }
 
 func (a *APIRateMiddleWare) AnonymousRateLimit() RateLimit {
-	return a.annoySet.Limit
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.annoyRate
 }
 
 func (a *APIRateMiddleWare) SetAnonymousRateLimit(v RateLimit) {
-	a.annoySet.Limit = v
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.annoyRate = v
 }
 
 func (a *APIRateMiddleWare) LoggedRateLimit() RateLimit {
-	return a.loggedSet.Limit
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.loggedRate
 }
 
 func (a *APIRateMiddleWare) SetLoggedRateLimit(v RateLimit) {
-	a.loggedSet.Limit = v
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.loggedRate = v
 }
 
-func (a *APIRateMiddleWare) Destroy() {
-	log.Debugf("API rate limiter destroyed")
-	a.cleanTicker.Stop()
+func (a *APIRateMiddleWare) Store() RateLimitStore {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.store
+}
+
+// SetStore replaces the counter store, the counts in the old store will not be moved
+func (a *APIRateMiddleWare) SetStore(store RateLimitStore) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.store = store
 }
 
-func (a *APIRateMiddleWare) clean(ishour bool) {
-	log.Debugf("Cleaning API rate limiter, ishour=%v", ishour)
-	a.loggedSet.clean(ishour)
-	a.annoySet.clean(ishour)
-	log.Debug("API rate limiter cleaned")
+func (a *APIRateMiddleWare) Destroy() {
+	log.Debugf("API rate limiter destroyed")
 }
 
 func (a *APIRateMiddleWare) ServeMiddle(rw http.ResponseWriter, req *http.Request, next http.Handler) {
@@ -254,44 +126,61 @@ func (a *APIRateMiddleWare) ServeMiddle(rw http.ResponseWriter, req *http.Reques
 	skipPtr := new(bool)
 	ctx = context.WithValue(ctx, RateLimitSkipContextKey, skipPtr)
 
-	var set *limitSet
+	a.mux.RLock()
+	store := a.store
+	var limit RateLimit
 	id, ok := ctx.Value(a.loggedContextKey).(string)
 	if ok {
-		set = &a.loggedSet
+		limit = a.loggedRate
+		id = "logged:" + id
 	} else {
-		id, _ = ctx.Value(a.realIPContextKey).(string)
-		if id == "" {
-			id, _, _ = net.SplitHostPort(req.RemoteAddr)
+		ip, _ := ctx.Value(a.realIPContextKey).(string)
+		if ip == "" {
+			ip, _, _ = net.SplitHostPort(req.RemoteAddr)
 		}
-		set = &a.annoySet
+		limit = a.annoyRate
+		id = "anonymous:" + ip
 	}
-	hourLeft, minLeft, cleanId := set.try(id)
+	a.mux.RUnlock()
+
 	now := time.Now()
-	var retryAfter int
-	if hourLeft == 0 {
-		retryAfter = 3600 - (int)(now.Sub(a.startAt)/time.Second%3600)
-	} else {
-		retryAfter = 60 - (int)(now.Sub(a.startAt)/time.Second%60)
+	res, err := store.Take(ctx, id, limit, now)
+	if err != nil {
+		// do not block the API when the store is unavailable
+		log.Errorf("Cannot check API rate limit for %s: %v", id, err)
+		next.ServeHTTP(rw, req.WithContext(ctx))
+		return
 	}
-	resetAfter := now.Add((time.Duration)(retryAfter) * time.Second).Unix()
-	rw.Header().Set("X-Ratelimit-Limit-Minute", strconv.FormatInt(set.Limit.PerMin, 10))
-	rw.Header().Set("X-Ratelimit-Limit-Hour", strconv.FormatInt(set.Limit.PerHour, 10))
-	rw.Header().Set("X-Ratelimit-Remaining-Minute", strconv.FormatInt(minLeft, 10))
-	rw.Header().Set("X-Ratelimit-Remaining-Hour", strconv.FormatInt(hourLeft, 10))
-	rw.Header().Set("X-Ratelimit-Reset-After", strconv.FormatInt(resetAfter, 10))
-	if cleanId == 0 {
-		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter+1))
+	resetAt := res.ResetAt()
+	rw.Header().Set("X-Ratelimit-Limit-Minute", strconv.FormatInt(limit.PerMin, 10))
+	rw.Header().Set("X-Ratelimit-Limit-Hour", strconv.FormatInt(limit.PerHour, 10))
+	rw.Header().Set("X-Ratelimit-Remaining-Minute", strconv.FormatInt(res.LeftMin, 10))
+	rw.Header().Set("X-Ratelimit-Remaining-Hour", strconv.FormatInt(res.LeftHour, 10))
+	rw.Header().Set("X-Ratelimit-Reset-After", strconv.FormatInt(resetAt.Unix(), 10))
+	if !res.Allowed {
+		retryAfter := (int64)(resetAt.Sub(now)/time.Second) + 1
+		rw.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
 		rw.WriteHeader(http.StatusTooManyRequests)
 		return
 	}
+	if res.LeftMin < 0 && res.LeftHour < 0 {
+		next.ServeHTTP(rw, req.WithContext(ctx))
+		return
+	}
 
 	srw := utils.WrapAsStatusResponseWriter(rw)
 	srw.BeforeWriteHeader(func(status int) {
 		s := status / 100
 		if *skipPtr || s == 3 || s == 1 {
-			rw.Header().Set("X-Ratelimit-Remaining-Minute", strconv.FormatInt(minLeft+1, 10))
-			rw.Header().Set("X-Ratelimit-Remaining-Hour", strconv.FormatInt(hourLeft+1, 10))
-			set.release(id, cleanId)
+			if res.LeftMin >= 0 {
+				rw.Header().Set("X-Ratelimit-Remaining-Minute", strconv.FormatInt(res.LeftMin+1, 10))
+			}
+			if res.LeftHour >= 0 {
+				rw.Header().Set("X-Ratelimit-Remaining-Hour", strconv.FormatInt(res.LeftHour+1, 10))
+			}
+			if err := store.Release(context.WithoutCancel(ctx), id, res); err != nil {
+				log.Errorf("Cannot release API rate limit for %s: %v", id, err)
+			}
 			return
 		}
 	})
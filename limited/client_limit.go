@@ -0,0 +1,285 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ClientLimitOptions struct {
+	// RequestRate is the number of requests per second that a client can make, 0 means no limit.
+	// RequestBurst is the size of the bucket, it should be at least 1
+	RequestRate  float64
+	RequestBurst int
+	// Bandwidth is the bytes per second that a client can download, 0 means no limit.
+	// BandwidthBurst is the bytes that can be sent without waiting after the client is idle
+	Bandwidth      int64
+	BandwidthBurst int64
+	// IPv4Prefix and IPv6Prefix are the prefix lengths that the addresses are grouped by,
+	// e.g. 24 makes every IPv4 /24 subnet share one limit
+	IPv4Prefix int
+	IPv6Prefix int
+	// Allow are the networks that are not limited, Deny are the networks that are refused.
+	// If an address matches both, the longer prefix wins, and deny wins if they are the same length
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// tokenBucket is a token bucket that starts full, the tokens can be negative after reserved
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate, burst float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(burst, b.tokens+rate*elapsed)
+	}
+	b.last = now
+}
+
+type clientBuckets struct {
+	requests tokenBucket
+	bytes    tokenBucket
+	active   int
+}
+
+// ClientLimiter limits the requests and the download bandwidth of each client by token buckets
+type ClientLimiter struct {
+	realIPContextKey any
+
+	mux       sync.Mutex
+	opts      ClientLimitOptions
+	clients   map[netip.Prefix]*clientBuckets
+	lastSweep time.Time
+}
+
+func NewClientLimiter(realIPContextKey any, opts ClientLimitOptions) *ClientLimiter {
+	return &ClientLimiter{
+		realIPContextKey: realIPContextKey,
+		opts:             opts,
+		clients:          make(map[netip.Prefix]*clientBuckets),
+	}
+}
+
+func (l *ClientLimiter) Options() ClientLimitOptions {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.opts
+}
+
+// SetOptions updates the limits, the tokens that the clients already have are kept
+func (l *ClientLimiter) SetOptions(opts ClientLimitOptions) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.opts = opts
+}
+
+func matchLongest(prefixes []netip.Prefix, addr netip.Addr) int {
+	longest := -1
+	for _, p := range prefixes {
+		if p.Bits() > longest && p.Contains(addr) {
+			longest = p.Bits()
+		}
+	}
+	return longest
+}
+
+func (l *ClientLimiter) clientAddr(req *http.Request) (addr netip.Addr, ok bool) {
+	ip, _ := req.Context().Value(l.realIPContextKey).(string)
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		return addr.Unmap(), true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if addr, err = netip.ParseAddr(host); err != nil {
+		return
+	}
+	return addr.Unmap(), true
+}
+
+// sweep removes the clients that are idle long enough to refill their buckets
+func (l *ClientLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	reqBurst, bwBurst := (float64)(l.opts.RequestBurst), (float64)(l.opts.BandwidthBurst)
+	for k, c := range l.clients {
+		if c.active > 0 {
+			continue
+		}
+		c.requests.refill(l.opts.RequestRate, reqBurst, now)
+		c.bytes.refill((float64)(l.opts.Bandwidth), bwBurst, now)
+		if c.requests.tokens >= reqBurst && c.bytes.tokens >= bwBurst {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// Limit checks the client of the request.
+// If the request is refused, the error response will be written and ok will be false.
+// Otherwise the caller must use the returned ResponseWriter, which throttles the response by the client's bandwidth,
+// and call done after the request is handled
+func (l *ClientLimiter) Limit(rw http.ResponseWriter, req *http.Request) (_ http.ResponseWriter, done func(), ok bool) {
+	addr, ok := l.clientAddr(req)
+	if !ok {
+		return rw, func() {}, true
+	}
+	now := time.Now()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	opts := &l.opts
+	allow, deny := matchLongest(opts.Allow, addr), matchLongest(opts.Deny, addr)
+	if deny >= 0 && deny >= allow {
+		http.Error(rw, "403 Forbidden", http.StatusForbidden)
+		return rw, nil, false
+	}
+	if allow >= 0 {
+		return rw, func() {}, true
+	}
+	if opts.RequestRate <= 0 && opts.Bandwidth <= 0 {
+		return rw, func() {}, true
+	}
+
+	bits := opts.IPv4Prefix
+	if addr.Is6() {
+		bits = opts.IPv6Prefix
+	}
+	key, err := addr.Prefix(bits)
+	if err != nil {
+		key = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	l.sweep(now)
+	c, exists := l.clients[key]
+	if !exists {
+		c = new(clientBuckets)
+		l.clients[key] = c
+	}
+
+	if opts.RequestRate > 0 {
+		c.requests.refill(opts.RequestRate, (float64)(opts.RequestBurst), now)
+		if c.requests.tokens < 1 {
+			wait := (1 - c.requests.tokens) / opts.RequestRate
+			rw.Header().Set("Retry-After", strconv.Itoa((int)(math.Ceil(wait))))
+			http.Error(rw, "429 Too Many Requests", http.StatusTooManyRequests)
+			return rw, nil, false
+		}
+		c.requests.tokens--
+	}
+	c.active++
+	done = func() {
+		l.mux.Lock()
+		defer l.mux.Unlock()
+		c.active--
+	}
+	if opts.Bandwidth <= 0 {
+		return rw, done, true
+	}
+	return &throttledResponseWriter{
+		ResponseWriter: rw,
+		ctx:            req.Context(),
+		limiter:        l,
+		client:         c,
+	}, done, true
+}
+
+func (l *ClientLimiter) WrapHandler(next http.Handler) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		rw, done, ok := l.Limit(rw, req)
+		if !ok {
+			return
+		}
+		defer done()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// reserveBytes takes n bytes from the client's bandwidth bucket, and returns how long the caller should wait
+func (l *ClientLimiter) reserveBytes(c *clientBuckets, n int) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	rate := (float64)(l.opts.Bandwidth)
+	if rate <= 0 {
+		return 0
+	}
+	c.bytes.refill(rate, (float64)(l.opts.BandwidthBurst), time.Now())
+	c.bytes.tokens -= (float64)(n)
+	if c.bytes.tokens >= 0 {
+		return 0
+	}
+	return (time.Duration)(-c.bytes.tokens / rate * (float64)(time.Second))
+}
+
+// throttleChunkSize is the max size of each write, so the waits are not too long
+const throttleChunkSize = 16 * 1024
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *ClientLimiter
+	client  *clientBuckets
+}
+
+func (w *throttledResponseWriter) Write(buf []byte) (n int, err error) {
+	for len(buf) > 0 {
+		chunk := buf[:min(len(buf), throttleChunkSize)]
+		if wait := w.limiter.reserveBytes(w.client, len(chunk)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return n, w.ctx.Err()
+			}
+		}
+		var m int
+		m, err = w.ResponseWriter.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		buf = buf[m:]
+	}
+	return
+}
+
+func (w *throttledResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"testing"
+
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+func newClientLimitHandler(opts ClientLimitOptions) http.Handler {
+	l := NewClientLimiter("ip", opts)
+	return l.WrapHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, strings.Repeat("x", 64*1024))
+	}))
+}
+
+func doClientRequest(h http.Handler, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/download/abc", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "ip", ip))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestClientLimiterRequestRate(t *testing.T) {
+	h := newClientLimitHandler(ClientLimitOptions{
+		RequestRate:  0.5,
+		RequestBurst: 2,
+		IPv4Prefix:   24,
+		IPv6Prefix:   64,
+	})
+	for i, ip := range []string{"192.0.2.1", "192.0.2.200"} {
+		if rw := doClientRequest(h, ip); rw.Code != http.StatusOK {
+			t.Fatalf("Request #%d: unexpected status %d", i, rw.Code)
+		}
+	}
+	// the same /24 shares the bucket
+	rw := doClientRequest(h, "192.0.2.3")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", rw.Code)
+	}
+	if got := rw.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Expected Retry-After 2, got %q", got)
+	}
+	if rw := doClientRequest(h, "198.51.100.1"); rw.Code != http.StatusOK {
+		t.Errorf("Expected other networks not to be affected, got %d", rw.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if rw := doClientRequest(h, "2001:db8:1:1::1"); rw.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", rw.Code)
+		}
+	}
+	if rw := doClientRequest(h, "2001:db8:1:1::2"); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the same /64 to be limited, got %d", rw.Code)
+	}
+}
+
+func TestClientLimiterAllowDeny(t *testing.T) {
+	h := newClientLimitHandler(ClientLimitOptions{
+		RequestRate:  0.001,
+		RequestBurst: 1,
+		IPv4Prefix:   32,
+		IPv6Prefix:   64,
+		Allow: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("203.0.113.7/32"),
+		},
+		Deny: []netip.Prefix{
+			netip.MustParsePrefix("10.1.0.0/16"),
+			netip.MustParsePrefix("203.0.113.0/24"),
+		},
+	})
+	for ip, want := range map[string]int{
+		"10.2.3.4":    http.StatusOK,        // allowed
+		"10.1.2.3":    http.StatusForbidden, // the longer deny wins
+		"203.0.113.7": http.StatusOK,        // the longer allow wins
+		"203.0.113.8": http.StatusForbidden,
+	} {
+		for i := 0; i < 3; i++ {
+			if rw := doClientRequest(h, ip); rw.Code != want {
+				t.Errorf("%s: expected status %d, got %d", ip, want, rw.Code)
+				break
+			}
+		}
+	}
+}
+
+func TestClientLimiterBandwidth(t *testing.T) {
+	h := newClientLimitHandler(ClientLimitOptions{
+		Bandwidth:      256 * 1024,
+		BandwidthBurst: 64 * 1024,
+		IPv4Prefix:     32,
+		IPv6Prefix:     64,
+	})
+	start := time.Now()
+	// the first response is sent with the burst, the second one has to wait for 64KiB / 256KiB/s
+	for i := 0; i < 2; i++ {
+		if rw := doClientRequest(h, "192.0.2.1"); rw.Body.Len() != 64*1024 {
+			t.Fatalf("Unexpected body length %d", rw.Body.Len())
+		}
+	}
+	if used := time.Since(start); used < time.Millisecond*200 || used > time.Second {
+		t.Errorf("Expected the responses to take about 250ms, got %v", used)
+	}
+}
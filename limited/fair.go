@@ -0,0 +1,271 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	// fairTick is how often the write rate is distributed
+	fairTick = time.Millisecond * 20
+	// fairIdleReset is how long a connection should be idle to be treated as a new response
+	fairIdleReset = time.Millisecond * 50
+	// fairMaxChunk is the max size that is requested at once by ReadFrom
+	fairMaxChunk = 256 * 1024
+)
+
+type FairShareOptions struct {
+	// MinRate is the bytes per second that every busy connection can write,
+	// it is guaranteed even if the total write rate is exceeded
+	MinRate int
+	// PriorityBytes is the size of the small responses.
+	// The connections that have written less than PriorityBytes since they became busy are served first,
+	// they can use at most half of the write rate
+	PriorityBytes int
+}
+
+// fairFlow is the write state of a connection
+type fairFlow struct {
+	credit   int // the bytes that can be written without waiting
+	granted  int // the bytes that are granted in the current tick
+	burst    int // the bytes written since the flow became busy
+	lastSeen time.Time
+	queued   bool
+	wake     chan struct{}
+}
+
+func newFairFlow() *fairFlow {
+	return &fairFlow{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// take uses the credit of the flow, the scheduler must be locked
+func (f *fairFlow) take(n int) int {
+	m := min(f.credit, n)
+	f.credit -= m
+	f.burst += m
+	f.lastSeen = time.Now()
+	return m
+}
+
+// fairScheduler splits the write rate between the busy connections.
+// Every tick, the rate of the tick is split equally between the waiting connections as their credits,
+// and the remainders are given in round robin.
+// The connections that still have credits do not take part in the split,
+// so the connections that write less than their shares leave the rest to the others
+type fairScheduler struct {
+	opts FairShareOptions
+	rate func() int
+
+	mux     sync.Mutex
+	queue   []*fairFlow
+	round   int
+	running bool
+}
+
+func newFairScheduler(opts FairShareOptions, rate func() int) *fairScheduler {
+	return &fairScheduler{
+		opts: opts,
+		rate: rate,
+	}
+}
+
+// wait blocks until the flow is allowed to write some bytes, the returned count is in (0, n]
+func (s *fairScheduler) wait(f *fairFlow, n int, deadline time.Time) (int, error) {
+	if n <= 0 || s.rate() <= 0 {
+		return n, nil
+	}
+	s.mux.Lock()
+	if time.Since(f.lastSeen) > fairIdleReset {
+		// it's a new response, and the old credit should not be used as a burst
+		f.credit = 0
+		f.burst = 0
+	}
+	if f.credit > 0 {
+		m := f.take(n)
+		s.mux.Unlock()
+		return m, nil
+	}
+	f.queued = true
+	s.queue = append(s.queue, f)
+	if !s.running {
+		s.running = true
+		go s.loop()
+	}
+	s.mux.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-f.wake:
+	case <-timeout:
+		s.mux.Lock()
+		if f.queued {
+			f.queued = false
+			for i, q := range s.queue {
+				if q == f {
+					s.queue = append(s.queue[:i], s.queue[i+1:]...)
+					break
+				}
+			}
+			s.mux.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.mux.Unlock()
+		// the flow was waked before it is removed
+		<-f.wake
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return f.take(n), nil
+}
+
+func (s *fairScheduler) loop() {
+	ticker := time.NewTicker(fairTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.tick() {
+			return
+		}
+	}
+}
+
+// tick grants the write rate of one tick to the queued flows, it returns false if the queue is empty
+func (s *fairScheduler) tick() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	flows := s.queue
+	if len(flows) == 0 {
+		s.running = false
+		return false
+	}
+	for _, f := range flows {
+		f.granted = 0
+	}
+
+	if rate := s.rate(); rate <= 0 {
+		for _, f := range flows {
+			f.granted = math.MaxInt32
+		}
+	} else {
+		budget := max((int)((int64)(rate)*(int64)(fairTick)/(int64)(time.Second)), 1)
+		if s.opts.PriorityBytes > 0 {
+			lane := budget / 2
+			for _, f := range flows {
+				if lane <= 0 {
+					break
+				}
+				if f.burst < s.opts.PriorityBytes {
+					g := min(s.opts.PriorityBytes-f.burst, lane)
+					f.granted += g
+					lane -= g
+					budget -= g
+				}
+			}
+		}
+		share, remain := budget/len(flows), budget%len(flows)
+		// start from a different flow every tick, so the remainders are not always given to the same flows
+		s.round++
+		for i, f := range flows {
+			f.granted += share
+			if (i-s.round%len(flows)+len(flows))%len(flows) < remain {
+				f.granted++
+			}
+		}
+		if minGrant := (int)((int64)(s.opts.MinRate) * (int64)(fairTick) / (int64)(time.Second)); minGrant > 0 {
+			for _, f := range flows {
+				f.granted = max(f.granted, minGrant)
+			}
+		}
+	}
+
+	rest := flows[:0]
+	for _, f := range flows {
+		if f.granted <= 0 {
+			rest = append(rest, f)
+			continue
+		}
+		f.credit += f.granted
+		f.queued = false
+		f.wake <- struct{}{}
+	}
+	clear(flows[len(rest):])
+	s.queue = rest
+	return true
+}
+
+// fairWrite writes buf to w with the rate granted by the scheduler
+func fairWrite(s *fairScheduler, f *fairFlow, w io.Writer, buf []byte, deadline time.Time) (n int, err error) {
+	for n < len(buf) {
+		var m int
+		if m, err = s.wait(f, len(buf)-n, deadline); err != nil {
+			return
+		}
+		m, err = w.Write(buf[n : n+m])
+		n += m
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// fairReadFrom is the zero copy version of fairWrite
+func fairReadFrom(s *fairScheduler, f *fairFlow, rf io.ReaderFrom, src io.Reader, deadline time.Time) (n int64, err error) {
+	lr := &io.LimitedReader{
+		R: src,
+		N: 0,
+	}
+	remain, _ := utils.GetReaderRemainSize(src)
+	for {
+		want := fairMaxChunk
+		if remain > 0 && remain < fairMaxChunk {
+			want = (int)(remain)
+		}
+		var m int
+		if m, err = s.wait(f, want, deadline); err != nil {
+			return
+		}
+		lr.N = (int64)(m)
+		var n0 int64
+		n0, err = rf.ReadFrom(lr)
+		n += n0
+		remain -= n0
+		if err != nil {
+			return
+		}
+		if lr.N > 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"testing"
+
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tickWith queues the flows, and returns the credits granted in one tick
+func tickWith(s *fairScheduler, flows ...*fairFlow) []int {
+	s.running = true // do not start the loop
+	for _, f := range flows {
+		f.queued = true
+		f.credit = 0
+		s.queue = append(s.queue, f)
+	}
+	s.tick()
+	granted := make([]int, len(flows))
+	for i, f := range flows {
+		select {
+		case <-f.wake:
+			granted[i] = f.credit
+		default:
+		}
+	}
+	return granted
+}
+
+func newFlows(n int) []*fairFlow {
+	flows := make([]*fairFlow, n)
+	for i := range flows {
+		flows[i] = newFairFlow()
+		flows[i].burst = 1 << 30
+	}
+	return flows
+}
+
+func TestFairSchedulerShare(t *testing.T) {
+	// 1000 bytes per tick
+	s := newFairScheduler(FairShareOptions{}, func() int { return 50000 })
+
+	flows := newFlows(4)
+	got := tickWith(s, flows...)
+	for i, n := range got {
+		if n != 250 {
+			t.Errorf("Flow %d: expected 250 bytes, got %d", i, n)
+		}
+	}
+
+	// the flow that still has credit leaves the rate to the others
+	got = tickWith(s, flows[0], flows[2], flows[3])
+	total := 0
+	for i, n := range got {
+		if n != 333 && n != 334 {
+			t.Errorf("Flow %d: expected 333 bytes, got %d", i, n)
+		}
+		total += n
+	}
+	if total != 1000 {
+		t.Errorf("Expected 1000 bytes to be granted, got %d", total)
+	}
+}
+
+func TestFairSchedulerPriority(t *testing.T) {
+	s := newFairScheduler(FairShareOptions{PriorityBytes: 400}, func() int { return 50000 })
+
+	flows := newFlows(3)
+	flows[2].burst = 0 // a new response
+	got := tickWith(s, flows...)
+	if got[0] != 200 || got[1] != 200 || got[2] != 600 {
+		t.Errorf("Expected the new response to get the priority lane, got %v", got)
+	}
+
+	// the priority lane can only use half of the rate
+	flows = newFlows(3)
+	flows[1].burst, flows[2].burst = 0, 0
+	got = tickWith(s, flows...)
+	if got[0] < 166 || got[1]+got[2] > 834 {
+		t.Errorf("Expected the other half to be shared with the bulk flow, got %v", got)
+	}
+}
+
+func TestFairSchedulerMinRate(t *testing.T) {
+	// 100 bytes per tick, but each flow should get 50 bytes per tick at least
+	s := newFairScheduler(FairShareOptions{MinRate: 2500}, func() int { return 5000 })
+	got := tickWith(s, newFlows(4)...)
+	for i, n := range got {
+		if n != 50 {
+			t.Errorf("Flow %d: expected 50 bytes, got %d", i, n)
+		}
+	}
+}
+
+func TestLimitedListenerFairShare(t *testing.T) {
+	const (
+		connCount = 4
+		writeRate = 256 * 1024
+		duration  = time.Second
+	)
+
+	imp := newPipeListener()
+	l := NewLimitedListener(imp, connCount, 0, writeRate)
+	defer l.Close()
+	l.SetFairShare(&FairShareOptions{})
+
+	var (
+		wg       sync.WaitGroup
+		received [connCount]atomic.Int64
+	)
+	go func() {
+		for i := 0; i < connCount; i++ {
+			conn, err := imp.Dial()
+			if err != nil {
+				t.Errorf("Dial: %v", err)
+				return
+			}
+			wg.Add(1)
+			go func(i int, conn net.Conn) {
+				defer wg.Done()
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					received[i].Add((int64)(n))
+					if err != nil {
+						return
+					}
+				}
+			}(i, conn)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < connCount; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			conn.SetWriteDeadline(start.Add(duration))
+			// the connections write different sizes, the large writes should not take more than their shares
+			buf := make([]byte, 1024<<(i*2))
+			for {
+				if _, err := conn.Write(buf); err != nil {
+					return
+				}
+			}
+		}(i, conn)
+	}
+	time.Sleep(time.Until(start.Add(duration)))
+	var counts [connCount]int64
+	for i := range received {
+		counts[i] = received[i].Load()
+	}
+	wg.Wait()
+
+	least, most, total := counts[0], counts[0], (int64)(0)
+	for i, n := range counts {
+		t.Logf("Received: <%d> %d", i, n)
+		least = min(least, n)
+		most = max(most, n)
+		total += n
+	}
+	if least <= 0 || (float64)(most)/(float64)(least) > 1.5 {
+		t.Errorf("Expected the connections to get equal shares, got %v", counts)
+	}
+	if rate := (float64)(total) / duration.Seconds(); rate > writeRate*1.5 {
+		t.Errorf("Expected the total rate not to exceed %d, got %.0f", writeRate, rate)
+	}
+}
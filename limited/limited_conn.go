@@ -33,75 +33,115 @@ import (
 
 type RateController struct {
 	*Semaphore
-	readRate     int // bytes per second
+	readRate     atomic.Int64 // bytes per second
 	minReadRate  int
-	writeRate    int // bytes per second
+	writeRate    atomic.Int64 // bytes per second
 	minWriteRate int
 
 	closed       atomic.Bool
 	closeCh      chan struct{}
+	active       atomic.Int64
 	rmux, wmux   sync.Mutex
 	lastRead     time.Time
 	preReadCount int
 	readCount    int
 	lastWrite    time.Time
 	wroteCount   int
+
+	fair atomic.Pointer[fairScheduler]
 }
 
 func NewRateController(maxConn int, readRate, writeRate int) *RateController {
-	return &RateController{
+	l := &RateController{
 		Semaphore:    NewSemaphore(maxConn),
 		closeCh:      make(chan struct{}, 0),
-		readRate:     readRate,
 		minReadRate:  256,
-		writeRate:    writeRate,
 		minWriteRate: 256,
 	}
+	l.readRate.Store((int64)(readRate))
+	l.writeRate.Store((int64)(writeRate))
+	return l
 }
 
 func (l *RateController) ReadRate() int {
-	return l.readRate
+	return (int)(l.readRate.Load())
 }
 
+// SetReadRate is safe to be called while there are active readers
 func (l *RateController) SetReadRate(rate int) {
-	l.readRate = rate
+	l.rmux.Lock()
+	defer l.rmux.Unlock()
+	l.readRate.Store((int64)(rate))
 	if rate > 0 && rate < l.minReadRate {
 		l.minReadRate = rate
 	}
 }
 
 func (l *RateController) MinReadRate() int {
+	l.rmux.Lock()
+	defer l.rmux.Unlock()
 	return l.minReadRate
 }
 
 func (l *RateController) SetMinReadRate(rate int) {
+	l.rmux.Lock()
+	defer l.rmux.Unlock()
 	l.minReadRate = rate
 }
 
 func (l *RateController) WriteRate() int {
-	return l.writeRate
+	return (int)(l.writeRate.Load())
 }
 
+// SetWriteRate is safe to be called while there are active writers
 func (l *RateController) SetWriteRate(rate int) {
-	l.writeRate = rate
+	l.wmux.Lock()
+	defer l.wmux.Unlock()
+	l.writeRate.Store((int64)(rate))
 	if rate > 0 && rate < l.minWriteRate {
 		l.minWriteRate = rate
 	}
 }
 
 func (l *RateController) MinWriteRate() int {
+	l.wmux.Lock()
+	defer l.wmux.Unlock()
 	return l.minWriteRate
 }
 
 func (l *RateController) SetMinWriteRate(rate int) {
+	l.wmux.Lock()
+	defer l.wmux.Unlock()
 	l.minWriteRate = rate
 }
 
+// FairShare returns the options of the fair share mode, nil means it is disabled
+func (l *RateController) FairShare() *FairShareOptions {
+	s := l.fair.Load()
+	if s == nil {
+		return nil
+	}
+	opts := s.opts
+	return &opts
+}
+
+// SetFairShare enables the fair share mode of the writes if opts is not nil.
+// In fair share mode, the write rate is split equally between the busy connections in round robin,
+// instead of first come first served.
+// The connections that are already waiting are not affected
+func (l *RateController) SetFairShare(opts *FairShareOptions) {
+	if opts == nil {
+		l.fair.Store(nil)
+		return
+	}
+	l.fair.Store(newFairScheduler(*opts, l.WriteRate))
+}
+
 func (l *RateController) preRead(n int) int {
 	if n <= 0 {
 		return n
 	}
-	readRate := l.readRate
+	readRate := l.ReadRate()
 	if readRate <= 0 {
 		return n
 	}
@@ -136,7 +176,7 @@ func (l *RateController) preRead(n int) int {
 }
 
 func (l *RateController) afterRead(n int, less int) time.Duration {
-	readRate := l.readRate
+	readRate := l.ReadRate()
 	if readRate <= 0 {
 		return 0
 	}
@@ -179,7 +219,7 @@ func (l *RateController) preWrite(n int) (int, time.Duration) {
 	if n <= 0 {
 		return n, 0
 	}
-	writeRate := l.writeRate
+	writeRate := l.WriteRate()
 	if writeRate <= 0 {
 		return n, 0
 	}
@@ -207,6 +247,16 @@ func (l *RateController) preWrite(n int) (int, time.Duration) {
 	return n, 0
 }
 
+// ActiveCount returns the count of the proxied objects that have not been closed yet
+func (l *RateController) ActiveCount() int64 {
+	return l.active.Load()
+}
+
+func (l *RateController) release() {
+	l.active.Add(-1)
+	l.Release()
+}
+
 // Close will interrupted the incoming operations
 // it will not close or interrupt the proxied connections and its operations
 func (l *RateController) Close() error {
@@ -234,6 +284,7 @@ func (l *RateController) DoWithContext(ctx context.Context, operator func() (net
 		l.Release()
 		return nil, err
 	}
+	l.active.Add(1)
 	conn := &LimitedConn{Conn: c, controller: l}
 	return conn, nil
 }
@@ -247,6 +298,7 @@ func (l *RateController) Do(operator func() (net.Conn, error)) (net.Conn, error)
 		l.Release()
 		return nil, err
 	}
+	l.active.Add(1)
 	conn := &LimitedConn{Conn: c, controller: l}
 	return conn, nil
 }
@@ -260,6 +312,7 @@ func (l *RateController) DoReader(operator func() (io.Reader, error)) (io.ReadCl
 		l.Release()
 		return nil, err
 	}
+	l.active.Add(1)
 	conn := &LimitedReader{Reader: r, controller: l}
 	return conn, nil
 }
@@ -273,6 +326,7 @@ func (l *RateController) DoWriter(operator func() (io.Writer, error)) (io.WriteC
 		l.Release()
 		return nil, err
 	}
+	l.active.Add(1)
 	conn := &LimitedWriter{Writer: w, controller: l}
 	return conn, nil
 }
@@ -307,7 +361,7 @@ func (r *LimitedReader) Read(buf []byte) (n int, err error) {
 
 func (r *LimitedReader) Close() error {
 	if r.closed.CompareAndSwap(false, true) {
-		r.controller.Release()
+		r.controller.release()
 	}
 	if c, ok := r.Reader.(io.Closer); ok {
 		return c.Close()
@@ -321,6 +375,7 @@ type LimitedWriter struct {
 
 	closed     atomic.Bool
 	writeAfter time.Time
+	flow       *fairFlow
 }
 
 var (
@@ -332,6 +387,12 @@ func (w *LimitedWriter) Write(buf []byte) (n int, err error) {
 	if len(buf) == 0 {
 		return w.Writer.Write(buf)
 	}
+	if s := w.controller.fair.Load(); s != nil {
+		if w.flow == nil {
+			w.flow = newFairFlow()
+		}
+		return fairWrite(s, w.flow, w.Writer, buf, time.Time{})
+	}
 	var n0 int
 	for n < len(buf) {
 		if !w.writeAfter.IsZero() {
@@ -368,6 +429,12 @@ func (w *LimitedWriter) ReadFrom(src io.Reader) (n int64, err error) {
 }
 
 func (w *LimitedWriter) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err error) {
+	if s := w.controller.fair.Load(); s != nil {
+		if w.flow == nil {
+			w.flow = newFairFlow()
+		}
+		return fairReadFrom(s, w.flow, rf, src, time.Time{})
+	}
 	lr := &io.LimitedReader{
 		R: src,
 		N: 0,
@@ -381,7 +448,7 @@ func (w *LimitedWriter) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err
 			}
 		}
 		if remain <= 0 {
-			remain = (int64)(w.controller.minWriteRate)
+			remain = (int64)(w.controller.MinWriteRate())
 		}
 		m, dur := w.controller.preWrite((int)(remain))
 		if dur > 0 {
@@ -407,7 +474,7 @@ func (w *LimitedWriter) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err
 
 func (w *LimitedWriter) Close() error {
 	if w.closed.CompareAndSwap(false, true) {
-		w.controller.Release()
+		w.controller.release()
 	}
 	if c, ok := w.Writer.(io.Closer); ok {
 		return c.Close()
@@ -428,6 +495,8 @@ type LimitedConn struct {
 
 	readDeadline  time.Time
 	writeDeadline time.Time
+
+	flow *fairFlow
 }
 
 var (
@@ -466,6 +535,12 @@ func (c *LimitedConn) Write(buf []byte) (n int, err error) {
 	if len(buf) == 0 {
 		return c.Conn.Write(buf)
 	}
+	if s := c.controller.fair.Load(); s != nil {
+		if c.flow == nil {
+			c.flow = newFairFlow()
+		}
+		return fairWrite(s, c.flow, c.Conn, buf, c.writeDeadline)
+	}
 	var n0 int
 	for n < len(buf) {
 		if !c.writeAfter.IsZero() {
@@ -511,6 +586,12 @@ func (c *LimitedConn) ReadFrom(src io.Reader) (n int64, err error) {
 }
 
 func (c *LimitedConn) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err error) {
+	if s := c.controller.fair.Load(); s != nil {
+		if c.flow == nil {
+			c.flow = newFairFlow()
+		}
+		return fairReadFrom(s, c.flow, rf, src, c.writeDeadline)
+	}
 	lr := &io.LimitedReader{
 		R: src,
 		N: 0,
@@ -533,7 +614,7 @@ func (c *LimitedConn) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err er
 			}
 		}
 		if remain <= 0 {
-			remain = (int64)(c.controller.minWriteRate)
+			remain = (int64)(c.controller.MinWriteRate())
 		}
 		m, dur := c.controller.preWrite((int)(remain))
 		if dur > 0 {
@@ -559,7 +640,7 @@ func (c *LimitedConn) readFrom(rf io.ReaderFrom, src io.Reader) (n int64, err er
 
 func (c *LimitedConn) Close() error {
 	if c.closed.CompareAndSwap(false, true) {
-		c.controller.Release()
+		c.controller.release()
 	}
 	return c.Conn.Close()
 }
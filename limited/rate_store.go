@@ -0,0 +1,169 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps the request counters of the API rate limiter.
+// The counters are in fixed minute and hour windows that are aligned to the unix time,
+// so the limiters that share one store report the same state
+type RateLimitStore interface {
+	// Take counts a request of the key in the current windows.
+	// If any of the limits is already reached, the request will not be counted and res.Allowed will be false
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (res RateLimitResult, err error)
+	// Release uncounts a request that was allowed by Take.
+	// It does nothing for the windows that have already passed
+	Release(ctx context.Context, key string, res RateLimitResult) error
+}
+
+// RateLimitResult is the state of the counters after a Take
+type RateLimitResult struct {
+	Allowed bool
+	// LeftMin and LeftHour are the remaining requests in the windows, -1 means not limited
+	LeftMin  int64
+	LeftHour int64
+	// MinWindow and HourWindow are the unix time of the windows divided by the window sizes
+	MinWindow  int64
+	HourWindow int64
+}
+
+func newRateLimitResult(limit RateLimit, now time.Time) RateLimitResult {
+	unix := now.Unix()
+	res := RateLimitResult{
+		LeftMin:    -1,
+		LeftHour:   -1,
+		MinWindow:  unix / 60,
+		HourWindow: unix / 3600,
+	}
+	if limit.PerMin > 0 {
+		res.LeftMin = 0
+	}
+	if limit.PerHour > 0 {
+		res.LeftHour = 0
+	}
+	return res
+}
+
+// setLeft fills the remaining requests by the counts after the request is counted
+func (r *RateLimitResult) setLeft(limit RateLimit, min, hour int64) {
+	if limit.PerMin > 0 {
+		r.LeftMin = max(limit.PerMin-min, 0)
+	}
+	if limit.PerHour > 0 {
+		r.LeftHour = max(limit.PerHour-hour, 0)
+	}
+}
+
+// ResetAt returns the time when the request will be allowed again,
+// or the time when the current minute window ends if the request is allowed
+func (r *RateLimitResult) ResetAt() time.Time {
+	if r.LeftHour == 0 {
+		return time.Unix((r.HourWindow+1)*3600, 0)
+	}
+	return time.Unix((r.MinWindow+1)*60, 0)
+}
+
+type memRateCounter struct {
+	minWin, hourWin int64
+	min, hour       int64
+}
+
+// MemoryRateLimitStore keeps the counters in the process
+type MemoryRateLimitStore struct {
+	mux       sync.Mutex
+	lastClean int64
+	counters  map[string]*memRateCounter
+}
+
+var _ RateLimitStore = (*MemoryRateLimitStore)(nil)
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		counters: make(map[string]*memRateCounter),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (res RateLimitResult, _ error) {
+	res = newRateLimitResult(limit, now)
+	if limit.PerMin <= 0 && limit.PerHour <= 0 {
+		res.Allowed = true
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.lastClean != res.HourWindow {
+		// all counters that are not in the current hour are useless
+		s.lastClean = res.HourWindow
+		for k, c := range s.counters {
+			if c.hourWin != res.HourWindow {
+				delete(s.counters, k)
+			}
+		}
+	}
+	c, ok := s.counters[key]
+	if !ok {
+		c = &memRateCounter{
+			minWin:  res.MinWindow,
+			hourWin: res.HourWindow,
+		}
+		s.counters[key] = c
+	}
+	if c.minWin != res.MinWindow {
+		c.minWin, c.min = res.MinWindow, 0
+	}
+	if c.hourWin != res.HourWindow {
+		c.hourWin, c.hour = res.HourWindow, 0
+	}
+	if (limit.PerHour > 0 && c.hour >= limit.PerHour) || (limit.PerMin > 0 && c.min >= limit.PerMin) {
+		res.setLeft(limit, c.min, c.hour)
+		return
+	}
+	c.min++
+	c.hour++
+	res.setLeft(limit, c.min, c.hour)
+	res.Allowed = true
+	return
+}
+
+func (s *MemoryRateLimitStore) Release(_ context.Context, key string, res RateLimitResult) error {
+	if !res.Allowed {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	c, ok := s.counters[key]
+	if !ok {
+		return nil
+	}
+	if c.minWin == res.MinWindow && c.min > 0 {
+		c.min--
+	}
+	if c.hourWin == res.HourWindow && c.hour > 0 {
+		c.hour--
+	}
+	return nil
+}
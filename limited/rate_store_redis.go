@@ -0,0 +1,123 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateTakeScript checks and increases the counters atomically.
+// KEYS: minute counter, hour counter
+// ARGV: per-minute limit, per-hour limit, minute counter TTL, hour counter TTL
+// returns: allowed (0 or 1), minute count, hour count
+var rateTakeScript = redis.NewScript(`
+local perMin, perHour = tonumber(ARGV[1]), tonumber(ARGV[2])
+local m = tonumber(redis.call('GET', KEYS[1]) or '0')
+local h = tonumber(redis.call('GET', KEYS[2]) or '0')
+if (perMin > 0 and m >= perMin) or (perHour > 0 and h >= perHour) then
+	return {0, m, h}
+end
+if perMin > 0 then
+	m = redis.call('INCR', KEYS[1])
+	if m == 1 then
+		redis.call('EXPIRE', KEYS[1], ARGV[3])
+	end
+end
+if perHour > 0 then
+	h = redis.call('INCR', KEYS[2])
+	if h == 1 then
+		redis.call('EXPIRE', KEYS[2], ARGV[4])
+	end
+end
+return {1, m, h}
+`)
+
+// rateReleaseScript decreases the counters that still exist
+var rateReleaseScript = redis.NewScript(`
+for _, k in ipairs(KEYS) do
+	if tonumber(redis.call('GET', k) or '0') > 0 then
+		redis.call('DECR', k)
+	end
+end
+return 0
+`)
+
+// RedisRateLimitStore keeps the counters in redis, so the replicas that use the same redis share the limits.
+// The counters of one key are in the same hash slot, so it works with redis cluster as well
+type RedisRateLimitStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+var _ RateLimitStore = (*RedisRateLimitStore)(nil)
+
+func NewRedisRateLimitStore(client redis.Scripter, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *RedisRateLimitStore) keys(key string, res RateLimitResult) []string {
+	k := s.prefix + "{" + key + "}"
+	return []string{
+		k + ":m:" + strconv.FormatInt(res.MinWindow, 10),
+		k + ":h:" + strconv.FormatInt(res.HourWindow, 10),
+	}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (res RateLimitResult, err error) {
+	res = newRateLimitResult(limit, now)
+	if limit.PerMin <= 0 && limit.PerHour <= 0 {
+		res.Allowed = true
+		return
+	}
+	// keep the counters a little longer than the windows, so the clock skew between the replicas will not reset them
+	vals, err := rateTakeScript.Run(ctx, s.client, s.keys(key, res),
+		limit.PerMin, limit.PerHour, 60+10, 3600+10).Int64Slice()
+	if err != nil {
+		return
+	}
+	if len(vals) != 3 {
+		err = fmt.Errorf("Unexpected rate limit script result %v", vals)
+		return
+	}
+	res.Allowed = vals[0] == 1
+	res.setLeft(limit, vals[1], vals[2])
+	return
+}
+
+func (s *RedisRateLimitStore) Release(ctx context.Context, key string, res RateLimitResult) error {
+	if !res.Allowed || (res.LeftMin < 0 && res.LeftHour < 0) {
+		return nil
+	}
+	keys := s.keys(key, res)
+	if res.LeftHour < 0 {
+		keys = keys[:1]
+	} else if res.LeftMin < 0 {
+		keys = keys[1:]
+	}
+	return rateReleaseScript.Run(ctx, s.client, keys).Err()
+}
@@ -0,0 +1,123 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package limited
+
+import (
+	"testing"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	ctx := context.Background()
+	limit := RateLimit{PerMin: 2, PerHour: 3}
+	now := time.Unix(3600*100+10, 0)
+
+	for i, want := range []bool{true, true, false} {
+		res, err := s.Take(ctx, "a", limit, now)
+		if err != nil {
+			t.Fatalf("Take: %v", err)
+		}
+		if res.Allowed != want {
+			t.Fatalf("Take #%d: expected allowed=%v, got %v", i, want, res.Allowed)
+		}
+	}
+	if res, _ := s.Take(ctx, "b", limit, now); !res.Allowed || res.LeftMin != 1 || res.LeftHour != 2 {
+		t.Errorf("Expected the keys to be counted separately, got %+v", res)
+	}
+
+	// the next minute only has one request left in the hour
+	now = now.Add(time.Minute)
+	res, _ := s.Take(ctx, "a", limit, now)
+	if !res.Allowed || res.LeftMin != 1 || res.LeftHour != 0 {
+		t.Fatalf("Unexpected result in the next minute: %+v", res)
+	}
+	if got := res.ResetAt(); !got.Equal(time.Unix(3600*101, 0)) {
+		t.Errorf("Expected to reset at the next hour, got %v", got)
+	}
+	if err := s.Release(ctx, "a", res); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if res, _ := s.Take(ctx, "a", limit, now); !res.Allowed {
+		t.Errorf("Expected the released request to be available again")
+	}
+	if res, _ := s.Take(ctx, "a", limit, now); res.Allowed {
+		t.Errorf("Expected the hour limit to be reached")
+	}
+
+	now = now.Add(time.Hour)
+	if res, _ := s.Take(ctx, "a", limit, now); !res.Allowed || res.LeftHour != 2 {
+		t.Errorf("Expected the counters to be reset in the next hour, got %+v", res)
+	}
+}
+
+func TestAPIRateMiddleWareSharedStore(t *testing.T) {
+	const ipKey = "ip"
+	store := NewMemoryRateLimitStore()
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/redirect" {
+			rw.WriteHeader(http.StatusFound)
+		}
+	})
+	// two replicas that share the store
+	replicas := make([]http.Handler, 2)
+	for i := range replicas {
+		a := NewAPIRateMiddleWare(ipKey, "user", store)
+		a.SetAnonymousRateLimit(RateLimit{PerMin: 3, PerHour: 100})
+		replicas[i] = a.WrapHandler(handler)
+	}
+	do := func(i int, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), ipKey, "192.0.2.1"))
+		rw := httptest.NewRecorder()
+		replicas[i].ServeHTTP(rw, req)
+		return rw
+	}
+
+	for i, want := range []string{"2", "1"} {
+		rw := do(i, "/")
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Request #%d: unexpected status %d", i, rw.Code)
+		}
+		if got := rw.Header().Get("X-Ratelimit-Remaining-Minute"); got != want {
+			t.Errorf("Request #%d: expected %s remaining, got %s", i, want, got)
+		}
+	}
+	// redirects are not counted
+	if rw := do(0, "/redirect"); rw.Header().Get("X-Ratelimit-Remaining-Minute") != "1" {
+		t.Errorf("Expected the redirect not to be counted, got %s", rw.Header().Get("X-Ratelimit-Remaining-Minute"))
+	}
+	if rw := do(1, "/"); rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", rw.Code)
+	}
+	rw := do(0, "/")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", rw.Code)
+	}
+	retry, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	if err != nil || retry <= 0 || retry > 61 {
+		t.Errorf("Unexpected Retry-After %q", rw.Header().Get("Retry-After"))
+	}
+}
@@ -42,8 +42,8 @@ import (
 
 	"runtime/pprof"
 
-	doh "github.com/libp2p/go-doh-resolver"
-
+	gocache "github.com/LiterMC/go-openbmclapi/cache"
+	"github.com/LiterMC/go-openbmclapi/certmgr"
 	"github.com/LiterMC/go-openbmclapi/database"
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/lang"
@@ -90,6 +90,18 @@ func parseArgs() {
 		case "upload-webdav":
 			cmdUploadWebdav(os.Args[2:])
 			os.Exit(0)
+		case "sync":
+			cmdSync(os.Args[2:])
+			os.Exit(0)
+		case "verify":
+			cmdVerify(os.Args[2:])
+			os.Exit(0)
+		case "user":
+			cmdUser(os.Args[2:])
+			os.Exit(0)
+		case "api-key":
+			cmdAPIKey(os.Args[2:])
+			os.Exit(0)
 		default:
 			fmt.Println("Unknown sub command:", subcmd)
 			printHelp()
@@ -151,6 +163,8 @@ START:
 	ctx, cancel := context.WithCancel(context.Background())
 
 	config = readConfig()
+	// the reloaded fields are already in the new config
+	liveConfig.Store(nil)
 	if config.Advanced.DebugLog {
 		log.SetLevel(log.LevelDebug)
 	} else {
@@ -166,9 +180,11 @@ START:
 
 	log.Infof(Tr("program.starting"), build.ClusterVersion, build.BuildVersion)
 
-	if config.ClusterId == defaultConfig.ClusterId || config.ClusterSecret == defaultConfig.ClusterSecret {
-		log.Error(Tr("error.set.cluster.id"))
-		osExit(CodeClientError)
+	for _, item := range config.clusterItems() {
+		if item.Id == defaultConfig.ClusterId || item.Secret == defaultConfig.ClusterSecret {
+			log.Error(Tr("error.set.cluster.id"))
+			osExit(CodeClientError)
+		}
 	}
 
 	r.InitCluster(ctx)
@@ -176,15 +192,20 @@ START:
 	go func(ctx context.Context) {
 		defer log.RecordPanic()
 
-		if !r.cluster.Connect(ctx) {
-			osExit(CodeClientOrServerError)
+		for _, cr := range r.group.Clusters() {
+			if !cr.Connect(ctx) {
+				osExit(CodeClientOrServerError)
+			}
 		}
 
 		firstSyncDone := make(chan struct{}, 0)
 		go func() {
 			defer log.RecordPanic()
 			defer close(firstSyncDone)
-			r.InitSynchronizer(ctx)
+			// the storages are shared, so do the first synchronization one by one
+			for _, cr := range r.group.Clusters() {
+				r.InitSynchronizer(ctx, cr)
+			}
 		}()
 
 		listener := r.CreateHTTPServerListener(ctx)
@@ -212,6 +233,12 @@ START:
 				}
 			}
 		}
+		if clusters := r.group.Clusters(); len(clusters) > 1 {
+			log.Infof("Hosting %d clusters:", len(clusters))
+			for _, cr := range clusters {
+				log.Infof("\t- %s (%s)", cr.clusterId, net.JoinHostPort(cr.host, strconv.Itoa((int)(cr.publicPort))))
+			}
+		}
 
 		log.Info(Tr("info.wait.first.sync"))
 		select {
@@ -233,10 +260,13 @@ START:
 type Runner struct {
 	restartFlag bool
 
+	// cluster is the primary cluster of the group
 	cluster    *Cluster
+	group      *ClusterGroup
 	clusterSvr *http.Server
 
 	tlsConfig   *tls.Config
+	acmeManager *certmgr.Manager
 	listener    net.Listener
 	publicHosts []string
 
@@ -254,7 +284,11 @@ func (r *Runner) getCertCount() int {
 	if r.tlsConfig == nil {
 		return 0
 	}
-	return len(r.tlsConfig.Certificates)
+	count := len(r.tlsConfig.Certificates)
+	if r.acmeManager != nil {
+		count++
+	}
+	return count
 }
 
 func (r *Runner) DoSignals(cancel context.CancelFunc) int {
@@ -305,6 +339,13 @@ func (r *Runner) DoSignals(cancel context.CancelFunc) int {
 				}
 				continue
 			}
+			if s == syscall.SIGHUP {
+				res := r.group.ReloadConfig()
+				if res.Error != "" || len(res.NeedRestart) == 0 {
+					continue
+				}
+				log.Warn("Restarting to apply the config changes")
+			}
 
 			cancel()
 			shutCtx, cancelShut := context.WithTimeout(context.Background(), time.Second*15)
@@ -313,7 +354,7 @@ func (r *Runner) DoSignals(cancel context.CancelFunc) int {
 			go func() {
 				defer close(shutExit)
 				defer cancelShut()
-				r.cluster.Disable(shutCtx)
+				r.group.Disable(shutCtx)
 				log.Warn(Tr("warn.httpserver.closing"))
 				r.clusterSvr.Shutdown(shutCtx)
 			}()
@@ -336,23 +377,29 @@ func (r *Runner) DoSignals(cancel context.CancelFunc) int {
 }
 
 func (r *Runner) InitCluster(ctx context.Context) {
-	var (
-		dialer *net.Dialer
-		cache  = config.Cache.newCache()
-	)
-
-	_ = doh.NewResolver // TODO: use doh resolver
+	cache := config.Cache.newCache()
+	if hc, ok := cache.(gocache.HealthChecker); ok {
+		if err := hc.Ping(ctx); err != nil {
+			log.Errorf("Cache is unavailable: %v", err)
+		}
+		gocache.StartHealthCheck(ctx, hc, time.Second*30)
+	}
+	dialers, err := newConfiguredDialers()
+	if err != nil {
+		log.Errorf("Cannot create outbound dialers: %v", err)
+		osExit(CodeClientError)
+	}
 
-	r.cluster = NewCluster(ctx,
+	r.group = NewClusterGroup(ctx,
 		ClusterServerURL,
 		baseDir,
-		config.PublicHost, r.getPublicPort(),
-		config.ClusterId, config.ClusterSecret,
-		config.Byoc, dialer,
+		config.clusterItems(),
+		config.Byoc, dialers,
 		config.Storages,
 		cache,
 	)
-	if err := r.cluster.Init(ctx); err != nil {
+	r.cluster = r.group.Primary()
+	if err := r.group.Init(ctx); err != nil {
 		log.Errorf(Tr("error.init.failed"), err)
 		osExit(CodeClientError)
 	}
@@ -361,7 +408,7 @@ func (r *Runner) InitCluster(ctx context.Context) {
 		Addr:        fmt.Sprintf("%s:%d", "0.0.0.0", config.Port),
 		ReadTimeout: 10 * time.Second,
 		IdleTimeout: 5 * time.Second,
-		Handler:     r.cluster.GetHandler(),
+		Handler:     r.group.GetHandler(),
 		ErrorLog:    log.ProxiedStdLog,
 	}
 }
@@ -398,9 +445,15 @@ func (r *Runner) UpdateFileRecords(files []FileInfo, oldfileset map[string]int64
 	log.Info("All file records are updated")
 }
 
-func (r *Runner) InitSynchronizer(ctx context.Context) {
+func (r *Runner) InitSynchronizer(ctx context.Context, cr *Cluster) {
+	if n, err := cr.LoadFileIndex(); err != nil {
+		log.Errorf("Cannot load file index: %v", err)
+	} else if n > 0 {
+		log.Infof("Loaded %d files from the file index", n)
+	}
+
 	log.Info(Tr("info.filelist.fetching"))
-	fl, err := r.cluster.GetFileList(ctx, 0)
+	fl, err := cr.GetFileList(ctx, 0)
 	if err != nil {
 		log.Errorf(Tr("error.filelist.fetch.failed"), err)
 		if errors.Is(err, context.Canceled) {
@@ -409,6 +462,8 @@ func (r *Runner) InitSynchronizer(ctx context.Context) {
 		if !config.Advanced.SkipFirstSync {
 			osExit(CodeClientOrServerError)
 		}
+	} else if err := cr.SaveLastFileList(fl, true); err != nil {
+		log.Errorf("Cannot save file list: %v", err)
 	}
 
 	checkCount := -1
@@ -419,16 +474,24 @@ func (r *Runner) InitSynchronizer(ctx context.Context) {
 	}
 
 	if !config.Advanced.SkipFirstSync {
-		if !r.cluster.SyncFiles(ctx, fl, false) {
+		if !cr.SyncFiles(ctx, fl, true, false) {
 			return
 		}
 		go r.UpdateFileRecords(fl, nil)
 
 		if !config.Advanced.NoGC {
-			go r.cluster.Gc()
+			go cr.Gc()
 		}
 	} else if fl != nil {
-		if err := r.cluster.SetFilesetByExists(ctx, fl); err != nil {
+		if cr.fileIndexReady.Load() {
+			// the fileset is already loaded from the file index, verify it in background
+			go func() {
+				defer log.RecoverPanic(nil)
+				if err := cr.SetFilesetByExists(ctx, fl); err != nil {
+					log.Errorf("Cannot verify the file index: %v", err)
+				}
+			}()
+		} else if err := cr.SetFilesetByExists(ctx, fl); err != nil {
 			return
 		}
 	}
@@ -442,7 +505,7 @@ func (r *Runner) InitSynchronizer(ctx context.Context) {
 
 	createInterval(ctx, func() {
 		log.Info(Tr("info.filelist.fetching"))
-		fl, err := r.cluster.GetFileList(ctx, lastMod)
+		fl, err := cr.GetFileList(ctx, lastMod)
 		if err != nil {
 			log.Errorf(Tr("error.filelist.fetch.failed"), err)
 			return
@@ -456,13 +519,16 @@ func (r *Runner) InitSynchronizer(ctx context.Context) {
 				lastMod = f.Mtime
 			}
 		}
+		if err := cr.SaveLastFileList(fl, false); err != nil {
+			log.Errorf("Cannot save file list: %v", err)
+		}
 
 		checkCount = (checkCount + 1) % heavyCheckInterval
-		oldfileset := r.cluster.CloneFileset()
-		if r.cluster.SyncFiles(ctx, fl, heavyCheck && checkCount == 0) {
+		oldfileset := cr.CloneFileset()
+		if cr.SyncFiles(ctx, fl, false, heavyCheck && checkCount == 0) {
 			go r.UpdateFileRecords(fl, oldfileset)
 			if !config.Advanced.NoGC && !config.OnlyGcWhenStart {
-				go r.cluster.Gc()
+				go cr.Gc()
 			}
 		}
 	}, (time.Duration)(config.SyncInterval)*time.Minute)
@@ -477,11 +543,19 @@ func (r *Runner) CreateHTTPServerListener(ctx context.Context) (listener net.Lis
 	if config.ServeLimit.Enable {
 		limted := limited.NewLimitedListener(listener, config.ServeLimit.MaxConn, 0, config.ServeLimit.UploadRate*1024)
 		limted.SetMinWriteRate(1024)
+		limted.SetFairShare(config.ServeLimit.FairShare())
+		r.group.limitedListener = limted
+		for _, cr := range r.group.Clusters() {
+			cr.limitedListener = limted
+		}
 		listener = limted
 	}
 
 	tlsConfig := r.GenerateTLSConfig(ctx)
 	r.publicHosts = make([]string, 0, 2)
+	if r.acmeManager != nil {
+		r.publicHosts = append(r.publicHosts, r.acmeManager.Domains()...)
+	}
 	if tlsConfig != nil {
 		for _, cert := range tlsConfig.Certificates {
 			if h, err := parseCertCommonName(cert.Certificate[0]); err == nil {
@@ -511,33 +585,53 @@ func (r *Runner) GenerateTLSConfig(ctx context.Context) (tlsConfig *tls.Config)
 			}
 		}
 	}
-	if !config.Byoc {
-		log.Info(Tr("info.cert.requesting"))
-		tctx, cancel := context.WithTimeout(ctx, time.Minute*10)
-		pair, err := r.cluster.RequestCert(tctx)
-		cancel()
-		if err != nil {
-			log.Errorf(Tr("error.cert.request.failed"), err)
-			osExit(CodeServerError)
-		}
-		if tlsConfig == nil {
-			tlsConfig = new(tls.Config)
+	if config.Acme.Enable {
+		if !config.Byoc {
+			log.Warn("acme.enable is ignored since byoc is not enabled")
+		} else {
+			if tlsConfig == nil {
+				tlsConfig = new(tls.Config)
+			}
+			if err := r.setupAcme(ctx, tlsConfig); err != nil {
+				log.Errorf("Cannot setup ACME certificate manager: %v", err)
+				osExit(CodeClientError)
+			}
 		}
-		var cert tls.Certificate
-		cert, err = tls.X509KeyPair(([]byte)(pair.Cert), ([]byte)(pair.Key))
-		if err != nil {
-			log.Errorf(Tr("error.cert.requested.parse.failed"), err)
-			osExit(CodeServerUnexpectedError)
+	}
+	if !config.Byoc {
+		// the certificates will be chosen by SNI
+		for _, cr := range r.group.Clusters() {
+			log.Info(Tr("info.cert.requesting"))
+			tctx, cancel := context.WithTimeout(ctx, time.Minute*10)
+			pair, err := cr.RequestCert(tctx)
+			cancel()
+			if err != nil {
+				log.Errorf(Tr("error.cert.request.failed"), err)
+				osExit(CodeServerError)
+			}
+			if tlsConfig == nil {
+				tlsConfig = new(tls.Config)
+			}
+			var cert tls.Certificate
+			cert, err = tls.X509KeyPair(([]byte)(pair.Cert), ([]byte)(pair.Key))
+			if err != nil {
+				log.Errorf(Tr("error.cert.requested.parse.failed"), err)
+				osExit(CodeServerUnexpectedError)
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+			certHost, _ := parseCertCommonName(cert.Certificate[0])
+			r.group.AddHost(cr, certHost)
+			log.Infof(Tr("info.cert.requested"), certHost)
 		}
-		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
-		certHost, _ := parseCertCommonName(cert.Certificate[0])
-		log.Infof(Tr("info.cert.requested"), certHost)
 	}
 	r.tlsConfig = tlsConfig
 	return
 }
 
 func (r *Runner) EnableCluster(ctx context.Context) {
+	if !r.waitAcmeCert(ctx) {
+		return
+	}
 	if config.Advanced.WaitBeforeEnable > 0 {
 		select {
 		case <-time.After(time.Second * (time.Duration)(config.Advanced.WaitBeforeEnable)):
@@ -549,12 +643,14 @@ func (r *Runner) EnableCluster(ctx context.Context) {
 	if config.Tunneler.Enable {
 		r.enableClusterByTunnel(ctx)
 	} else {
-		if err := r.cluster.Enable(ctx); err != nil {
-			log.Errorf(Tr("error.cluster.enable.failed"), err)
-			if ctx.Err() != nil {
-				return
+		for _, cr := range r.group.Clusters() {
+			if err := cr.Enable(ctx); err != nil {
+				log.Errorf(Tr("error.cluster.enable.failed"), err)
+				if ctx.Err() != nil {
+					return
+				}
+				osExit(CodeServerOrEnvionmentError)
 			}
-			osExit(CodeServerOrEnvionmentError)
 		}
 	}
 }
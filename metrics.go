@@ -0,0 +1,206 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LiterMC/go-openbmclapi/notify"
+)
+
+const metricsPrefix = "openbmclapi_"
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// defaultLatencyBuckets are the upper bounds (in seconds) of the download latency histogram
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	bounds []float64
+
+	mux    sync.Mutex
+	counts []uint64 // the last one is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+// snapshot returns the cumulative counts of each buckets
+func (h *histogram) snapshot() (counts []uint64, sum float64) {
+	counts = make([]uint64, len(h.counts))
+	h.mux.Lock()
+	copy(counts, h.counts)
+	sum = h.sum
+	h.mux.Unlock()
+	for i := 1; i < len(counts); i++ {
+		counts[i] += counts[i-1]
+	}
+	return
+}
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) meta(name string, typ string, help string) {
+	fmt.Fprintf(m.w, "# TYPE %s%s %s\n", metricsPrefix, name, typ)
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+}
+
+// sample writes a metric sample, labels must be key value pairs
+func (m *metricsWriter) sample(name string, value string, labels ...string) {
+	m.w.WriteString(metricsPrefix)
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			m.w.WriteString(labels[i])
+			m.w.WriteString(`="`)
+			metricsLabelEscaper.WriteString(m.w, labels[i+1])
+			m.w.WriteByte('"')
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(value)
+	m.w.WriteByte('\n')
+}
+
+func (m *metricsWriter) intSample(name string, value int64, labels ...string) {
+	m.sample(name, strconv.FormatInt(value, 10), labels...)
+}
+
+func (m *metricsWriter) floatSample(name string, value float64, labels ...string) {
+	m.sample(name, strconv.FormatFloat(value, 'g', -1, 64), labels...)
+}
+
+func (m *metricsWriter) boolSample(name string, value bool, labels ...string) {
+	var v int64
+	if value {
+		v = 1
+	}
+	m.intSample(name, v, labels...)
+}
+
+func (m *metricsWriter) histogram(name string, h *histogram) {
+	counts, sum := h.snapshot()
+	for i, b := range h.bounds {
+		m.intSample(name+"_bucket", (int64)(counts[i]), "le", strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	total := (int64)(counts[len(counts)-1])
+	m.intSample(name+"_bucket", total, "le", "+Inf")
+	m.floatSample(name+"_sum", sum)
+	m.intSample(name+"_count", total)
+}
+
+func (cr *Cluster) WriteMetrics(w io.Writer) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+
+	m.meta("enabled", "gauge", "Whether the cluster is enabled")
+	m.boolSample("enabled", cr.enabled.Load())
+
+	m.meta("syncing", "gauge", "Whether the cluster is synchronizing files")
+	m.boolSample("syncing", cr.issync.Load())
+	m.meta("sync_progress", "gauge", "Count of the files that have been synchronized in current sync")
+	m.intSample("sync_progress", cr.syncProg.Load())
+	m.meta("sync_total", "gauge", "Count of the files that need to be synchronized in current sync")
+	m.intSample("sync_total", cr.syncTotal.Load())
+
+	m.meta("keepalive", "counter", "Count of the keep-alive requests")
+	m.intSample("keepalive_total", cr.keepaliveSuccess.Load(), "result", "success")
+	m.intSample("keepalive_total", cr.keepaliveFailure.Load(), "result", "failure")
+
+	type storageStat struct {
+		id          string
+		hits, bytes int64
+	}
+	var storageStats []storageStat
+	cr.stats.ForEachSubStat(func(name string, data *notify.StatData) {
+		hits, bytes := data.Total()
+		storageStats = append(storageStats, storageStat{name, hits, bytes})
+	})
+	sort.Slice(storageStats, func(i, j int) bool { return storageStats[i].id < storageStats[j].id })
+	m.meta("storage_hits", "counter", "Count of the downloads served by each storage")
+	for _, s := range storageStats {
+		m.intSample("storage_hits_total", s.hits, "storage", s.id)
+	}
+	m.meta("storage_bytes", "counter", "Bytes served by each storage")
+	for _, s := range storageStats {
+		m.intSample("storage_bytes_total", s.bytes, "storage", s.id)
+	}
+
+	m.meta("storage_health", "gauge", "Health state of each storage, 0 is healthy, 1 is degraded, 2 is down")
+	for i, h := range cr.storageHealths {
+		m.intSample("storage_health", (int64)(h.State()), "storage", cr.storageOpts[i].Id)
+	}
+
+	m.meta("buf_slots_used", "gauge", "Count of the download buffer slots in use")
+	m.intSample("buf_slots_used", (int64)(cr.bufSlots.Cap()-cr.bufSlots.Len()))
+	m.meta("buf_slots_capacity", "gauge", "Count of the download buffer slots")
+	m.intSample("buf_slots_capacity", (int64)(cr.bufSlots.Cap()))
+
+	if l := cr.limitedListener; l != nil {
+		m.meta("connections_active", "gauge", "Count of the active connections to the server")
+		m.intSample("connections_active", l.ActiveCount())
+		m.meta("connections_max", "gauge", "Maximum count of the connections to the server, 0 means unlimited")
+		m.intSample("connections_max", (int64)(l.Cap()))
+	}
+
+	m.meta("download_duration_seconds", "histogram", "Time used to serve the download requests")
+	m.histogram("download_duration_seconds", cr.downloadLatency)
+
+	m.w.WriteString("# EOF\n")
+	return m.w.Flush()
+}
+
+func (cr *Cluster) apiV0Metrics(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	rw.Header().Set("Content-Type", openMetricsContentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	cr.WriteMetrics(rw)
+}
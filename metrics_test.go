@@ -0,0 +1,250 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+type metricSample struct {
+	name   string
+	labels map[string]string
+	value  string
+}
+
+// parseMetricSample parses a sample line in the OpenMetrics text format
+func parseMetricSample(t *testing.T, line string) (s metricSample) {
+	i := strings.IndexAny(line, "{ ")
+	if i < 0 {
+		t.Fatalf("Malformed sample %q", line)
+	}
+	s.name = line[:i]
+	line = line[i:]
+	if line[0] == '{' {
+		s.labels = make(map[string]string)
+		line = line[1:]
+		for line[0] != '}' {
+			eq := strings.Index(line, `="`)
+			if eq <= 0 {
+				t.Fatalf("Malformed labels in %q", line)
+			}
+			key := line[:eq]
+			line = line[eq+2:]
+			var value strings.Builder
+			for {
+				if line == "" {
+					t.Fatalf("Unterminated label value of %s", key)
+				}
+				c := line[0]
+				line = line[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\n' {
+					t.Fatalf("Unescaped newline in label value of %s", key)
+				}
+				if c == '\\' {
+					switch line[0] {
+					case '\\', '"':
+						value.WriteByte(line[0])
+					case 'n':
+						value.WriteByte('\n')
+					default:
+						t.Fatalf("Unknown escape sequence \\%c in label value of %s", line[0], key)
+					}
+					line = line[1:]
+					continue
+				}
+				value.WriteByte(c)
+			}
+			s.labels[key] = value.String()
+			if line[0] == ',' {
+				line = line[1:]
+			}
+		}
+		line = line[1:]
+	}
+	if line == "" || line[0] != ' ' {
+		t.Fatalf("Missing value of sample %s", s.name)
+	}
+	s.value = line[1:]
+	return
+}
+
+func TestWriteMetrics(t *testing.T) {
+	const weirdId = "we\"ird\\id\nstorage"
+	local := new(storage.LocalStorage)
+	local.SetOptions(&storage.LocalStorageOption{CachePath: t.TempDir()})
+	cr := &Cluster{
+		storageOpts: []storage.StorageOption{{BasicStorageOption: storage.BasicStorageOption{Id: weirdId}}},
+		storageHealths: []*storage.HealthTracker{
+			storage.NewHealthTracker(weirdId, local, storage.HealthCheckOption{}, nil),
+		},
+		bufSlots:        limited.NewBufSlots(4),
+		downloadLatency: newHistogram(defaultLatencyBuckets),
+	}
+	cr.stats.AddHits(3, 1024, weirdId)
+	observed := []float64{0.003, 0.02, 0.02, 7, 100}
+	var expectSum float64
+	for _, v := range observed {
+		cr.downloadLatency.Observe(v)
+		expectSum += v
+	}
+
+	var buf bytes.Buffer
+	if err := cr.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics: %v", err)
+	}
+	out := buf.String()
+	if !strings.HasSuffix(out, "\n# EOF\n") {
+		t.Fatalf("Expect the output to end with # EOF, got %q", out[max(0, len(out)-32):])
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	lines = lines[:len(lines)-1]
+
+	types := make(map[string]string)
+	helps := make(map[string]bool)
+	samples := make(map[string][]metricSample)
+	var order []string
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, typ, _ := strings.Cut(rest, " ")
+			if _, ok := types[name]; ok {
+				t.Errorf("Duplicated TYPE of %s", name)
+			}
+			types[name] = typ
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+			name, help, _ := strings.Cut(rest, " ")
+			if help == "" {
+				t.Errorf("Empty HELP of %s", name)
+			}
+			helps[name] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			t.Errorf("Unexpected comment %q", line)
+			continue
+		}
+		s := parseMetricSample(t, line)
+		family := s.name
+		switch typ := types[family]; {
+		case typ != "":
+		case types[strings.TrimSuffix(family, "_total")] == "counter":
+			family = strings.TrimSuffix(family, "_total")
+		default:
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if f, ok := strings.CutSuffix(family, suffix); ok && types[f] == "histogram" {
+					family = f
+					break
+				}
+			}
+		}
+		if types[family] == "" || !helps[family] {
+			t.Errorf("Sample %s appears before the TYPE and HELP of its family", s.name)
+		}
+		if !strings.HasPrefix(s.name, metricsPrefix) {
+			t.Errorf("Sample %s does not have the prefix %s", s.name, metricsPrefix)
+		}
+		samples[s.name] = append(samples[s.name], s)
+		order = append(order, s.name)
+	}
+
+	// label escaping
+	if hits := samples[metricsPrefix+"storage_hits_total"]; len(hits) != 1 || hits[0].labels["storage"] != weirdId || hits[0].value != "3" {
+		t.Errorf("Unexpected storage hits %+v", hits)
+	}
+	if health := samples[metricsPrefix+"storage_health"]; len(health) != 1 || health[0].labels["storage"] != weirdId || health[0].value != "0" {
+		t.Errorf("Unexpected storage health %+v", health)
+	}
+
+	// histogram
+	const histName = metricsPrefix + "download_duration_seconds"
+	if typ := types[histName]; typ != "histogram" {
+		t.Errorf("Expect the type of %s to be histogram, got %q", histName, typ)
+	}
+	buckets := samples[histName+"_bucket"]
+	if len(buckets) != len(defaultLatencyBuckets)+1 {
+		t.Fatalf("Expect %d buckets, got %d", len(defaultLatencyBuckets)+1, len(buckets))
+	}
+	var last uint64
+	for i, b := range buckets {
+		count, err := strconv.ParseUint(b.value, 10, 64)
+		if err != nil {
+			t.Fatalf("Cannot parse bucket count %q: %v", b.value, err)
+		}
+		if count < last {
+			t.Errorf("Bucket le=%s is not cumulative, %d < %d", b.labels["le"], count, last)
+		}
+		last = count
+		if i == len(buckets)-1 {
+			if le := b.labels["le"]; le != "+Inf" {
+				t.Errorf("Expect the last bucket to be +Inf, got %q", le)
+			}
+			break
+		}
+		le, err := strconv.ParseFloat(b.labels["le"], 64)
+		if err != nil || le != defaultLatencyBuckets[i] {
+			t.Errorf("Unexpected bucket bound %q, expect %v", b.labels["le"], defaultLatencyBuckets[i])
+			continue
+		}
+		var expect uint64
+		for _, v := range observed {
+			if v <= le {
+				expect++
+			}
+		}
+		if count != expect {
+			t.Errorf("Bucket le=%v: expect %d, got %d", le, expect, count)
+		}
+	}
+	if last != (uint64)(len(observed)) {
+		t.Errorf("Expect the +Inf bucket to be %d, got %d", len(observed), last)
+	}
+	if c := samples[histName+"_count"]; len(c) != 1 || c[0].value != strconv.Itoa(len(observed)) {
+		t.Errorf("Unexpected histogram count %+v", c)
+	}
+	if s := samples[histName+"_sum"]; len(s) != 1 {
+		t.Errorf("Unexpected histogram sum %+v", s)
+	} else if sum, err := strconv.ParseFloat(s[0].value, 64); err != nil || math.Abs(sum-expectSum) > 1e-9 {
+		t.Errorf("Expect histogram sum %v, got %q", expectSum, s[0].value)
+	}
+	// the buckets must come before the sum and the count
+	var seenSum bool
+	for _, name := range order {
+		switch name {
+		case histName + "_sum", histName + "_count":
+			seenSum = true
+		case histName + "_bucket":
+			if seenSum {
+				t.Errorf("Bucket appears after the sum or the count")
+			}
+		}
+	}
+}
@@ -0,0 +1,993 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	mfaTokenSubject = "GOBA-mfa"
+
+	// the login session must finish the second factor in this time
+	mfaTokenExpire = time.Minute * 5
+
+	mfaActionLogin            = "login"
+	mfaActionWebAuthnLogin    = "webauthn-login"
+	mfaActionWebAuthnRegister = "webauthn-register"
+
+	recoveryCodeCount = 10
+)
+
+var ErrMFACodeMismatch = errors.New("the code is incorrect")
+
+type mfaTokenClaims struct {
+	jwt.RegisteredClaims
+
+	Client string `json:"cli"`
+	User   string `json:"usr"`
+	Action string `json:"act"`
+	// WebAuthn is the session data between the begin and the finish of a WebAuthn ceremony
+	WebAuthn *webauthn.SessionData `json:"wa,omitempty"`
+}
+
+// generateMFAToken generates a token which proves the user has passed the steps before the second factor.
+// The token is recorded as a jti, and should be removed once it's used
+func (cr *Cluster) generateMFAToken(cliId string, user string, action string, session *webauthn.SessionData) (string, error) {
+	jti, err := utils.GenRandB64(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	exp := now.Add(mfaTokenExpire)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &mfaTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   mfaTokenSubject,
+			Issuer:    cr.jwtIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+		Client:   cliId,
+		User:     user,
+		Action:   action,
+		WebAuthn: session,
+	})
+	tokenStr, err := token.SignedString(cr.apiHmacKey)
+	if err != nil {
+		return "", err
+	}
+	if err = cr.database.AddJTI(jti, exp); err != nil {
+		return "", err
+	}
+	return tokenStr, nil
+}
+
+// consumeMFAToken removes the jti of the token, it responds 401 and returns false if the token is already used.
+// The token must be consumed before checking the second factor, so one token cannot be tried more than once
+func (cr *Cluster) consumeMFAToken(rw http.ResponseWriter, claims *mfaTokenClaims) bool {
+	if err := cr.database.RemoveJTI(claims.ID); err != nil {
+		if err == database.ErrNotFound {
+			writeJson(rw, http.StatusUnauthorized, Map{
+				"error": "Invalid token",
+			})
+			return false
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+func (cr *Cluster) verifyMFAToken(cliId string, action string, token string) (claims *mfaTokenClaims, err error) {
+	claims = new(mfaTokenClaims)
+	if _, err = jwt.ParseWithClaims(
+		token,
+		claims,
+		cr.getJWTKey,
+		jwt.WithSubject(mfaTokenSubject),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(cr.jwtIssuer),
+	); err != nil {
+		return nil, err
+	}
+	if claims.Client != cliId {
+		return nil, ErrClientIdNotMatch
+	}
+	if claims.Action != action || claims.User == "" {
+		return nil, ErrJTINotExists
+	}
+	if ok, _ := cr.database.ValidJTI(claims.ID); !ok {
+		return nil, ErrJTINotExists
+	}
+	return
+}
+
+// userMFAStatus is the enabled second factors of a user
+type userMFAStatus struct {
+	TOTP          bool                 `json:"totp"`
+	WebAuthn      []webauthnCredential `json:"webauthn"`
+	RecoveryCodes int                  `json:"recoveryCodes"`
+
+	credentials []webauthn.Credential
+}
+
+type webauthnCredential struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Enabled reports whether the user must pass a second factor to login
+func (s *userMFAStatus) Enabled() bool {
+	return s.TOTP || len(s.WebAuthn) > 0
+}
+
+func (s *userMFAStatus) Methods() []string {
+	methods := make([]string, 0, 3)
+	if s.TOTP {
+		methods = append(methods, database.SecondFactorTOTP)
+	}
+	if len(s.WebAuthn) > 0 {
+		methods = append(methods, database.SecondFactorWebAuthn)
+	}
+	if s.RecoveryCodes > 0 {
+		methods = append(methods, database.SecondFactorRecovery)
+	}
+	return methods
+}
+
+func (cr *Cluster) getUserMFAStatus(user string) (status *userMFAStatus, err error) {
+	status = &userMFAStatus{
+		WebAuthn: make([]webauthnCredential, 0, 2),
+	}
+	err = cr.database.ForEachUsersSecondFactor(user, func(rec *database.SecondFactorRecord) error {
+		if !rec.Enabled {
+			return nil
+		}
+		switch rec.Type {
+		case database.SecondFactorTOTP:
+			status.TOTP = true
+		case database.SecondFactorWebAuthn:
+			var cred webauthn.Credential
+			if err := json.Unmarshal(([]byte)(rec.Secret), &cred); err != nil {
+				log.Errorf("Cannot decode WebAuthn credential %s of user %q: %v", rec.Id, user, err)
+				return nil
+			}
+			status.credentials = append(status.credentials, cred)
+			status.WebAuthn = append(status.WebAuthn, webauthnCredential{
+				Id:        rec.Id,
+				Name:      rec.Name,
+				CreatedAt: rec.CreatedAt,
+			})
+		case database.SecondFactorRecovery:
+			status.RecoveryCodes++
+		}
+		return nil
+	})
+	return
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// resetRecoveryCodes replaces the recovery codes of the user, the codes are only saved as their hashes
+func (cr *Cluster) resetRecoveryCodes(user string) (codes []string, err error) {
+	if err = cr.database.RemoveUsersSecondFactors(user, database.SecondFactorRecovery); err != nil {
+		return
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	now := time.Now()
+	codes = make([]string, recoveryCodeCount)
+	buf := make([]byte, 5)
+	for i := range codes {
+		if _, err = rand.Read(buf); err != nil {
+			return
+		}
+		code := strings.ToLower(enc.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+		if err = cr.database.AddSecondFactor(database.SecondFactorRecord{
+			User:      user,
+			Type:      database.SecondFactorRecovery,
+			Id:        utils.AsSha256Hex(code),
+			Name:      "Recovery code",
+			Enabled:   true,
+			CreatedAt: now,
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// useSecondFactor checks the TOTP code or consumes the recovery code
+func (cr *Cluster) useSecondFactor(user string, method string, code string) (err error) {
+	switch method {
+	case database.SecondFactorTOTP:
+		rec, err := cr.database.GetSecondFactor(user, database.SecondFactorTOTP, "")
+		if err != nil {
+			if err == database.ErrNotFound {
+				return ErrMFACodeMismatch
+			}
+			return err
+		}
+		if !rec.Enabled {
+			return ErrMFACodeMismatch
+		}
+		step, ok := utils.VerifyTOTP(rec.Secret, strings.TrimSpace(code), time.Now(), rec.Counter)
+		if !ok {
+			return ErrMFACodeMismatch
+		}
+		// the counter is only advanced if no one else has used the step or a later one
+		if err = cr.database.AdvanceSecondFactorCounter(user, database.SecondFactorTOTP, "", step); err != nil {
+			if err == database.ErrNotFound {
+				return ErrMFACodeMismatch
+			}
+			return err
+		}
+		return nil
+	case database.SecondFactorRecovery:
+		// removing is atomic, so a recovery code can only be used once
+		hash := utils.AsSha256Hex(normalizeRecoveryCode(code))
+		if err = cr.database.RemoveSecondFactor(user, database.SecondFactorRecovery, hash); err != nil {
+			if err == database.ErrNotFound {
+				return ErrMFACodeMismatch
+			}
+			return
+		}
+		return nil
+	}
+	return ErrMFACodeMismatch
+}
+
+// webauthnUser adapts a dashboard user to webauthn.User
+type webauthnUser struct {
+	name        string
+	credentials []webauthn.Credential
+}
+
+var _ webauthn.User = (*webauthnUser)(nil)
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	id := sha256.Sum256(([]byte)("GOBA-user:" + u.name))
+	return id[:]
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.name
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.name
+}
+
+func (u *webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// newWebAuthn creates the relying party by the config, or by the request if the config is empty
+func newWebAuthn(req *http.Request) (*webauthn.WebAuthn, error) {
+	host := req.Host
+	scheme := "http"
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	dashboard := &currentConfig().Dashboard
+	rpId := dashboard.WebAuthnRPID
+	if rpId == "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			rpId = h
+		} else {
+			rpId = host
+		}
+	}
+	origins := dashboard.WebAuthnOrigins
+	if len(origins) == 0 {
+		origins = []string{scheme + "://" + host}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: "Go-OpenBmclAPI Dashboard",
+		RPOrigins:     origins,
+	})
+}
+
+// loginResponse issues the auth token to the user
+func (cr *Cluster) loginResponse(rw http.ResponseWriter, cli string, user string) {
+	token, err := cr.generateAuthToken(cli, user)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate token",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"token": token,
+	})
+}
+
+// loginOrRequireMFA issues the auth token if the user has no second factor,
+// otherwise responses a short-lived token which can be used to pass the second factor
+func (cr *Cluster) loginOrRequireMFA(rw http.ResponseWriter, req *http.Request, user string) {
+	cli := apiGetClientId(req)
+	status, err := cr.getUserMFAStatus(user)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if !status.Enabled() {
+		cr.loginResponse(rw, cli, user)
+		return
+	}
+	token, err := cr.generateMFAToken(cli, user, mfaActionLogin, nil)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate token",
+			"message": err.Error(),
+		})
+		return
+	}
+	setAuditMessage(req, "second factor required")
+	writeJson(rw, http.StatusOK, Map{
+		"mfa": Map{
+			"token":   token,
+			"methods": status.Methods(),
+		},
+	})
+}
+
+func (cr *Cluster) apiV0LoginMFA(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	cli := apiGetClientId(req)
+
+	type T = struct {
+		Token  string `json:"token"`
+		Method string `json:"method"`
+		Code   string `json:"code"`
+	}
+	data, ok := parseRequestBody[T](rw, req, nil)
+	if !ok {
+		return
+	}
+	claims, err := cr.verifyMFAToken(cli, mfaActionLogin, data.Token)
+	if err != nil {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "Invalid token",
+		})
+		return
+	}
+	setAuditActor(req, claims.User)
+	setAuditTarget(req, data.Method)
+	// one token can only be tried once, so the codes cannot be brute forced
+	if !cr.consumeMFAToken(rw, claims) {
+		return
+	}
+	if err := cr.useSecondFactor(claims.User, data.Method, data.Code); err != nil {
+		if err == ErrMFACodeMismatch {
+			writeJson(rw, http.StatusUnauthorized, Map{
+				"error": "The code is incorrect",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cr.loginResponse(rw, cli, claims.User)
+}
+
+func (cr *Cluster) apiV0LoginWebAuthn(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	cli := apiGetClientId(req)
+
+	type T = struct {
+		Token string `json:"token"`
+	}
+	data, ok := parseRequestBody[T](rw, req, nil)
+	if !ok {
+		return
+	}
+	claims, err := cr.verifyMFAToken(cli, mfaActionLogin, data.Token)
+	if err != nil {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "Invalid token",
+		})
+		return
+	}
+	status, err := cr.getUserMFAStatus(claims.User)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(status.credentials) == 0 {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error": "WebAuthn is not enabled for the user",
+		})
+		return
+	}
+	wa, err := newWebAuthn(req)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "WebAuthn config error",
+			"message": err.Error(),
+		})
+		return
+	}
+	options, session, err := wa.BeginLogin(&webauthnUser{name: claims.User, credentials: status.credentials})
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot begin WebAuthn login",
+			"message": err.Error(),
+		})
+		return
+	}
+	// the login token is consumed here, so the session token is the only way to continue
+	if !cr.consumeMFAToken(rw, claims) {
+		return
+	}
+	sessionToken, err := cr.generateMFAToken(cli, claims.User, mfaActionWebAuthnLogin, session)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate token",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"options": options,
+		"session": sessionToken,
+	})
+}
+
+type webauthnFinishPayload struct {
+	Session    string          `json:"session"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+func (cr *Cluster) apiV0LoginWebAuthnFinish(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	cli := apiGetClientId(req)
+
+	data, ok := parseRequestBody[webauthnFinishPayload](rw, req, nil)
+	if !ok {
+		return
+	}
+	claims, err := cr.verifyMFAToken(cli, mfaActionWebAuthnLogin, data.Session)
+	if err != nil || claims.WebAuthn == nil {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "Invalid session",
+		})
+		return
+	}
+	setAuditActor(req, claims.User)
+	if !cr.consumeMFAToken(rw, claims) {
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(data.Credential))
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "Cannot parse credential",
+			"message": err.Error(),
+		})
+		return
+	}
+	status, err := cr.getUserMFAStatus(claims.User)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	wa, err := newWebAuthn(req)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "WebAuthn config error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cred, err := wa.ValidateLogin(&webauthnUser{name: claims.User, credentials: status.credentials}, *claims.WebAuthn, parsed)
+	if err != nil {
+		log.Debugf("WebAuthn login of user %q failed: %v", claims.User, err)
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "WebAuthn verification failed",
+		})
+		return
+	}
+	if cred.Authenticator.CloneWarning {
+		log.Warnf("The sign count of WebAuthn credential of user %q went backwards, the authenticator may be cloned", claims.User)
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "WebAuthn verification failed",
+		})
+		return
+	}
+	// save the new sign count
+	if err := cr.saveWebAuthnCredential(claims.User, cred); err != nil {
+		log.Errorf("Cannot update WebAuthn credential of user %q: %v", claims.User, err)
+	}
+	cr.loginResponse(rw, cli, claims.User)
+}
+
+func (cr *Cluster) saveWebAuthnCredential(user string, cred *webauthn.Credential) error {
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	rec, err := cr.database.GetSecondFactor(user, database.SecondFactorWebAuthn, id)
+	if err != nil {
+		return err
+	}
+	secret, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	updated := *rec
+	updated.Secret = (string)(secret)
+	return cr.database.UpdateSecondFactor(updated)
+}
+
+// checkMFAManageable rejects the API tokens, since the second factors can only be managed in the dashboard
+func checkMFAManageable(rw http.ResponseWriter, req *http.Request) bool {
+	if getRequestTokenType(req) != tokenTypeAuth {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "invalid authorization type",
+		})
+		return false
+	}
+	return true
+}
+
+func (cr *Cluster) apiV0MFA(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	status, err := cr.getUserMFAStatus(getLoggedUser(req))
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, status)
+}
+
+// apiV0MFATOTP starts the TOTP enrollment with POST, and disables TOTP with DELETE
+func (cr *Cluster) apiV0MFATOTP(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	user := getLoggedUser(req)
+	old, err := cr.database.GetSecondFactor(user, database.SecondFactorTOTP, "")
+	if err != nil && err != database.ErrNotFound {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		if old != nil && old.Enabled {
+			// a stolen session should not be able to remove the second factor
+			type T = struct {
+				Method string `json:"method"`
+				Code   string `json:"code"`
+			}
+			data, ok := parseRequestBody[T](rw, req, nil)
+			if !ok {
+				return
+			}
+			if err := cr.useSecondFactor(user, data.Method, data.Code); err != nil {
+				if err == ErrMFACodeMismatch {
+					writeJson(rw, http.StatusForbidden, Map{
+						"error": "The code is incorrect",
+					})
+					return
+				}
+				writeJson(rw, http.StatusInternalServerError, Map{
+					"error":   "database error",
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		if old != nil {
+			if err := cr.database.RemoveSecondFactor(user, database.SecondFactorTOTP, ""); err != nil && err != database.ErrNotFound {
+				writeJson(rw, http.StatusInternalServerError, Map{
+					"error":   "database error",
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		cr.cleanupRecoveryCodes(user)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if old != nil && old.Enabled {
+		writeJson(rw, http.StatusConflict, Map{
+			"error": "TOTP is already enabled",
+		})
+		return
+	}
+	secret, err := utils.GenTOTPSecret()
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate secret",
+			"message": err.Error(),
+		})
+		return
+	}
+	rec := database.SecondFactorRecord{
+		User:      user,
+		Type:      database.SecondFactorTOTP,
+		Name:      "TOTP",
+		Secret:    secret,
+		Enabled:   false,
+		CreatedAt: time.Now(),
+	}
+	if old != nil {
+		err = cr.database.UpdateSecondFactor(rec)
+	} else {
+		err = cr.database.AddSecondFactor(rec)
+	}
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"secret": secret,
+		"uri":    utils.TOTPURI("Go-OpenBmclAPI", user, secret),
+	})
+}
+
+// apiV0MFATOTPConfirm enables TOTP after the user entered a valid code
+func (cr *Cluster) apiV0MFATOTPConfirm(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	user := getLoggedUser(req)
+	type T = struct {
+		Code string `json:"code"`
+	}
+	data, ok := parseRequestBody[T](rw, req, nil)
+	if !ok {
+		return
+	}
+	rec, err := cr.database.GetSecondFactor(user, database.SecondFactorTOTP, "")
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error": "TOTP enrollment is not started",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if rec.Enabled {
+		writeJson(rw, http.StatusConflict, Map{
+			"error": "TOTP is already enabled",
+		})
+		return
+	}
+	step, ok := utils.VerifyTOTP(rec.Secret, strings.TrimSpace(data.Code), time.Now(), 0)
+	if !ok {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error": "The code is incorrect",
+		})
+		return
+	}
+	totp := *rec
+	totp.Enabled = true
+	totp.Counter = step
+	if err := cr.database.UpdateSecondFactor(totp); err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cr.mfaEnabledResponse(rw, user, Map{})
+}
+
+// mfaEnabledResponse generates the recovery codes if the user does not have any, and sends them within the response
+func (cr *Cluster) mfaEnabledResponse(rw http.ResponseWriter, user string, res Map) {
+	status, err := cr.getUserMFAStatus(user)
+	if err == nil && status.RecoveryCodes == 0 {
+		var codes []string
+		if codes, err = cr.resetRecoveryCodes(user); err == nil {
+			res["recoveryCodes"] = codes
+		}
+	}
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate recovery codes",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, res)
+}
+
+// cleanupRecoveryCodes removes the recovery codes once the user has no other second factor
+func (cr *Cluster) cleanupRecoveryCodes(user string) {
+	status, err := cr.getUserMFAStatus(user)
+	if err != nil || status.Enabled() {
+		return
+	}
+	if err := cr.database.RemoveUsersSecondFactors(user, database.SecondFactorRecovery); err != nil {
+		log.Errorf("Cannot remove recovery codes of user %q: %v", user, err)
+	}
+}
+
+func (cr *Cluster) apiV0MFAWebAuthnRegister(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	cli := apiGetClientId(req)
+	user := getLoggedUser(req)
+	status, err := cr.getUserMFAStatus(user)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	wa, err := newWebAuthn(req)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "WebAuthn config error",
+			"message": err.Error(),
+		})
+		return
+	}
+	exclusions := make([]protocol.CredentialDescriptor, len(status.credentials))
+	for i, c := range status.credentials {
+		exclusions[i] = c.Descriptor()
+	}
+	options, session, err := wa.BeginRegistration(&webauthnUser{name: user, credentials: status.credentials},
+		webauthn.WithExclusions(exclusions))
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot begin WebAuthn registration",
+			"message": err.Error(),
+		})
+		return
+	}
+	sessionToken, err := cr.generateMFAToken(cli, user, mfaActionWebAuthnRegister, session)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate token",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"options": options,
+		"session": sessionToken,
+	})
+}
+
+func (cr *Cluster) apiV0MFAWebAuthnRegisterFinish(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	cli := apiGetClientId(req)
+	user := getLoggedUser(req)
+	data, ok := parseRequestBody[webauthnFinishPayload](rw, req, nil)
+	if !ok {
+		return
+	}
+	claims, err := cr.verifyMFAToken(cli, mfaActionWebAuthnRegister, data.Session)
+	if err != nil || claims.WebAuthn == nil || claims.User != user {
+		writeJson(rw, http.StatusUnauthorized, Map{
+			"error": "Invalid session",
+		})
+		return
+	}
+	if !cr.consumeMFAToken(rw, claims) {
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(data.Credential))
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "Cannot parse credential",
+			"message": err.Error(),
+		})
+		return
+	}
+	wa, err := newWebAuthn(req)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "WebAuthn config error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cred, err := wa.CreateCredential(&webauthnUser{name: user}, *claims.WebAuthn, parsed)
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "WebAuthn verification failed",
+			"message": err.Error(),
+		})
+		return
+	}
+	secret, err := json.Marshal(cred)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot encode credential",
+			"message": err.Error(),
+		})
+		return
+	}
+	name := data.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	id := base64.RawURLEncoding.EncodeToString(cred.ID)
+	if err := cr.database.AddSecondFactor(database.SecondFactorRecord{
+		User:      user,
+		Type:      database.SecondFactorWebAuthn,
+		Id:        id,
+		Name:      name,
+		Secret:    (string)(secret),
+		Enabled:   true,
+		CreatedAt: time.Now(),
+	}); err != nil {
+		if err == database.ErrExists {
+			writeJson(rw, http.StatusConflict, Map{
+				"error": "The credential is already registered",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cr.mfaEnabledResponse(rw, user, Map{
+		"id": id,
+	})
+}
+
+// apiV0MFAWebAuthnCredential removes the WebAuthn credential at the path
+func (cr *Cluster) apiV0MFAWebAuthnCredential(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodDelete) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	user := getLoggedUser(req)
+	if err := cr.database.RemoveSecondFactor(user, database.SecondFactorWebAuthn, req.URL.Path); err != nil {
+		if err == database.ErrNotFound {
+			writeJson(rw, http.StatusNotFound, Map{
+				"error": "credential not found",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	cr.cleanupRecoveryCodes(user)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// apiV0MFARecoveryCodes generates a new set of recovery codes, the old codes will be invalid
+func (cr *Cluster) apiV0MFARecoveryCodes(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPost) {
+		return
+	}
+	if !checkMFAManageable(rw, req) {
+		return
+	}
+	user := getLoggedUser(req)
+	status, err := cr.getUserMFAStatus(user)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if !status.Enabled() {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error": "No second factor is enabled",
+		})
+		return
+	}
+	codes, err := cr.resetRecoveryCodes(user)
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate recovery codes",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"recoveryCodes": codes,
+	})
+}
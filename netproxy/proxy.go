@@ -0,0 +1,210 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package netproxy dials the connections through HTTP CONNECT or SOCKS5 proxies
+package netproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+)
+
+// Direct can be used as the proxy URL to connect without proxy
+const Direct = "direct"
+
+// Dialer dials the connections through a proxy server
+type Dialer struct {
+	url    *url.URL
+	dialer limited.NetDialer
+}
+
+var _ limited.NetDialer = (*Dialer)(nil)
+
+// New creates a dialer that connects through the proxy.
+// The supported schemes are http, https, socks5 and socks5h, the userinfo of the URL is used for authentication.
+// The hosts that match noProxy (comma-separated, in the format of golang.org/x/net/proxy.PerHost.AddFromString)
+// will be connected directly.
+// The connections to the proxy server, and the direct connections are dialed by forward,
+// nil forward means the default net.Dialer
+func New(proxyURL string, noProxy string, forward limited.NetDialer) (*Dialer, error) {
+	if forward == nil {
+		forward = &net.Dialer{
+			Timeout:   time.Second * 30,
+			KeepAlive: time.Second * 30,
+		}
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Proxy host is empty in %q", proxyURL)
+	}
+	var d limited.NetDialer
+	switch u.Scheme {
+	case "http", "https":
+		d = &httpConnectDialer{
+			proxy:   u,
+			addr:    hostWithDefaultPort(u, map[string]string{"http": "80", "https": "443"}[u.Scheme]),
+			forward: forward,
+		}
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		pd, err := proxy.SOCKS5("tcp", hostWithDefaultPort(u, "1080"), auth, dialerAdapter{forward})
+		if err != nil {
+			return nil, err
+		}
+		d = pd.(proxy.ContextDialer)
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q", u.Scheme)
+	}
+	if noProxy != "" {
+		ph := proxy.NewPerHost(dialerAdapter{d}, dialerAdapter{forward})
+		ph.AddFromString(noProxy)
+		d = ph
+	}
+	return &Dialer{
+		url:    u,
+		dialer: d,
+	}, nil
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// String returns the proxy URL without the password
+func (d *Dialer) String() string {
+	return d.url.Redacted()
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// dialerAdapter adapts limited.NetDialer to proxy.Dialer
+type dialerAdapter struct {
+	limited.NetDialer
+}
+
+func (d dialerAdapter) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+type httpConnectDialer struct {
+	proxy   *url.URL
+	addr    string
+	forward limited.NetDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP proxy does not support network %q", network)
+	}
+	raw, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			raw.Close()
+			conn = nil
+		}
+	}()
+	conn = raw
+
+	// interrupt the handshake when the context is canceled
+	stop := context.AfterFunc(ctx, func() {
+		raw.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if d.proxy.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{
+			ServerName: d.proxy.Hostname(),
+		})
+		if err = tc.HandshakeContext(ctx); err != nil {
+			return
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		passwd, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString(([]byte)(u.Username() + ":" + passwd))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		return
+	}
+	br := bufio.NewReader(conn)
+	// do not touch the response body, a successful CONNECT response has no body,
+	// and the following data belongs to the tunnel
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Proxy %s refused CONNECT %s: %s", d.proxy.Redacted(), address, res.Status)
+	}
+	if br.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return
+}
+
+// bufferedConn reads the data that was buffered when reading the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
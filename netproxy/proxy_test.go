@@ -0,0 +1,143 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package netproxy
+
+import (
+	"testing"
+
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+)
+
+func newConnectProxy(t *testing.T, auth string) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			http.Error(rw, "only CONNECT is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			http.Error(rw, "bad auth", http.StatusProxyAuthRequired)
+			return
+		}
+		count.Add(1)
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		rw.WriteHeader(http.StatusOK)
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go io.Copy(target, brw)
+		io.Copy(conn, target)
+	}))
+	t.Cleanup(svr.Close)
+	return svr, &count
+}
+
+func getThrough(t *testing.T, d *Dialer, target string) (string, error) {
+	cli := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+	res, err := cli.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return (string)(body), err
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello")
+	}))
+	defer target.Close()
+
+	proxySvr, count := newConnectProxy(t, "Basic dXNlcjpwYXNz") // user:pass
+
+	d, err := New("http://user:pass@"+proxySvr.Listener.Addr().String(), "", nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := d.String(); got != "http://user:xxxxx@"+proxySvr.Listener.Addr().String() {
+		t.Errorf("Expected the password to be redacted, got %q", got)
+	}
+	body, err := getThrough(t, d, target.URL)
+	if err != nil {
+		t.Fatalf("Cannot get through the proxy: %v", err)
+	}
+	if body != "hello" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if n := count.Load(); n != 1 {
+		t.Errorf("Expected 1 connection through the proxy, got %d", n)
+	}
+
+	bad, err := New("http://user:wrong@"+proxySvr.Listener.Addr().String(), "", nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := getThrough(t, bad, target.URL); err == nil {
+		t.Errorf("Expected error with wrong proxy credentials")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "direct")
+	}))
+	defer target.Close()
+
+	proxySvr, count := newConnectProxy(t, "")
+	d, err := New("http://"+proxySvr.Listener.Addr().String(), "example.com,127.0.0.0/8", nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	body, err := getThrough(t, d, target.URL)
+	if err != nil {
+		t.Fatalf("Cannot connect directly: %v", err)
+	}
+	if body != "direct" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if n := count.Load(); n != 0 {
+		t.Errorf("Expected no connection through the proxy, got %d", n)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	for _, u := range []string{"ftp://127.0.0.1:21", "socks4://127.0.0.1:1080", "http://"} {
+		if _, err := New(u, "", nil); err == nil {
+			t.Errorf("Expected New(%q) to fail", u)
+		}
+	}
+}
@@ -215,3 +215,14 @@ func (p *Plugin) OnReportStatus(e *notify.ReportStatusEvent) error {
 	defer cancel()
 	return p.sendEmailIf(tctx, "Go-OpenBMCLAPI Daily Report", buf.Bytes(), func(record *database.EmailSubscriptionRecord) bool { return record.Scopes.DailyReport })
 }
+
+func (p *Plugin) OnStorageStateChange(e *notify.StorageStateChangeEvent) error {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "storage-state", e); err != nil {
+		return err
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEmailIf(tctx, "Go-OpenBMCLAPI Storage "+e.Storage+" is "+e.To, buf.Bytes(), func(record *database.EmailSubscriptionRecord) bool { return record.Scopes.StorageState })
+}
@@ -50,4 +50,12 @@ type (
 		TimestampEvent
 		Stats *StatData
 	}
+
+	StorageStateChangeEvent struct {
+		TimestampEvent
+		Storage string
+		From    string
+		To      string
+		Error   string
+	}
 )
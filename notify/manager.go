@@ -39,6 +39,7 @@ type Plugin interface {
 	OnSyncDone(*SyncDoneEvent) error
 	OnUpdateAvaliable(*UpdateAvaliableEvent) error
 	OnReportStatus(*ReportStatusEvent) error
+	OnStorageStateChange(*StorageStateChangeEvent) error
 }
 
 type Manager struct {
@@ -51,7 +52,8 @@ type Manager struct {
 	nextReportAfter time.Time
 	lastRelease     update.GithubRelease
 
-	plugins []Plugin
+	pluginMux sync.RWMutex
+	plugins   []Plugin
 }
 
 func NewManager(dataDir string, db database.DB, client *http.Client, subject string) *Manager {
@@ -80,11 +82,24 @@ func (m *Manager) Subject() string {
 }
 
 func (m *Manager) AddPlugin(p Plugin) {
+	m.pluginMux.Lock()
+	defer m.pluginMux.Unlock()
 	m.plugins = append(m.plugins, p)
 }
 
+func (m *Manager) getPlugins() []Plugin {
+	m.pluginMux.RLock()
+	defer m.pluginMux.RUnlock()
+	return m.plugins
+}
+
+// Plugins returns the plugins that are in use, the returned slice must not be modified
+func (m *Manager) Plugins() []Plugin {
+	return m.getPlugins()
+}
+
 func (m *Manager) Init(ctx context.Context) (err error) {
-	for _, p := range m.plugins {
+	for _, p := range m.getPlugins() {
 		if err = p.Init(ctx, m); err != nil {
 			return
 		}
@@ -92,18 +107,44 @@ func (m *Manager) Init(ctx context.Context) (err error) {
 	return
 }
 
+// SetPlugins replaces the plugins of the manager.
+// The plugins that are not added before will be initialized first,
+// if any of them failed to initialize, the old plugins will be kept.
+func (m *Manager) SetPlugins(ctx context.Context, plugins []Plugin) (err error) {
+	old := m.getPlugins()
+	for _, p := range plugins {
+		exists := false
+		for _, o := range old {
+			if o == p {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			if err = p.Init(ctx, m); err != nil {
+				return
+			}
+		}
+	}
+	m.pluginMux.Lock()
+	defer m.pluginMux.Unlock()
+	m.plugins = plugins
+	return
+}
+
 func (m *Manager) OnEnabled() {
 	e := &EnabledEvent{
 		At: time.Now(),
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnEnabled(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
@@ -114,14 +155,15 @@ func (m *Manager) OnDisabled() {
 	e := &DisabledEvent{
 		At: time.Now(),
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnDisabled(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
@@ -136,14 +178,15 @@ func (m *Manager) OnSyncBegin(count int, size int64) {
 		Count: count,
 		Size:  size,
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnSyncBegin(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
@@ -154,14 +197,15 @@ func (m *Manager) OnSyncDone() {
 	e := &SyncDoneEvent{
 		At: time.Now(),
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnSyncDone(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
@@ -177,14 +221,15 @@ func (m *Manager) OnUpdateAvaliable(release *update.GithubRelease) {
 	e := &UpdateAvaliableEvent{
 		Release: release,
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnUpdateAvaliable(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
@@ -210,14 +255,41 @@ func (m *Manager) OnReportStatus(stats *Stats) {
 		},
 		Stats: stats.Clone(),
 	}
+	plugins := m.getPlugins()
 	res := make(chan error, 0)
-	for _, p := range m.plugins {
+	for _, p := range plugins {
 		go func(p Plugin) {
 			defer log.RecoverPanic(nil)
 			res <- p.OnReportStatus(e)
 		}(p)
 	}
-	for i := len(m.plugins); i > 0; i-- {
+	for i := len(plugins); i > 0; i-- {
+		err := <-res
+		if err != nil {
+			log.Errorf("Cannot send notification: %v", err)
+		}
+	}
+}
+
+func (m *Manager) OnStorageStateChange(storage string, from, to string, reason string) {
+	e := &StorageStateChangeEvent{
+		TimestampEvent: TimestampEvent{
+			At: time.Now(),
+		},
+		Storage: storage,
+		From:    from,
+		To:      to,
+		Error:   reason,
+	}
+	plugins := m.getPlugins()
+	res := make(chan error, 0)
+	for _, p := range plugins {
+		go func(p Plugin) {
+			defer log.RecoverPanic(nil)
+			res <- p.OnStorageStateChange(e)
+		}(p)
+	}
+	for i := len(plugins); i > 0; i-- {
 		err := <-res
 		if err != nil {
 			log.Errorf("Cannot send notification: %v", err)
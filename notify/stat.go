@@ -318,6 +318,38 @@ func (s *Stats) Save(dir string) (err error) {
 	return
 }
 
+// Total returns the accumulated hits and bytes of all time
+func (d *StatData) Total() (hits int64, bytes int64) {
+	for _, v := range d.Years {
+		hits += (int64)(v.Hits)
+		bytes += v.Bytes
+	}
+	for _, v := range d.Months[:d.Date.Month] {
+		hits += (int64)(v.Hits)
+		bytes += v.Bytes
+	}
+	for _, v := range d.Days[:d.Date.Day] {
+		hits += (int64)(v.Hits)
+		bytes += v.Bytes
+	}
+	for _, v := range d.Hours[:d.Date.Hour+1] {
+		hits += (int64)(v.Hits)
+		bytes += v.Bytes
+	}
+	return
+}
+
+// ForEachSubStat calls cb with each storage's StatData
+// The StatData must not be retained after cb returns
+func (s *Stats) ForEachSubStat(cb func(name string, data *StatData)) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for name, data := range s.subStat {
+		cb(name, data)
+	}
+}
+
 func (s *Stats) GetTmpHits() (hits int32, bts int64) {
 	return s.hits.Load(), s.bts.Load()
 }
@@ -0,0 +1,267 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/internal/build"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/notify"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	HeaderEvent     = "X-Openbmclapi-Event"
+	HeaderDelivery  = "X-Openbmclapi-Delivery"
+	HeaderTimestamp = "X-Openbmclapi-Timestamp"
+	HeaderSignature = "X-Openbmclapi-Signature"
+)
+
+const (
+	maxRetryCount = 3
+	// deliveryRetention is how long the delivery records are kept in the database
+	deliveryRetention = 30 * 24 * time.Hour
+)
+
+// baseRetryDelay is the delay before the first retry, it's doubled for each next retry
+var baseRetryDelay = time.Second
+
+// Delivery records the result of sending one event to one webhook
+type Delivery = database.WebhookDeliveryRecord
+
+type Plugin struct {
+	db     database.DB
+	client *http.Client
+
+	lastPrune atomic.Int64 // unix timestamp of the last time old deliveries were removed
+}
+
+var _ notify.Plugin = (*Plugin)(nil)
+
+func (p *Plugin) ID() string {
+	return "webhook"
+}
+
+func (p *Plugin) Init(ctx context.Context, m *notify.Manager) (err error) {
+	p.db = m.DB()
+	p.client = m.HTTPClient()
+	return
+}
+
+func (p *Plugin) recordDelivery(d Delivery) {
+	if err := p.db.AddWebhookDelivery(d); err != nil {
+		log.Errorf("Cannot record webhook delivery %s: %v", d.Id, err)
+	}
+	now := time.Now()
+	last := p.lastPrune.Load()
+	if now.Unix()-last < int64(time.Hour/time.Second) || !p.lastPrune.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	if err := p.db.RemoveWebhookDeliveriesBefore(now.Add(-deliveryRetention)); err != nil {
+		log.Errorf("Cannot remove old webhook deliveries: %v", err)
+	}
+}
+
+// Sign returns the signature of the payload, which is `sha256=hex(HMAC-SHA256(key, timestamp + "." + payload))`.
+// The key is the secret of the webhook, which is never sent with the requests
+func Sign(key string, timestamp string, payload []byte) string {
+	m := hmac.New(sha256.New, ([]byte)(key))
+	m.Write(([]byte)(timestamp))
+	m.Write([]byte{'.'})
+	m.Write(payload)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+func (p *Plugin) post(ctx context.Context, record *database.WebhookRecord, event string, deliveryId uuid.UUID, payload []byte) (status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, record.EndPoint, bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("User-Agent", build.ClusterUserAgentFull)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, deliveryId.String())
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if record.Auth != nil && *record.Auth != "" {
+		req.Header.Set("Authorization", *record.Auth)
+	}
+	if record.Secret != nil && *record.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(*record.Secret, timestamp, payload))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+	if status/100 != 2 {
+		return status, utils.NewHTTPStatusErrorFromResponse(resp)
+	}
+	return
+}
+
+func (p *Plugin) deliver(ctx context.Context, record *database.WebhookRecord, event string, payload []byte) {
+	d := Delivery{
+		User:    record.User,
+		Webhook: record.Id,
+		Event:   event,
+		At:      time.Now(),
+	}
+	var err error
+	if d.Id, err = uuid.NewV7(); err != nil {
+		d.Id = uuid.New()
+	}
+	delay := baseRetryDelay
+	for {
+		d.Attempts++
+		start := time.Now()
+		d.Status, err = p.post(ctx, record, event, d.Id, payload)
+		d.Latency = time.Since(start)
+		if err == nil {
+			d.Error = ""
+			break
+		}
+		d.Error = err.Error()
+		log.Warnf("Cannot deliver webhook %s (%s) [%d/%d]: %v", record.Name, record.Id, d.Attempts, maxRetryCount, err)
+		// do not retry on client errors except 408 and 429
+		if d.Status/100 == 4 && d.Status != http.StatusRequestTimeout && d.Status != http.StatusTooManyRequests {
+			break
+		}
+		if d.Attempts >= maxRetryCount {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			d.Error = ctx.Err().Error()
+			p.recordDelivery(d)
+			return
+		}
+		delay *= 2
+	}
+	log.Debugf("Webhook %s (%s) delivered event %s with status %d in %v", record.Name, record.Id, event, d.Status, d.Latency)
+	p.recordDelivery(d)
+}
+
+func (p *Plugin) sendEventIf(ctx context.Context, event string, data any, filter func(*database.WebhookRecord) bool) (err error) {
+	payload, err := json.Marshal(Map{
+		"typ":  event,
+		"at":   time.Now().UnixMilli(),
+		"data": data,
+	})
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	err = p.db.ForEachEnabledWebhook(func(record *database.WebhookRecord) error {
+		if filter(record) {
+			wg.Add(1)
+			go func(record database.WebhookRecord) {
+				defer wg.Done()
+				p.deliver(ctx, &record, event, payload)
+			}(*record)
+		}
+		return nil
+	})
+	wg.Wait()
+	return
+}
+
+type Map = map[string]any
+
+func (p *Plugin) OnEnabled(e *notify.EnabledEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "enabled", Map{
+		"at": e.At.UnixMilli(),
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.Enabled })
+}
+
+func (p *Plugin) OnDisabled(e *notify.DisabledEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "disabled", Map{
+		"at": e.At.UnixMilli(),
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.Disabled })
+}
+
+func (p *Plugin) OnSyncBegin(e *notify.SyncBeginEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "syncbegin", Map{
+		"at":    e.At.UnixMilli(),
+		"count": e.Count,
+		"size":  e.Size,
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.SyncBegin })
+}
+
+func (p *Plugin) OnSyncDone(e *notify.SyncDoneEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "syncdone", Map{
+		"at": e.At.UnixMilli(),
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.SyncDone })
+}
+
+func (p *Plugin) OnUpdateAvaliable(e *notify.UpdateAvaliableEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "updates", Map{
+		"tag":  e.Release.Tag.String(),
+		"url":  e.Release.HtmlURL,
+		"body": e.Release.Body,
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.Updates })
+}
+
+func (p *Plugin) OnReportStatus(e *notify.ReportStatusEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "daily-report", Map{
+		"at":    e.At.UnixMilli(),
+		"stats": e.Stats,
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.DailyReport })
+}
+
+func (p *Plugin) OnStorageStateChange(e *notify.StorageStateChangeEvent) error {
+	tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return p.sendEventIf(tctx, "storage-state", Map{
+		"at":      e.At.UnixMilli(),
+		"storage": e.Storage,
+		"from":    e.From,
+		"to":      e.To,
+		"error":   e.Error,
+	}, func(record *database.WebhookRecord) bool { return record.Scopes.StorageState })
+}
@@ -0,0 +1,196 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package webhook
+
+import (
+	"testing"
+
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"typ":"test"}' | openssl dgst -sha256 -hmac secret
+	const expect = "sha256=d3c7d6b65f2ddf1b36d73207273ddb53aa26553f3ba533a068fbd21b227201c2"
+	if got := Sign("secret", "1700000000", ([]byte)(`{"typ":"test"}`)); got != expect {
+		t.Errorf("Sign() = %q, expect %q", got, expect)
+	}
+	if got := Sign("secret", "1700000001", ([]byte)(`{"typ":"test"}`)); got == expect {
+		t.Errorf("Expected the signature to depend on the timestamp")
+	}
+}
+
+func newTestPlugin() *Plugin {
+	return &Plugin{
+		db:     database.NewMemoryDB(),
+		client: http.DefaultClient,
+	}
+}
+
+// lastDelivery returns the newest delivery record of the webhook
+func lastDelivery(t *testing.T, p *Plugin, record *database.WebhookRecord) (d Delivery) {
+	found := false
+	if err := p.db.ForEachUsersWebhookDelivery(record.User, record.Id, func(r *Delivery) error {
+		d, found = *r, true
+		return database.ErrStopIter
+	}); err != nil {
+		t.Fatalf("Cannot read delivery records: %v", err)
+	}
+	if !found {
+		t.Fatalf("No delivery was recorded for webhook %s", record.Id)
+	}
+	return
+}
+
+func TestDeliverRetry(t *testing.T) {
+	old := baseRetryDelay
+	baseRetryDelay = time.Millisecond
+	defer func() { baseRetryDelay = old }()
+
+	const (
+		auth   = "Bearer token"
+		secret = "secret"
+	)
+	var (
+		mux        sync.Mutex
+		calls      int
+		deliveries = make(map[string]struct{})
+		// respond returns the status code of the nth call
+		respond func(n int) int
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		payload, _ := io.ReadAll(req.Body)
+		if got := req.Header.Get("Authorization"); got != auth {
+			t.Errorf("Authorization header mismatch, got %q, expect %q", got, auth)
+		}
+		// the signature must be made with the secret, which is not sent with the request
+		if sig := Sign(secret, req.Header.Get(HeaderTimestamp), payload); req.Header.Get(HeaderSignature) != sig {
+			t.Errorf("Signature mismatch, got %q, expect %q", req.Header.Get(HeaderSignature), sig)
+		}
+		mux.Lock()
+		calls++
+		deliveries[req.Header.Get(HeaderDelivery)] = struct{}{}
+		status := respond(calls)
+		mux.Unlock()
+		rw.WriteHeader(status)
+	}))
+	defer svr.Close()
+
+	p := newTestPlugin()
+	authStr, secretStr := auth, secret
+	record := &database.WebhookRecord{
+		Name:     "test",
+		Id:       uuid.New(),
+		EndPoint: svr.URL,
+		Auth:     &authStr,
+		Secret:   &secretStr,
+	}
+	deliver := func(fn func(n int) int) int {
+		mux.Lock()
+		calls = 0
+		clear(deliveries)
+		respond = fn
+		mux.Unlock()
+		p.deliver(context.Background(), record, "test", ([]byte)(`{"typ":"test"}`))
+		mux.Lock()
+		defer mux.Unlock()
+		return calls
+	}
+
+	// fails twice, then succeeds
+	n := deliver(func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusNoContent
+	})
+	if n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+	if len(deliveries) != 1 {
+		t.Errorf("Expected the retries to use the same delivery id, got %d ids", len(deliveries))
+	}
+	d := lastDelivery(t, p, record)
+	if d.Attempts != 3 || d.Status != http.StatusNoContent || d.Error != "" {
+		t.Errorf("Unexpected delivery record %+v", d)
+	}
+
+	// client errors should not be retried
+	if n := deliver(func(int) int { return http.StatusNotFound }); n != 1 {
+		t.Errorf("Expected no retry on 404, got %d attempts", n)
+	}
+	// but 429 should be
+	if n := deliver(func(n int) int {
+		if n == 1 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	}); n != 2 {
+		t.Errorf("Expected a retry on 429, got %d attempts", n)
+	}
+	// the attempts are limited
+	if n := deliver(func(int) int { return http.StatusBadGateway }); n != maxRetryCount {
+		t.Errorf("Expected %d attempts, got %d", maxRetryCount, n)
+	}
+	d = lastDelivery(t, p, record)
+	if d.Attempts != maxRetryCount || d.Status != http.StatusBadGateway || d.Error == "" {
+		t.Errorf("Unexpected delivery record %+v", d)
+	}
+}
+
+func TestRecordDeliveryPrune(t *testing.T) {
+	p := newTestPlugin()
+	webhook := uuid.New()
+	old := Delivery{Id: uuid.New(), User: "user", Webhook: webhook, At: time.Now().Add(-deliveryRetention - time.Hour)}
+	if err := p.db.AddWebhookDelivery(old); err != nil {
+		t.Fatalf("Cannot add delivery: %v", err)
+	}
+	recent := Delivery{Id: uuid.New(), User: "user", Webhook: webhook, At: time.Now()}
+	p.recordDelivery(recent)
+
+	var got []uuid.UUID
+	p.db.ForEachUsersWebhookDelivery("user", uuid.Nil, func(d *Delivery) error {
+		got = append(got, d.Id)
+		return nil
+	})
+	if len(got) != 1 || got[0] != recent.Id {
+		t.Errorf("Expected only the recent delivery %s to be kept, got %v", recent.Id, got)
+	}
+
+	// the old records are not removed again within an hour
+	p.db.AddWebhookDelivery(old)
+	p.recordDelivery(Delivery{Id: uuid.New(), User: "user", Webhook: webhook, At: time.Now()})
+	got = got[:0]
+	p.db.ForEachUsersWebhookDelivery("user", uuid.Nil, func(d *Delivery) error {
+		got = append(got, d.Id)
+		return nil
+	})
+	if len(got) != 3 {
+		t.Errorf("Expected 3 deliveries, got %d", len(got))
+	}
+}
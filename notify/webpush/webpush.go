@@ -411,3 +411,25 @@ func (p *Plugin) OnReportStatus(e *notify.ReportStatusEvent) (err error) {
 	}
 	return
 }
+
+func (p *Plugin) OnStorageStateChange(e *notify.StorageStateChangeEvent) error {
+	message, err := json.Marshal(Map{
+		"typ":     "storage-state",
+		"at":      e.At.UnixMilli(),
+		"storage": e.Storage,
+		"from":    e.From,
+		"to":      e.To,
+	})
+	if err != nil {
+		return err
+	}
+	opts := &PushOptions{
+		Topic:   "storage-state",
+		TTL:     60 * 60 * 12,
+		Urgency: UrgencyHigh,
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	return p.sendMessageIf(tctx, message, opts, func(record *database.SubscribeRecord) bool { return record.Scopes.StorageState })
+}
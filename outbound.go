@@ -0,0 +1,130 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/netproxy"
+)
+
+// outboundDialers are the dialers of the subsystems, nil means the default dialer
+type outboundDialers struct {
+	// Base is the dialer without proxy
+	Base         limited.NetDialer
+	Sync         limited.NetDialer
+	SocketIO     limited.NetDialer // also used by the other requests to the center
+	Hijack       limited.NetDialer
+	Webdav       limited.NetDialer
+	Notification limited.NetDialer
+	UpdateCheck  limited.NetDialer
+}
+
+// newConfiguredDialers creates the dialers by the dns and the proxies config
+func newConfiguredDialers() (dialers outboundDialers, err error) {
+	var base limited.NetDialer
+	if config.DNS.Enable {
+		res, err := config.DNS.NewResolver()
+		if err != nil {
+			return dialers, err
+		}
+		base = res
+	}
+	return newOutboundDialers(config.Proxies, base)
+}
+
+// newOutboundDialers creates the dialers by the proxies config, base is the dialer used to connect the proxies
+func newOutboundDialers(cfg ProxiesConfig, base limited.NetDialer) (dialers outboundDialers, err error) {
+	proxied := make(map[string]limited.NetDialer)
+	get := func(name string, proxyURL string) (limited.NetDialer, error) {
+		if proxyURL == "" {
+			proxyURL = cfg.Default
+		}
+		if proxyURL == "" || proxyURL == netproxy.Direct {
+			return base, nil
+		}
+		if d, ok := proxied[proxyURL]; ok {
+			return d, nil
+		}
+		d, err := netproxy.New(proxyURL, cfg.NoProxy, base)
+		if err != nil {
+			return nil, fmt.Errorf("proxies.%s: %w", name, err)
+		}
+		log.Infof("Outbound %s connections will go through proxy %s", name, d)
+		proxied[proxyURL] = d
+		return d, nil
+	}
+
+	dialers.Base = base
+	if dialers.Sync, err = get("sync", cfg.Sync); err != nil {
+		return
+	}
+	if dialers.SocketIO, err = get("socketio", cfg.SocketIO); err != nil {
+		return
+	}
+	if dialers.Hijack, err = get("hijack", cfg.Hijack); err != nil {
+		return
+	}
+	if dialers.Webdav, err = get("webdav", cfg.Webdav); err != nil {
+		return
+	}
+	if dialers.Notification, err = get("notification", cfg.Notification); err != nil {
+		return
+	}
+	if dialers.UpdateCheck, err = get("update-check", cfg.UpdateCheck); err != nil {
+		return
+	}
+	return
+}
+
+// newDialerTransport returns a http transport that dials with the dialer.
+// The proxies from the environment will be ignored if the dialer is a proxy
+func newDialerTransport(dialer limited.NetDialer) http.RoundTripper {
+	if dialer == nil {
+		return http.DefaultTransport
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if _, ok := dialer.(*netproxy.Dialer); ok {
+		transport.Proxy = nil
+	}
+	return transport
+}
+
+// newWebsocketDialer returns nil if the default websocket dialer should be used
+func newWebsocketDialer(dialer limited.NetDialer) *websocket.Dialer {
+	if dialer == nil {
+		return nil
+	}
+	wd := &websocket.Dialer{
+		NetDialContext:   dialer.DialContext,
+		HandshakeTimeout: time.Second * 30,
+	}
+	if _, ok := dialer.(*netproxy.Dialer); !ok {
+		wd.Proxy = http.ProxyFromEnvironment
+	}
+	return wd
+}
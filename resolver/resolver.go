@@ -0,0 +1,273 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package resolver resolves host names with DNS-over-HTTPS / DNS-over-TLS upstreams
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	doh "github.com/libp2p/go-doh-resolver"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+type Upstream interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	String() string
+}
+
+// ParseUpstream parses the upstream address.
+// https://<host>/<path> is a DoH upstream,
+// tls://<host>[:port] is a DoT upstream, the default port is 853,
+// udp://<host>[:port], tcp://<host>[:port] or <host>[:port] is a plain DNS upstream, the default port is 53
+func ParseUpstream(addr string) (Upstream, error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		scheme, rest = "udp", addr
+	}
+	switch scheme {
+	case "https":
+		r, err := doh.NewResolver(addr, doh.WithCacheDisabled())
+		if err != nil {
+			return nil, err
+		}
+		return &dohUpstream{Resolver: r, url: addr}, nil
+	case "tls":
+		return newDNSUpstream(scheme, rest, "853")
+	case "udp", "tcp":
+		return newDNSUpstream(scheme, rest, "53")
+	}
+	return nil, fmt.Errorf("Unsupported DNS upstream scheme %q", scheme)
+}
+
+type dohUpstream struct {
+	*doh.Resolver
+	url string
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+// dnsUpstream is a plain DNS or DNS-over-TLS upstream
+type dnsUpstream struct {
+	*net.Resolver
+	scheme string
+	addr   string
+}
+
+func newDNSUpstream(scheme string, hostport string, defaultPort string) (*dnsUpstream, error) {
+	if u, err := url.Parse("//" + hostport); err != nil || u.Host != hostport {
+		return nil, fmt.Errorf("Invalid DNS upstream address %q", hostport)
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), defaultPort
+	}
+	u := &dnsUpstream{
+		scheme: scheme,
+		addr:   net.JoinHostPort(host, port),
+	}
+	u.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			switch u.scheme {
+			case "tls":
+				// the go resolver uses TCP framing when the returned conn is not a net.PacketConn
+				d := &tls.Dialer{
+					Config: &tls.Config{
+						ServerName: host,
+					},
+				}
+				return d.DialContext(ctx, "tcp", u.addr)
+			case "tcp":
+				network = "tcp"
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, u.addr)
+		},
+	}
+	return u, nil
+}
+
+func (u *dnsUpstream) String() string {
+	return u.scheme + "://" + u.addr
+}
+
+type Options struct {
+	// Upstreams are queried in order, the next one will be used only if the previous one failed
+	Upstreams []Upstream
+	// CacheTTL is how long the results are cached, 0 disables the cache
+	CacheTTL time.Duration
+	// Timeout is the timeout of each upstream query
+	Timeout time.Duration
+}
+
+type cacheEntry struct {
+	ips    []net.IPAddr
+	expire time.Time
+}
+
+// Resolver looks up the hosts by the upstreams with fallback, and caches the results.
+// It can be used as a dialer for http.Transport
+type Resolver struct {
+	upstreams []Upstream
+	cacheTTL  time.Duration
+	timeout   time.Duration
+	dialer    net.Dialer
+
+	cacheMux sync.RWMutex
+	cache    map[string]cacheEntry
+}
+
+func New(opts Options) *Resolver {
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 5
+	}
+	return &Resolver{
+		upstreams: opts.Upstreams,
+		cacheTTL:  opts.CacheTTL,
+		timeout:   opts.Timeout,
+		dialer: net.Dialer{
+			Timeout:   time.Second * 30,
+			KeepAlive: time.Second * 30,
+		},
+		cache: make(map[string]cacheEntry),
+	}
+}
+
+func (r *Resolver) getCache(host string) (ips []net.IPAddr, expired bool, ok bool) {
+	r.cacheMux.RLock()
+	defer r.cacheMux.RUnlock()
+	e, ok := r.cache[host]
+	if !ok {
+		return nil, false, false
+	}
+	return e.ips, time.Now().After(e.expire), true
+}
+
+func (r *Resolver) putCache(host string, ips []net.IPAddr) {
+	if r.cacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	r.cacheMux.Lock()
+	defer r.cacheMux.Unlock()
+	if len(r.cache) >= 1024 {
+		for h, e := range r.cache {
+			if now.After(e.expire) {
+				delete(r.cache, h)
+			}
+		}
+	}
+	r.cache[host] = cacheEntry{
+		ips:    ips,
+		expire: now.Add(r.cacheTTL),
+	}
+}
+
+// LookupIPAddr queries the upstreams in order until one of them succeeded.
+// If all upstreams failed, the expired cached result will be used if there is one
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) (ips []net.IPAddr, err error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	cached, expired, ok := r.getCache(host)
+	if ok && !expired {
+		return cached, nil
+	}
+
+	var errs []error
+	for _, u := range r.upstreams {
+		tctx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, err = u.LookupIPAddr(tctx, host)
+		cancel()
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("No address found for %q", host)
+		}
+		if err == nil {
+			r.putCache(host, ips)
+			return
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Debugf("DNS upstream %s cannot resolve %q: %v", u, host, err)
+		errs = append(errs, fmt.Errorf("%s: %w", u, err))
+	}
+	if ok {
+		log.Warnf("All DNS upstreams failed to resolve %q, using expired cache", host)
+		return cached, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("No DNS upstream is configured")
+	}
+	return nil, fmt.Errorf("Cannot resolve %q: %w", host, errors.Join(errs...))
+}
+
+// DialContext resolves the address with the upstreams, and connects to the resolved IPs in order
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return r.dialer.DialContext(ctx, network, address)
+	}
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return
+	}
+	// prefer IPv4 since IPv6 is often unreachable
+	sorted := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() == nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	err = fmt.Errorf("No suitable address found for %q", host)
+	for _, ip := range sorted {
+		is4 := ip.IP.To4() != nil
+		if (strings.HasSuffix(network, "4") && !is4) || (strings.HasSuffix(network, "6") && is4) {
+			continue
+		}
+		if conn, err = r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
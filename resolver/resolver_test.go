@@ -0,0 +1,133 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package resolver
+
+import (
+	"testing"
+
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+type fakeUpstream struct {
+	name  string
+	ips   []net.IPAddr
+	err   error
+	calls int
+}
+
+func (u *fakeUpstream) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	u.calls++
+	return u.ips, u.err
+}
+
+func (u *fakeUpstream) String() string {
+	return u.name
+}
+
+func TestResolverFallback(t *testing.T) {
+	bad := &fakeUpstream{name: "bad", err: errors.New("poisoned")}
+	good := &fakeUpstream{name: "good", ips: []net.IPAddr{{IP: net.IPv4(10, 0, 0, 1)}}}
+	r := New(Options{
+		Upstreams: []Upstream{bad, good},
+		CacheTTL:  time.Minute,
+	})
+
+	ips, err := r.LookupIPAddr(context.Background(), "Example.COM.")
+	if err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Unexpected result %v", ips)
+	}
+	if bad.calls != 1 || good.calls != 1 {
+		t.Errorf("Expected each upstream to be called once, got bad=%d good=%d", bad.calls, good.calls)
+	}
+
+	// the result should be cached
+	if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	if bad.calls != 1 || good.calls != 1 {
+		t.Errorf("Expected the cached result to be used, got bad=%d good=%d", bad.calls, good.calls)
+	}
+
+	// IP literals should not be resolved
+	if ips, err := r.LookupIPAddr(context.Background(), "127.0.0.1"); err != nil || len(ips) != 1 {
+		t.Errorf("Unexpected result for IP literal: %v, %v", ips, err)
+	}
+	if good.calls != 1 {
+		t.Errorf("Expected IP literal not to be resolved")
+	}
+}
+
+func TestResolverStaleCache(t *testing.T) {
+	up := &fakeUpstream{name: "up", ips: []net.IPAddr{{IP: net.IPv4(10, 0, 0, 2)}}}
+	r := New(Options{
+		Upstreams: []Upstream{up},
+		CacheTTL:  time.Nanosecond,
+	})
+	if _, err := r.LookupIPAddr(context.Background(), "example.com"); err != nil {
+		t.Fatalf("LookupIPAddr: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	up.ips, up.err = nil, errors.New("down")
+	ips, err := r.LookupIPAddr(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Expected the expired cache to be used, got %v", err)
+	}
+	if len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Unexpected result %v", ips)
+	}
+	if up.calls != 2 {
+		t.Errorf("Expected the upstream to be queried again, got %d calls", up.calls)
+	}
+
+	if _, err := r.LookupIPAddr(context.Background(), "other.example.com"); err == nil {
+		t.Errorf("Expected error when all upstreams failed")
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	for addr, want := range map[string]string{
+		"https://1.1.1.1/dns-query": "https://1.1.1.1/dns-query",
+		"tls://1.0.0.1":             "tls://1.0.0.1:853",
+		"tls://dns.google:8853":     "tls://dns.google:8853",
+		"8.8.8.8":                   "udp://8.8.8.8:53",
+		"tcp://[2001:4860::8888]":   "tcp://[2001:4860::8888]:53",
+	} {
+		u, err := ParseUpstream(addr)
+		if err != nil {
+			t.Errorf("ParseUpstream(%q): %v", addr, err)
+			continue
+		}
+		if got := u.String(); got != want {
+			t.Errorf("ParseUpstream(%q) = %q, want %q", addr, got, want)
+		}
+	}
+	for _, addr := range []string{"quic://1.1.1.1", "udp://bad host"} {
+		if _, err := ParseUpstream(addr); err == nil {
+			t.Errorf("Expected ParseUpstream(%q) to fail", addr)
+		}
+	}
+}
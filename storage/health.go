@@ -0,0 +1,372 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type HealthState int32
+
+const (
+	HealthHealthy HealthState = iota
+	HealthDegraded
+	HealthDown
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDown:
+		return "down"
+	default:
+		return fmt.Sprintf("HealthState(%d)", (int32)(s))
+	}
+}
+
+func (s HealthState) MarshalText() ([]byte, error) {
+	return ([]byte)(s.String()), nil
+}
+
+type HealthCheckOption struct {
+	// Interval is the duration between two active probes
+	Interval utils.YAMLDuration `yaml:"interval"`
+	// Timeout is the maximum duration of one probe
+	Timeout utils.YAMLDuration `yaml:"timeout"`
+	// DegradeAfter is the count of consecutive failures before the storage is marked as degraded
+	DegradeAfter int `yaml:"degrade-after"`
+	// DownAfter is the count of consecutive failures before the storage is marked as down
+	DownAfter int `yaml:"down-after"`
+	// RecoverAfter is the count of consecutive successes before a degraded storage is marked as healthy
+	RecoverAfter int `yaml:"recover-after"`
+}
+
+type HealthStatus struct {
+	State     HealthState `json:"state"`
+	Since     time.Time   `json:"since"`
+	Failures  int         `json:"failures"`
+	LastCheck time.Time   `json:"lastCheck"`
+	LastError string      `json:"lastError,omitempty"`
+}
+
+// HealthTracker wraps a storage and tracks its health state by both
+// the result of the download requests and the periodic probes.
+//
+// The state machine is:
+//
+//	healthy  --(DegradeAfter failures)-->  degraded
+//	degraded --(DownAfter failures)----->  down
+//	down     --(1 success)-------------->  degraded
+//	degraded --(RecoverAfter successes)->  healthy
+type HealthTracker struct {
+	Storage
+
+	id       string
+	opt      HealthCheckOption
+	onChange func(t *HealthTracker, from, to HealthState)
+
+	state     atomic.Int32
+	mux       sync.Mutex
+	since     time.Time
+	failures  int
+	successes int
+	lastCheck time.Time
+	lastErr   error
+	// initFailed is set if Init failed, the storage will be initialized again by the probes
+	initFailed bool
+	// runCtx is the context passed to Start, the storage is initialized again with it
+	// since the storage may keep using the context after Init returned
+	runCtx context.Context
+}
+
+func NewHealthTracker(id string, s Storage, opt HealthCheckOption, onChange func(t *HealthTracker, from, to HealthState)) *HealthTracker {
+	if opt.DegradeAfter <= 0 {
+		opt.DegradeAfter = 1
+	}
+	if opt.DownAfter < opt.DegradeAfter {
+		opt.DownAfter = opt.DegradeAfter
+	}
+	if opt.RecoverAfter <= 0 {
+		opt.RecoverAfter = 1
+	}
+	return &HealthTracker{
+		Storage:  s,
+		id:       id,
+		opt:      opt,
+		onChange: onChange,
+		since:    time.Now(),
+	}
+}
+
+func (t *HealthTracker) Id() string {
+	return t.id
+}
+
+// Unwrap returns the underlying storage
+func (t *HealthTracker) Unwrap() Storage {
+	return t.Storage
+}
+
+func (t *HealthTracker) State() HealthState {
+	return (HealthState)(t.state.Load())
+}
+
+func (t *HealthTracker) Status() (s HealthStatus) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	s.State = t.State()
+	s.Since = t.since
+	s.Failures = t.failures
+	s.LastCheck = t.lastCheck
+	if t.lastErr != nil {
+		s.LastError = t.lastErr.Error()
+	}
+	return
+}
+
+func (t *HealthTracker) setStateLocked(state HealthState) (from HealthState, changed bool) {
+	from = (HealthState)(t.state.Swap((int32)(state)))
+	if from == state {
+		return from, false
+	}
+	t.since = time.Now()
+	return from, true
+}
+
+// Init initializes the storage, the storage is marked as down if it failed
+func (t *HealthTracker) Init(ctx context.Context) (err error) {
+	if err = t.Storage.Init(ctx); err != nil {
+		err = fmt.Errorf("Init failed: %w", err)
+		t.mux.Lock()
+		t.initFailed = true
+		t.mux.Unlock()
+		t.markDown(err)
+		return
+	}
+	return nil
+}
+
+// markDown marks the storage as down immediately
+func (t *HealthTracker) markDown(err error) {
+	t.mux.Lock()
+	t.successes = 0
+	t.failures = max(t.failures, t.opt.DownAfter)
+	t.lastErr = err
+	from, changed := t.setStateLocked(HealthDown)
+	t.mux.Unlock()
+
+	if changed {
+		log.Warnf("Storage %s is now %s (was %s): %v", t.id, HealthDown, from, err)
+		if t.onChange != nil {
+			t.onChange(t, from, HealthDown)
+		}
+	}
+}
+
+func (t *HealthTracker) ReportFailure(err error) {
+	t.mux.Lock()
+	t.successes = 0
+	t.failures++
+	t.lastErr = err
+	state := t.State()
+	if t.failures >= t.opt.DownAfter {
+		state = HealthDown
+	} else if t.failures >= t.opt.DegradeAfter && state == HealthHealthy {
+		state = HealthDegraded
+	}
+	from, changed := t.setStateLocked(state)
+	t.mux.Unlock()
+
+	if changed {
+		log.Warnf("Storage %s is now %s (was %s): %v", t.id, state, from, err)
+		if t.onChange != nil {
+			t.onChange(t, from, state)
+		}
+	}
+}
+
+func (t *HealthTracker) ReportSuccess() {
+	t.mux.Lock()
+	if t.State() == HealthHealthy && t.failures == 0 {
+		t.mux.Unlock()
+		return
+	}
+	t.failures = 0
+	t.successes++
+	state := t.State()
+	switch state {
+	case HealthDown:
+		state = HealthDegraded
+		t.successes = 0
+	case HealthDegraded:
+		if t.successes >= t.opt.RecoverAfter {
+			state = HealthHealthy
+			t.lastErr = nil
+		}
+	}
+	from, changed := t.setStateLocked(state)
+	t.mux.Unlock()
+
+	if changed {
+		log.Infof("Storage %s is now %s (was %s)", t.id, state, from)
+		if t.onChange != nil {
+			t.onChange(t, from, state)
+		}
+	}
+}
+
+// isStorageFailure reports whether the error is caused by the storage itself,
+// not by the client or a missing file
+func isStorageFailure(req *http.Request, err error) bool {
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if req != nil && req.Context().Err() != nil {
+		return false
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+func (t *HealthTracker) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	n, err := t.Storage.ServeDownload(rw, req, hash, size)
+	if err == nil {
+		t.ReportSuccess()
+	} else if isStorageFailure(req, err) {
+		t.ReportFailure(err)
+	}
+	return n, err
+}
+
+// discardResponseWriter only records the status code
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(buf), nil
+}
+
+// Probe checks if the storage is writable and can serve the measure requests
+// The timeout only applies to the checks, the storage is initialized again with the context passed to Start
+func (t *HealthTracker) Probe(ctx context.Context) (err error) {
+	defer func() {
+		t.mux.Lock()
+		t.lastCheck = time.Now()
+		t.mux.Unlock()
+	}()
+
+	t.mux.Lock()
+	initFailed, initCtx := t.initFailed, t.runCtx
+	t.mux.Unlock()
+	if initFailed {
+		if initCtx == nil {
+			initCtx = ctx
+		}
+		if err = t.Storage.Init(initCtx); err != nil {
+			return fmt.Errorf("Init failed: %w", err)
+		}
+		t.mux.Lock()
+		t.initFailed = false
+		t.mux.Unlock()
+	}
+
+	if timeout := t.opt.Timeout.Dur(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err = t.Storage.CheckUpload(ctx); err != nil {
+		return fmt.Errorf("Check upload failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/measure/1", nil)
+	if err != nil {
+		return
+	}
+	rw := &discardResponseWriter{header: make(http.Header)}
+	if err = t.Storage.ServeMeasure(rw, req, 1); err != nil {
+		return fmt.Errorf("Serve measure failed: %w", err)
+	}
+	if rw.status >= 400 {
+		return fmt.Errorf("Serve measure failed: unexpected status %d", rw.status)
+	}
+	return nil
+}
+
+// Start probes the storage periodically until the context is canceled
+func (t *HealthTracker) Start(ctx context.Context) {
+	t.mux.Lock()
+	t.runCtx = ctx
+	t.mux.Unlock()
+
+	interval := t.opt.Interval.Dur()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		defer log.RecoverPanic(nil)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := t.Probe(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Debugf("Storage %s probe failed: %v", t.id, err)
+				t.ReportFailure(err)
+			} else {
+				t.ReportSuccess()
+			}
+		}
+	}()
+}
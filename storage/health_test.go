@@ -0,0 +1,151 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type flakyStorage struct {
+	LocalStorage
+	err     error
+	initErr error
+	initCtx context.Context
+}
+
+func (s *flakyStorage) Init(ctx context.Context) error {
+	s.initCtx = ctx
+	return s.initErr
+}
+
+func (s *flakyStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 0, nil
+}
+
+func TestHealthTracker(t *testing.T) {
+	type change struct{ from, to HealthState }
+	var changes []change
+
+	s := new(flakyStorage)
+	h := NewHealthTracker("test", s, HealthCheckOption{
+		DegradeAfter: 1,
+		DownAfter:    3,
+		RecoverAfter: 2,
+	}, func(_ *HealthTracker, from, to HealthState) {
+		changes = append(changes, change{from, to})
+	})
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "/download/test", nil)
+		h.ServeDownload(httptest.NewRecorder(), req, "test", 0)
+	}
+
+	s.err = os.ErrNotExist
+	serve()
+	if st := h.State(); st != HealthHealthy {
+		t.Fatalf("Missing file should not affect the health state, got %s", st)
+	}
+
+	s.err = errors.New("connection refused")
+	for i, expect := range []HealthState{HealthDegraded, HealthDegraded, HealthDown} {
+		serve()
+		if st := h.State(); st != expect {
+			t.Fatalf("After %d failures, expect state %s, got %s", i+1, expect, st)
+		}
+	}
+
+	s.err = nil
+	for i, expect := range []HealthState{HealthDegraded, HealthDegraded, HealthHealthy} {
+		serve()
+		if st := h.State(); st != expect {
+			t.Fatalf("After %d successes, expect state %s, got %s", i+1, expect, st)
+		}
+	}
+
+	expectChanges := []change{
+		{HealthHealthy, HealthDegraded},
+		{HealthDegraded, HealthDown},
+		{HealthDown, HealthDegraded},
+		{HealthDegraded, HealthHealthy},
+	}
+	if len(changes) != len(expectChanges) {
+		t.Fatalf("Expect state changes %v, got %v", expectChanges, changes)
+	}
+	for i, c := range expectChanges {
+		if changes[i] != c {
+			t.Errorf("State change [%d]: expect %v, got %v", i, c, changes[i])
+		}
+	}
+}
+
+func TestHealthTrackerInitFailed(t *testing.T) {
+	var changes int
+	s := &flakyStorage{initErr: errors.New("connection refused")}
+	h := NewHealthTracker("test", s, HealthCheckOption{
+		Timeout:      (utils.YAMLDuration)(time.Second),
+		DegradeAfter: 1,
+		DownAfter:    3,
+		RecoverAfter: 1,
+	}, func(_ *HealthTracker, from, to HealthState) {
+		changes++
+	})
+
+	if err := h.Init(context.Background()); err == nil {
+		t.Fatalf("Expect Init to fail")
+	}
+	if st := h.State(); st != HealthDown {
+		t.Fatalf("Expect state %s after Init failed, got %s", HealthDown, st)
+	}
+	if status := h.Status(); status.LastError == "" {
+		t.Errorf("Expect the Init error to be recorded")
+	}
+	if changes != 1 {
+		t.Errorf("Expect 1 state change, got %d", changes)
+	}
+
+	if err := h.Probe(context.Background()); err == nil {
+		t.Fatalf("Expect Probe to fail while Init is still failing")
+	}
+
+	// the storage should be initialized again with the context passed to Start, not the probe's timeout context
+	type ctxKey struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "run"))
+	defer cancel()
+	h.Start(ctx)
+	s.initErr = nil
+	h.Probe(context.Background())
+	if s.initCtx.Value(ctxKey{}) != "run" {
+		t.Errorf("Expect the storage to be initialized again with the context passed to Start")
+	}
+	if _, ok := s.initCtx.Deadline(); ok {
+		t.Errorf("Expect the init context to have no deadline")
+	}
+}
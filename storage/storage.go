@@ -58,6 +58,8 @@ const (
 	StorageLocal  = "local"
 	StorageMount  = "mount"
 	StorageWebdav = "webdav"
+	StorageS3     = "s3"
+	StorageTiered = "tiered"
 )
 
 type StorageFactory struct {
@@ -0,0 +1,460 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"gopkg.in/yaml.v3"
+
+	gocache "github.com/LiterMC/go-openbmclapi/cache"
+	"github.com/LiterMC/go-openbmclapi/internal/build"
+	"github.com/LiterMC/go-openbmclapi/internal/gosrc"
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type S3StorageOption struct {
+	// EndPoint is the host[:port] of the S3 service, without scheme
+	EndPoint  string `yaml:"endpoint"`
+	UseSSL    bool   `yaml:"use-ssl"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+	PathStyle bool   `yaml:"path-style"`
+
+	PresignExpiry   utils.YAMLDuration `yaml:"presign-expiry"`
+	Proxy           bool               `yaml:"proxy"`
+	MaxConn         int                `yaml:"max-conn"`
+	MaxUploadRate   int                `yaml:"max-upload-rate"`
+	MaxDownloadRate int                `yaml:"max-download-rate"`
+	PreGenMeasures  bool               `yaml:"pre-gen-measures"`
+}
+
+var (
+	_ yaml.Marshaler   = (*S3StorageOption)(nil)
+	_ yaml.Unmarshaler = (*S3StorageOption)(nil)
+)
+
+func (o *S3StorageOption) MarshalYAML() (any, error) {
+	type T S3StorageOption
+	return (*T)(o), nil
+}
+
+func (o *S3StorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.UseSSL = true
+	o.PathStyle = false
+	o.PresignExpiry = (utils.YAMLDuration)(time.Hour)
+	o.Proxy = false
+	o.MaxConn = 64
+	o.MaxUploadRate = 0
+	o.MaxDownloadRate = 0
+	o.PreGenMeasures = false
+
+	type T S3StorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	return
+}
+
+type S3Storage struct {
+	opt S3StorageOption
+
+	cache         gocache.Cache
+	cli           *minio.Client
+	limitedDialer *limited.LimitedDialer
+	httpCli       *http.Client
+
+	measures *utils.SyncMap[int, struct{}]
+}
+
+var _ Storage = (*S3Storage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageS3, StorageFactory{
+		New:       func() Storage { return new(S3Storage) },
+		NewConfig: func() any { return new(S3StorageOption) },
+	})
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("<S3Storage endpoint=%q bucket=%q prefix=%q>", s.opt.EndPoint, s.opt.Bucket, s.opt.Prefix)
+}
+
+func (s *S3Storage) Options() any {
+	return &s.opt
+}
+
+func (s *S3Storage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*S3StorageOption))
+}
+
+func s3IsNotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return true
+	}
+	return false
+}
+
+// s3WrapError converts the S3 not found errors to os.ErrNotExist
+func s3WrapError(err error) error {
+	if err != nil && s3IsNotFound(err) {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	return err
+}
+
+func (s *S3Storage) Init(ctx context.Context) (err error) {
+	if s.opt.EndPoint == "" {
+		return errors.New("S3 endpoint cannot be empty")
+	}
+	if s.opt.Bucket == "" {
+		return errors.New("S3 bucket cannot be empty")
+	}
+
+	if cache, ok := ctx.Value(ClusterCacheCtxKey).(gocache.Cache); ok && cache != nil {
+		s.cache = gocache.NewCacheWithNamespace(cache, fmt.Sprintf("presign-cache@%s/%s/%s@", s.opt.EndPoint, s.opt.Bucket, s.opt.Prefix))
+	} else {
+		s.cache = gocache.NoCache
+	}
+
+	s.limitedDialer = limited.NewLimitedDialer(nil, s.opt.MaxConn, s.opt.MaxDownloadRate*1024, s.opt.MaxUploadRate*1024)
+	s.limitedDialer.SetMinReadRate(1024)
+	s.limitedDialer.SetMinWriteRate(1024)
+
+	transport := &http.Transport{
+		DialContext: s.limitedDialer.DialContext,
+	}
+	s.httpCli = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	lookup := minio.BucketLookupAuto
+	if s.opt.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	if s.cli, err = minio.New(s.opt.EndPoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(s.opt.AccessKey, s.opt.SecretKey, ""),
+		Secure:       s.opt.UseSSL,
+		Region:       s.opt.Region,
+		BucketLookup: lookup,
+		Transport:    transport,
+	}); err != nil {
+		return
+	}
+	s.cli.SetAppInfo("go-openbmclapi-cluster", build.BuildVersion)
+
+	ok, err := s.cli.BucketExists(ctx, s.opt.Bucket)
+	if err != nil {
+		return
+	}
+	if !ok {
+		return fmt.Errorf("S3 bucket %q does not exist", s.opt.Bucket)
+	}
+
+	s.measures = utils.NewSyncMap[int, struct{}]()
+	if s.opt.PreGenMeasures {
+		log.Infof("Creating measure files at %s", s.String())
+		for i := 1; i <= 200; i++ {
+			if err := s.createMeasureFile(ctx, i); err != nil {
+				log.Errorf("Cannot create measure file %d", i)
+			}
+		}
+		log.Info("Measure files created")
+	}
+	return
+}
+
+func (s *S3Storage) objectName(p string) string {
+	return path.Join(s.opt.Prefix, p)
+}
+
+func (s *S3Storage) hashToObject(hash string) string {
+	return s.objectName(path.Join("download", hash[0:2], hash))
+}
+
+func (s *S3Storage) putObject(ctx context.Context, name string, r io.ReadSeeker) error {
+	size, err := utils.GetReaderRemainSize(r)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Putting object %q", name)
+	_, err = s.cli.PutObject(ctx, s.opt.Bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *S3Storage) Size(hash string) (int64, error) {
+	info, err := s.cli.StatObject(context.Background(), s.opt.Bucket, s.hashToObject(hash), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s3WrapError(err)
+	}
+	return info.Size, nil
+}
+
+func (s *S3Storage) Open(hash string) (io.ReadCloser, error) {
+	return s.limitedDialer.DoReader(func() (io.Reader, error) {
+		obj, err := s.cli.GetObject(context.Background(), s.opt.Bucket, s.hashToObject(hash), minio.GetObjectOptions{})
+		if err != nil {
+			return nil, s3WrapError(err)
+		}
+		// GetObject is lazy, stat the object to make sure it's exists
+		if _, err = obj.Stat(); err != nil {
+			obj.Close()
+			return nil, s3WrapError(err)
+		}
+		return obj, nil
+	})
+}
+
+func (s *S3Storage) Create(hash string, r io.ReadSeeker) error {
+	return s.putObject(context.Background(), s.hashToObject(hash), r)
+}
+
+func (s *S3Storage) Remove(hash string) error {
+	return s.cli.RemoveObject(context.Background(), s.opt.Bucket, s.hashToObject(hash), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) WalkDir(walker func(hash string, size int64) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prefix := s.objectName("download") + "/"
+	for obj := range s.cli.ListObjects(ctx, s.opt.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		dir, hash := path.Split(strings.TrimPrefix(obj.Key, prefix))
+		if len(hash) < 2 || dir != hash[:2]+"/" {
+			continue
+		}
+		if err := walker(hash, obj.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) presign(ctx context.Context, name string, filename string) (string, error) {
+	expiry := s.opt.PresignExpiry.Dur()
+	if expiry <= 0 {
+		expiry = time.Hour
+	}
+	var params url.Values
+	if filename != "" {
+		params = url.Values{
+			"response-content-disposition": {fmt.Sprintf("attachment; filename=%q", filename)},
+		}
+	}
+	u, err := s.cli.PresignedGetObject(ctx, s.opt.Bucket, name, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *S3Storage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	name := req.URL.Query().Get("name")
+	if !s.opt.Proxy {
+		// only reuse the link that have at least half of its lifetime
+		cacheExp := s.opt.PresignExpiry.Dur() / 2
+		cacheKey := hash + ";" + name
+		location, ok := s.cache.Get(cacheKey)
+		if !ok {
+			var err error
+			if location, err = s.presign(req.Context(), s.hashToObject(hash), name); err != nil {
+				return 0, err
+			}
+			if cacheExp > 0 {
+				s.cache.Set(cacheKey, location, gocache.CacheOpt{Expiration: cacheExp})
+			}
+		}
+		// fix the size for Ranged request
+		rgs, err := gosrc.ParseRange(req.Header.Get("Range"), size)
+		if err == nil && len(rgs) > 0 {
+			var newSize int64 = 0
+			for _, r := range rgs {
+				newSize += r.Length
+			}
+			if newSize < size {
+				size = newSize
+			}
+		}
+		rw.Header().Set("Location", location)
+		if cacheExp > 0 {
+			rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", (int64)(cacheExp.Seconds())))
+		}
+		rw.WriteHeader(http.StatusFound)
+		return size, nil
+	}
+
+	target, err := s.presign(req.Context(), s.hashToObject(hash), "")
+	if err != nil {
+		return 0, err
+	}
+	tgReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	tgReq.Header.Set("User-Agent", build.ClusterUserAgentFull)
+	copyHeader("Range", tgReq.Header, req.Header)
+	copyHeader("If-Modified-Since", tgReq.Header, req.Header)
+	copyHeader("If-Unmodified-Since", tgReq.Header, req.Header)
+	copyHeader("If-None-Match", tgReq.Header, req.Header)
+	copyHeader("If-Match", tgReq.Header, req.Header)
+	copyHeader("If-Range", tgReq.Header, req.Header)
+
+	resp, err := s.httpCli.Do(tgReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	log.Debugf("Requested %q: status=%d", s.hashToObject(hash), resp.StatusCode)
+
+	rwh := rw.Header()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		copyHeader("ETag", rwh, resp.Header)
+		copyHeader("Last-Modified", rwh, resp.Header)
+		copyHeader("Content-Length", rwh, resp.Header)
+		copyHeader("Content-Range", rwh, resp.Header)
+		if name != "" {
+			rwh.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		rw.WriteHeader(resp.StatusCode)
+		n, _ := io.Copy(rw, resp.Body)
+		return n, nil
+	case http.StatusNotModified:
+		copyHeader("ETag", rwh, resp.Header)
+		copyHeader("Last-Modified", rwh, resp.Header)
+		rw.WriteHeader(resp.StatusCode)
+		return 0, nil
+	case http.StatusNotFound:
+		return 0, fmt.Errorf("%w: %v", os.ErrNotExist, utils.NewHTTPStatusErrorFromResponse(resp))
+	default:
+		return 0, utils.NewHTTPStatusErrorFromResponse(resp)
+	}
+}
+
+func (s *S3Storage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	if !s.opt.Proxy {
+		if err := s.createMeasureFile(req.Context(), size); err != nil {
+			return err
+		}
+		location, err := s.presign(req.Context(), s.objectName(path.Join("measure", strconv.Itoa(size))), "")
+		if err != nil {
+			return err
+		}
+		rw.Header().Set("Location", location)
+		rw.WriteHeader(http.StatusFound)
+		return nil
+	}
+	// Do not read empty file from S3, it's not helpful
+	rw.Header().Set("Content-Length", strconv.Itoa(size*utils.MbChunkSize))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		for i := 0; i < size; i++ {
+			rw.Write(utils.MbChunk[:])
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) createMeasureFile(ctx context.Context, size int) error {
+	if s.measures.Has(size) {
+		return nil
+	}
+	t := s.objectName(path.Join("measure", strconv.Itoa(size)))
+	tsz := (int64)(size) * utils.MbChunkSize
+	if size == 0 {
+		tsz = 2
+	}
+	if info, err := s.cli.StatObject(ctx, s.opt.Bucket, t, minio.StatObjectOptions{}); err == nil {
+		if info.Size == tsz {
+			s.measures.Set(size, struct{}{})
+			return nil
+		}
+		log.Debugf("File [%d] size %d does not match %d", size, info.Size, tsz)
+	} else if e := ctx.Err(); e != nil {
+		return e
+	} else if !s3IsNotFound(err) {
+		log.Errorf("Cannot get stat of %s: %v", t, err)
+	}
+	log.Infof("Creating measure file at %q", t)
+	if err := s.putObject(ctx, t, io.NewSectionReader(utils.EmptyReader, 0, tsz)); err != nil {
+		log.Errorf("Cannot create measure file %q: %v", t, err)
+		return err
+	}
+	s.measures.Set(size, struct{}{})
+	return nil
+}
+
+func (s *S3Storage) CheckUpload(ctx context.Context) (err error) {
+	fileName := s.objectName(".check")
+	log.Debugf("Checking upload at %s ...", s.String())
+
+	data := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err = s.putObject(ctx, fileName, strings.NewReader(data)); err != nil {
+		return
+	}
+
+	obj, err := s.cli.GetObject(ctx, s.opt.Bucket, fileName, minio.GetObjectOptions{})
+	if err != nil {
+		return
+	}
+	res, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil {
+		return
+	}
+	if sres := (string)(res); sres != data {
+		return fmt.Errorf("Content not match, expected %q, got %q", data, sres)
+	}
+
+	if err = s.cli.RemoveObject(ctx, s.opt.Bucket, fileName, minio.RemoveObjectOptions{}); err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,323 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// s3Stub is a minimal in memory S3 (MinIO style, path bucket lookup) server
+// it only implements the APIs that S3Storage is using, and does not verify signatures
+type s3Stub struct {
+	bucket string
+
+	mux     sync.RWMutex
+	objects map[string][]byte
+}
+
+func newS3Stub(bucket string) *s3Stub {
+	return &s3Stub{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+	}
+}
+
+func (s *s3Stub) writeError(rw http.ResponseWriter, req *http.Request, code int, errCode string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(code)
+	if req.Method != http.MethodHead {
+		fmt.Fprintf(rw, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, errCode, errCode)
+	}
+}
+
+// readAWSChunked decodes the body that signed with STREAMING-AWS4-HMAC-SHA256-PAYLOAD
+func readAWSChunked(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		data = append(data, buf[:size]...)
+	}
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *s3Stub) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.writeError(rw, req, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		switch req.Method {
+		case http.MethodHead:
+			rw.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			s.listObjects(rw, req)
+		default:
+			s.writeError(rw, req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		var (
+			data []byte
+			err  error
+		)
+		if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data, err = readAWSChunked(req.Body)
+		} else {
+			data, err = io.ReadAll(req.Body)
+		}
+		if err != nil {
+			s.writeError(rw, req, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.mux.Lock()
+		s.objects[key] = data
+		s.mux.Unlock()
+		rw.Header().Set("ETag", etagOf(data))
+		rw.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		s.mux.RLock()
+		data, ok := s.objects[key]
+		s.mux.RUnlock()
+		if !ok {
+			s.writeError(rw, req, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		rw.Header().Set("ETag", etagOf(data))
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		http.ServeContent(rw, req, key, time.Unix(0, 0), strings.NewReader((string)(data)))
+	case http.MethodDelete:
+		s.mux.Lock()
+		delete(s.objects, key)
+		s.mux.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(rw, req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *s3Stub) listObjects(rw http.ResponseWriter, req *http.Request) {
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+	type listBucketResult struct {
+		XMLName     xml.Name  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string    `xml:"Name"`
+		Prefix      string    `xml:"Prefix"`
+		KeyCount    int       `xml:"KeyCount"`
+		MaxKeys     int       `xml:"MaxKeys"`
+		IsTruncated bool      `xml:"IsTruncated"`
+		Contents    []content `xml:"Contents"`
+	}
+	prefix := req.URL.Query().Get("prefix")
+	res := listBucketResult{
+		Name:    s.bucket,
+		Prefix:  prefix,
+		MaxKeys: 1000,
+	}
+	s.mux.RLock()
+	for k, v := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			res.Contents = append(res.Contents, content{
+				Key:          k,
+				LastModified: time.Unix(0, 0).UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag:         etagOf(v),
+				Size:         (int64)(len(v)),
+			})
+		}
+	}
+	s.mux.RUnlock()
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	res.KeyCount = len(res.Contents)
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(http.StatusOK)
+	xml.NewEncoder(rw).Encode(&res)
+}
+
+func newTestS3Storage(t *testing.T, proxy bool) (*S3Storage, *s3Stub) {
+	stub := newS3Stub("bmclapi")
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+
+	s := new(S3Storage)
+	s.SetOptions(&S3StorageOption{
+		EndPoint:      u.Host,
+		UseSSL:        false,
+		Region:        "us-east-1",
+		Bucket:        "bmclapi",
+		Prefix:        "cache",
+		AccessKey:     "minioadmin",
+		SecretKey:     "minioadmin",
+		PathStyle:     true,
+		PresignExpiry: (utils.YAMLDuration)(time.Hour),
+		Proxy:         proxy,
+		MaxConn:       4,
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Cannot init S3 storage: %v", err)
+	}
+	return s, stub
+}
+
+func TestS3Storage(t *testing.T) {
+	s, stub := newTestS3Storage(t, false)
+
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	const content = "hello, openbmclapi"
+
+	if _, err := s.Size(hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Size of not exists file should returns os.ErrNotExist, got %v", err)
+	}
+	if err := s.Create(hash, strings.NewReader(content)); err != nil {
+		t.Fatalf("Cannot create file: %v", err)
+	}
+	if _, ok := stub.objects["cache/download/01/"+hash]; !ok {
+		t.Errorf("Object is not created at the expected key")
+	}
+	if size, err := s.Size(hash); err != nil {
+		t.Errorf("Cannot get size: %v", err)
+	} else if size != (int64)(len(content)) {
+		t.Errorf("Size not match, expect %d, got %d", len(content), size)
+	}
+
+	r, err := s.Open(hash)
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Errorf("Cannot read file: %v", err)
+	} else if (string)(data) != content {
+		t.Errorf("Content not match, expect %q, got %q", content, data)
+	}
+
+	walked := make(map[string]int64)
+	if err := s.WalkDir(func(hash string, size int64) error {
+		walked[hash] = size
+		return nil
+	}); err != nil {
+		t.Errorf("WalkDir failed: %v", err)
+	}
+	if len(walked) != 1 || walked[hash] != (int64)(len(content)) {
+		t.Errorf("Unexpected WalkDir result: %v", walked)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash+"?name=a.jar", nil)
+	rec := httptest.NewRecorder()
+	if _, err := s.ServeDownload(rec, req, hash, (int64)(len(content))); err != nil {
+		t.Errorf("ServeDownload failed: %v", err)
+	}
+	if rec.Code != http.StatusFound {
+		t.Errorf("ServeDownload should redirect, got status %d", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); !strings.Contains(loc, "X-Amz-Signature=") || !strings.Contains(loc, hash) {
+		t.Errorf("Location %q is not a presigned link", loc)
+	}
+
+	if err := s.CheckUpload(context.Background()); err != nil {
+		t.Errorf("CheckUpload failed: %v", err)
+	}
+
+	if err := s.Remove(hash); err != nil {
+		t.Errorf("Cannot remove file: %v", err)
+	}
+	if _, err := s.Size(hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Size of removed file should returns os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestS3StorageProxy(t *testing.T) {
+	s, _ := newTestS3Storage(t, true)
+
+	const hash = "89abcdef0123456789abcdef0123456789abcdef"
+	const content = "proxied content"
+
+	if err := s.Create(hash, strings.NewReader(content)); err != nil {
+		t.Fatalf("Cannot create file: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	req.Header.Set("Range", "bytes=8-")
+	rec := httptest.NewRecorder()
+	n, err := s.ServeDownload(rec, req, hash, (int64)(len(content)))
+	if err != nil {
+		t.Fatalf("ServeDownload failed: %v", err)
+	}
+	if rec.Code != http.StatusPartialContent {
+		t.Errorf("Expect status %d, got %d", http.StatusPartialContent, rec.Code)
+	}
+	if body := rec.Body.String(); body != content[8:] || n != (int64)(len(body)) {
+		t.Errorf("Unexpected proxied body %q (%d bytes)", body, n)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/download/0000000000000000000000000000000000000000", nil)
+	rec = httptest.NewRecorder()
+	if _, err := s.ServeDownload(rec, req, "0000000000000000000000000000000000000000", 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ServeDownload should returns os.ErrNotExist for not exists file, got %v", err)
+	}
+}
@@ -0,0 +1,516 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type TieredStorageOption struct {
+	// Fast is the small and fast tier, usually a local storage
+	Fast StorageOption `yaml:"fast"`
+	// Slow is the large and slow tier that stores all files, usually a webdav or mount storage
+	Slow StorageOption `yaml:"slow"`
+
+	// FastSizeLimit is the size budget of the fast tier in MiB
+	FastSizeLimit int64 `yaml:"fast-size-limit"`
+	// PromoteHits is the count of hits within Window that a file needs to be promoted
+	PromoteHits int                `yaml:"promote-hits"`
+	Window      utils.YAMLDuration `yaml:"window"`
+}
+
+var (
+	_ yaml.Marshaler   = (*TieredStorageOption)(nil)
+	_ yaml.Unmarshaler = (*TieredStorageOption)(nil)
+)
+
+func (o *TieredStorageOption) MarshalYAML() (any, error) {
+	type T TieredStorageOption
+	return (*T)(o), nil
+}
+
+func (o *TieredStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.FastSizeLimit = 1024 * 10
+	o.PromoteHits = 5
+	o.Window = (utils.YAMLDuration)(time.Hour)
+
+	type T TieredStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	if o.Fast.Type == StorageTiered || o.Slow.Type == StorageTiered {
+		return errors.New("Tiered storage cannot be nested")
+	}
+	return
+}
+
+const (
+	TieredActionPromote = "promote"
+	TieredActionEvict   = "evict"
+)
+
+const maxTieredDecisions = 64
+
+// TieredDecision records a promotion or an eviction of the fast tier
+type TieredDecision struct {
+	At     time.Time `json:"at"`
+	Action string    `json:"action"`
+	Hash   string    `json:"hash"`
+	Size   int64     `json:"size"`
+	Hits   int       `json:"hits"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type TieredStatus struct {
+	FastUsed   int64            `json:"fastUsed"`
+	FastLimit  int64            `json:"fastLimit"`
+	HotFiles   int              `json:"hotFiles"`
+	Promotions int64            `json:"promotions"`
+	Evictions  int64            `json:"evictions"`
+	Decisions  []TieredDecision `json:"decisions"`
+}
+
+type hotFile struct {
+	size    int64
+	lastHit time.Time
+}
+
+type promoteState struct {
+	// removed is set if the file is removed while it is being promoted
+	removed bool
+}
+
+type TieredStorage struct {
+	opt TieredStorageOption
+
+	fast, slow Storage
+
+	hitMux sync.Mutex
+	// hits stores the recent hit times of each file, at most PromoteHits entries
+	hits map[string][]time.Time
+
+	mux        sync.RWMutex
+	hot        map[string]*hotFile
+	promoting  map[string]*promoteState
+	evicting   map[string]struct{} // the files that are being removed from the fast tier
+	fastUsed   int64
+	promotions int64
+	evictions  int64
+	decisions  []TieredDecision // a ring buffer
+	decPtr     int
+}
+
+var _ Storage = (*TieredStorage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageTiered, StorageFactory{
+		New:       func() Storage { return new(TieredStorage) },
+		NewConfig: func() any { return new(TieredStorageOption) },
+	})
+}
+
+func (s *TieredStorage) String() string {
+	return fmt.Sprintf("<TieredStorage fast=%s slow=%s>", s.fast, s.slow)
+}
+
+func (s *TieredStorage) Options() any {
+	return &s.opt
+}
+
+func (s *TieredStorage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*TieredStorageOption))
+	s.fast = NewStorage(s.opt.Fast)
+	s.slow = NewStorage(s.opt.Slow)
+}
+
+func (s *TieredStorage) fastLimit() int64 {
+	return s.opt.FastSizeLimit * 1024 * 1024
+}
+
+func (s *TieredStorage) Init(ctx context.Context) (err error) {
+	s.hits = make(map[string][]time.Time)
+	s.hot = make(map[string]*hotFile)
+	s.promoting = make(map[string]*promoteState)
+	s.evicting = make(map[string]struct{})
+	s.decisions = make([]TieredDecision, 0, maxTieredDecisions)
+
+	if err = s.slow.Init(ctx); err != nil {
+		return
+	}
+	if err = s.fast.Init(ctx); err != nil {
+		return
+	}
+
+	// files that promoted in the previous run are still hot
+	now := time.Now()
+	if err = s.fast.WalkDir(func(hash string, size int64) error {
+		s.hot[hash] = &hotFile{
+			size:    size,
+			lastHit: now,
+		}
+		s.fastUsed += size
+		return nil
+	}); err != nil {
+		return
+	}
+	log.Infof("Loaded %d hot files (%s) from %s", len(s.hot), utils.BytesToUnit((float64)(s.fastUsed)), s.fast.String())
+	s.mux.Lock()
+	victims := s.evictLocked(0)
+	s.mux.Unlock()
+	s.removeEvicted(victims)
+
+	go s.cleaner(ctx)
+	return
+}
+
+func (s *TieredStorage) cleaner(ctx context.Context) {
+	window := s.opt.Window.Dur()
+	if window <= 0 {
+		return
+	}
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired := time.Now().Add(-window)
+			s.hitMux.Lock()
+			for hash, times := range s.hits {
+				if times[len(times)-1].Before(expired) {
+					delete(s.hits, hash)
+				}
+			}
+			s.hitMux.Unlock()
+		}
+	}
+}
+
+// recordHit returns the count of the hits within the sliding window
+func (s *TieredStorage) recordHit(hash string) int {
+	now := time.Now()
+	expired := now.Add(-s.opt.Window.Dur())
+
+	s.hitMux.Lock()
+	defer s.hitMux.Unlock()
+
+	times := s.hits[hash]
+	i := 0
+	for i < len(times) && times[i].Before(expired) {
+		i++
+	}
+	times = append(times[i:], now)
+	if limit := s.opt.PromoteHits; limit > 0 && len(times) > limit {
+		times = times[len(times)-limit:]
+	}
+	s.hits[hash] = times
+	return len(times)
+}
+
+func (s *TieredStorage) addDecisionLocked(d TieredDecision) {
+	switch d.Action {
+	case TieredActionPromote:
+		s.promotions++
+	case TieredActionEvict:
+		s.evictions++
+	}
+	log.Debugf("[tiered]: %s %s (%d bytes, %d hits): %s", d.Action, d.Hash, d.Size, d.Hits, d.Reason)
+	if len(s.decisions) < maxTieredDecisions {
+		s.decisions = append(s.decisions, d)
+		return
+	}
+	s.decisions[s.decPtr] = d
+	s.decPtr = (s.decPtr + 1) % maxTieredDecisions
+}
+
+// evictLocked picks the least recently hit files out of the fast tier
+// until there are enough space for the incoming file.
+// The picked files must be removed by removeEvicted after the lock is released
+func (s *TieredStorage) evictLocked(incoming int64) (victims []string) {
+	limit := s.fastLimit()
+	if s.fastUsed+incoming <= limit {
+		return
+	}
+	type entry struct {
+		hash string
+		*hotFile
+	}
+	entries := make([]entry, 0, len(s.hot))
+	for hash, f := range s.hot {
+		entries = append(entries, entry{hash, f})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastHit.Before(entries[j].lastHit) })
+	now := time.Now()
+	for _, e := range entries {
+		if s.fastUsed+incoming <= limit {
+			break
+		}
+		delete(s.hot, e.hash)
+		s.evicting[e.hash] = struct{}{}
+		s.fastUsed -= e.size
+		victims = append(victims, e.hash)
+		s.addDecisionLocked(TieredDecision{
+			At:     now,
+			Action: TieredActionEvict,
+			Hash:   e.hash,
+			Size:   e.size,
+			Reason: fmt.Sprintf("cold since %s", e.lastHit.Format(time.RFC3339)),
+		})
+	}
+	return
+}
+
+// removeEvicted removes the files picked by evictLocked from the fast tier
+func (s *TieredStorage) removeEvicted(victims []string) {
+	for _, hash := range victims {
+		if err := s.fast.Remove(hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot remove %s from the fast tier: %v", hash, err)
+		}
+		s.mux.Lock()
+		delete(s.evicting, hash)
+		s.mux.Unlock()
+	}
+}
+
+// stagingDir returns the directory to download the promoting files,
+// so they are on the same disk as the fast tier
+func (s *TieredStorage) stagingDir() string {
+	switch fast := s.fast.(type) {
+	case *LocalStorage:
+		return fast.opt.CachePath
+	case *MountStorage:
+		return fast.opt.Path
+	}
+	return ""
+}
+
+func (s *TieredStorage) promote(hash string, size int64, hits int, state *promoteState) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.promoting, hash)
+		s.mux.Unlock()
+	}()
+
+	r, err := s.slow.Open(hash)
+	if err != nil {
+		log.Errorf("Cannot open %s from the slow tier: %v", hash, err)
+		return
+	}
+	fd, err := os.CreateTemp(s.stagingDir(), ".tiered-*.downloading")
+	if err != nil {
+		r.Close()
+		log.Errorf("Cannot create temporary file: %v", err)
+		return
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	n, err := io.Copy(fd, r)
+	r.Close()
+	if err != nil {
+		log.Errorf("Cannot read %s from the slow tier: %v", hash, err)
+		return
+	}
+	if size >= 0 && n != size {
+		log.Errorf("File size of %s does not match, expect %d, got %d", hash, size, n)
+		return
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	s.mux.Lock()
+	if state.removed {
+		s.mux.Unlock()
+		return
+	}
+	victims := s.evictLocked(n)
+	s.fastUsed += n // reserve the space
+	s.mux.Unlock()
+	s.removeEvicted(victims)
+
+	if err = s.fast.Create(hash, fd); err != nil {
+		log.Errorf("Cannot promote %s to the fast tier: %v", hash, err)
+		s.mux.Lock()
+		s.fastUsed -= n
+		s.mux.Unlock()
+		return
+	}
+
+	now := time.Now()
+	s.mux.Lock()
+	if state.removed {
+		// the file was removed during the promotion, so the copy in the fast tier is orphaned
+		s.fastUsed -= n
+		s.mux.Unlock()
+		if err := s.fast.Remove(hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot remove %s from the fast tier: %v", hash, err)
+		}
+		return
+	}
+	s.hot[hash] = &hotFile{
+		size:    n,
+		lastHit: now,
+	}
+	s.addDecisionLocked(TieredDecision{
+		At:     now,
+		Action: TieredActionPromote,
+		Hash:   hash,
+		Size:   n,
+		Hits:   hits,
+		Reason: fmt.Sprintf("%d hits within %s", hits, s.opt.Window.Dur()),
+	})
+	s.mux.Unlock()
+}
+
+// Status returns the status of the fast tier and the recent decisions from the newest to the oldest
+func (s *TieredStorage) Status() *TieredStatus {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	n := len(s.decisions)
+	decisions := make([]TieredDecision, n)
+	for i := 0; i < n; i++ {
+		decisions[i] = s.decisions[(s.decPtr-1-i+n*2)%n]
+	}
+	return &TieredStatus{
+		FastUsed:   s.fastUsed,
+		FastLimit:  s.fastLimit(),
+		HotFiles:   len(s.hot),
+		Promotions: s.promotions,
+		Evictions:  s.evictions,
+		Decisions:  decisions,
+	}
+}
+
+func (s *TieredStorage) isHot(hash string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if f, ok := s.hot[hash]; ok {
+		f.lastHit = time.Now()
+		return true
+	}
+	return false
+}
+
+func (s *TieredStorage) CheckUpload(ctx context.Context) (err error) {
+	if err = s.slow.CheckUpload(ctx); err != nil {
+		return
+	}
+	return s.fast.CheckUpload(ctx)
+}
+
+func (s *TieredStorage) Size(hash string) (int64, error) {
+	return s.slow.Size(hash)
+}
+
+func (s *TieredStorage) Open(hash string) (io.ReadCloser, error) {
+	if s.isHot(hash) {
+		if r, err := s.fast.Open(hash); err == nil {
+			return r, nil
+		}
+	}
+	return s.slow.Open(hash)
+}
+
+func (s *TieredStorage) Create(hash string, r io.ReadSeeker) error {
+	return s.slow.Create(hash, r)
+}
+
+func (s *TieredStorage) Remove(hash string) error {
+	s.mux.Lock()
+	f, hot := s.hot[hash]
+	if hot {
+		delete(s.hot, hash)
+		s.fastUsed -= f.size
+	}
+	if state, ok := s.promoting[hash]; ok {
+		state.removed = true
+	}
+	s.mux.Unlock()
+	if hot {
+		if err := s.fast.Remove(hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot remove %s from the fast tier: %v", hash, err)
+		}
+	}
+	return s.slow.Remove(hash)
+}
+
+func (s *TieredStorage) WalkDir(walker func(hash string, size int64) error) error {
+	return s.slow.WalkDir(walker)
+}
+
+func (s *TieredStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	hits := s.recordHit(hash)
+	if s.isHot(hash) {
+		srw := utils.WrapAsStatusResponseWriter(rw)
+		status, wrote := srw.Status, srw.Wrote
+		n, err := s.fast.ServeDownload(srw, req, hash, size)
+		if err == nil {
+			return n, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			s.mux.Lock()
+			if f, ok := s.hot[hash]; ok {
+				delete(s.hot, hash)
+				s.fastUsed -= f.size
+			}
+			s.mux.Unlock()
+		}
+		// the response cannot be restarted once anything was sent
+		if n != 0 || srw.Status != status || srw.Wrote != wrote {
+			return n, err
+		}
+		log.Warnf("Cannot serve %s from the fast tier, fallback to the slow tier: %v", hash, err)
+		rw = srw
+	} else if s.opt.PromoteHits > 0 && hits >= s.opt.PromoteHits && size <= s.fastLimit() {
+		var state *promoteState
+		s.mux.Lock()
+		_, promoting := s.promoting[hash]
+		_, evicting := s.evicting[hash]
+		if !promoting && !evicting {
+			state = new(promoteState)
+			s.promoting[hash] = state
+		}
+		s.mux.Unlock()
+		if state != nil {
+			go s.promote(hash, size, hits, state)
+		}
+	}
+	return s.slow.ServeDownload(rw, req, hash, size)
+}
+
+func (s *TieredStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	return s.fast.ServeMeasure(rw, req, size)
+}
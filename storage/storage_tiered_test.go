@@ -0,0 +1,270 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// blockingStorage blocks Open after the file is opened until unblock is closed
+type blockingStorage struct {
+	Storage
+	opened  chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingStorage) Open(hash string) (io.ReadCloser, error) {
+	r, err := s.Storage.Open(hash)
+	close(s.opened)
+	<-s.unblock
+	return r, err
+}
+
+// brokenStorage writes the first half of the file then fails
+type brokenStorage struct {
+	Storage
+	served int
+}
+
+func (s *brokenStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	s.served++
+	rw.WriteHeader(http.StatusOK)
+	n, _ := rw.Write(make([]byte, size/2))
+	return (int64)(n), errors.New("connection reset")
+}
+
+// newTestTieredStorage creates a tiered storage with a fast tier limited to 1 MiB
+func newTestTieredStorage(t *testing.T, promoteHits int) (*TieredStorage, string) {
+	dir := t.TempDir()
+	s := new(TieredStorage)
+	s.SetOptions(&TieredStorageOption{
+		Fast: StorageOption{
+			BasicStorageOption: BasicStorageOption{Type: StorageLocal},
+			Data:               &LocalStorageOption{CachePath: filepath.Join(dir, "fast")},
+		},
+		Slow: StorageOption{
+			BasicStorageOption: BasicStorageOption{Type: StorageLocal},
+			Data:               &LocalStorageOption{CachePath: filepath.Join(dir, "slow")},
+		},
+		FastSizeLimit: 1,
+		PromoteHits:   promoteHits,
+		Window:        (utils.YAMLDuration)(time.Hour),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	return s, dir
+}
+
+func tieredTestHash(c byte) string {
+	return strings.Repeat(string(c), 32)
+}
+
+func createTieredTestFile(t *testing.T, s *TieredStorage, hash string, size int) {
+	if err := s.Create(hash, bytes.NewReader(make([]byte, size))); err != nil {
+		t.Fatalf("Create %s: %v", hash, err)
+	}
+}
+
+func serveTiered(s *TieredStorage, hash string, size int64) {
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	s.ServeDownload(httptest.NewRecorder(), req, hash, size)
+}
+
+func waitTiered(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func (s *TieredStorage) isPromoting(hash string) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	_, ok := s.promoting[hash]
+	return ok
+}
+
+func TestTieredPromoteThreshold(t *testing.T) {
+	s, _ := newTestTieredStorage(t, 3)
+	hash := tieredTestHash('a')
+	createTieredTestFile(t, s, hash, 1024)
+
+	for i := 0; i < 2; i++ {
+		serveTiered(s, hash, 1024)
+	}
+	if s.isPromoting(hash) || s.isHot(hash) {
+		t.Fatalf("Expected the file not to be promoted before %d hits", 3)
+	}
+	serveTiered(s, hash, 1024)
+	waitTiered(t, func() bool { return !s.isPromoting(hash) })
+	if !s.isHot(hash) {
+		t.Fatalf("Expected the file to be promoted after 3 hits")
+	}
+	if _, err := s.fast.Size(hash); err != nil {
+		t.Errorf("Expected the file in the fast tier: %v", err)
+	}
+	st := s.Status()
+	if st.Promotions != 1 || st.FastUsed != 1024 || st.HotFiles != 1 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+}
+
+func TestTieredEvictionOrder(t *testing.T) {
+	s, dir := newTestTieredStorage(t, 1)
+	const size = 400 * 1024
+	a, b, c := tieredTestHash('a'), tieredTestHash('b'), tieredTestHash('c')
+	promote := func(hash string) {
+		serveTiered(s, hash, size)
+		waitTiered(t, func() bool { return !s.isPromoting(hash) })
+	}
+	for _, hash := range []string{a, b, c} {
+		createTieredTestFile(t, s, hash, size)
+	}
+	promote(a)
+	time.Sleep(time.Millisecond)
+	promote(b)
+	time.Sleep(time.Millisecond)
+	// a is hit again, so b becomes the least recently used one
+	serveTiered(s, a, size)
+	time.Sleep(time.Millisecond)
+	promote(c)
+
+	if !s.isHot(a) || s.isHot(b) || !s.isHot(c) {
+		t.Fatalf("Expected b to be evicted, hot a=%v b=%v c=%v", s.isHot(a), s.isHot(b), s.isHot(c))
+	}
+	if _, err := s.fast.Size(b); !os.IsNotExist(err) {
+		t.Errorf("Expected b to be removed from the fast tier, got %v", err)
+	}
+	st := s.Status()
+	if st.FastUsed != size*2 || st.Evictions != 1 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	if d := st.Decisions[0]; d.Action != TieredActionPromote || d.Hash != c {
+		t.Errorf("Expected the newest decision to be the promotion of c, got %+v", d)
+	}
+	if d := st.Decisions[1]; d.Action != TieredActionEvict || d.Hash != b {
+		t.Errorf("Expected the eviction of b, got %+v", d)
+	}
+	// the promoting files should be staged in the fast tier, not the system temp dir
+	if matches, _ := filepath.Glob(filepath.Join(dir, "fast", ".tiered-*")); len(matches) != 0 {
+		t.Errorf("Expected the staging files to be removed, got %v", matches)
+	}
+}
+
+func TestTieredRemoveDuringPromote(t *testing.T) {
+	s, _ := newTestTieredStorage(t, 1)
+	hash := tieredTestHash('a')
+	createTieredTestFile(t, s, hash, 1024)
+	slow := &blockingStorage{
+		Storage: s.slow,
+		opened:  make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	s.slow = slow
+
+	serveTiered(s, hash, 1024)
+	<-slow.opened
+	if !s.isPromoting(hash) {
+		t.Fatalf("Expected the file to be promoting")
+	}
+	if err := s.Remove(hash); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	close(slow.unblock)
+	waitTiered(t, func() bool { return !s.isPromoting(hash) })
+
+	if s.isHot(hash) {
+		t.Errorf("Expected the removed file not to be hot")
+	}
+	if _, err := s.fast.Size(hash); !os.IsNotExist(err) {
+		t.Errorf("Expected no orphaned copy in the fast tier, got %v", err)
+	}
+	if st := s.Status(); st.FastUsed != 0 || st.Promotions != 0 {
+		t.Errorf("Expected the reservation to be released, got %+v", st)
+	}
+}
+
+func TestTieredFallbackAfterPartialWrite(t *testing.T) {
+	s, _ := newTestTieredStorage(t, 1)
+	hash := tieredTestHash('a')
+	createTieredTestFile(t, s, hash, 1024)
+	serveTiered(s, hash, 1024)
+	waitTiered(t, func() bool { return !s.isPromoting(hash) })
+	if !s.isHot(hash) {
+		t.Fatalf("Expected the file to be promoted")
+	}
+
+	fast := &brokenStorage{Storage: s.fast}
+	s.fast = fast
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	rec := httptest.NewRecorder()
+	n, err := s.ServeDownload(rec, req, hash, 1024)
+	if fast.served != 1 {
+		t.Fatalf("Expected the file to be served from the fast tier")
+	}
+	if err == nil {
+		t.Errorf("Expected the error of the fast tier to be returned")
+	}
+	if n != 512 || rec.Body.Len() != 512 {
+		t.Errorf("Expected the slow tier not to write after the fast tier, got n=%d body=%d", n, rec.Body.Len())
+	}
+}
+
+func TestTieredFallbackMissingFile(t *testing.T) {
+	s, _ := newTestTieredStorage(t, 1)
+	hash := tieredTestHash('a')
+	createTieredTestFile(t, s, hash, 1024)
+	serveTiered(s, hash, 1024)
+	waitTiered(t, func() bool { return !s.isPromoting(hash) })
+	if err := s.fast.Remove(hash); err != nil {
+		t.Fatalf("Remove from the fast tier: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	rec := httptest.NewRecorder()
+	if _, err := s.ServeDownload(rec, req, hash, 1024); err != nil {
+		t.Fatalf("Expected the file to be served from the slow tier, got %v", err)
+	}
+	if rec.Body.Len() != 1024 {
+		t.Errorf("Expected 1024 bytes, got %d", rec.Body.Len())
+	}
+	if s.isHot(hash) {
+		t.Errorf("Expected the missing file not to be hot")
+	}
+}
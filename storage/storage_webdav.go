@@ -128,6 +128,7 @@ type WebDavStorage struct {
 	limitedDialer *limited.LimitedDialer
 	httpCli       *http.Client
 	noRedCli      *http.Client // no redirect client
+	checkCli      *http.Client // the client without rate limit, used by the checks
 
 	measures  *utils.SyncMap[int, struct{}]
 	working   atomic.Int32
@@ -161,7 +162,19 @@ func webdavIsHTTPError(err error, code int) bool {
 	return strings.Contains(err.Error(), expect)
 }
 
-const ClusterCacheCtxKey = "go-openbmclapi.cluster.cache"
+const (
+	ClusterCacheCtxKey  = "go-openbmclapi.cluster.cache"
+	ClusterDialerCtxKey = "go-openbmclapi.cluster.dialer"
+)
+
+// newDialerTransport clones the default transport to connect with the dialer.
+// The proxy from the environment is not used, since the dialer decides how to connect
+func newDialerTransport(dialer limited.NetDialer) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return transport
+}
 
 func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 	if s.opt.GetEndPoint() == "" {
@@ -174,7 +187,14 @@ func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 		s.cache = gocache.NoCache
 	}
 
-	s.limitedDialer = limited.NewLimitedDialer(nil, s.opt.MaxConn, s.opt.MaxDownloadRate*1024, s.opt.MaxUploadRate*1024)
+	s.checkCli = http.DefaultClient
+	dialer, _ := ctx.Value(ClusterDialerCtxKey).(limited.NetDialer)
+	if dialer != nil {
+		s.checkCli = &http.Client{
+			Transport: newDialerTransport(dialer),
+		}
+	}
+	s.limitedDialer = limited.NewLimitedDialer(dialer, s.opt.MaxConn, s.opt.MaxDownloadRate*1024, s.opt.MaxUploadRate*1024)
 	s.limitedDialer.SetMinReadRate(1024)
 	s.limitedDialer.SetMinWriteRate(1024)
 
@@ -190,6 +210,9 @@ func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 	}
 
 	s.cli = gowebdav.NewClient(s.opt.GetEndPoint(), s.opt.GetUsername(), s.opt.GetPassword())
+	if dialer != nil {
+		s.cli.SetTransport(s.checkCli.Transport)
+	}
 	s.cli.SetHeader("User-Agent", build.ClusterUserAgentFull)
 
 	if _, err = s.cli.ReadDir(""); err != nil {
@@ -595,7 +618,7 @@ func (s *WebDavStorage) checkAlive(ctx context.Context, size int) (err error) {
 	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
 	req.Header.Set("User-Agent", build.ClusterUserAgentFull)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.checkCli.Do(req)
 	if err != nil {
 		return
 	}
@@ -622,10 +645,10 @@ func (s *WebDavStorage) checkAlive(ctx context.Context, size int) (err error) {
 
 func (s *WebDavStorage) CheckUpload(ctx context.Context) (err error) {
 	const fileName = ".check"
-	log.Infof("Checking upload at %s ...", s.String())
+	log.Debugf("Checking upload at %s ...", s.String())
 
 	data := strconv.FormatInt(time.Now().UnixMilli(), 10)
-	if err = s.putFileWithClient(http.DefaultClient, fileName, strings.NewReader(data)); err != nil {
+	if err = s.putFileWithClient(s.checkCli, fileName, strings.NewReader(data)); err != nil {
 		return err
 	}
 
@@ -640,7 +663,7 @@ func (s *WebDavStorage) CheckUpload(ctx context.Context) (err error) {
 	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
 	req.Header.Set("User-Agent", build.ClusterUserAgentFull)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.checkCli.Do(req)
 	if err != nil {
 		return
 	}
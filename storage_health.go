@@ -0,0 +1,113 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+// availableStorageWeights returns the weights of the storages that are not down
+// the weight of a down storage will always be zero
+func (cr *Cluster) availableStorageWeights() (weights []uint, total uint, alive int) {
+	cr.storageWeightMux.RLock()
+	defer cr.storageWeightMux.RUnlock()
+
+	weights = make([]uint, len(cr.storageWeights))
+	for i, h := range cr.storageHealths {
+		if h.State() == storage.HealthDown {
+			continue
+		}
+		alive++
+		weights[i] = cr.storageWeights[i]
+		total += weights[i]
+	}
+	return
+}
+
+// setStorageWeights replaces the weights of the storages by their ids,
+// the storages that are not in the map will keep their old weights
+func (cr *Cluster) setStorageWeights(weights map[string]uint) {
+	cr.storageWeightMux.Lock()
+	defer cr.storageWeightMux.Unlock()
+	newWeights := make([]uint, len(cr.storageOpts))
+	var total uint
+	for i, opt := range cr.storageOpts {
+		w, ok := weights[opt.Id]
+		if !ok {
+			w = cr.storageWeights[i]
+		}
+		newWeights[i] = w
+		total += w
+	}
+	cr.storageWeights = newWeights
+	cr.storageTotalWeight = total
+}
+
+// firstAvailableStorage returns the first storage that is not down,
+// or the first storage if all of them are down
+func (cr *Cluster) firstAvailableStorage() storage.Storage {
+	for _, h := range cr.storageHealths {
+		if h.State() != storage.HealthDown {
+			return h
+		}
+	}
+	return cr.storages[0]
+}
+
+func (cr *Cluster) allStoragesDown() bool {
+	for _, h := range cr.storageHealths {
+		if h.State() != storage.HealthDown {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *Cluster) onStorageStateChange(h *storage.HealthTracker, from, to storage.HealthState) {
+	if to == storage.HealthDown {
+		if !cr.allStoragesDown() || !cr.shouldEnable.Load() {
+			return
+		}
+		if !cr.disabledByStorage.CompareAndSwap(false, true) {
+			return
+		}
+		log.Errorf("All storages are down, disabling the cluster")
+		go func() {
+			tctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			cr.Disable(tctx)
+		}()
+		return
+	}
+	if from == storage.HealthDown && cr.disabledByStorage.CompareAndSwap(true, false) {
+		log.Infof("Storage %s recovered, re-enabling the cluster", h.Id())
+		go func() {
+			tctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := cr.Enable(tctx); err != nil {
+				log.Errorf(Tr("error.cluster.enable.failed"), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,123 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+type storageStateListener = func(h *storage.HealthTracker, from, to storage.HealthState)
+
+// StoragePool holds the storages that are shared by the clusters,
+// so each storage is initialized and health checked only once
+type StoragePool struct {
+	opts    []storage.StorageOption
+	healths []*storage.HealthTracker
+	index   map[string]int
+
+	listenerMux  sync.RWMutex
+	listeners    map[string][]storageStateListener
+	allListeners []storageStateListener
+
+	initOnce sync.Once
+
+	// fileIndexMux serializes the read-modify-write operations on the file index,
+	// it's shared by all the clusters that use the pool, since they share the database and the storages
+	fileIndexMux sync.Mutex
+}
+
+func NewStoragePool(opts []storage.StorageOption) (p *StoragePool) {
+	p = &StoragePool{
+		opts:      opts,
+		healths:   make([]*storage.HealthTracker, len(opts)),
+		index:     make(map[string]int, len(opts)),
+		listeners: make(map[string][]storageStateListener),
+	}
+	for i, s := range opts {
+		p.healths[i] = storage.NewHealthTracker(s.Id, storage.NewStorage(s), config.StorageHealth, p.onStateChange)
+		p.index[s.Id] = i
+	}
+	return
+}
+
+// Select returns the options and the health trackers of the storages by their ids in order.
+// Empty ids means all storages
+func (p *StoragePool) Select(ids []string) (opts []storage.StorageOption, healths []*storage.HealthTracker, err error) {
+	if len(ids) == 0 {
+		return p.opts, p.healths, nil
+	}
+	opts = make([]storage.StorageOption, len(ids))
+	healths = make([]*storage.HealthTracker, len(ids))
+	for i, id := range ids {
+		j, ok := p.index[id]
+		if !ok {
+			return nil, nil, fmt.Errorf("Storage %q does not exist", id)
+		}
+		opts[i] = p.opts[j]
+		healths[i] = p.healths[j]
+	}
+	return
+}
+
+// Subscribe adds a listener that will be called when the state of the storage changed
+func (p *StoragePool) Subscribe(id string, listener storageStateListener) {
+	p.listenerMux.Lock()
+	defer p.listenerMux.Unlock()
+	p.listeners[id] = append(p.listeners[id], listener)
+}
+
+// SubscribeAll adds a listener that will be called when the state of any storage changed
+func (p *StoragePool) SubscribeAll(listener storageStateListener) {
+	p.listenerMux.Lock()
+	defer p.listenerMux.Unlock()
+	p.allListeners = append(p.allListeners, listener)
+}
+
+func (p *StoragePool) onStateChange(h *storage.HealthTracker, from, to storage.HealthState) {
+	p.listenerMux.RLock()
+	listeners := p.listeners[h.Id()]
+	allListeners := p.allListeners
+	p.listenerMux.RUnlock()
+	for _, l := range allListeners {
+		l(h, from, to)
+	}
+	for _, l := range listeners {
+		l(h, from, to)
+	}
+}
+
+// Init initializes the storages and starts the health checkers, only the first call takes effect
+func (p *StoragePool) Init(ctx context.Context) {
+	p.initOnce.Do(func() {
+		for _, h := range p.healths {
+			if err := h.Init(ctx); err != nil {
+				log.Errorf("Cannot initialize storage %s: %v", h.Id(), err)
+			}
+		}
+		for _, h := range p.healths {
+			h.Start(ctx)
+		}
+	})
+}
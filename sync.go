@@ -188,7 +188,9 @@ type syncStats struct {
 	lastInc  atomic.Int64
 }
 
-func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) bool {
+// SyncFiles downloads the missing files in the list.
+// full should be true if files is the complete file list rather than the updated files since the last sync
+func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, full bool, heavyCheck bool) bool {
 	log.Infof(Tr("info.sync.prepare"), len(files))
 	if !cr.issync.CompareAndSwap(false, true) {
 		log.Warn("Another sync task is running!")
@@ -196,10 +198,29 @@ func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	}
 	defer cr.issync.Store(false)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cr.syncCancelMux.Lock()
+	cr.syncCancel = cancel
+	cr.syncCancelMux.Unlock()
+	defer func() {
+		cr.syncCancelMux.Lock()
+		cr.syncCancel = nil
+		cr.syncCancelMux.Unlock()
+	}()
+
+	if cr.group != nil {
+		cr.group.syncMux.Lock()
+		defer cr.group.syncMux.Unlock()
+	}
+
 	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
-	if cr.syncFiles(ctx, files, heavyCheck) != nil {
+	if cr.syncFiles(ctx, files, full, heavyCheck) != nil {
 		return false
 	}
+	if full {
+		cr.cleanStalePartials(files)
+	}
 
 	cr.filesetMux.Lock()
 	for _, f := range files {
@@ -210,6 +231,17 @@ func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	return true
 }
 
+// CancelSync interrupts the running sync task, it returns false if there is no sync task
+func (cr *Cluster) CancelSync() bool {
+	cr.syncCancelMux.Lock()
+	defer cr.syncCancelMux.Unlock()
+	if cr.syncCancel == nil {
+		return false
+	}
+	cr.syncCancel()
+	return true
+}
+
 type fileInfoWithTargets struct {
 	FileInfo
 	tgMux   sync.Mutex
@@ -381,8 +413,19 @@ func (cr *Cluster) CheckFiles(
 	heavyCheck bool,
 	pg *mpb.Progress,
 ) (map[string]*fileInfoWithTargets, error) {
+	missing, _, err := cr.checkFiles(ctx, files, heavyCheck, pg)
+	return missing, err
+}
+
+// checkFiles is same as CheckFiles, but also returns the storages that failed to check
+func (cr *Cluster) checkFiles(
+	ctx context.Context,
+	files []FileInfo,
+	heavyCheck bool,
+	pg *mpb.Progress,
+) (map[string]*fileInfoWithTargets, []storage.Storage, error) {
 	missingMap := utils.NewSyncMap[string, *fileInfoWithTargets]()
-	done := make(chan bool, 0)
+	done := make(chan storage.Storage, 0)
 
 	for _, s := range cr.storages {
 		go func(s storage.Storage) {
@@ -391,34 +434,36 @@ func (cr *Cluster) CheckFiles(
 			if ctx.Err() != nil {
 				return
 			}
+			var failed storage.Storage
 			if err != nil {
 				log.Errorf(Tr("error.check.failed"), s, err)
+				failed = s
 			}
 			select {
-			case done <- err == nil:
+			case done <- failed:
 			case <-ctx.Done():
 			}
 		}(s)
 	}
-	goodCount := 0
+	var failed []storage.Storage
 	for i := len(cr.storages); i > 0; i-- {
 		select {
-		case ok := <-done:
-			if ok {
-				goodCount++
+		case s := <-done:
+			if s != nil {
+				failed = append(failed, s)
 			}
 		case <-ctx.Done():
 			log.Warn(Tr("warn.sync.interrupted"))
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
 		}
 	}
 	if err := ctx.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if goodCount == 0 {
-		return nil, errors.New("All storages are failed")
+	if len(failed) == len(cr.storages) {
+		return nil, nil, errors.New("All storages are failed")
 	}
-	return missingMap.RawMap(), nil
+	return missingMap.RawMap(), failed, nil
 }
 
 func (cr *Cluster) SetFilesetByExists(ctx context.Context, files []FileInfo) error {
@@ -427,10 +472,17 @@ func (cr *Cluster) SetFilesetByExists(ctx context.Context, files []FileInfo) err
 	log.SetLogOutput(pg)
 	defer log.SetLogOutput(nil)
 
-	missingMap, err := cr.CheckFiles(ctx, files, false, pg)
+	missingMap, failed, err := cr.checkFiles(ctx, files, false, pg)
 	if err != nil {
 		return err
 	}
+	// the file index may be loaded before, so check if it matches the storages
+	indexReady := cr.fileIndexReady.Load()
+	if changed, err := cr.updateFileIndexByCheck(files, true, missingMap, failed); err != nil {
+		log.Errorf("Cannot update file index: %v", err)
+	} else if indexReady && changed > 0 {
+		log.Warnf("%d files in the file index do not match the storages, the index is updated", changed)
+	}
 	fileset := make(map[string]int64, len(files))
 	stoCount := len(cr.storages)
 	for _, f := range files {
@@ -439,13 +491,32 @@ func (cr *Cluster) SetFilesetByExists(ctx context.Context, files []FileInfo) err
 		}
 	}
 
-	cr.mux.Lock()
+	cr.filesetMux.Lock()
 	cr.fileset = fileset
-	cr.mux.Unlock()
+	cr.filesetMux.Unlock()
 	return nil
 }
 
-func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) error {
+// findMissingFiles finds out the files that need to be downloaded.
+// The file index is used instead of walking the storages if it's ready and heavyCheck is false.
+// byIndex reports whether the file index is used, failed are the storages that failed to check
+func (cr *Cluster) findMissingFiles(
+	ctx context.Context,
+	files []FileInfo,
+	heavyCheck bool,
+	pg *mpb.Progress,
+) (missing map[string]*fileInfoWithTargets, failed []storage.Storage, byIndex bool, err error) {
+	if !heavyCheck && cr.fileIndexReady.Load() {
+		if missing, err = cr.checkFilesByIndex(files); err == nil {
+			return missing, nil, true, nil
+		}
+		log.Errorf("Cannot check files by the file index: %v", err)
+	}
+	missing, failed, err = cr.checkFiles(ctx, files, heavyCheck, pg)
+	return
+}
+
+func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, full bool, heavyCheck bool) error {
 	pg := mpb.New(mpb.WithRefreshRate(time.Second/2), mpb.WithAutoRefresh(), mpb.WithWidth(140))
 	defer pg.Shutdown()
 	log.SetLogOutput(pg)
@@ -454,10 +525,19 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	cr.syncProg.Store(0)
 	cr.syncTotal.Store(-1)
 
-	missingMap, err := cr.CheckFiles(ctx, files, heavyCheck, pg)
+	missingMap, failed, byIndex, err := cr.findMissingFiles(ctx, files, heavyCheck, pg)
 	if err != nil {
 		return err
 	}
+	if byIndex {
+		if full {
+			if err := cr.pruneFileIndex(files); err != nil {
+				log.Errorf("Cannot update file index: %v", err)
+			}
+		}
+	} else if _, err := cr.updateFileIndexByCheck(files, full, missingMap, failed); err != nil {
+		log.Errorf("Cannot update file index: %v", err)
+	}
 	var (
 		missing           = make([]*fileInfoWithTargets, 0, len(missingMap))
 		missingSize int64 = 0
@@ -582,7 +662,7 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 					return
 				}
 				defer srcFd.Close()
-				var failed []storage.Storage
+				var failed, stored []storage.Storage
 				for _, target := range f.targets {
 					if _, err = srcFd.Seek(0, io.SeekStart); err != nil {
 						log.Errorf("Cannot seek file %q to start: %v", path, err)
@@ -593,8 +673,10 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 						log.Errorf(Tr("error.sync.create.failed"), target.String(), f.Hash, err)
 						continue
 					}
+					stored = append(stored, target)
 				}
 				free()
+				cr.markFileStored(f.FileInfo, stored)
 				srcFd.Close()
 				os.Remove(path)
 				select {
@@ -640,20 +722,35 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 }
 
 func (cr *Cluster) Gc() {
+	if cr.group != nil && !cr.group.filesetsReady() {
+		log.Warn("Skipped gc since not all clusters have finished their first synchronization")
+		return
+	}
 	for _, s := range cr.storages {
-		cr.gcFor(s)
+		cr.gcFor(context.Background(), s, nil)
 	}
 }
 
-func (cr *Cluster) gcFor(s storage.Storage) {
+// gcFor removes the files that are not in use from the storage.
+// It will be interrupted when the context is canceled or a sync task started.
+// onWalk is called with the count of the walked and the removed files if it's not nil
+func (cr *Cluster) gcFor(ctx context.Context, s storage.Storage, onWalk func(walked, removed int64)) (removed int64, err error) {
 	log.Infof(Tr("info.gc.start"), s.String())
-	err := s.WalkDir(func(hash string, _ int64) error {
-		if cr.issync.Load() {
+	var walked int64
+	err = s.WalkDir(func(hash string, _ int64) error {
+		if cr.syncing() || ctx.Err() != nil {
 			return context.Canceled
 		}
-		if _, ok := cr.CachedFileSize(hash); !ok {
+		walked++
+		if !cr.fileInUse(hash) {
 			log.Infof(Tr("info.gc.found"), s.String()+"/"+hash)
-			s.Remove(hash)
+			if err := s.Remove(hash); err == nil {
+				cr.markFileRemoved(hash, s)
+				removed++
+			}
+		}
+		if onWalk != nil {
+			onWalk(walked, removed)
 		}
 		return nil
 	})
@@ -666,6 +763,7 @@ func (cr *Cluster) gcFor(s storage.Storage) {
 		return
 	}
 	log.Infof(Tr("info.gc.done"), s.String())
+	return
 }
 
 func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo) (<-chan string, error) {
@@ -717,7 +815,7 @@ func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo)
 		badOpen := false
 		interval := time.Second
 		for {
-			bar.SetCurrent(0)
+			bar.SetCurrent(cr.partialSize(f))
 			hashMethod, err := getHashMethod(len(f.Hash))
 			if err == nil {
 				var path string
@@ -776,11 +874,16 @@ func (cr *Cluster) fetchFileWithBuf(
 			"noopen": {"1"},
 		}
 	}
+	if cr.useResumableFetch(f) {
+		if path, err = cr.fetchFileResumable(ctx, f, reqPath, query, hashMethod, buf, wrapper); err != errPartialLocked {
+			return
+		}
+	}
 	if req, err = cr.makeReqWithAuth(ctx, http.MethodGet, reqPath, query); err != nil {
 		return
 	}
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	if res, err = cr.client.Do(req); err != nil {
+	if res, err = cr.syncClient.Do(req); err != nil {
 		return
 	}
 	defer res.Body.Close()
@@ -944,6 +1047,7 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 			}
 			size := stat.Size()
 
+			var stored []storage.Storage
 			for _, target := range cr.storages {
 				if _, err = srcFd.Seek(0, io.SeekStart); err != nil {
 					log.Errorf("Cannot seek file %q: %v", path, err)
@@ -953,7 +1057,10 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 					log.Errorf(Tr("error.sync.create.failed"), target.String(), hash, err)
 					continue
 				}
+				stored = append(stored, target)
 			}
+			f.Size = size
+			cr.markFileStored(f, stored)
 
 			cr.filesetMux.Lock()
 			cr.fileset[hash] = -size // negative means that the file was not stored into the database yet
@@ -976,7 +1083,7 @@ func (cr *Cluster) checkUpdate() (err error) {
 		return
 	}
 	log.Info(Tr("info.update.checking"))
-	release, err := update.Check(cr.cachedCli, config.GithubAPI.Authorization)
+	release, err := update.Check(cr.updateCli, config.GithubAPI.Authorization)
 	if err != nil || release == nil {
 		return
 	}
@@ -0,0 +1,91 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+type SyncBandwidthStatus struct {
+	Window string `json:"window,omitempty"`
+	Rate   int    `json:"rate"` // KiB/s, 0 means unlimited
+}
+
+// newSyncClient returns a http client that the reading rate can be controlled by the returned dialer
+func newSyncClient(dialer limited.NetDialer) (*http.Client, *limited.LimitedDialer) {
+	ld := limited.NewLimitedDialer(dialer, 0, 0, 0)
+	ld.SetMinReadRate(1024)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = ld.DialContext
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: redirectChecker,
+	}, ld
+}
+
+// applySyncBandwidth updates the sync rate limit by the current time window
+func (cr *Cluster) applySyncBandwidth(now time.Time) {
+	window, rate := currentConfig().SyncBandwidth.Current(now)
+	status := &SyncBandwidthStatus{
+		Rate: rate,
+	}
+	if window != nil {
+		status.Window = window.String()
+	}
+	if old := cr.syncBandwidth.Swap(status); old == nil || *old != *status {
+		if rate > 0 {
+			log.Infof("Sync bandwidth is limited to %d KiB/s (window %q)", rate, status.Window)
+		} else {
+			log.Infof("Sync bandwidth is unlimited (window %q)", status.Window)
+		}
+	}
+	cr.syncDialer.SetReadRate(rate * 1024)
+}
+
+func (cr *Cluster) startSyncBandwidthScheduler(ctx context.Context) {
+	if cr.syncDialer == nil {
+		return
+	}
+	cr.applySyncBandwidth(time.Now())
+	go func() {
+		defer log.RecoverPanic(nil)
+		for {
+			// wake up at the beginning of each minute
+			now := time.Now()
+			next := now.Truncate(time.Minute).Add(time.Minute)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next.Sub(now)):
+			}
+			cr.applySyncBandwidth(time.Now())
+		}
+	}()
+}
+
+// SyncBandwidthStatus returns nil if the sync bandwidth scheduling is disabled
+func (cr *Cluster) SyncBandwidthStatus() *SyncBandwidthStatus {
+	return cr.syncBandwidth.Load()
+}
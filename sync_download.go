@@ -0,0 +1,576 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	partialFileExt      = ".part"
+	partialChunksExt    = ".chunks"
+	chunkSaveInterval   = 8 * 1024 * 1024
+	partialChunkBufSize = 32 * 1024
+)
+
+var (
+	errRangeNotSupported = errors.New("Remote does not support range requests")
+	errPartialLocked     = errors.New("Partial file is locked by another download")
+)
+
+func (cr *Cluster) partialDir() string {
+	if dir := config.SyncDownload.PartialDir; dir != "" {
+		return dir
+	}
+	return filepath.Join(cr.dataDir, "downloading")
+}
+
+func (cr *Cluster) partialPath(hash string) string {
+	return filepath.Join(cr.partialDir(), hash+partialFileExt)
+}
+
+// lockPartial makes sure only one goroutine is writing to the partial file of the hash
+func (cr *Cluster) lockPartial(hash string) (unlock func(), ok bool) {
+	cr.partialMux.Lock()
+	defer cr.partialMux.Unlock()
+	if _, ok := cr.partials[hash]; ok {
+		return nil, false
+	}
+	cr.partials[hash] = struct{}{}
+	return func() {
+		cr.partialMux.Lock()
+		defer cr.partialMux.Unlock()
+		delete(cr.partials, hash)
+	}, true
+}
+
+// partialSize returns the bytes that have already been downloaded for the file
+func (cr *Cluster) partialSize(f FileInfo) int64 {
+	if !config.SyncDownload.Resume || f.Size <= 0 {
+		return 0
+	}
+	path := cr.partialPath(f.Hash)
+	if chunks, err := loadPartialChunks(path + partialChunksExt); err == nil {
+		if chunks.Size != f.Size {
+			return 0
+		}
+		return chunks.Done()
+	}
+	stat, err := os.Stat(path)
+	if err != nil || stat.Size() > f.Size {
+		return 0
+	}
+	return stat.Size()
+}
+
+func (cr *Cluster) useResumableFetch(f FileInfo) bool {
+	return config.SyncDownload.Resume && f.Size > 0
+}
+
+// fetchFileResumable downloads the file into a persistent partial file,
+// so the download can be resumed with Range requests after it's interrupted, even across restarts.
+// The returned path is owned by the caller, and the caller should remove it after use.
+func (cr *Cluster) fetchFileResumable(
+	ctx context.Context, f FileInfo,
+	reqPath string, query url.Values,
+	hashMethod crypto.Hash, buf []byte,
+	wrapper func(io.Reader) io.Reader,
+) (path string, err error) {
+	unlock, ok := cr.lockPartial(f.Hash)
+	if !ok {
+		return "", errPartialLocked
+	}
+	defer unlock()
+
+	if err = os.MkdirAll(cr.partialDir(), 0755); err != nil {
+		return
+	}
+	partPath := cr.partialPath(f.Hash)
+	chunksPath := partPath + partialChunksExt
+
+	chunkCount := config.SyncDownload.ParallelChunks
+	if chunkCount > 1 && f.Size >= (int64)(config.SyncDownload.ChunkThreshold)*1024*1024 {
+		err = cr.fetchPartialChunks(ctx, f, reqPath, query, partPath, chunkCount, wrapper)
+		if err == errRangeNotSupported {
+			log.Warnf("Remote does not support range requests for %s, fallback to sequential download", f.Path)
+			os.Remove(chunksPath)
+			os.Remove(partPath)
+			err = cr.fetchPartial(ctx, f, reqPath, query, partPath, buf, wrapper)
+		}
+	} else {
+		if _, e := os.Stat(chunksPath); e == nil {
+			// the file was downloading in chunks, cannot resume it sequentially
+			os.Remove(chunksPath)
+			os.Remove(partPath)
+		}
+		err = cr.fetchPartial(ctx, f, reqPath, query, partPath, buf, wrapper)
+	}
+	if err != nil {
+		return
+	}
+
+	if err = validatePartialFile(partPath, f, hashMethod, buf); err != nil {
+		os.Remove(chunksPath)
+		os.Remove(partPath)
+		return
+	}
+	os.Remove(chunksPath)
+
+	// move the completed file out, so it will not be picked up as a partial file
+	fd, err := os.CreateTemp(cr.partialDir(), cr.completedPrefix()+f.Hash+".*.done")
+	if err != nil {
+		return
+	}
+	path = fd.Name()
+	fd.Close()
+	if err = os.Rename(partPath, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return
+}
+
+func (cr *Cluster) getRange(ctx context.Context, reqPath string, query url.Values, start, end int64) (res *http.Response, err error) {
+	req, err := cr.makeReqWithAuth(ctx, http.MethodGet, reqPath, query)
+	if err != nil {
+		return
+	}
+	// Do not set Accept-Encoding, the transport will decompress the response transparently
+	// so the bytes in the partial file are always the identity representation
+	if end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	} else if start > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+	if res, err = cr.syncClient.Do(req); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return
+}
+
+// parseContentRangeStart returns the first byte position in the Content-Range header
+func parseContentRangeStart(header string) (start int64, ok bool) {
+	rng, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// fetchPartial downloads the file sequentially, and appends the data to the partial file
+func (cr *Cluster) fetchPartial(
+	ctx context.Context, f FileInfo,
+	reqPath string, query url.Values,
+	partPath string, buf []byte,
+	wrapper func(io.Reader) io.Reader,
+) (err error) {
+	fd, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	offset, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	if offset > f.Size {
+		if err = fd.Truncate(0); err != nil {
+			return
+		}
+		offset = 0
+	}
+	if offset == f.Size {
+		return
+	}
+	if offset > 0 {
+		log.Debugf("Resuming %s from offset %d", f.Path, offset)
+	}
+
+	res, err := cr.getRange(ctx, reqPath, query, offset, -1)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if start, ok := parseContentRangeStart(res.Header.Get("Content-Range")); !ok || start != offset {
+			fd.Truncate(0)
+			return ErrorFromRedirect(fmt.Errorf("Unexpected Content-Range %q, expect start at %d", res.Header.Get("Content-Range"), offset), res)
+		}
+	case http.StatusOK:
+		if offset > 0 {
+			log.Debugf("Remote does not support range requests for %s, restart from beginning", f.Path)
+			if err = fd.Truncate(0); err != nil {
+				return
+			}
+			if _, err = fd.Seek(0, io.SeekStart); err != nil {
+				return
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		fd.Truncate(0)
+		return ErrorFromRedirect(utils.NewHTTPStatusErrorFromResponse(res), res)
+	default:
+		return ErrorFromRedirect(utils.NewHTTPStatusErrorFromResponse(res), res)
+	}
+
+	var r io.Reader = res.Body
+	if wrapper != nil {
+		r = wrapper(r)
+	}
+	if _, err = io.CopyBuffer(struct{ io.Writer }{fd}, r, buf); err != nil {
+		return ErrorFromRedirect(err, res)
+	}
+	return
+}
+
+type partialChunk struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // exclusive
+	Done  int64 `json:"done"`
+}
+
+type partialChunks struct {
+	Size   int64           `json:"size"`
+	Chunks []*partialChunk `json:"chunks"`
+}
+
+func loadPartialChunks(path string) (c *partialChunks, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	c = new(partialChunks)
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func newPartialChunks(size int64, count int) *partialChunks {
+	c := &partialChunks{
+		Size:   size,
+		Chunks: make([]*partialChunk, count),
+	}
+	chunkSize := (size + (int64)(count) - 1) / (int64)(count)
+	for i := range c.Chunks {
+		start := chunkSize * (int64)(i)
+		end := min(start+chunkSize, size)
+		c.Chunks[i] = &partialChunk{Start: start, End: end}
+	}
+	return c
+}
+
+func (c *partialChunks) Done() (n int64) {
+	for _, ch := range c.Chunks {
+		n += atomic.LoadInt64(&ch.Done)
+	}
+	return
+}
+
+func (c *partialChunks) save(path string) error {
+	snapshot := &partialChunks{
+		Size:   c.Size,
+		Chunks: make([]*partialChunk, len(c.Chunks)),
+	}
+	for i, ch := range c.Chunks {
+		snapshot.Chunks[i] = &partialChunk{Start: ch.Start, End: ch.End, Done: atomic.LoadInt64(&ch.Done)}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// chunkWriter writes the data of a chunk to the partial file, and records the progress
+type chunkWriter struct {
+	fd     *os.File
+	chunk  *partialChunk
+	saved  int64
+	onSave func()
+}
+
+func (w *chunkWriter) Write(buf []byte) (n int, err error) {
+	done := atomic.LoadInt64(&w.chunk.Done)
+	if remain := w.chunk.End - w.chunk.Start - done; (int64)(len(buf)) > remain {
+		buf = buf[:remain]
+		err = io.ErrShortWrite
+	}
+	n, e := w.fd.WriteAt(buf, w.chunk.Start+done)
+	done = atomic.AddInt64(&w.chunk.Done, (int64)(n))
+	if e != nil {
+		return n, e
+	}
+	if done-w.saved >= chunkSaveInterval {
+		w.saved = done
+		w.onSave()
+	}
+	return
+}
+
+// fetchPartialChunks downloads the file with parallel range requests
+func (cr *Cluster) fetchPartialChunks(
+	ctx context.Context, f FileInfo,
+	reqPath string, query url.Values,
+	partPath string, count int,
+	wrapper func(io.Reader) io.Reader,
+) (err error) {
+	chunksPath := partPath + partialChunksExt
+	chunks, err := loadPartialChunks(chunksPath)
+	if err != nil || chunks.Size != f.Size || len(chunks.Chunks) != count {
+		chunks = newPartialChunks(f.Size, count)
+		os.Remove(partPath)
+	}
+	fd, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if err = fd.Truncate(f.Size); err != nil {
+		return
+	}
+
+	var saveMux sync.Mutex
+	save := func() {
+		saveMux.Lock()
+		defer saveMux.Unlock()
+		if err := chunks.save(chunksPath); err != nil {
+			log.Errorf("Cannot save chunk progress of %s: %v", f.Path, err)
+		}
+	}
+	if err = chunks.save(chunksPath); err != nil {
+		return
+	}
+	defer save()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMux   sync.Mutex
+		firstErr error
+	)
+	for _, ch := range chunks.Chunks {
+		if atomic.LoadInt64(&ch.Done) >= ch.End-ch.Start {
+			continue
+		}
+		wg.Add(1)
+		go func(ch *partialChunk) {
+			defer wg.Done()
+			if err := cr.fetchChunk(ctx, reqPath, query, fd, ch, save, wrapper); err != nil {
+				errMux.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				errMux.Unlock()
+			}
+		}(ch)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (cr *Cluster) fetchChunk(
+	ctx context.Context,
+	reqPath string, query url.Values,
+	fd *os.File, ch *partialChunk,
+	save func(), wrapper func(io.Reader) io.Reader,
+) (err error) {
+	start := ch.Start + atomic.LoadInt64(&ch.Done)
+	res, err := cr.getRange(ctx, reqPath, query, start, ch.End-1)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return errRangeNotSupported
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return ErrorFromRedirect(utils.NewHTTPStatusErrorFromResponse(res), res)
+	}
+	if s, ok := parseContentRangeStart(res.Header.Get("Content-Range")); !ok || s != start {
+		return errRangeNotSupported
+	}
+	var r io.Reader = res.Body
+	if wrapper != nil {
+		r = wrapper(r)
+	}
+	w := &chunkWriter{
+		fd:     fd,
+		chunk:  ch,
+		saved:  atomic.LoadInt64(&ch.Done),
+		onSave: save,
+	}
+	buf := make([]byte, partialChunkBufSize)
+	if _, err = io.CopyBuffer(w, r, buf); err != nil {
+		return ErrorFromRedirect(err, res)
+	}
+	if atomic.LoadInt64(&ch.Done) != ch.End-ch.Start {
+		return ErrorFromRedirect(io.ErrUnexpectedEOF, res)
+	}
+	return
+}
+
+// validatePartialFile checks the size and the hash of the downloaded file
+func validatePartialFile(path string, f FileInfo, hashMethod crypto.Hash, buf []byte) (err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	if t := stat.Size(); t != f.Size {
+		return fmt.Errorf("File size wrong, got %d, expect %d", t, f.Size)
+	}
+	hw := hashMethod.New()
+	if _, err = io.CopyBuffer(hw, fd, buf); err != nil {
+		return
+	}
+	if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != f.Hash {
+		return fmt.Errorf("File hash not match, got %s, expect %s", hs, f.Hash)
+	}
+	return
+}
+
+// completedPrefix is the name prefix of the completed files of the cluster,
+// so the clusters sharing the partial directory will not remove each other's files
+func (cr *Cluster) completedPrefix() string {
+	return cr.clusterId + "."
+}
+
+// cleanCompletedPartials removes the completed files of the cluster that were not cleaned up because of an unexpected exit
+func (cr *Cluster) cleanCompletedPartials() {
+	entries, err := os.ReadDir(cr.partialDir())
+	if err != nil {
+		return
+	}
+	prefix := cr.completedPrefix()
+	for _, e := range entries {
+		if name := e.Name(); !e.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".done") {
+			os.Remove(filepath.Join(cr.partialDir(), name))
+		}
+	}
+}
+
+// partialHash returns the hash of the partial file or its chunk progress file
+func partialHash(name string) (hash string, ok bool) {
+	for _, ext := range []string{partialChunksExt + ".tmp", partialChunksExt, ""} {
+		if h, ok := strings.CutSuffix(name, partialFileExt+ext); ok {
+			return h, h != ""
+		}
+	}
+	return "", false
+}
+
+// cleanStalePartials removes the partial files of the hashes that are no longer in the full file list.
+// If the partial directory is shared, the files in the other clusters' last file lists are kept
+func (cr *Cluster) cleanStalePartials(files []FileInfo) {
+	entries, err := os.ReadDir(cr.partialDir())
+	if err != nil {
+		return
+	}
+	wanted := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		wanted[f.Hash] = struct{}{}
+	}
+	if cr.group != nil && config.SyncDownload.PartialDir != "" {
+		for _, c := range cr.group.clusters {
+			if c == cr {
+				continue
+			}
+			others, err := c.LoadLastFileList()
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Errorf("Cannot load the file list of cluster %s, skip cleaning partial files: %v", c.clusterId, err)
+					return
+				}
+				continue
+			}
+			for _, f := range others {
+				wanted[f.Hash] = struct{}{}
+			}
+		}
+	}
+
+	cr.partialMux.Lock()
+	defer cr.partialMux.Unlock()
+	removed := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		hash, ok := partialHash(e.Name())
+		if !ok {
+			continue
+		}
+		if _, ok := wanted[hash]; ok {
+			continue
+		}
+		if _, ok := cr.partials[hash]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cr.partialDir(), e.Name())); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Infof("Removed %d stale partial files", removed)
+	}
+}
@@ -0,0 +1,263 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func TestParseContentRangeStart(t *testing.T) {
+	data := []struct {
+		H  string
+		S  int64
+		Ok bool
+	}{
+		{"bytes 0-99/100", 0, true},
+		{"bytes 100-199/200", 100, true},
+		{"bytes 42-/*", 42, true},
+		{"bytes  7-9/10", 7, true},
+		{"bytes */100", 0, false},
+		{"bytes -5/100", 0, false},
+		{"items 0-9/10", 0, false},
+		{"bytes abc-9/10", 0, false},
+		{"", 0, false},
+	}
+	for _, d := range data {
+		s, ok := parseContentRangeStart(d.H)
+		if s != d.S || ok != d.Ok {
+			t.Errorf("parseContentRangeStart(%q) = %d, %v; expect %d, %v", d.H, s, ok, d.S, d.Ok)
+		}
+	}
+}
+
+func TestNewPartialChunks(t *testing.T) {
+	data := []struct {
+		Size  int64
+		Count int
+		Ends  []int64
+	}{
+		{100, 4, []int64{25, 50, 75, 100}},
+		{10, 3, []int64{4, 8, 10}},
+		{1, 1, []int64{1}},
+		{5, 2, []int64{3, 5}},
+	}
+	for _, d := range data {
+		c := newPartialChunks(d.Size, d.Count)
+		if len(c.Chunks) != len(d.Ends) {
+			t.Errorf("newPartialChunks(%d, %d): expect %d chunks, got %d", d.Size, d.Count, len(d.Ends), len(c.Chunks))
+			continue
+		}
+		var start int64
+		for i, ch := range c.Chunks {
+			if ch.Start != start || ch.End != d.Ends[i] {
+				t.Errorf("newPartialChunks(%d, %d): chunk %d is [%d, %d), expect [%d, %d)", d.Size, d.Count, i, ch.Start, ch.End, start, d.Ends[i])
+			}
+			start = ch.End
+		}
+	}
+
+	c := newPartialChunks(100, 4)
+	c.Chunks[0].Done = 25
+	c.Chunks[2].Done = 10
+	if n := c.Done(); n != 35 {
+		t.Errorf("Done() = %d, expect 35", n)
+	}
+	path := filepath.Join(t.TempDir(), "test"+partialChunksExt)
+	if err := c.save(path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	loaded, err := loadPartialChunks(path)
+	if err != nil {
+		t.Fatalf("loadPartialChunks: %v", err)
+	}
+	if loaded.Size != 100 || loaded.Done() != 35 || len(loaded.Chunks) != 4 {
+		t.Errorf("Unexpected loaded chunks %+v", loaded)
+	}
+}
+
+func TestPartialHash(t *testing.T) {
+	data := []struct {
+		N  string
+		H  string
+		Ok bool
+	}{
+		{"abc.part", "abc", true},
+		{"abc.part.chunks", "abc", true},
+		{"abc.part.chunks.tmp", "abc", true},
+		{"abc.1234.done", "", false},
+		{".part", "", false},
+		{"abc", "", false},
+	}
+	for _, d := range data {
+		h, ok := partialHash(d.N)
+		if h != d.H || ok != d.Ok {
+			t.Errorf("partialHash(%q) = %q, %v; expect %q, %v", d.N, h, ok, d.H, d.Ok)
+		}
+	}
+}
+
+// newDroppingServer serves the content, but drops the connection after sending half of it for the first request
+func newDroppingServer(t *testing.T, content []byte) (*httptest.Server, func() []string) {
+	var (
+		mux     sync.Mutex
+		ranges  []string
+		dropped bool
+	)
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mux.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		drop := !dropped
+		dropped = true
+		mux.Unlock()
+
+		if drop {
+			rw.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			rw.WriteHeader(http.StatusOK)
+			rw.Write(content[:len(content)/2])
+			rw.(http.Flusher).Flush()
+			conn, _, err := rw.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(svr.Close)
+	return svr, func() []string {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
+
+func TestFetchPartialResume(t *testing.T) {
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = (byte)(i * 7)
+	}
+	sum := md5.Sum(content)
+	f := FileInfo{
+		Path: "/test",
+		Hash: hex.EncodeToString(sum[:]),
+		Size: (int64)(len(content)),
+	}
+	svr, getRanges := newDroppingServer(t, content)
+	cr := &Cluster{
+		prefix:     svr.URL,
+		dataDir:    t.TempDir(),
+		partials:   make(map[string]struct{}),
+		syncClient: svr.Client(),
+		authToken: &ClusterToken{
+			Token:    "test",
+			ExpireAt: time.Now().Add(time.Hour),
+		},
+	}
+	os.MkdirAll(cr.partialDir(), 0755)
+	partPath := cr.partialPath(f.Hash)
+	buf := make([]byte, 1024)
+
+	if err := cr.fetchPartial(context.Background(), f, "/download/"+f.Hash, nil, partPath, buf, nil); err == nil {
+		t.Fatalf("Expected the first download to fail")
+	}
+	stat, err := os.Stat(partPath)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	offset := stat.Size()
+	if offset == 0 || offset >= f.Size {
+		t.Fatalf("Expected a partial file, got %d bytes", offset)
+	}
+
+	if err := cr.fetchPartial(context.Background(), f, "/download/"+f.Hash, nil, partPath, buf, nil); err != nil {
+		t.Fatalf("Cannot resume the download: %v", err)
+	}
+	ranges := getRanges()
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != fmt.Sprintf("bytes=%d-", offset) {
+		t.Errorf("Unexpected range headers %q, expect the second one to start at %d", ranges, offset)
+	}
+	if err := validatePartialFile(partPath, f, crypto.MD5, buf); err != nil {
+		t.Errorf("Resumed file is broken: %v", err)
+	}
+}
+
+func TestCleanStalePartials(t *testing.T) {
+	cr := &Cluster{
+		dataDir:  t.TempDir(),
+		partials: map[string]struct{}{"locked": {}},
+	}
+	dir := cr.partialDir()
+	os.MkdirAll(dir, 0755)
+	names := []string{
+		"keep.part", "keep.part.chunks",
+		"stale.part", "stale.part.chunks", "stale.part.chunks.tmp",
+		"locked.part",
+		"other.txt",
+	}
+	for _, n := range names {
+		os.WriteFile(filepath.Join(dir, n), nil, 0644)
+	}
+	cr.cleanStalePartials([]FileInfo{{Hash: "keep"}})
+	for _, n := range names {
+		_, err := os.Stat(filepath.Join(dir, n))
+		removed := os.IsNotExist(err)
+		if expect := n[:5] == "stale"; removed != expect {
+			t.Errorf("%s: expect removed=%v, got %v", n, expect, removed)
+		}
+	}
+}
+
+func TestCleanCompletedPartials(t *testing.T) {
+	cr := &Cluster{
+		clusterId: "cluster1",
+		dataDir:   t.TempDir(),
+	}
+	dir := cr.partialDir()
+	os.MkdirAll(dir, 0755)
+	names := map[string]bool{
+		"cluster1.hash.1234.done": true,
+		"cluster2.hash.1234.done": false,
+		"cluster1.hash.part":      false,
+		"hash.part":               false,
+	}
+	for n := range names {
+		os.WriteFile(filepath.Join(dir, n), nil, 0644)
+	}
+	cr.cleanCompletedPartials()
+	for n, expect := range names {
+		_, err := os.Stat(filepath.Join(dir, n))
+		if removed := os.IsNotExist(err); removed != expect {
+			t.Errorf("%s: expect removed=%v, got %v", n, expect, removed)
+		}
+	}
+}
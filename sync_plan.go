@@ -0,0 +1,383 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type SyncPlanFile struct {
+	Hash string `json:"hash"`
+	Path string `json:"path,omitempty"`
+	Size int64  `json:"size"`
+}
+
+type SyncPlanMismatch struct {
+	Hash     string `json:"hash"`
+	Path     string `json:"path"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+}
+
+type StorageSyncPlan struct {
+	Storage string `json:"storage"`
+	Error   string `json:"error,omitempty"`
+
+	// Missing are the files that do not exist in the storage
+	Missing      []SyncPlanFile `json:"missing"`
+	MissingBytes int64          `json:"missingBytes"`
+	// Mismatched are the files that exist but failed the check (wrong size, or wrong hash with heavy check),
+	// they will be re-downloaded
+	Mismatched []SyncPlanMismatch `json:"mismatched"`
+	// Orphans are the files that are not in the file list, gc will remove them
+	Orphans     []SyncPlanFile `json:"orphans"`
+	OrphanBytes int64          `json:"orphanBytes"`
+}
+
+// SyncPlan is what a sync would do, it's generated without downloading or removing any file
+type SyncPlan struct {
+	GeneratedAt time.Time          `json:"generatedAt"`
+	RemoteFiles int                `json:"remoteFiles"`
+	RemoteBytes int64              `json:"remoteBytes"`
+	Storages    []*StorageSyncPlan `json:"storages"`
+	// TransferFiles and TransferBytes count each file only once,
+	// since a file will only be downloaded once even if it's missing in multiple storages
+	TransferFiles int   `json:"transferFiles"`
+	TransferBytes int64 `json:"transferBytes"`
+}
+
+// planSyncFor builds the plan of a storage from the missing files found by the sync check.
+// The storage is walked to find out the orphans and the actual sizes of the mismatched files.
+// The files that are not in the file list but still inUse are not orphans
+func planSyncFor(sto storage.Storage, files []FileInfo, missing map[string]*fileInfoWithTargets, inUse func(hash string) bool) (plan *StorageSyncPlan, err error) {
+	plan = &StorageSyncPlan{
+		Storage:    sto.String(),
+		Missing:    []SyncPlanFile{},
+		Mismatched: []SyncPlanMismatch{},
+		Orphans:    []SyncPlanFile{},
+	}
+	sizeMap := make(map[string]int64, len(files))
+	if err = sto.WalkDir(func(hash string, size int64) error {
+		sizeMap[hash] = size
+		return nil
+	}); err != nil {
+		plan.Error = err.Error()
+		return
+	}
+	for _, f := range files {
+		size, exists := sizeMap[f.Hash]
+		delete(sizeMap, f.Hash)
+		info := missing[f.Hash]
+		if info == nil || !slices.Contains(info.targets, sto) {
+			continue
+		}
+		if !exists {
+			plan.Missing = append(plan.Missing, SyncPlanFile{Hash: f.Hash, Path: f.Path, Size: f.Size})
+		} else {
+			plan.Mismatched = append(plan.Mismatched, SyncPlanMismatch{
+				Hash:     f.Hash,
+				Path:     f.Path,
+				Expected: f.Size,
+				Actual:   size,
+			})
+		}
+		plan.MissingBytes += f.Size
+	}
+	for hash, size := range sizeMap {
+		if inUse(hash) {
+			continue
+		}
+		plan.Orphans = append(plan.Orphans, SyncPlanFile{Hash: hash, Size: size})
+		plan.OrphanBytes += size
+	}
+	sort.Slice(plan.Orphans, func(i, j int) bool { return plan.Orphans[i].Hash < plan.Orphans[j].Hash })
+	return
+}
+
+// PlanSync checks every storage against the file list in the same way as SyncFiles does, and reports what a sync would do.
+// The file index is used if it's ready and heavyCheck is false.
+// The orphans are checked in the same way as gc does, so the files used by the other clusters are not reported
+func (cr *Cluster) PlanSync(ctx context.Context, files []FileInfo, heavyCheck bool) (*SyncPlan, error) {
+	files = append([]FileInfo(nil), files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
+
+	plan := &SyncPlan{
+		GeneratedAt: time.Now(),
+		RemoteFiles: len(files),
+		Storages:    make([]*StorageSyncPlan, len(cr.storages)),
+	}
+	for _, f := range files {
+		plan.RemoteBytes += f.Size
+	}
+
+	pg := mpb.New(mpb.WithOutput(nil))
+	missing, failed, _, err := cr.findMissingFiles(ctx, files, heavyCheck, pg)
+	pg.Shutdown()
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range cr.storages {
+		if slices.Contains(failed, s) {
+			plan.Storages[i] = &StorageSyncPlan{
+				Storage: s.String(),
+				Error:   "Cannot check the storage",
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s storage.Storage) {
+			defer wg.Done()
+			defer log.RecordPanic()
+			p, err := planSyncFor(s, files, missing, cr.fileInUse)
+			if err != nil {
+				log.Errorf(Tr("error.check.failed"), s, err)
+			}
+			plan.Storages[i] = p
+		}(i, s)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	transfer := make(map[string]int64)
+	for _, p := range plan.Storages {
+		for _, f := range p.Missing {
+			transfer[f.Hash] = f.Size
+		}
+		for _, f := range p.Mismatched {
+			transfer[f.Hash] = f.Expected
+		}
+	}
+	plan.TransferFiles = len(transfer)
+	for _, size := range transfer {
+		plan.TransferBytes += size
+	}
+	return plan, nil
+}
+
+// WriteText writes the human readable report of the plan
+func (p *SyncPlan) WriteText(w io.Writer, verbose bool) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Sync plan generated at %s\n", p.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(bw, "Remote files: %d (%s)\n", p.RemoteFiles, utils.BytesToUnit((float64)(p.RemoteBytes)))
+	for _, s := range p.Storages {
+		fmt.Fprintf(bw, "\nStorage %s\n", s.Storage)
+		if s.Error != "" {
+			fmt.Fprintf(bw, "  error: %s\n", s.Error)
+			continue
+		}
+		fmt.Fprintf(bw, "  missing:    %d files (%s)\n", len(s.Missing), utils.BytesToUnit((float64)(s.MissingBytes)))
+		if verbose {
+			for _, f := range s.Missing {
+				fmt.Fprintf(bw, "    + %s %s (%s)\n", f.Hash, f.Path, utils.BytesToUnit((float64)(f.Size)))
+			}
+		}
+		fmt.Fprintf(bw, "  mismatched: %d files\n", len(s.Mismatched))
+		for _, f := range s.Mismatched {
+			fmt.Fprintf(bw, "    ~ %s %s (expect %d bytes, got %d bytes)\n", f.Hash, f.Path, f.Expected, f.Actual)
+		}
+		fmt.Fprintf(bw, "  orphans:    %d files (%s)\n", len(s.Orphans), utils.BytesToUnit((float64)(s.OrphanBytes)))
+		if verbose {
+			for _, f := range s.Orphans {
+				fmt.Fprintf(bw, "    - %s (%s)\n", f.Hash, utils.BytesToUnit((float64)(f.Size)))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "\nTotal to transfer: %d files (%s)\n", p.TransferFiles, utils.BytesToUnit((float64)(p.TransferBytes)))
+	return bw.Flush()
+}
+
+func (cr *Cluster) apiV0SyncPlan(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	files, err := cr.GetFileList(req.Context(), 0)
+	if err != nil {
+		writeJson(rw, http.StatusBadGateway, Map{
+			"error":   "Cannot get file list",
+			"message": err.Error(),
+		})
+		return
+	}
+	query := req.URL.Query()
+	plan, err := cr.PlanSync(req.Context(), files, query.Has("heavy"))
+	if err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "Cannot generate sync plan",
+			"message": err.Error(),
+		})
+		return
+	}
+	if query.Get("format") == "text" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		plan.WriteText(rw, query.Has("verbose"))
+		return
+	}
+	writeJson(rw, http.StatusOK, plan)
+}
+
+// newCmdClusters creates the clusters by the config for the sub commands, and initializes the storages of the selected clusters.
+// All the clusters are selected if only is empty
+func newCmdClusters(ctx context.Context, only string) (g *ClusterGroup, clusters []*Cluster) {
+	dialers, err := newConfiguredDialers()
+	if err != nil {
+		log.Errorf("Cannot create outbound dialers: %v", err)
+		os.Exit(1)
+	}
+	g = NewClusterGroup(ctx,
+		ClusterServerURL,
+		baseDir,
+		config.clusterItems(),
+		config.Byoc, dialers,
+		config.Storages,
+		config.Cache.newCache(),
+	)
+	if only == "" {
+		clusters = g.Clusters()
+	} else if cr := g.Get(only); cr != nil {
+		clusters = []*Cluster{cr}
+	} else {
+		log.Errorf("Cluster %q does not exist", only)
+		os.Exit(2)
+	}
+	// the storages may be shared by the clusters, only initialize them once
+	inited := make(map[storage.Storage]struct{})
+	for _, cr := range clusters {
+		vctx := cr.storageInitContext(ctx)
+		for _, s := range cr.storages {
+			if _, ok := inited[s]; ok {
+				continue
+			}
+			inited[s] = struct{}{}
+			if err := s.Init(vctx); err != nil {
+				log.Errorf("Cannot initialize %s: %v", s.String(), err)
+				os.Exit(1)
+			}
+		}
+	}
+	return
+}
+
+func cmdSync(args []string) {
+	var dryRun, heavyCheck, jsonOutput, verbose bool
+	var clusterId string
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--dry-run", "-n":
+			dryRun = true
+		case "--heavy":
+			heavyCheck = true
+		case "--json":
+			jsonOutput = true
+		case "--verbose", "-v":
+			verbose = true
+		case "--cluster":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "Missing value for option:", a)
+				os.Exit(2)
+			}
+			i++
+			clusterId = args[i]
+		default:
+			fmt.Fprintln(os.Stderr, "Unknown option:", a)
+			os.Exit(2)
+		}
+	}
+	if !dryRun {
+		fmt.Fprintln(os.Stderr, "Only --dry-run is supported, run the main program to synchronize files")
+		os.Exit(2)
+	}
+
+	if jsonOutput {
+		// keep stdout clean for the JSON output
+		log.SetLogOutput(os.Stderr)
+	}
+
+	config = readConfig()
+	ctx := context.Background()
+
+	g, clusters := newCmdClusters(ctx, clusterId)
+	// the file lists of all the clusters are needed to find out the orphans, since the storages may be shared
+	fileLists := make(map[*Cluster][]FileInfo, len(g.Clusters()))
+	for _, cr := range g.Clusters() {
+		files, err := cr.GetFileList(ctx, 0)
+		if err != nil {
+			log.Errorf("Cluster %s: "+Tr("error.filelist.fetch.failed"), cr.clusterId, err)
+			os.Exit(1)
+		}
+		fileset := make(map[string]int64, len(files))
+		for _, f := range files {
+			fileset[f.Hash] = f.Size
+		}
+		cr.filesetMux.Lock()
+		cr.fileset = fileset
+		cr.filesetMux.Unlock()
+		fileLists[cr] = files
+	}
+
+	plans := make(map[string]*SyncPlan, len(clusters))
+	for _, cr := range clusters {
+		plan, err := cr.PlanSync(ctx, fileLists[cr], heavyCheck)
+		if err != nil {
+			log.Errorf("Cannot generate sync plan for cluster %s: %v", cr.clusterId, err)
+			os.Exit(1)
+		}
+		plans[cr.clusterId] = plan
+	}
+	if jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if len(clusters) == 1 {
+			e.Encode(plans[clusters[0].clusterId])
+		} else {
+			e.Encode(plans)
+		}
+		return
+	}
+	for i, cr := range clusters {
+		if len(clusters) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("==> Cluster %s\n", cr.clusterId)
+		}
+		plans[cr.clusterId].WriteText(os.Stdout, verbose)
+	}
+}
@@ -0,0 +1,103 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+
+	"github.com/LiterMC/go-openbmclapi/lang"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+func TestPlanSync(t *testing.T) {
+	lang.SetLang("en-us")
+
+	newStorage := func() storage.Storage {
+		s := new(storage.LocalStorage)
+		s.SetOptions(&storage.LocalStorageOption{CachePath: t.TempDir()})
+		if err := s.Init(context.Background()); err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+		return s
+	}
+	sto1, sto2 := newStorage(), newStorage()
+	put := func(s storage.Storage, hash string, data []byte) {
+		if err := s.Create(hash, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Create %s: %v", hash, err)
+		}
+	}
+	file := func(data string) (FileInfo, []byte) {
+		sum := md5.Sum([]byte(data))
+		hash := hex.EncodeToString(sum[:])
+		return FileInfo{Hash: hash, Path: "/" + data, Size: (int64)(len(data))}, []byte(data)
+	}
+
+	shared, sharedData := file("shared")
+	partial, partialData := file("partial")
+	modified, modifiedData := file("modified")
+	orphan, orphanData := file("orphan")
+	other, otherData := file("other")
+	put(sto1, shared.Hash, sharedData)
+	put(sto2, shared.Hash, sharedData)
+	put(sto1, partial.Hash, partialData)
+	put(sto1, modified.Hash, modifiedData[:3])
+	put(sto2, modified.Hash, modifiedData)
+	put(sto1, orphan.Hash, orphanData)
+	put(sto1, other.Hash, otherData)
+
+	cr := &Cluster{
+		storages: []storage.Storage{sto1, sto2},
+	}
+	// the other cluster shares the storages, its files should not be reported as orphans
+	otherCr := &Cluster{
+		storages: []storage.Storage{sto1, sto2},
+		fileset:  map[string]int64{other.Hash: other.Size},
+	}
+	cr.group = &ClusterGroup{clusters: []*Cluster{cr, otherCr}}
+	plan, err := cr.PlanSync(context.Background(), []FileInfo{shared, partial, modified}, false)
+	if err != nil {
+		t.Fatalf("PlanSync: %v", err)
+	}
+
+	p1, p2 := plan.Storages[0], plan.Storages[1]
+	if len(p1.Missing) != 0 {
+		t.Errorf("Expect no missing file in storage 1, got %v", p1.Missing)
+	}
+	if len(p1.Mismatched) != 1 || p1.Mismatched[0].Hash != modified.Hash || p1.Mismatched[0].Actual != 3 {
+		t.Errorf("Expect %s mismatched with 3 bytes in storage 1, got %v", modified.Hash, p1.Mismatched)
+	}
+	if len(p1.Orphans) != 1 || p1.Orphans[0].Hash != orphan.Hash {
+		t.Errorf("Expect orphan %s in storage 1, got %v", orphan.Hash, p1.Orphans)
+	}
+	if len(p2.Missing) != 1 || p2.Missing[0].Hash != partial.Hash {
+		t.Errorf("Expect %s missing in storage 2, got %v", partial.Hash, p2.Missing)
+	}
+	if len(p2.Mismatched) != 0 || len(p2.Orphans) != 0 {
+		t.Errorf("Expect no mismatched or orphan file in storage 2, got %v, %v", p2.Mismatched, p2.Orphans)
+	}
+	if expect := partial.Size + modified.Size; plan.TransferFiles != 2 || plan.TransferBytes != expect {
+		t.Errorf("Expect to transfer 2 files (%d bytes), got %d files (%d bytes)", expect, plan.TransferFiles, plan.TransferBytes)
+	}
+}
@@ -0,0 +1,361 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// The dashboard user roles, a role has all permissions of the roles before it
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+func isValidRole(role string) bool {
+	return roleLevels[role] > 0
+}
+
+// roleAllows reports whether the role has the permissions of the required role
+func roleAllows(role string, required string) bool {
+	level := roleLevels[role]
+	return level > 0 && level >= roleLevels[required]
+}
+
+var usernameRe = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+var (
+	ErrInvalidUsername  = errors.New("username can only contain letters, digits and `_.@-`, and must be shorter than 64 characters")
+	ErrInvalidRole      = errors.New("role must be one of viewer, operator or admin")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrPasswordMismatch = errors.New("the username or password is incorrect")
+)
+
+// hashUserPassword hashes the hex encoded sha256 of the password, which is what the dashboard sends
+func hashUserPassword(passwordSha256 string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(([]byte)(strings.ToLower(passwordSha256)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return (string)(hash), nil
+}
+
+// isConfigUser reports whether the username is the one in the dashboard config, which is always an admin
+func isConfigUser(username string) bool {
+	dashboard := &currentConfig().Dashboard
+	return dashboard.Username != "" && dashboard.Password != "" && username == dashboard.Username
+}
+
+// getUserRole returns the current role of the user, so the role changes take effect without login again
+func (cr *Cluster) getUserRole(username string) (string, error) {
+	if isConfigUser(username) {
+		return roleAdmin, nil
+	}
+	rec, err := cr.database.GetUser(username)
+	if err != nil {
+		if err == database.ErrNotFound {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+	return rec.Role, nil
+}
+
+// checkUserSignature checks the challenge signature of the user in the dashboard config
+func checkUserSignature(username string, challenge string, signature string) bool {
+	dashboard := &currentConfig().Dashboard
+	if dashboard.Username == "" || dashboard.Password == "" || username != dashboard.Username {
+		return false
+	}
+	expectSignature := utils.HMACSha256Hex(utils.AsSha256Hex(dashboard.Password), challenge)
+	return subtle.ConstantTimeCompare(([]byte)(expectSignature), ([]byte)(signature)) == 1
+}
+
+// checkUserPassword checks the plain password of the user in the database
+func (cr *Cluster) checkUserPassword(username string, password string) error {
+	rec, err := cr.database.GetUser(username)
+	if err != nil {
+		if err == database.ErrNotFound {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+	// the stored hashes are generated from the sha256 of the passwords
+	if bcrypt.CompareHashAndPassword(([]byte)(rec.Password), ([]byte)(utils.AsSha256Hex(password))) != nil {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (cr *Cluster) countUsers() (n int, err error) {
+	err = cr.database.ForEachUser(func(*database.UserRecord) error {
+		n++
+		return nil
+	})
+	return
+}
+
+// newUserRecord validates the inputs and creates a user record with the hashed password
+func newUserRecord(username string, passwordSha256 string, role string) (rec database.UserRecord, err error) {
+	if !usernameRe.MatchString(username) {
+		return rec, ErrInvalidUsername
+	}
+	if isConfigUser(username) {
+		return rec, fmt.Errorf("%q is the dashboard user in the config", username)
+	}
+	if !isValidRole(role) {
+		return rec, ErrInvalidRole
+	}
+	if passwordSha256 == "" {
+		return rec, errors.New("password cannot be empty")
+	}
+	rec.Username = username
+	rec.Role = role
+	rec.CreatedAt = time.Now()
+	if rec.Password, err = hashUserPassword(passwordSha256); err != nil {
+		return
+	}
+	return
+}
+
+func getLoggedRole(req *http.Request) string {
+	if role, ok := req.Context().Value(loggedRoleKey).(string); ok {
+		return role
+	}
+	return ""
+}
+
+// apiRoleHandle rejects the requests that are not logged in, or whose role does not have the permissions of role
+func (cr *Cluster) apiRoleHandle(role string, next http.Handler) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Context().Value(tokenTypeKey) == nil {
+			writeJson(rw, http.StatusUnauthorized, Map{
+				"error": "403 Unauthorized",
+			})
+			return
+		}
+		if rejectUnscopedAPIKey(rw, req) {
+			return
+		}
+		if !roleAllows(getLoggedRole(req), role) {
+			writeJson(rw, http.StatusForbidden, Map{
+				"error":    "403 Forbidden",
+				"message":  "permission denied",
+				"required": role,
+			})
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (cr *Cluster) apiRoleHandleFunc(role string, next http.HandlerFunc) http.Handler {
+	return cr.apiRoleHandle(role, next)
+}
+
+func (cr *Cluster) apiV0Me(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet) {
+		return
+	}
+	user := getLoggedUser(req)
+	writeJson(rw, http.StatusOK, Map{
+		"username": user,
+		"role":     getLoggedRole(req),
+		"builtin":  isConfigUser(user),
+	})
+}
+
+type userPayload struct {
+	Username string `json:"username"`
+	// Password is the hex encoded sha256 of the password
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+func (cr *Cluster) apiV0Users(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		users := make([]database.UserRecord, 0, 4)
+		if err := cr.database.ForEachUser(func(rec *database.UserRecord) error {
+			users = append(users, *rec)
+			return nil
+		}); err != nil {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "database error",
+				"message": err.Error(),
+			})
+			return
+		}
+		writeJson(rw, http.StatusOK, users)
+	case http.MethodPost:
+		data, ok := parseRequestBody[userPayload](rw, req, nil)
+		if !ok {
+			return
+		}
+		setAuditTarget(req, data.Username)
+		rec, err := newUserRecord(data.Username, data.Password, data.Role)
+		if err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "invalid user",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := cr.database.AddUser(rec); err != nil {
+			if err == database.ErrExists {
+				writeJson(rw, http.StatusConflict, Map{
+					"error": "user already exists",
+				})
+				return
+			}
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "database error",
+				"message": err.Error(),
+			})
+			return
+		}
+		writeJson(rw, http.StatusCreated, rec)
+	default:
+		checkRequestMethodOrRejectWithJson(rw, req, http.MethodGet, http.MethodPost)
+	}
+}
+
+// apiV0User edits or removes the user at the path.
+// Admins can edit everyone, and other users can only change their own password
+func (cr *Cluster) apiV0User(rw http.ResponseWriter, req *http.Request) {
+	if checkRequestMethodOrRejectWithJson(rw, req, http.MethodPatch, http.MethodDelete) {
+		return
+	}
+	username := req.URL.Path
+	self := getLoggedUser(req)
+	isAdmin := roleAllows(getLoggedRole(req), roleAdmin)
+	if !isAdmin && username != self {
+		writeJson(rw, http.StatusForbidden, Map{
+			"error":    "403 Forbidden",
+			"message":  "permission denied",
+			"required": roleAdmin,
+		})
+		return
+	}
+	if isConfigUser(username) {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error": "the dashboard user in the config cannot be edited",
+		})
+		return
+	}
+	rec, err := cr.database.GetUser(username)
+	if err != nil {
+		if err == database.ErrNotFound {
+			writeJson(rw, http.StatusNotFound, Map{
+				"error": "user not found",
+			})
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		if !isAdmin {
+			writeJson(rw, http.StatusForbidden, Map{
+				"error":    "403 Forbidden",
+				"message":  "permission denied",
+				"required": roleAdmin,
+			})
+			return
+		}
+		if err := cr.database.RemoveUser(username); err != nil && err != database.ErrNotFound {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "database error",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := cr.database.RemoveUsersSecondFactors(username, ""); err != nil {
+			log.Errorf("Cannot remove the second factors of user %q: %v", username, err)
+		}
+		cr.revokeUsersAPIKeys(username)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, ok := parseRequestBody[userPayload](rw, req, nil)
+	if !ok {
+		return
+	}
+	user := *rec
+	if data.Role != "" && data.Role != user.Role {
+		if !isAdmin {
+			writeJson(rw, http.StatusForbidden, Map{
+				"error":    "403 Forbidden",
+				"message":  "permission denied",
+				"required": roleAdmin,
+			})
+			return
+		}
+		if !isValidRole(data.Role) {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "invalid user",
+				"message": ErrInvalidRole.Error(),
+			})
+			return
+		}
+		user.Role = data.Role
+	}
+	if data.Password != "" {
+		if user.Password, err = hashUserPassword(data.Password); err != nil {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "cannot hash password",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if err := cr.database.UpdateUser(user); err != nil {
+		writeJson(rw, http.StatusInternalServerError, Map{
+			"error":   "database error",
+			"message": err.Error(),
+		})
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -91,6 +91,11 @@ func (w *StatusResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+// Unwrap is used by http.ResponseController
+func (w *StatusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *StatusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := w.ResponseWriter.(http.Hijacker)
 	if ok {
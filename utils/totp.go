@@ -0,0 +1,119 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTPPeriod is the time step of the TOTP codes, as the authenticator apps use by default
+const TOTPPeriod = 30
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenTOTPSecret returns a random 160 bits base32 encoded TOTP secret
+func GenTOTPSecret() (s string, err error) {
+	buf := make([]byte, 20)
+	if _, err = io.ReadFull(rand.Reader, buf); err != nil {
+		return
+	}
+	s = totpEncoding.EncodeToString(buf)
+	return
+}
+
+// TOTPStep returns the time step of t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// hotp generates the HMAC-SHA1 one time password as RFC 4226 describes
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// TOTPCode returns the 6 digits code of the secret at the time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, (uint64)(step), 6), nil
+}
+
+// VerifyTOTP checks the code with one step of clock skew allowed.
+// The steps that are not after last are rejected, so a code cannot be used twice.
+// It returns the matched step, which should be saved as the next last
+func VerifyTOTP(secret string, code string, now time.Time, last int64) (step int64, ok bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != 6 {
+		return 0, false
+	}
+	cur := TOTPStep(now)
+	for s := cur - 1; s <= cur+1; s++ {
+		if s <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare(([]byte)(hotp(key, (uint64)(s), 6)), ([]byte)(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI returns the otpauth URI which can be imported into the authenticator apps by QR code
+func TOTPURI(issuer string, account string, secret string) string {
+	u := &url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+	q := make(url.Values, 3)
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("period", fmt.Sprint(TOTPPeriod))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
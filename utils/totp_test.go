@@ -0,0 +1,74 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"testing"
+
+	"time"
+)
+
+func TestHOTPVectors(t *testing.T) {
+	// test vectors from RFC 6238 Appendix B, SHA1 mode
+	key := ([]byte)("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		if got := hotp(key, (uint64)(unix/TOTPPeriod), 8); got != want {
+			t.Errorf("hotp at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenTOTPSecret: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	cur := TOTPStep(now)
+	code, err := TOTPCode(secret, cur)
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	if !ok || step != cur {
+		t.Fatalf("Expect the current code to be accepted, got %d, %v", step, ok)
+	}
+	if _, ok := VerifyTOTP(secret, code, now, step); ok {
+		t.Errorf("Expect a used code to be rejected")
+	}
+	prev, _ := TOTPCode(secret, cur-1)
+	if _, ok := VerifyTOTP(secret, prev, now, 0); !ok {
+		t.Errorf("Expect the code of the previous step to be accepted")
+	}
+	old, _ := TOTPCode(secret, cur-3)
+	if _, ok := VerifyTOTP(secret, old, now, 0); ok {
+		t.Errorf("Expect an expired code to be rejected")
+	}
+	if _, ok := VerifyTOTP(secret, "abcdef", now, 0); ok {
+		t.Errorf("Expect an invalid code to be rejected")
+	}
+}
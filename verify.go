@@ -0,0 +1,666 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	VerifyActionQuarantined = "quarantined"
+	VerifyActionDeleted     = "deleted"
+	VerifyActionRefetched   = "refetched"
+)
+
+type VerifyIssue struct {
+	Hash   string `json:"hash"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+	// Action is what the repair did to the file, it's empty if nothing was done
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type StorageVerifyReport struct {
+	Storage string `json:"storage"`
+	Error   string `json:"error,omitempty"`
+
+	Checked      int   `json:"checked"`
+	CheckedBytes int64 `json:"checkedBytes"`
+	// Corrupted are the files which content does not match the hash or the size in the file list
+	Corrupted []*VerifyIssue `json:"corrupted"`
+	// Unreadable are the files that cannot be opened or read, they will not be repaired
+	Unreadable []*VerifyIssue `json:"unreadable"`
+	// Missing are the files that in the file list but not exist in the storage
+	Missing []*VerifyIssue `json:"missing"`
+	// Unknown are the files that not in the file list
+	Unknown []SyncPlanFile `json:"unknown"`
+}
+
+type VerifyReport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// FileList is where the file list come from, it can be "saved", "remote" or "none"
+	FileList   string                 `json:"fileList"`
+	KnownFiles int                    `json:"knownFiles"`
+	Repair     bool                   `json:"repair"`
+	Storages   []*StorageVerifyReport `json:"storages"`
+}
+
+// Problems returns the count of the issues that are not repaired
+func (r *VerifyReport) Problems() (n int) {
+	for _, s := range r.Storages {
+		if s.Error != "" {
+			n++
+		}
+		n += len(s.Unreadable)
+		for _, l := range [][]*VerifyIssue{s.Corrupted, s.Missing} {
+			for _, i := range l {
+				if i.Action != VerifyActionRefetched {
+					n++
+				}
+			}
+		}
+	}
+	return
+}
+
+func (cr *Cluster) verifyStorage(
+	ctx context.Context,
+	sto storage.Storage, known map[string]FileInfo,
+	pg *mpb.Progress,
+) (report *StorageVerifyReport) {
+	report = &StorageVerifyReport{
+		Storage:    sto.String(),
+		Corrupted:  []*VerifyIssue{},
+		Unreadable: []*VerifyIssue{},
+		Missing:    []*VerifyIssue{},
+		Unknown:    []SyncPlanFile{},
+	}
+
+	log.Infof("Verifying files in %s", sto.String())
+
+	sizeMap := make(map[string]int64)
+	if err := sto.WalkDir(func(hash string, size int64) error {
+		sizeMap[hash] = size
+		return nil
+	}); err != nil {
+		log.Errorf("Cannot walk %s: %v", sto.String(), err)
+		report.Error = err.Error()
+		return
+	}
+	hashes := make([]string, 0, len(sizeMap))
+	for hash := range sizeMap {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	var (
+		checkingHashMux  sync.Mutex
+		checkingHash     string
+		lastCheckingHash string
+		reportMux        sync.Mutex
+		wg               sync.WaitGroup
+	)
+	slots := limited.NewBufSlots(runtime.GOMAXPROCS(0) * 2)
+
+	var barUnit decor.SizeB1024
+	var totalSize int64
+	for _, size := range sizeMap {
+		totalSize += size
+	}
+	bar := pg.AddBar(totalSize,
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(
+			decor.Name(Tr("hint.check.checking")),
+			decor.Name(sto.String()),
+		),
+		mpb.AppendDecorators(
+			decor.Counters(barUnit, "(%.1f/%.1f) ", decor.WCSyncSpaceR),
+			decor.NewPercentage("%d", decor.WCSyncSpaceR),
+			decor.EwmaETA(decor.ET_STYLE_GO, 60),
+		),
+		mpb.BarExtender((mpb.BarFillerFunc)(func(w io.Writer, _ decor.Statistics) (err error) {
+			if checkingHashMux.TryLock() {
+				lastCheckingHash = checkingHash
+				checkingHashMux.Unlock()
+			}
+			if lastCheckingHash != "" {
+				_, err = fmt.Fprintln(w, "\t", lastCheckingHash)
+			}
+			return
+		}), false),
+	)
+	defer bar.Wait()
+	defer bar.Abort(true)
+
+	addIssue := func(list *[]*VerifyIssue, issue *VerifyIssue) {
+		reportMux.Lock()
+		*list = append(*list, issue)
+		reportMux.Unlock()
+	}
+
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			break
+		}
+		size := sizeMap[hash]
+		name := sto.String() + "/" + hash
+		f, isKnown := known[hash]
+		if known != nil && !isKnown {
+			report.Unknown = append(report.Unknown, SyncPlanFile{Hash: hash, Size: size})
+		}
+		issue := &VerifyIssue{
+			Hash: hash,
+			Path: f.Path,
+			Size: size,
+		}
+		if isKnown && size != f.Size {
+			log.Warnf(Tr("warn.check.modified.size"), name, size, f.Size)
+			issue.Reason = fmt.Sprintf("size mismatch, expect %d, got %d", f.Size, size)
+			addIssue(&report.Corrupted, issue)
+			bar.IncrInt64(size)
+			continue
+		}
+		hashMethod, err := getHashMethod(len(hash))
+		if err != nil {
+			log.Errorf(Tr("error.check.unknown.hash.method"), hash)
+			issue.Reason = err.Error()
+			addIssue(&report.Corrupted, issue)
+			bar.IncrInt64(size)
+			continue
+		}
+		_, buf, free := slots.Alloc(ctx)
+		if buf == nil {
+			break
+		}
+		if checkingHashMux.TryLock() {
+			checkingHash = hash
+			checkingHashMux.Unlock()
+		}
+		wg.Add(1)
+		go func(issue *VerifyIssue, buf []byte, free func()) {
+			defer wg.Done()
+			defer log.RecoverPanic(nil)
+			defer free()
+			start := time.Now()
+			defer func() {
+				bar.EwmaIncrInt64(issue.Size, time.Since(start))
+			}()
+			r, err := sto.Open(issue.Hash)
+			if err != nil {
+				log.Errorf(Tr("error.check.open.failed"), name, err)
+				issue.Reason = err.Error()
+				addIssue(&report.Unreadable, issue)
+				return
+			}
+			hw := hashMethod.New()
+			_, err = io.CopyBuffer(hw, r, buf)
+			r.Close()
+			if err != nil {
+				log.Errorf(Tr("error.check.hash.failed"), name, err)
+				issue.Reason = err.Error()
+				addIssue(&report.Unreadable, issue)
+				return
+			}
+			if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != issue.Hash {
+				log.Warnf(Tr("warn.check.modified.hash"), name, hs, issue.Hash)
+				issue.Reason = fmt.Sprintf("hash mismatch, got %s", hs)
+				addIssue(&report.Corrupted, issue)
+			}
+		}(issue, buf, free)
+	}
+	wg.Wait()
+
+	checkingHashMux.Lock()
+	checkingHash = ""
+	checkingHashMux.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		report.Error = err.Error()
+		return
+	}
+
+	report.Checked = len(hashes)
+	report.CheckedBytes = totalSize
+	for hash, f := range known {
+		if f.Size == 0 {
+			continue
+		}
+		if _, ok := sizeMap[hash]; !ok {
+			report.Missing = append(report.Missing, &VerifyIssue{
+				Hash:   hash,
+				Path:   f.Path,
+				Size:   f.Size,
+				Reason: "not exists",
+			})
+		}
+	}
+	for _, l := range [][]*VerifyIssue{report.Corrupted, report.Unreadable, report.Missing} {
+		sort.Slice(l, func(i, j int) bool { return l[i].Hash < l[j].Hash })
+	}
+
+	bar.SetTotal(-1, true)
+	log.Infof("Verified %d files in %s, %d corrupted, %d unreadable, %d missing",
+		report.Checked, sto.String(), len(report.Corrupted), len(report.Unreadable), len(report.Missing))
+	return
+}
+
+// quarantineFile moves the file out of the storage into the quarantine directory
+func quarantineFile(sto storage.Storage, dir string, hash string) (err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	r, err := sto.Open(hash)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	fd, err := os.Create(filepath.Join(dir, hash))
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(fd, r)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	return sto.Remove(hash)
+}
+
+type verifyRepairTarget struct {
+	FileInfo
+	issues  []*VerifyIssue
+	targets []storage.Storage
+}
+
+// repairVerified removes the corrupted files and re-fetch them and the missing files from the center
+func (cr *Cluster) repairVerified(
+	ctx context.Context,
+	report *VerifyReport,
+	known map[string]FileInfo,
+	quarantineDir string,
+	pg *mpb.Progress,
+) {
+	refetch := make(map[string]*verifyRepairTarget)
+	addRefetch := func(sto storage.Storage, issue *VerifyIssue) {
+		f, ok := known[issue.Hash]
+		if !ok {
+			return
+		}
+		t := refetch[issue.Hash]
+		if t == nil {
+			t = &verifyRepairTarget{FileInfo: f}
+			refetch[issue.Hash] = t
+		}
+		t.issues = append(t.issues, issue)
+		t.targets = append(t.targets, sto)
+	}
+
+	for i, s := range report.Storages {
+		sto := cr.storages[i]
+		for _, issue := range s.Corrupted {
+			var err error
+			if quarantineDir == "" {
+				if err = sto.Remove(issue.Hash); err == nil {
+					issue.Action = VerifyActionDeleted
+				}
+			} else {
+				dir := filepath.Join(quarantineDir, url.PathEscape(cr.storageHealths[i].Id()))
+				if err = quarantineFile(sto, dir, issue.Hash); err == nil {
+					issue.Action = VerifyActionQuarantined
+				}
+			}
+			if err != nil {
+				log.Errorf("Cannot remove corrupted file %s/%s: %v", sto.String(), issue.Hash, err)
+				issue.Error = err.Error()
+				continue
+			}
+			addRefetch(sto, issue)
+		}
+		for _, issue := range s.Missing {
+			addRefetch(sto, issue)
+		}
+	}
+	if len(refetch) == 0 {
+		return
+	}
+
+	files := make([]*verifyRepairTarget, 0, len(refetch))
+	var totalSize int64
+	for _, t := range refetch {
+		files = append(files, t)
+		totalSize += t.Size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
+
+	log.Infof(Tr("hint.sync.start"), len(files), utils.BytesToUnit((float64)(totalSize)))
+
+	var (
+		barUnit decor.SizeB1024
+		lastInc atomic.Int64
+		okCount atomic.Int32
+	)
+	lastInc.Store(time.Now().UnixNano())
+	totalBar := pg.AddBar(totalSize,
+		mpb.BarRemoveOnComplete(),
+		mpb.BarPriority(1),
+		mpb.PrependDecorators(
+			decor.Name(Tr("hint.sync.total")),
+			decor.NewPercentage("%.2f"),
+		),
+		mpb.AppendDecorators(
+			decor.Any(func(decor.Statistics) string {
+				return fmt.Sprintf("(%d / %d) ", okCount.Load(), len(files))
+			}),
+			decor.Counters(barUnit, "(%.1f/%.1f) "),
+			decor.EwmaSpeed(barUnit, "%.1f ", 30),
+			decor.OnComplete(
+				decor.EwmaETA(decor.ET_STYLE_GO, 30), "done",
+			),
+		),
+	)
+	defer totalBar.Abort(true)
+
+	buf := make([]byte, 1024*64)
+	for _, t := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		err := cr.refetchFile(ctx, t, buf, pg, totalBar, &lastInc)
+		for _, issue := range t.issues {
+			if err != nil {
+				issue.Error = err.Error()
+			}
+		}
+		if err != nil {
+			log.Errorf(Tr("error.sync.download.failed"), t.Path, err)
+			continue
+		}
+		okCount.Add(1)
+	}
+}
+
+func (cr *Cluster) refetchFile(
+	ctx context.Context, t *verifyRepairTarget, buf []byte,
+	pg *mpb.Progress, totalBar *mpb.Bar, lastInc *atomic.Int64,
+) (err error) {
+	hashMethod, err := getHashMethod(len(t.Hash))
+	if err != nil {
+		return
+	}
+
+	var barUnit decor.SizeB1024
+	bar := pg.AddBar(t.Size,
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(
+			decor.Name(Tr("hint.sync.downloading")),
+			decor.Name(t.Path, decor.WCSyncSpaceR),
+		),
+		mpb.AppendDecorators(
+			decor.NewPercentage("%d", decor.WCSyncSpace),
+			decor.Counters(barUnit, "[%.1f / %.1f]", decor.WCSyncSpace),
+			decor.EwmaSpeed(barUnit, "%.1f", 30, decor.WCSyncSpace),
+		),
+	)
+	defer bar.Abort(true)
+
+	var path string
+	// try the redirected source first, then the center
+	for _, badOpen := range []bool{false, true} {
+		bar.SetCurrent(cr.partialSize(t.FileInfo))
+		if path, err = cr.fetchFileWithBuf(ctx, t.FileInfo, hashMethod, buf, false, badOpen, func(r io.Reader) io.Reader {
+			return ProxyReader(r, bar, totalBar, lastInc)
+		}); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+	defer os.Remove(path)
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	var failed error
+	for i, target := range t.targets {
+		if _, err = fd.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if err := target.Create(t.Hash, fd); err != nil {
+			log.Errorf(Tr("error.sync.create.failed"), target.String(), t.Hash, err)
+			t.issues[i].Error = err.Error()
+			failed = err
+			continue
+		}
+		t.issues[i].Action = VerifyActionRefetched
+	}
+	return failed
+}
+
+// Verify re-hashes every file in the storages, and repairs them if repair is true.
+// If quarantineDir is empty, corrupted files will be deleted directly
+func (cr *Cluster) Verify(ctx context.Context, files []FileInfo, repair bool, quarantineDir string) *VerifyReport {
+	pg := mpb.New(mpb.WithRefreshRate(time.Second/2), mpb.WithAutoRefresh(), mpb.WithWidth(140))
+	defer pg.Shutdown()
+	log.SetLogOutput(pg)
+	defer log.SetLogOutput(nil)
+
+	report := &VerifyReport{
+		GeneratedAt: time.Now(),
+		KnownFiles:  len(files),
+		Repair:      repair,
+		Storages:    make([]*StorageVerifyReport, len(cr.storages)),
+	}
+	var known map[string]FileInfo
+	if files != nil {
+		known = make(map[string]FileInfo, len(files))
+		for _, f := range files {
+			known[f.Hash] = f
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range cr.storages {
+		wg.Add(1)
+		go func(i int, s storage.Storage) {
+			defer wg.Done()
+			defer log.RecordPanic()
+			report.Storages[i] = cr.verifyStorage(ctx, s, known, pg)
+		}(i, s)
+	}
+	wg.Wait()
+
+	if repair && ctx.Err() == nil {
+		cr.repairVerified(ctx, report, known, quarantineDir, pg)
+	}
+	pg.Wait()
+	return report
+}
+
+// WriteText writes the human readable summary of the report
+func (r *VerifyReport) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Verify report generated at %s\n", r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(bw, "Known files: %d (from %s file list)\n", r.KnownFiles, r.FileList)
+	writeIssues := func(name string, issues []*VerifyIssue) {
+		fmt.Fprintf(bw, "  %-11s %d files\n", name+":", len(issues))
+		for _, i := range issues {
+			fmt.Fprintf(bw, "    ! %s %s: %s", i.Hash, i.Path, i.Reason)
+			if i.Action != "" {
+				fmt.Fprintf(bw, " [%s]", i.Action)
+			}
+			if i.Error != "" {
+				fmt.Fprintf(bw, " (error: %s)", i.Error)
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+	for _, s := range r.Storages {
+		fmt.Fprintf(bw, "\nStorage %s\n", s.Storage)
+		if s.Error != "" {
+			fmt.Fprintf(bw, "  error: %s\n", s.Error)
+			continue
+		}
+		fmt.Fprintf(bw, "  checked:    %d files (%s)\n", s.Checked, utils.BytesToUnit((float64)(s.CheckedBytes)))
+		writeIssues("corrupted", s.Corrupted)
+		writeIssues("unreadable", s.Unreadable)
+		writeIssues("missing", s.Missing)
+		fmt.Fprintf(bw, "  unknown:    %d files\n", len(s.Unknown))
+	}
+	fmt.Fprintf(bw, "\nUnresolved problems: %d\n", r.Problems())
+	return bw.Flush()
+}
+
+func cmdVerify(args []string) {
+	var (
+		repair     bool
+		deleteMode bool
+		reportPath string
+		quarantine string
+		clusterId  string
+	)
+	for i := 0; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "--repair", "-r":
+			repair = true
+		case "--delete":
+			deleteMode = true
+		case "--report", "--quarantine", "--cluster":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "Missing value for option:", a)
+				os.Exit(2)
+			}
+			i++
+			switch a {
+			case "--report":
+				reportPath = args[i]
+			case "--quarantine":
+				quarantine = args[i]
+			case "--cluster":
+				clusterId = args[i]
+			}
+		default:
+			fmt.Fprintln(os.Stderr, "Unknown option:", a)
+			os.Exit(2)
+		}
+	}
+
+	config = readConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, clusters := newCmdClusters(ctx, clusterId)
+	if reportPath != "" && len(clusters) > 1 {
+		fmt.Fprintln(os.Stderr, "--report requires --cluster when there are multiple clusters")
+		os.Exit(2)
+	}
+
+	problems := 0
+	for _, cr := range clusters {
+		if len(clusters) > 1 {
+			log.Infof("Verifying cluster %s", cr.clusterId)
+		}
+		problems += cr.verifyCmd(ctx, repair, deleteMode, reportPath, quarantine)
+	}
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyCmd verifies the storages of the cluster for the verify command and saves the report,
+// it returns the count of the unresolved problems
+func (cr *Cluster) verifyCmd(ctx context.Context, repair bool, deleteMode bool, reportPath string, quarantine string) int {
+	if deleteMode {
+		quarantine = ""
+	} else if quarantine == "" {
+		quarantine = filepath.Join(cr.dataDir, "quarantine")
+	}
+	if reportPath == "" {
+		reportPath = filepath.Join(cr.dataDir, "verify-report-"+time.Now().Format("20060102-150405")+".json")
+	}
+
+	fileListSource := "saved"
+	files, err := cr.LoadLastFileList()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Cannot load saved file list: %v", err)
+		}
+		log.Info(Tr("info.filelist.fetching"))
+		fileListSource = "remote"
+		if files, err = cr.GetFileList(ctx, 0); err != nil {
+			log.Errorf(Tr("error.filelist.fetch.failed"), err)
+			log.Warn("No file list is available, only the file hashes will be verified")
+			fileListSource = "none"
+			files = nil
+		}
+	}
+
+	report := cr.Verify(ctx, files, repair, quarantine)
+	report.FileList = fileListSource
+
+	if err := os.MkdirAll(filepath.Dir(reportPath), 0755); err != nil {
+		log.Errorf("Cannot create report directory: %v", err)
+	} else if fd, err := os.Create(reportPath); err != nil {
+		log.Errorf("Cannot create report file: %v", err)
+	} else {
+		e := json.NewEncoder(fd)
+		e.SetIndent("", "  ")
+		err := e.Encode(report)
+		fd.Close()
+		if err != nil {
+			log.Errorf("Cannot write report file: %v", err)
+		} else {
+			log.Infof("Verify report is saved to %s", reportPath)
+		}
+	}
+
+	report.WriteText(os.Stdout)
+	return report.Problems()
+}